@@ -249,6 +249,9 @@ func buildProvider(
 		p, err = dnsimple.NewDnsimpleProvider(domainFilter, zoneIDFilter, cfg.DryRun)
 	case "coredns", "skydns":
 		p, err = coredns.NewCoreDNSProvider(domainFilter, cfg.CoreDNSPrefix, cfg.DryRun)
+		if reloader, ok := p.(coredns.Reloader); ok {
+			go handleSighup(ctx, reloader)
+		}
 	case "exoscale":
 		p, err = exoscale.NewExoscaleProvider(
 			cfg.ExoscaleAPIEnvironment,
@@ -482,6 +485,25 @@ func handleSigterm(cancel func()) {
 	cancel()
 }
 
+// handleSighup reloads the backend of the CoreDNS provider, as configured by
+// the environment, each time a SIGHUP signal is received until ctx is done.
+func handleSighup(ctx context.Context, reloader coredns.Reloader) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	defer signal.Stop(signals)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-signals:
+			log.Info("Received SIGHUP. Reloading the CoreDNS backend...")
+			if err := reloader.Reload(nil); err != nil {
+				log.Errorf("Failed to reload the CoreDNS backend: %v", err)
+			}
+		}
+	}
+}
+
 // serveMetrics starts an HTTP server that serves health and metrics endpoints.
 // The /healthz endpoint returns a 200 OK status to indicate the service is healthy.
 // The /metrics endpoint serves Prometheus metrics.
@@ -18,9 +18,15 @@ package coredns
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
+	"fmt"
 	"os"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 // BackendType represents the type of backend storage
@@ -33,11 +39,34 @@ const (
 	BackendTypeSQLite BackendType = "sqlite"
 	// BackendTypeMemory uses in-memory storage (non-persistent)
 	BackendTypeMemory BackendType = "memory"
+	// BackendTypeMySQL uses a MySQL or MariaDB database as the storage backend
+	BackendTypeMySQL BackendType = "mysql"
 )
 
+// backendTypes lists the known backend types, in the order they are
+// suggested when an unknown one is configured.
+var backendTypes = []BackendType{BackendTypeEtcd, BackendTypeSQLite, BackendTypeMemory, BackendTypeMySQL}
+
 var (
 	// ErrUnknownBackend is returned when an unknown backend type is specified
 	ErrUnknownBackend = errors.New("unknown backend type")
+
+	// ErrBackendClosed is returned when a backend is used after Close
+	ErrBackendClosed = errors.New("backend is closed")
+
+	// ErrNotFound wraps backend errors reporting that an entity doesn't exist
+	ErrNotFound = errors.New("not found")
+
+	// ErrConflict wraps backend errors reporting a write that conflicts with
+	// the stored state (e.g. a constraint violation)
+	ErrConflict = errors.New("conflict")
+
+	// ErrUnavailable wraps backend errors reporting that the store can't be
+	// reached or is temporarily busy; the operation may succeed if retried
+	ErrUnavailable = errors.New("backend unavailable")
+
+	// ErrInvalidPageLimit is returned by GetServicesPage for a non-positive limit
+	ErrInvalidPageLimit = errors.New("page limit must be positive")
 )
 
 // Backend defines the interface for CoreDNS service storage.
@@ -48,28 +77,198 @@ var (
 type Backend interface {
 	// GetServices retrieves all services under the given prefix.
 	// The prefix follows the CoreDNS etcd key format: /skydns/com/example/...
-	// Returns an empty slice if no services are found.
+	// Returns a non-nil empty slice if no services are found; the other
+	// methods returning services follow the same contract.
 	GetServices(ctx context.Context, prefix string) ([]*Service, error)
 
+	// GetServicesWithOptions retrieves the services under the given prefix
+	// as GetServices does, with the behavior adjusted by opts.
+	GetServicesWithOptions(ctx context.Context, prefix string, opts GetServicesOptions) ([]*Service, error)
+
+	// GetServicesByType retrieves the services under the given prefix that
+	// produce a record of the given type (see Service.HasRecordType).
+	GetServicesByType(ctx context.Context, prefix, recordType string) ([]*Service, error)
+
+	// GetServicesBySource retrieves the services under the given prefix that
+	// were created by the given source (see Service.Source).
+	GetServicesBySource(ctx context.Context, prefix, source string) ([]*Service, error)
+
+	// GetServicesPage returns up to limit services under the given prefix whose
+	// key sorts after afterKey (all of them if afterKey is empty), in key order,
+	// along with the cursor to pass as afterKey for the next page. The cursor
+	// is empty once the last page has been returned. Services are returned as
+	// stored: no deduplication or defaulting is applied across pages.
+	GetServicesPage(ctx context.Context, prefix, afterKey string, limit int) ([]*Service, string, error)
+
+	// Exists reports whether any service is stored under the given prefix,
+	// without fetching the services.
+	Exists(ctx context.Context, prefix string) (bool, error)
+
 	// SaveService persists a service record.
 	// If a service with the same key exists, it will be overwritten.
 	SaveService(ctx context.Context, service *Service) error
 
+	// ForEach calls fn for every stored service under the given prefix,
+	// without loading all of them into memory at once where the backend allows it.
+	// Services are passed as stored: no deduplication or defaulting is applied.
+	// Iteration stops at the first error returned by fn or when ctx is done,
+	// and that error is returned. fn must not call back into the backend.
+	ForEach(ctx context.Context, prefix string, fn func(key string, svc *Service) error) error
+
+	// Snapshot returns a consistent point-in-time copy of the services stored
+	// under the backend's root prefix, keyed by their key. Values have an
+	// empty Key field.
+	Snapshot(ctx context.Context) (map[string]Service, error)
+
 	// DeleteService removes a service and all services under the given key prefix.
 	// This is a prefix-based delete to support hierarchical key structures.
 	DeleteService(ctx context.Context, key string) error
 
+	// ClearPrefix removes every service under the given prefix, e.g. to
+	// wipe a zone. It deletes as DeleteService does but fails with
+	// ErrInvalidPrefix for the backend's root prefix or a prefix above it.
+	ClearPrefix(ctx context.Context, prefix string) error
+
+	// Flush forces writes the backend buffers, if any, to durable storage.
+	// It is a no-op for backends that write through.
+	Flush(ctx context.Context) error
+
+	// Capabilities reports the optional features the backend supports.
+	Capabilities() BackendCapabilities
+
 	// Close releases any resources held by the backend.
+	// Close is idempotent: calling it more than once returns nil.
+	// Other methods return ErrBackendClosed once the backend is closed.
 	Close() error
 }
 
+// BackendCapabilities describes the optional features of a backend, so
+// callers can discover them at runtime instead of type-asserting.
+type BackendCapabilities struct {
+	// SupportsWatch is set when the backend implements Watcher.
+	SupportsWatch bool
+
+	// SupportsLease is set when written keys can be attached to an
+	// expiring lease.
+	SupportsLease bool
+
+	// SupportsCAS is set when writes can be conditioned on the stored value.
+	SupportsCAS bool
+
+	// SupportsTransactions is set when several writes can be applied atomically.
+	SupportsTransactions bool
+
+	// Persistent is set when stored services survive a restart.
+	Persistent bool
+}
+
+// decoratorCapabilities returns the capabilities of a decorator wrapping
+// backend. Decorators don't forward Watch, so SupportsWatch is cleared.
+func decoratorCapabilities(backend Backend) BackendCapabilities {
+	caps := backend.Capabilities()
+	caps.SupportsWatch = false
+	return caps
+}
+
+// GetServicesOptions adjusts how services are retrieved.
+// The zero value matches GetServices.
+type GetServicesOptions struct {
+	// Raw returns every stored record: services producing the same DNS
+	// answer are not deduplicated and no default priority is applied.
+	Raw bool
+}
+
 // BackendConfig holds configuration for backend creation
 type BackendConfig struct {
 	// Type specifies which backend to use (etcd, sqlite)
 	Type BackendType
 
-	// SQLite-specific settings
-	SQLitePath string
+	// Prefix is the root under which keys are stored (DefaultPrefix if empty).
+	// Relative keys passed to the backend are resolved against it.
+	Prefix string
+
+	// KeySeparator separates the labels of keys, "/" if empty. It must be a
+	// single character that can't appear in a DNS label (see NewKeyScheme).
+	KeySeparator string
+
+	// SQLite-specific settings: SQLiteReapInterval enables the TTL reaper
+	// (see SQLiteOptions.ReapInterval) and the connection settings recycle
+	// stale connections (see SQLiteOptions.ConnMaxLifetime).
+	SQLitePath            string
+	SQLiteReapInterval    time.Duration
+	SQLiteConnMaxLifetime time.Duration
+	SQLiteConnMaxIdleTime time.Duration
+	SQLiteMaxIdleConns    int
+
+	// SQLiteShards, when greater than 1, spreads zones over that many
+	// SQLite files named after SQLitePath (see NewShardedSQLiteBackend).
+	SQLiteShards int
+
+	// etcd-specific settings: EtcdEndpoints, when set, replaces ETCD_URLS as
+	// the list of cluster members and EtcdDialTimeout bounds connection setup.
+	EtcdEndpoints   []string
+	EtcdDialTimeout time.Duration
+
+	// EtcdUsername and EtcdPassword, when EtcdUsername is set, replace
+	// ETCD_USERNAME and ETCD_PASSWORD. EtcdTLS, when set, replaces the TLS
+	// configuration read from the ETCD_* certificate variables.
+	EtcdUsername string
+	EtcdPassword string
+	EtcdTLS      *tls.Config
+
+	// When EtcdLeaseTTL is set, written keys are attached to a lease kept
+	// alive while the process runs, so records expire if external-dns stops
+	// refreshing them.
+	EtcdLeaseTTL time.Duration
+
+	// EtcdCompactInterval enables periodic compaction of the etcd revision
+	// history. Zero disables compaction.
+	EtcdCompactInterval time.Duration
+
+	// EtcdPageSize is the number of keys read per etcd range request, so
+	// large zones don't exceed gRPC message limits (1000 if zero).
+	EtcdPageSize int
+
+	// Memory-specific settings: snapshot file loaded at startup and written on
+	// Close. Empty keeps the memory backend non-persistent.
+	MemoryPath string
+
+	// MySQL-specific settings: the data source name of the database (see
+	// NewMySQLBackend).
+	MySQLDSN string
+
+	// Codec used to serialize stored values (etcd, SQLite).
+	// If nil, DefaultCodec is used.
+	Codec Codec
+
+	// Defaults are the priority and weight applied to read services per
+	// record type. If nil, DefaultServiceDefaults is used.
+	Defaults ServiceDefaults
+
+	// RateLimit caps backend operations per second. Zero disables limiting.
+	RateLimit float64
+
+	// MaxRecords and MaxValueBytes cap the number of stored records and the
+	// encoded size of a record. Zero disables the corresponding limit.
+	MaxRecords    int
+	MaxValueBytes int
+
+	// CoalesceWindow buffers writes for this long so that only the latest
+	// value of a key is written. Zero disables coalescing.
+	CoalesceWindow time.Duration
+
+	// ReadOnly rejects every write with ErrReadOnly, for stores that
+	// external-dns must observe but not change.
+	ReadOnly bool
+
+	// RequireRootPrefix rejects reads and deletes of absolute prefixes
+	// outside Prefix with ErrInvalidPrefix.
+	RequireRootPrefix bool
+
+	// InstanceID, when set, isolates the keys of this external-dns instance
+	// under an extra label after Prefix (see KeyScheme.InstancePrefix), so
+	// that several instances can share a store.
+	InstanceID string
 
 	// Additional options can be added here for other backends
 }
@@ -82,6 +281,8 @@ func GetBackendType() BackendType {
 		return BackendTypeSQLite
 	case "memory", "mem", "inmemory", "in-memory":
 		return BackendTypeMemory
+	case "mysql", "mariadb":
+		return BackendTypeMySQL
 	case "etcd", "":
 		return BackendTypeEtcd
 	default:
@@ -89,34 +290,367 @@ func GetBackendType() BackendType {
 	}
 }
 
+// GetBackendTypeStrict is like GetBackendType but returns an error wrapping
+// ErrUnknownBackend, listing the valid options, if COREDNS_BACKEND names no
+// known backend.
+func GetBackendTypeStrict() (BackendType, error) {
+	backendType := GetBackendType()
+	if err := validateBackendType(backendType); err != nil {
+		return "", fmt.Errorf("COREDNS_BACKEND: %w", err)
+	}
+	return backendType, nil
+}
+
+// validateBackendType returns an error wrapping ErrUnknownBackend if
+// backendType is not a known backend type.
+func validateBackendType(backendType BackendType) error {
+	if slices.Contains(backendTypes, backendType) {
+		return nil
+	}
+	valid := make([]string, len(backendTypes))
+	for i, t := range backendTypes {
+		valid[i] = string(t)
+	}
+	return fmt.Errorf("%w %q, valid options are: %s", ErrUnknownBackend, backendType, strings.Join(valid, ", "))
+}
+
 // GetBackendConfig builds a BackendConfig from environment variables
 func GetBackendConfig() BackendConfig {
 	return BackendConfig{
 		Type:       GetBackendType(),
+		Prefix:     os.Getenv("COREDNS_ETCD_PREFIX"),
 		SQLitePath: os.Getenv("COREDNS_SQLITE_PATH"),
+		MemoryPath: os.Getenv("COREDNS_MEMORY_PATH"),
+		MySQLDSN:   os.Getenv("COREDNS_MYSQL_DSN"),
+		RateLimit:  getEnvFloat("COREDNS_BACKEND_RATE_LIMIT"),
+
+		KeySeparator: os.Getenv("COREDNS_KEY_SEPARATOR"),
+
+		MaxRecords:    getEnvInt("COREDNS_MAX_RECORDS"),
+		MaxValueBytes: getEnvInt("COREDNS_MAX_VALUE_BYTES"),
+
+		CoalesceWindow: getEnvDuration("COREDNS_COALESCE_WINDOW"),
+		ReadOnly:       getEnvBool("COREDNS_BACKEND_READONLY"),
+
+		RequireRootPrefix: getEnvBool("COREDNS_REQUIRE_ROOT_PREFIX"),
+		InstanceID:        os.Getenv("COREDNS_INSTANCE_ID"),
+
+		EtcdEndpoints:   getEnvList("COREDNS_ETCD_ENDPOINTS"),
+		EtcdDialTimeout: getEnvDuration("COREDNS_ETCD_DIAL_TIMEOUT"),
+		EtcdLeaseTTL:    getEnvDuration("COREDNS_ETCD_LEASE_TTL"),
+
+		EtcdCompactInterval: getEnvDuration("COREDNS_ETCD_COMPACT_INTERVAL"),
+		EtcdPageSize:        getEnvInt("COREDNS_ETCD_PAGE_SIZE"),
+
+		SQLiteReapInterval:    getEnvDuration("COREDNS_SQLITE_REAP_INTERVAL"),
+		SQLiteConnMaxLifetime: getEnvDuration("COREDNS_SQLITE_CONN_MAX_LIFETIME"),
+		SQLiteConnMaxIdleTime: getEnvDuration("COREDNS_SQLITE_CONN_MAX_IDLE_TIME"),
+		SQLiteMaxIdleConns:    getEnvInt("COREDNS_SQLITE_MAX_IDLE_CONNS"),
+		SQLiteShards:          getEnvInt("COREDNS_SQLITE_SHARDS"),
+
+		Defaults: getServiceDefaults(),
+	}
+}
+
+// getEnvList splits the named environment variable on commas, trimming
+// spaces and dropping empty items. Unset values yield nil.
+func getEnvList(name string) []string {
+	var items []string
+	for _, item := range strings.Split(os.Getenv(name), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
 	}
+	return items
+}
+
+// getEnvDuration parses a non-negative duration from the named environment
+// variable. Plain integers are interpreted as seconds.
+// Unset or invalid values yield zero.
+func getEnvDuration(name string) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		log.Warnf("Ignoring invalid %s=%q: must be a non-negative duration", name, value)
+		return 0
+	}
+	return d
+}
+
+// getEnvInt parses a non-negative integer from the named environment variable.
+// Unset or invalid values yield zero.
+func getEnvInt(name string) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return 0
+	}
+	i, err := strconv.Atoi(value)
+	if err != nil || i < 0 {
+		log.Warnf("Ignoring invalid %s=%q: must be a non-negative integer", name, value)
+		return 0
+	}
+	return i
+}
+
+// getEnvFloat parses a non-negative float from the named environment variable.
+// Unset or invalid values yield zero.
+func getEnvFloat(name string) float64 {
+	value := os.Getenv(name)
+	if value == "" {
+		return 0
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil || f < 0 {
+		log.Warnf("Ignoring invalid %s=%q: must be a non-negative number", name, value)
+		return 0
+	}
+	return f
+}
+
+// getEnvBool parses a boolean from the named environment variable.
+// Unset or invalid values yield false.
+func getEnvBool(name string) bool {
+	value := os.Getenv(name)
+	if value == "" {
+		return false
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Warnf("Ignoring invalid %s=%q: must be a boolean", name, value)
+		return false
+	}
+	return b
+}
+
+// nextCursor returns the cursor following page: the key of its last service,
+// or empty if the page is shorter than limit and thus the last one.
+func nextCursor(page []*Service, limit int) string {
+	if len(page) < limit {
+		return ""
+	}
+	return page[len(page)-1].Key
 }
 
 // NewBackend creates a new backend based on the configuration.
 // If cfg is nil, configuration is read from environment variables.
 func NewBackend(cfg *BackendConfig) (Backend, error) {
 	if cfg == nil {
+		if _, err := GetBackendTypeStrict(); err != nil {
+			return nil, err
+		}
 		c := GetBackendConfig()
 		cfg = &c
 	}
+	if err := validateBackendType(cfg.Type); err != nil {
+		return nil, err
+	}
+	if cfg.InstanceID != "" {
+		instance, err := instanceConfig(cfg)
+		if err != nil {
+			return nil, err
+		}
+		return NewBackend(instance)
+	}
+
+	backend, err := newBaseBackend(cfg)
+	if err != nil {
+		return nil, err
+	}
+	keys, _ := NewKeyScheme(cfg.KeySeparator) // validated by newBaseBackend
+
+	if cfg.MaxRecords > 0 || cfg.MaxValueBytes > 0 {
+		log.Infof("Limiting backend to %d records of %d bytes (0 is unlimited)", cfg.MaxRecords, cfg.MaxValueBytes)
+		backend = NewLimitedBackend(backend, Limits{
+			MaxRecords:    cfg.MaxRecords,
+			MaxValueBytes: cfg.MaxValueBytes,
+			Codec:         cfg.Codec,
+			Prefix:        cfg.Prefix,
+			Keys:          keys,
+		})
+	}
+
+	if cfg.RateLimit > 0 {
+		log.Infof("Rate limiting backend operations to %g/s", cfg.RateLimit)
+		backend = NewRateLimitedBackend(backend, cfg.RateLimit)
+	}
+
+	if cfg.CoalesceWindow > 0 {
+		log.Infof("Coalescing backend writes over %s", cfg.CoalesceWindow)
+		backend = NewCoalescingBackendWithOptions(backend, cfg.CoalesceWindow, CoalescingOptions{Keys: keys})
+	}
+
+	// Outermost, so writes are rejected before any layer buffers them
+	if cfg.ReadOnly {
+		log.Info("Backend is read-only, writes will be rejected")
+		backend = NewReadOnlyBackend(backend)
+	}
+
+	return backend, nil
+}
+
+// instanceConfig returns a copy of cfg rooted at the instance prefix of
+// cfg.InstanceID.
+func instanceConfig(cfg *BackendConfig) (*BackendConfig, error) {
+	if err := validateInstanceID(cfg.InstanceID); err != nil {
+		return nil, fmt.Errorf("COREDNS_INSTANCE_ID: %w", err)
+	}
+	keys, err := NewKeyScheme(cfg.KeySeparator)
+	if err != nil {
+		return nil, err
+	}
+	instance := *cfg
+	instance.Prefix = keys.InstancePrefix(cfg.Prefix, cfg.InstanceID)
+	instance.InstanceID = ""
+	log.Infof("Isolating the keys of instance %s under %s", cfg.InstanceID, instance.Prefix)
+	return &instance, nil
+}
+
+// NewBackendContext creates a new backend like NewBackend and returns a
+// cleanup function that closes it, stopping its background goroutines.
+// The cleanup function is safe to call several times and is called
+// automatically when ctx is done.
+func NewBackendContext(ctx context.Context, cfg *BackendConfig) (Backend, func(), error) {
+	backend, err := NewBackend(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	stop := make(chan struct{})
+	var once sync.Once
+	cleanup := func() {
+		once.Do(func() {
+			close(stop)
+			if err := backend.Close(); err != nil {
+				log.Warnf("Failed to close backend: %v", err)
+			}
+		})
+	}
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			cleanup()
+		case <-stop:
+		}
+	}()
+
+	return backend, cleanup, nil
+}
+
+// newBaseBackend creates the storage backend selected by cfg.Type,
+// without any decorators applied.
+func newBaseBackend(cfg *BackendConfig) (Backend, error) {
+	keys, err := NewKeyScheme(cfg.KeySeparator)
+	if err != nil {
+		return nil, err
+	}
+	keys.RequireRoot = cfg.RequireRootPrefix
 
 	switch cfg.Type {
 	case BackendTypeEtcd:
-		return newETCDClient()
+		backend, err := newETCDClient(cfg, keys)
+		if err != nil {
+			return nil, &BackendError{
+				Type:   cfg.Type,
+				Target: etcdTarget(cfg),
+				Hint:   "check that COREDNS_ETCD_ENDPOINTS or ETCD_URLS lists reachable http:// or https:// endpoints and that the ETCD_* TLS files exist",
+				Err:    err,
+			}
+		}
+		return backend, nil
 	case BackendTypeSQLite:
 		path := cfg.SQLitePath
 		if path == "" {
-			path = "/var/lib/external-dns/coredns.db"
+			path = defaultSQLitePath
+		}
+		opts := SQLiteOptions{
+			Codec:        cfg.Codec,
+			Prefix:       cfg.Prefix,
+			ReapInterval: cfg.SQLiteReapInterval,
+			Defaults:     cfg.Defaults,
+			Keys:         keys,
+
+			ConnMaxLifetime: cfg.SQLiteConnMaxLifetime,
+			ConnMaxIdleTime: cfg.SQLiteConnMaxIdleTime,
+			MaxIdleConns:    cfg.SQLiteMaxIdleConns,
+		}
+		var backend Backend
+		var err error
+		if cfg.SQLiteShards > 1 {
+			log.Infof("Sharding SQLite zones over %d files", cfg.SQLiteShards)
+			backend, err = NewShardedSQLiteBackend(path, cfg.SQLiteShards, opts)
+		} else {
+			backend, err = NewSQLiteBackendWithOptions(path, opts)
 		}
-		return NewSQLiteBackend(path)
+		if err != nil {
+			return nil, &BackendError{
+				Type:   cfg.Type,
+				Target: path,
+				Hint:   "set COREDNS_SQLITE_PATH to a writable location",
+				Err:    err,
+			}
+		}
+		return backend, nil
 	case BackendTypeMemory:
-		return NewMemoryBackend(), nil
+		opts := MemoryOptions{Prefix: cfg.Prefix, Keys: keys, Defaults: cfg.Defaults}
+		if cfg.MemoryPath != "" {
+			backend, err := NewPersistentMemoryBackendWithOptions(cfg.MemoryPath, opts)
+			if err != nil {
+				return nil, &BackendError{
+					Type:   cfg.Type,
+					Target: cfg.MemoryPath,
+					Hint:   "set COREDNS_MEMORY_PATH to a readable snapshot file in a writable directory, or unset it",
+					Err:    err,
+				}
+			}
+			return backend, nil
+		}
+		return NewMemoryBackendWithOptions(opts), nil
+	case BackendTypeMySQL:
+		if cfg.MySQLDSN == "" {
+			return nil, &BackendError{
+				Type:   cfg.Type,
+				Target: "(no DSN)",
+				Hint:   "set COREDNS_MYSQL_DSN",
+				Err:    errors.New("no MySQL data source name configured"),
+			}
+		}
+		backend, err := NewMySQLBackend(cfg.MySQLDSN, MySQLOptions{
+			Prefix:   cfg.Prefix,
+			Keys:     keys,
+			Defaults: cfg.Defaults,
+			Codec:    cfg.Codec,
+		})
+		if err != nil {
+			return nil, &BackendError{
+				Type:   cfg.Type,
+				Target: redactDSN(cfg.MySQLDSN),
+				Hint:   "check that COREDNS_MYSQL_DSN names a reachable database the user can create tables in",
+				Err:    err,
+			}
+		}
+		return backend, nil
 	default:
 		return nil, ErrUnknownBackend
 	}
 }
+
+// defaultSQLitePath is the database used when COREDNS_SQLITE_PATH is unset.
+const defaultSQLitePath = "/var/lib/external-dns/coredns.db"
+
+// etcdTarget returns the etcd endpoints cfg connects to, for error messages.
+func etcdTarget(cfg *BackendConfig) string {
+	if len(cfg.EtcdEndpoints) > 0 {
+		return strings.Join(cfg.EtcdEndpoints, ",")
+	}
+	if urls := os.Getenv("ETCD_URLS"); urls != "" {
+		return urls
+	}
+	return defaultETCDURL
+}
@@ -0,0 +1,241 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package coredns
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// AuditEvent describes a mutation made through an AuditBackend.
+type AuditEvent struct {
+	Time      time.Time `json:"time"`
+	Operation Operation `json:"operation"`
+	Key       string    `json:"key"`
+
+	// ValueHash is the hex SHA-256 of the encoded service, for saves.
+	ValueHash string `json:"valueHash,omitempty"`
+}
+
+// AuditSink receives the events of an AuditBackend.
+type AuditSink interface {
+	Record(ctx context.Context, event AuditEvent) error
+}
+
+// JSONAuditSink writes audit events to an io.Writer as JSON lines.
+type JSONAuditSink struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+// NewJSONAuditSink returns a sink writing one JSON object per line to w.
+func NewJSONAuditSink(w io.Writer) *JSONAuditSink {
+	return &JSONAuditSink{enc: json.NewEncoder(w)}
+}
+
+// Record writes event as a line of JSON.
+func (s *JSONAuditSink) Record(_ context.Context, event AuditEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.enc.Encode(event)
+}
+
+// AuditBackend wraps a Backend and records each successful save and delete
+// to an AuditSink, as a trail of the changes made to the store. Reads are
+// not audited. A write is not undone if its event can't be recorded; the
+// failure is logged instead.
+type AuditBackend struct {
+	backend Backend
+	sink    AuditSink
+	codec   Codec
+	clock   Clock
+}
+
+// Compile-time check that AuditBackend implements Backend
+var _ Backend = (*AuditBackend)(nil)
+
+// NewAuditBackend wraps backend so that its mutations are recorded to sink.
+// Saved values are hashed in their DefaultCodec encoding.
+func NewAuditBackend(backend Backend, sink AuditSink) *AuditBackend {
+	return &AuditBackend{
+		backend: backend,
+		sink:    sink,
+		codec:   DefaultCodec,
+		clock:   SystemClock,
+	}
+}
+
+// record sends event to the sink, logging failures.
+func (a *AuditBackend) record(ctx context.Context, event AuditEvent) {
+	event.Time = a.clock.Now().UTC()
+	if err := a.sink.Record(ctx, event); err != nil {
+		log.Errorf("Failed to record audit event for %s of %s: %v", event.Operation, event.Key, err)
+	}
+}
+
+// GetServices delegates to the wrapped backend.
+func (a *AuditBackend) GetServices(ctx context.Context, prefix string) ([]*Service, error) {
+	return a.backend.GetServices(ctx, prefix)
+}
+
+// GetServicesWithOptions delegates to the wrapped backend.
+func (a *AuditBackend) GetServicesWithOptions(ctx context.Context, prefix string, opts GetServicesOptions) ([]*Service, error) {
+	return a.backend.GetServicesWithOptions(ctx, prefix, opts)
+}
+
+// GetServicesByType delegates to the wrapped backend.
+func (a *AuditBackend) GetServicesByType(ctx context.Context, prefix, recordType string) ([]*Service, error) {
+	return a.backend.GetServicesByType(ctx, prefix, recordType)
+}
+
+// GetServicesBySource delegates to the wrapped backend.
+func (a *AuditBackend) GetServicesBySource(ctx context.Context, prefix, source string) ([]*Service, error) {
+	return a.backend.GetServicesBySource(ctx, prefix, source)
+}
+
+// ForEach delegates to the wrapped backend.
+func (a *AuditBackend) ForEach(ctx context.Context, prefix string, fn func(key string, svc *Service) error) error {
+	return a.backend.ForEach(ctx, prefix, fn)
+}
+
+// StreamKeys delegates to the wrapped backend.
+func (a *AuditBackend) StreamKeys(ctx context.Context, prefix string, fn func(key string) error) error {
+	return StreamKeys(ctx, a.backend, prefix, fn)
+}
+
+// GetServicesPage delegates to the wrapped backend.
+func (a *AuditBackend) GetServicesPage(ctx context.Context, prefix, afterKey string, limit int) ([]*Service, string, error) {
+	return a.backend.GetServicesPage(ctx, prefix, afterKey, limit)
+}
+
+// Exists delegates to the wrapped backend.
+func (a *AuditBackend) Exists(ctx context.Context, prefix string) (bool, error) {
+	return a.backend.Exists(ctx, prefix)
+}
+
+// IsEmpty delegates to the wrapped backend.
+func (a *AuditBackend) IsEmpty(ctx context.Context) (bool, error) {
+	return IsEmpty(ctx, a.backend)
+}
+
+// Snapshot delegates to the wrapped backend.
+func (a *AuditBackend) Snapshot(ctx context.Context) (map[string]Service, error) {
+	return a.backend.Snapshot(ctx)
+}
+
+// SaveService saves the service and records the save.
+func (a *AuditBackend) SaveService(ctx context.Context, service *Service) error {
+	value, err := a.codec.Marshal(service)
+	if err != nil {
+		return err
+	}
+	if err := a.backend.SaveService(ctx, service); err != nil {
+		return err
+	}
+	sum := sha256.Sum256(value)
+	a.record(ctx, AuditEvent{Operation: OpSaveService, Key: service.Key, ValueHash: hex.EncodeToString(sum[:])})
+	return nil
+}
+
+// SaveServiceWithPolicy saves the service according to policy and records
+// the save if the service was written.
+func (a *AuditBackend) SaveServiceWithPolicy(ctx context.Context, service *Service, policy ConflictPolicy) (bool, error) {
+	value, err := a.codec.Marshal(service)
+	if err != nil {
+		return false, err
+	}
+	written, err := SaveServiceWithPolicy(ctx, a.backend, service, policy)
+	if err != nil || !written {
+		return written, err
+	}
+	sum := sha256.Sum256(value)
+	a.record(ctx, AuditEvent{Operation: OpSaveServiceWithPolicy, Key: service.Key, ValueHash: hex.EncodeToString(sum[:])})
+	return true, nil
+}
+
+// UpdateService updates the service and records the update.
+func (a *AuditBackend) UpdateService(ctx context.Context, service *Service) error {
+	value, err := a.codec.Marshal(service)
+	if err != nil {
+		return err
+	}
+	if err := UpdateService(ctx, a.backend, service); err != nil {
+		return err
+	}
+	sum := sha256.Sum256(value)
+	a.record(ctx, AuditEvent{Operation: OpUpdateService, Key: service.Key, ValueHash: hex.EncodeToString(sum[:])})
+	return nil
+}
+
+// DeleteService deletes the key and its children and records the delete.
+func (a *AuditBackend) DeleteService(ctx context.Context, key string) error {
+	if err := a.backend.DeleteService(ctx, key); err != nil {
+		return err
+	}
+	a.record(ctx, AuditEvent{Operation: OpDeleteService, Key: key})
+	return nil
+}
+
+// deleteIfCovered deletes the key and its children if covered accepts all
+// of them, and records the delete.
+func (a *AuditBackend) deleteIfCovered(ctx context.Context, key string, covered func(key string) bool) (bool, error) {
+	deleted, err := deleteIfCovered(ctx, a.backend, key, covered)
+	if err != nil || !deleted {
+		return deleted, err
+	}
+	a.record(ctx, AuditEvent{Operation: OpDeleteService, Key: key})
+	return true, nil
+}
+
+// ClearPrefix clears the prefix and records the clear.
+func (a *AuditBackend) ClearPrefix(ctx context.Context, prefix string) error {
+	if err := a.backend.ClearPrefix(ctx, prefix); err != nil {
+		return err
+	}
+	a.record(ctx, AuditEvent{Operation: OpClearPrefix, Key: prefix})
+	return nil
+}
+
+// Flush flushes the wrapped backend.
+func (a *AuditBackend) Flush(ctx context.Context) error {
+	return a.backend.Flush(ctx)
+}
+
+// Close closes the wrapped backend.
+func (a *AuditBackend) Close() error {
+	return a.backend.Close()
+}
+
+// Health reports the health of the wrapped backend.
+func (a *AuditBackend) Health(ctx context.Context) error {
+	return checkHealth(ctx, a.backend)
+}
+
+// Capabilities reports the capabilities of the wrapped backend, except Watch.
+func (a *AuditBackend) Capabilities() BackendCapabilities {
+	return decoratorCapabilities(a.backend)
+}
+
+// Unwrap returns the wrapped backend.
+func (a *AuditBackend) Unwrap() Backend {
+	return a.backend
+}
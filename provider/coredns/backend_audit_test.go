@@ -0,0 +1,84 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package coredns
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuditBackend(t *testing.T) {
+	ctx := context.Background()
+	var out bytes.Buffer
+	fault := NewFaultInjectingBackend(NewMemoryBackend())
+	backend := NewAuditBackend(fault, NewJSONAuditSink(&out))
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	backend.clock = NewFakeClock(now)
+
+	readEvents := func() []AuditEvent {
+		var events []AuditEvent
+		for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+			if line == "" {
+				continue
+			}
+			var event AuditEvent
+			require.NoError(t, json.Unmarshal([]byte(line), &event))
+			events = append(events, event)
+		}
+		out.Reset()
+		return events
+	}
+
+	svc := &Service{Host: "10.0.0.1", Key: "/skydns/com/example/www"}
+	require.NoError(t, backend.SaveService(ctx, svc))
+	value, err := DefaultCodec.Marshal(svc)
+	require.NoError(t, err)
+	sum := sha256.Sum256(value)
+	assert.Equal(t, []AuditEvent{{
+		Time:      now,
+		Operation: OpSaveService,
+		Key:       "/skydns/com/example/www",
+		ValueHash: hex.EncodeToString(sum[:]),
+	}}, readEvents())
+
+	_, err = backend.GetServices(ctx, "/skydns")
+	require.NoError(t, err)
+	_, err = backend.Snapshot(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, readEvents(), "reads are not audited")
+
+	require.NoError(t, backend.DeleteService(ctx, "/skydns/com/example/www"))
+	assert.Equal(t, []AuditEvent{{
+		Time:      now,
+		Operation: OpDeleteService,
+		Key:       "/skydns/com/example/www",
+	}}, readEvents())
+
+	fault.FailOn(OpSaveService, 0, errors.New("unavailable"))
+	assert.Error(t, backend.SaveService(ctx, svc))
+	assert.Empty(t, readEvents(), "failed writes are not audited")
+}
@@ -0,0 +1,379 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package coredns
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// CoalescingBackend wraps a Backend and buffers writes for a short window,
+// so that a key saved many times in quick succession (e.g. a flapping
+// endpoint) is written to the backend only once, with its latest value.
+// A delete supersedes the buffered saves of the keys it removes.
+//
+// Buffered writes are sent to the backend, in the order they were made,
+// when the window elapses, on Flush and on Close. Reads flush first, so they
+// always observe earlier writes. Errors of writes flushed when the window
+// elapses are logged; those flushed by Flush or Close are returned, and the
+// writes that could not be applied stay buffered.
+type CoalescingBackend struct {
+	backend Backend
+	window  time.Duration
+	keys    KeyScheme // scheme of the keys deletes remove the children of
+
+	// flushMu serializes flushes so that writes reach the backend in order
+	flushMu sync.Mutex
+
+	mu      sync.Mutex
+	pending []*coalescedWrite
+	saves   map[string]*coalescedWrite // latest buffered save per key
+	timer   *time.Timer
+	closed  bool
+}
+
+// coalescedWrite is a buffered save, or a delete if service is nil.
+type coalescedWrite struct {
+	key        string
+	service    *Service
+	superseded bool
+}
+
+// Compile-time check that CoalescingBackend implements Backend
+var _ Backend = (*CoalescingBackend)(nil)
+
+// CoalescingOptions configures a CoalescingBackend.
+type CoalescingOptions struct {
+	// Keys is the scheme of stored keys, whose children buffered deletes
+	// remove. The zero value separates labels with "/".
+	Keys KeyScheme
+}
+
+// NewCoalescingBackend wraps backend so that writes are buffered for window
+// before being sent to it.
+func NewCoalescingBackend(backend Backend, window time.Duration) *CoalescingBackend {
+	return NewCoalescingBackendWithOptions(backend, window, CoalescingOptions{})
+}
+
+// NewCoalescingBackendWithOptions is NewCoalescingBackend with the key
+// scheme given by opts.
+func NewCoalescingBackendWithOptions(backend Backend, window time.Duration, opts CoalescingOptions) *CoalescingBackend {
+	return &CoalescingBackend{
+		backend: backend,
+		window:  window,
+		keys:    opts.Keys,
+		saves:   make(map[string]*coalescedWrite),
+	}
+}
+
+// GetServices flushes buffered writes, then delegates to the wrapped backend.
+func (c *CoalescingBackend) GetServices(ctx context.Context, prefix string) ([]*Service, error) {
+	if err := c.flushPending(ctx); err != nil {
+		return nil, err
+	}
+	return c.backend.GetServices(ctx, prefix)
+}
+
+// GetServicesWithOptions flushes buffered writes, then delegates to the wrapped backend.
+func (c *CoalescingBackend) GetServicesWithOptions(ctx context.Context, prefix string, opts GetServicesOptions) ([]*Service, error) {
+	if err := c.flushPending(ctx); err != nil {
+		return nil, err
+	}
+	return c.backend.GetServicesWithOptions(ctx, prefix, opts)
+}
+
+// GetServicesByType flushes buffered writes, then delegates to the wrapped backend.
+func (c *CoalescingBackend) GetServicesByType(ctx context.Context, prefix, recordType string) ([]*Service, error) {
+	if err := c.flushPending(ctx); err != nil {
+		return nil, err
+	}
+	return c.backend.GetServicesByType(ctx, prefix, recordType)
+}
+
+// GetServicesBySource flushes buffered writes, then delegates to the wrapped backend.
+func (c *CoalescingBackend) GetServicesBySource(ctx context.Context, prefix, source string) ([]*Service, error) {
+	if err := c.flushPending(ctx); err != nil {
+		return nil, err
+	}
+	return c.backend.GetServicesBySource(ctx, prefix, source)
+}
+
+// GetServicesPage flushes buffered writes, then delegates to the wrapped backend.
+func (c *CoalescingBackend) GetServicesPage(ctx context.Context, prefix, afterKey string, limit int) ([]*Service, string, error) {
+	if err := c.flushPending(ctx); err != nil {
+		return nil, "", err
+	}
+	return c.backend.GetServicesPage(ctx, prefix, afterKey, limit)
+}
+
+// Exists flushes buffered writes, then delegates to the wrapped backend.
+func (c *CoalescingBackend) Exists(ctx context.Context, prefix string) (bool, error) {
+	if err := c.flushPending(ctx); err != nil {
+		return false, err
+	}
+	return c.backend.Exists(ctx, prefix)
+}
+
+// IsEmpty flushes buffered writes, then delegates to the wrapped backend.
+func (c *CoalescingBackend) IsEmpty(ctx context.Context) (bool, error) {
+	if err := c.flushPending(ctx); err != nil {
+		return false, err
+	}
+	return IsEmpty(ctx, c.backend)
+}
+
+// ForEach flushes buffered writes, then delegates to the wrapped backend.
+func (c *CoalescingBackend) ForEach(ctx context.Context, prefix string, fn func(key string, svc *Service) error) error {
+	if err := c.flushPending(ctx); err != nil {
+		return err
+	}
+	return c.backend.ForEach(ctx, prefix, fn)
+}
+
+// StreamKeys flushes buffered writes, then delegates to the wrapped backend.
+func (c *CoalescingBackend) StreamKeys(ctx context.Context, prefix string, fn func(key string) error) error {
+	if err := c.flushPending(ctx); err != nil {
+		return err
+	}
+	return StreamKeys(ctx, c.backend, prefix, fn)
+}
+
+// Snapshot flushes buffered writes, then delegates to the wrapped backend.
+func (c *CoalescingBackend) Snapshot(ctx context.Context) (map[string]Service, error) {
+	if err := c.flushPending(ctx); err != nil {
+		return nil, err
+	}
+	return c.backend.Snapshot(ctx)
+}
+
+// SaveService validates the service and buffers it, replacing any buffered
+// save of the same key. With DurabilitySync, the buffered writes are sent to
+// the backend before it returns.
+func (c *CoalescingBackend) SaveService(ctx context.Context, service *Service) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := service.Validate(); err != nil {
+		return err
+	}
+
+	svcCopy := *service
+
+	if err := c.enqueue(&coalescedWrite{key: service.Key, service: &svcCopy}); err != nil {
+		return err
+	}
+	if durabilityFrom(ctx) == DurabilitySync {
+		return c.flushPending(ctx)
+	}
+	return nil
+}
+
+// DeleteService buffers a delete of the key and its children, dropping the
+// buffered saves it supersedes. With DurabilitySync, the buffered writes are
+// sent to the backend before it returns.
+func (c *CoalescingBackend) DeleteService(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if err := c.enqueue(&coalescedWrite{key: key}); err != nil {
+		return err
+	}
+	if durabilityFrom(ctx) == DurabilitySync {
+		return c.flushPending(ctx)
+	}
+	return nil
+}
+
+// deleteIfCovered flushes buffered writes, then deletes the key and its
+// children in the wrapped backend if covered accepts all of them. The
+// delete itself isn't buffered.
+func (c *CoalescingBackend) deleteIfCovered(ctx context.Context, key string, covered func(key string) bool) (bool, error) {
+	if err := c.flushPending(ctx); err != nil {
+		return false, err
+	}
+	return deleteIfCovered(ctx, c.backend, key, covered)
+}
+
+// SaveServiceWithPolicy flushes buffered writes, then saves the service in
+// the wrapped backend according to policy. The save isn't buffered, as the
+// policy must see the stored service.
+func (c *CoalescingBackend) SaveServiceWithPolicy(ctx context.Context, service *Service, policy ConflictPolicy) (bool, error) {
+	if err := c.flushPending(ctx); err != nil {
+		return false, err
+	}
+	return SaveServiceWithPolicy(ctx, c.backend, service, policy)
+}
+
+// UpdateService flushes buffered writes, then updates the service in the
+// wrapped backend. The update isn't buffered, as it must see whether the key
+// is stored.
+func (c *CoalescingBackend) UpdateService(ctx context.Context, service *Service) error {
+	if err := c.flushPending(ctx); err != nil {
+		return err
+	}
+	return UpdateService(ctx, c.backend, service)
+}
+
+// ClearPrefix flushes buffered writes, then clears the prefix in the wrapped
+// backend. The clear itself isn't buffered.
+func (c *CoalescingBackend) ClearPrefix(ctx context.Context, prefix string) error {
+	if err := c.flushPending(ctx); err != nil {
+		return err
+	}
+	return c.backend.ClearPrefix(ctx, prefix)
+}
+
+// enqueue buffers write and schedules a flush.
+func (c *CoalescingBackend) enqueue(write *coalescedWrite) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return ErrBackendClosed
+	}
+	c.enqueueLocked(write)
+	c.armTimerLocked()
+	return nil
+}
+
+// enqueueLocked buffers write, marking the buffered saves it replaces as
+// superseded. The caller must hold c.mu.
+func (c *CoalescingBackend) enqueueLocked(write *coalescedWrite) {
+	if write.service != nil {
+		if previous, ok := c.saves[write.key]; ok {
+			previous.superseded = true
+		}
+		c.saves[write.key] = write
+	} else {
+		for k, save := range c.saves {
+			if c.keys.isUnder(k, write.key) {
+				save.superseded = true
+				delete(c.saves, k)
+			}
+		}
+	}
+	c.pending = append(c.pending, write)
+}
+
+// armTimerLocked schedules a flush when the window elapses, unless one is
+// already scheduled. The caller must hold c.mu.
+func (c *CoalescingBackend) armTimerLocked() {
+	if c.timer != nil || len(c.pending) == 0 {
+		return
+	}
+	c.timer = time.AfterFunc(c.window, func() {
+		if err := c.flushPending(context.Background()); err != nil {
+			log.Errorf("Failed to flush coalesced writes: %v", err)
+		}
+	})
+}
+
+// flushPending sends the buffered writes to the backend in order. Writes
+// that fail, and those after them, are buffered again.
+func (c *CoalescingBackend) flushPending(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	c.flushMu.Lock()
+	defer c.flushMu.Unlock()
+
+	c.mu.Lock()
+	pending := c.pending
+	c.pending = nil
+	c.saves = make(map[string]*coalescedWrite)
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+	c.mu.Unlock()
+
+	for i, write := range pending {
+		if write.superseded {
+			continue
+		}
+		var err error
+		if write.service != nil {
+			err = c.backend.SaveService(ctx, write.service)
+		} else {
+			err = c.backend.DeleteService(ctx, write.key)
+		}
+		if err != nil {
+			c.requeue(pending[i:])
+			return err
+		}
+	}
+	return nil
+}
+
+// requeue buffers writes again ahead of those made since they were taken.
+func (c *CoalescingBackend) requeue(writes []*coalescedWrite) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	newer := c.pending
+	c.pending = nil
+	c.saves = make(map[string]*coalescedWrite)
+	for _, write := range append(append([]*coalescedWrite(nil), writes...), newer...) {
+		if !write.superseded {
+			c.enqueueLocked(write)
+		}
+	}
+	if !c.closed {
+		c.armTimerLocked()
+	}
+}
+
+// Flush sends the buffered writes to the backend, then flushes it.
+func (c *CoalescingBackend) Flush(ctx context.Context) error {
+	if err := c.flushPending(ctx); err != nil {
+		return err
+	}
+	return c.backend.Flush(ctx)
+}
+
+// Health reports the health of the wrapped backend.
+func (c *CoalescingBackend) Health(ctx context.Context) error {
+	return checkHealth(ctx, c.backend)
+}
+
+// Capabilities reports the capabilities of the wrapped backend, except Watch.
+func (c *CoalescingBackend) Capabilities() BackendCapabilities {
+	return decoratorCapabilities(c.backend)
+}
+
+// Close flushes the buffered writes and closes the wrapped backend, even
+// if flushing fails.
+func (c *CoalescingBackend) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	c.mu.Unlock()
+
+	flushErr := c.flushPending(context.Background())
+	return errors.Join(flushErr, c.backend.Close())
+}
+
+// Unwrap returns the wrapped backend.
+func (c *CoalescingBackend) Unwrap() Backend {
+	return c.backend
+}
@@ -0,0 +1,174 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package coredns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestCoalescingBackend(window time.Duration) (*CoalescingBackend, *FaultInjectingBackend) {
+	fault := NewFaultInjectingBackend(NewMemoryBackend())
+	return NewCoalescingBackend(fault, window), fault
+}
+
+func TestCoalescingBackend_RapidSavesWriteOnce(t *testing.T) {
+	ctx := context.Background()
+	backend, fault := newTestCoalescingBackend(time.Hour)
+	defer backend.Close()
+
+	for i := 0; i < 10; i++ {
+		require.NoError(t, backend.SaveService(ctx, &Service{Host: fmt.Sprintf("10.0.0.%d", i), Key: "/skydns/com/example/www"}))
+	}
+	assert.Equal(t, 0, fault.Calls(OpSaveService))
+
+	require.NoError(t, backend.Flush(ctx))
+	assert.Equal(t, 1, fault.Calls(OpSaveService))
+
+	services, err := fault.GetServices(ctx, "/skydns/com/example/www")
+	require.NoError(t, err)
+	require.Len(t, services, 1)
+	assert.Equal(t, "10.0.0.9", services[0].Host)
+}
+
+func TestCoalescingBackend_DeleteSupersedesSaves(t *testing.T) {
+	ctx := context.Background()
+	backend, fault := newTestCoalescingBackend(time.Hour)
+	defer backend.Close()
+
+	require.NoError(t, fault.SaveService(ctx, &Service{Host: "10.0.0.1", Key: "/skydns/com/example/old"}))
+	require.NoError(t, backend.SaveService(ctx, &Service{Host: "10.0.0.2", Key: "/skydns/com/example/www"}))
+	require.NoError(t, backend.SaveService(ctx, &Service{Host: "10.0.0.3", Key: "/skydns/com/example/www/x1"}))
+	require.NoError(t, backend.DeleteService(ctx, "/skydns/com/example"))
+	require.NoError(t, backend.SaveService(ctx, &Service{Host: "10.0.0.4", Key: "/skydns/com/example/api"}))
+
+	require.NoError(t, backend.Flush(ctx))
+	assert.Equal(t, 2, fault.Calls(OpSaveService), "one direct save and the save made after the delete")
+	assert.Equal(t, 1, fault.Calls(OpDeleteService))
+
+	snapshot, err := fault.Snapshot(ctx)
+	require.NoError(t, err)
+	assert.Len(t, snapshot, 1)
+	assert.Contains(t, snapshot, "/skydns/com/example/api")
+}
+
+func TestCoalescingBackend_DeleteSupersedesSavesWithKeyScheme(t *testing.T) {
+	ctx := context.Background()
+	inner := NewMemoryBackendWithOptions(MemoryOptions{Prefix: ":skydns", Keys: KeyScheme{Separator: ':'}})
+	backend := NewCoalescingBackendWithOptions(inner, time.Hour, CoalescingOptions{Keys: KeyScheme{Separator: ':'}})
+	defer backend.Close()
+
+	require.NoError(t, backend.SaveService(ctx, &Service{Host: "10.0.0.1", Key: ":skydns:com:example:www"}))
+	require.NoError(t, backend.SaveService(ctx, &Service{Host: "10.0.0.2", Key: ":skydns:com:examplez:www"}))
+	require.NoError(t, backend.DeleteService(ctx, ":skydns:com:example"))
+
+	require.NoError(t, backend.Flush(ctx))
+	assert.Equal(t, []string{":skydns:com:examplez:www"}, inner.Keys())
+}
+
+func TestCoalescingBackend_ReadsFlushFirst(t *testing.T) {
+	ctx := context.Background()
+	backend, fault := newTestCoalescingBackend(time.Hour)
+	defer backend.Close()
+
+	require.NoError(t, backend.SaveService(ctx, &Service{Host: "10.0.0.1", Key: "/skydns/com/example/www"}))
+	exists, err := backend.Exists(ctx, "/skydns/com/example/www")
+	require.NoError(t, err)
+	assert.True(t, exists)
+	assert.Equal(t, 1, fault.Calls(OpSaveService))
+}
+
+func TestCoalescingBackend_FlushesAfterWindow(t *testing.T) {
+	ctx := context.Background()
+	backend, fault := newTestCoalescingBackend(10 * time.Millisecond)
+	defer backend.Close()
+
+	require.NoError(t, backend.SaveService(ctx, &Service{Host: "10.0.0.1", Key: "/skydns/com/example/www"}))
+	assert.Eventually(t, func() bool {
+		return fault.Calls(OpSaveService) == 1
+	}, time.Second, 5*time.Millisecond)
+}
+
+func TestCoalescingBackend_CloseFlushes(t *testing.T) {
+	ctx := context.Background()
+	backend, fault := newTestCoalescingBackend(time.Hour)
+
+	require.NoError(t, backend.SaveService(ctx, &Service{Host: "10.0.0.1", Key: "/skydns/com/example/www"}))
+	require.NoError(t, backend.Close())
+	assert.Equal(t, 1, fault.Calls(OpSaveService))
+	assert.Equal(t, 1, fault.Calls(OpClose))
+
+	assert.ErrorIs(t, backend.SaveService(ctx, &Service{Host: "10.0.0.3", Key: "/skydns/com/example/www"}), ErrBackendClosed)
+	assert.ErrorIs(t, backend.DeleteService(ctx, "/skydns/com/example/www"), ErrBackendClosed)
+}
+
+func TestCoalescingBackend_RespectsContext(t *testing.T) {
+	backend, fault := newTestCoalescingBackend(time.Hour)
+	defer backend.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.ErrorIs(t, backend.SaveService(ctx, &Service{Host: "10.0.0.1", Key: "/skydns/com/example/www"}), context.Canceled)
+	assert.ErrorIs(t, backend.DeleteService(ctx, "/skydns/com/example/www"), context.Canceled)
+
+	require.NoError(t, backend.SaveService(context.Background(), &Service{Host: "10.0.0.1", Key: "/skydns/com/example/www"}))
+	assert.ErrorIs(t, backend.Flush(ctx), context.Canceled)
+	assert.Equal(t, 0, fault.Calls(OpSaveService))
+
+	require.NoError(t, backend.Flush(context.Background()))
+	assert.Equal(t, 1, fault.Calls(OpSaveService))
+}
+
+func TestCoalescingBackend_FailedFlushKeepsWrites(t *testing.T) {
+	ctx := context.Background()
+	backend, fault := newTestCoalescingBackend(time.Hour)
+	defer backend.Close()
+
+	errUnavailable := errors.New("unavailable")
+	fault.FailOn(OpSaveService, 1, errUnavailable)
+
+	require.NoError(t, backend.SaveService(ctx, &Service{Host: "10.0.0.1", Key: "/skydns/com/example/www"}))
+	assert.ErrorIs(t, backend.Flush(ctx), errUnavailable)
+
+	require.NoError(t, backend.SaveService(ctx, &Service{Host: "10.0.0.2", Key: "/skydns/com/example/api"}))
+	require.NoError(t, backend.Flush(ctx))
+
+	snapshot, err := fault.Snapshot(ctx)
+	require.NoError(t, err)
+	assert.Len(t, snapshot, 2)
+}
+
+func TestCoalescingBackend_SyncWritesFlush(t *testing.T) {
+	ctx := context.Background()
+	backend, fault := newTestCoalescingBackend(time.Hour)
+	defer backend.Close()
+
+	require.NoError(t, backend.SaveService(ctx, &Service{Host: "10.0.0.1", Key: "/skydns/com/example/api"}))
+	assert.Equal(t, 0, fault.Calls(OpSaveService))
+
+	require.NoError(t, backend.SaveService(WithDurability(ctx, DurabilitySync), &Service{Host: "10.0.0.2", Key: "/skydns/com/example/www"}))
+	assert.Equal(t, 2, fault.Calls(OpSaveService), "the sync write and the one buffered before it")
+
+	require.NoError(t, backend.DeleteService(WithDurability(ctx, DurabilitySync), "/skydns/com/example/api"))
+	assert.Equal(t, 1, fault.Calls(OpDeleteService))
+}
@@ -0,0 +1,1013 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package coredns
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	etcdcv3 "go.etcd.io/etcd/client/v3"
+
+	"sigs.k8s.io/external-dns/endpoint"
+)
+
+// fakeEtcdKV is an in-memory etcd KV honoring the range, limit, keys-only
+// and count-only options used by etcdClient, and transactions comparing key
+// existence or mod revisions (see fakeEtcdTxn). Ranges are returned in key
+// order. Every write bumps the revision reported in response headers, and
+// the range requests received are recorded.
+type fakeEtcdKV struct {
+	etcdcv3.KV
+
+	mu       sync.Mutex
+	kvs      map[string]string
+	mods     map[string]int64
+	revision int64
+	gets     []etcdcv3.Op
+}
+
+func newFakeEtcdKV() *fakeEtcdKV {
+	return &fakeEtcdKV{kvs: make(map[string]string), mods: make(map[string]int64)}
+}
+
+// inRange reports whether key falls in the range selected by op.
+func inRange(op etcdcv3.Op, key string) bool {
+	start, end := op.KeyBytes(), op.RangeBytes()
+	switch {
+	case len(end) == 0:
+		return key == string(start)
+	case bytes.Equal(end, []byte{0}):
+		return key >= string(start)
+	default:
+		return key >= string(start) && key < string(end)
+	}
+}
+
+func (f *fakeEtcdKV) Put(_ context.Context, key, val string, _ ...etcdcv3.OpOption) (*etcdcv3.PutResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.putLocked(key, val)
+	return &etcdcv3.PutResponse{}, nil
+}
+
+// putLocked stores val at key in a new revision. The caller must hold f.mu.
+func (f *fakeEtcdKV) putLocked(key, val string) {
+	f.revision++
+	f.kvs[key] = val
+	f.mods[key] = f.revision
+}
+
+// deleteLocked deletes the keys in the range selected by op in a new
+// revision, if any. The caller must hold f.mu.
+func (f *fakeEtcdKV) deleteLocked(op etcdcv3.Op) int64 {
+	var deleted int64
+	for k := range f.kvs {
+		if inRange(op, k) {
+			delete(f.kvs, k)
+			delete(f.mods, k)
+			deleted++
+		}
+	}
+	if deleted > 0 {
+		f.revision++
+	}
+	return deleted
+}
+
+func (f *fakeEtcdKV) Get(_ context.Context, key string, opts ...etcdcv3.OpOption) (*etcdcv3.GetResponse, error) {
+	op := etcdcv3.OpGet(key, opts...)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.gets = append(f.gets, op)
+
+	var keys []string
+	for k := range f.kvs {
+		if inRange(op, k) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	resp := &etcdcv3.GetResponse{
+		Header: &etcdserverpb.ResponseHeader{Revision: f.revision},
+		Count:  int64(len(keys)),
+	}
+	if op.IsCountOnly() {
+		return resp, nil
+	}
+	if limit := int(op.Limit()); limit > 0 && len(keys) > limit {
+		keys = keys[:limit]
+		resp.More = true
+	}
+	for _, k := range keys {
+		kv := &mvccpb.KeyValue{Key: []byte(k)}
+		if !op.IsKeysOnly() {
+			kv.Value = []byte(f.kvs[k])
+		}
+		resp.Kvs = append(resp.Kvs, kv)
+	}
+	return resp, nil
+}
+
+func (f *fakeEtcdKV) Delete(_ context.Context, key string, opts ...etcdcv3.OpOption) (*etcdcv3.DeleteResponse, error) {
+	op := etcdcv3.OpDelete(key, opts...)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return &etcdcv3.DeleteResponse{Deleted: f.deleteLocked(op)}, nil
+}
+
+func (f *fakeEtcdKV) Txn(_ context.Context) etcdcv3.Txn {
+	return &fakeEtcdTxn{kv: f}
+}
+
+// fakeEtcdTxn is a transaction of a fakeEtcdKV. It supports the existence
+// compares (create revision against 0), mod revision compares over a key or
+// a range, and put and delete ops.
+type fakeEtcdTxn struct {
+	kv        *fakeEtcdKV
+	cmps      []etcdcv3.Cmp
+	then, els []etcdcv3.Op
+}
+
+func (t *fakeEtcdTxn) If(cmps ...etcdcv3.Cmp) etcdcv3.Txn {
+	t.cmps = append(t.cmps, cmps...)
+	return t
+}
+
+func (t *fakeEtcdTxn) Then(ops ...etcdcv3.Op) etcdcv3.Txn {
+	t.then = append(t.then, ops...)
+	return t
+}
+
+func (t *fakeEtcdTxn) Else(ops ...etcdcv3.Op) etcdcv3.Txn {
+	t.els = append(t.els, ops...)
+	return t
+}
+
+func (t *fakeEtcdTxn) Commit() (*etcdcv3.TxnResponse, error) {
+	t.kv.mu.Lock()
+	defer t.kv.mu.Unlock()
+
+	succeeded := true
+	for _, cmp := range t.cmps {
+		ok, err := t.compare(cmp)
+		if err != nil {
+			return nil, err
+		}
+		succeeded = succeeded && ok
+	}
+
+	ops := t.then
+	if !succeeded {
+		ops = t.els
+	}
+	for _, op := range ops {
+		switch {
+		case op.IsPut():
+			t.kv.putLocked(string(op.KeyBytes()), string(op.ValueBytes()))
+		case op.IsDelete():
+			t.kv.deleteLocked(op)
+		default:
+			return nil, fmt.Errorf("fake etcd: unsupported txn op on %s", op.KeyBytes())
+		}
+	}
+	return &etcdcv3.TxnResponse{Succeeded: succeeded}, nil
+}
+
+// compare evaluates cmp as etcd does: a compare over a range holds if it
+// holds for every key in the range, or for a missing key if there is none.
+func (t *fakeEtcdTxn) compare(cmp etcdcv3.Cmp) (bool, error) {
+	switch target := cmp.TargetUnion.(type) {
+	case *etcdserverpb.Compare_CreateRevision:
+		if target.CreateRevision != 0 || len(cmp.RangeEnd) > 0 {
+			return false, fmt.Errorf("fake etcd: unsupported compare %v", cmp)
+		}
+		_, exists := t.kv.kvs[string(cmp.KeyBytes())]
+		switch cmp.Result {
+		case etcdserverpb.Compare_EQUAL:
+			return !exists, nil
+		case etcdserverpb.Compare_GREATER:
+			return exists, nil
+		}
+	case *etcdserverpb.Compare_ModRevision:
+		if cmp.Result != etcdserverpb.Compare_LESS {
+			break
+		}
+		rangeOp := etcdcv3.OpGet(string(cmp.KeyBytes()), etcdcv3.WithRange(string(cmp.RangeEnd)))
+		for k, mod := range t.kv.mods {
+			if inRange(rangeOp, k) && mod >= target.ModRevision {
+				return false, nil
+			}
+		}
+		return true, nil
+	}
+	return false, fmt.Errorf("fake etcd: unsupported compare %v", cmp)
+}
+
+func TestBackendConformance(t *testing.T) {
+	t.Run("memory", func(t *testing.T) {
+		runBackendConformance(t, func() Backend {
+			return NewMemoryBackend()
+		})
+	})
+	t.Run("sqlite", func(t *testing.T) {
+		runBackendConformance(t, func() Backend {
+			backend, err := NewSQLiteBackend(":memory:")
+			require.NoError(t, err)
+			return backend
+		})
+	})
+	t.Run("sharded sqlite", func(t *testing.T) {
+		runBackendConformance(t, func() Backend {
+			backend, err := NewShardedSQLiteBackend(":memory:", 4, SQLiteOptions{})
+			require.NoError(t, err)
+			return backend
+		})
+	})
+	t.Run("etcd", func(t *testing.T) {
+		runBackendConformance(t, func() Backend {
+			client := etcdcv3.NewCtxClient(context.Background())
+			client.KV = newFakeEtcdKV()
+			return &etcdClient{client: client}
+		})
+	})
+}
+
+// runBackendConformance checks that a backend implements the Backend contract
+// the same way as the others. newBackend must return an empty backend using
+// DefaultPrefix.
+func runBackendConformance(t *testing.T, newBackend func() Backend) {
+	keysOf := func(services []*Service) []string {
+		var keys []string
+		for _, svc := range services {
+			keys = append(keys, svc.Key)
+		}
+		return keys
+	}
+
+	tests := []struct {
+		name string
+		run  func(t *testing.T, ctx context.Context, backend Backend)
+	}{
+		{
+			name: "save and get",
+			run: func(t *testing.T, ctx context.Context, backend Backend) {
+				svc := &Service{Host: "1.2.3.4", Port: 8080, Priority: 20, Weight: 5, Text: "hello", TTL: 300, TargetStrip: 1, Group: "blue", Key: "/skydns/com/example/www/1a2b"}
+				require.NoError(t, backend.SaveService(ctx, svc))
+
+				services, err := backend.GetServices(ctx, "/skydns/com/example")
+				require.NoError(t, err)
+				require.Len(t, services, 1)
+				assert.Equal(t, svc, services[0])
+
+				empty, err := backend.GetServices(ctx, "/skydns/org")
+				require.NoError(t, err)
+				assert.Empty(t, empty)
+			},
+		},
+		{
+			name: "update overwrites",
+			run: func(t *testing.T, ctx context.Context, backend Backend) {
+				require.NoError(t, backend.SaveService(ctx, &Service{Host: "1.1.1.1", Key: "/skydns/com/example/www"}))
+				require.NoError(t, backend.SaveService(ctx, &Service{Host: "2.2.2.2", Key: "/skydns/com/example/www"}))
+
+				services, err := backend.GetServices(ctx, "/skydns/")
+				require.NoError(t, err)
+				require.Len(t, services, 1)
+				assert.Equal(t, "2.2.2.2", services[0].Host)
+			},
+		},
+		{
+			name: "delete",
+			run: func(t *testing.T, ctx context.Context, backend Backend) {
+				require.NoError(t, backend.SaveService(ctx, &Service{Host: "1.1.1.1", Key: "/skydns/com/example/www"}))
+				require.NoError(t, backend.SaveService(ctx, &Service{Host: "2.2.2.2", Key: "/skydns/com/example/api"}))
+				require.NoError(t, backend.DeleteService(ctx, "/skydns/com/example/www"))
+				// Deleting a missing key is not an error
+				require.NoError(t, backend.DeleteService(ctx, "/skydns/com/example/missing"))
+
+				services, err := backend.GetServices(ctx, "/skydns/")
+				require.NoError(t, err)
+				assert.Equal(t, []string{"/skydns/com/example/api"}, keysOf(services))
+			},
+		},
+		{
+			name: "prefix delete",
+			run: func(t *testing.T, ctx context.Context, backend Backend) {
+				for _, key := range []string{"/skydns/com/example/www", "/skydns/com/example/www/a", "/skydns/com/example/www/b", "/skydns/org/other"} {
+					require.NoError(t, backend.SaveService(ctx, &Service{Host: "1.1.1.1", Key: key}))
+				}
+				require.NoError(t, backend.DeleteService(ctx, "/skydns/com/example"))
+
+				services, err := backend.GetServices(ctx, "/skydns/")
+				require.NoError(t, err)
+				assert.Equal(t, []string{"/skydns/org/other"}, keysOf(services))
+			},
+		},
+		{
+			name: "dedup",
+			run: func(t *testing.T, ctx context.Context, backend Backend) {
+				for _, key := range []string{"/skydns/com/example/www/aaaa", "/skydns/com/example/www/bbbb"} {
+					require.NoError(t, backend.SaveService(ctx, &Service{Host: "1.2.3.4", TargetStrip: 1, Key: key}))
+				}
+				require.NoError(t, backend.SaveService(ctx, &Service{Host: "5.6.7.8", TargetStrip: 1, Key: "/skydns/com/example/www/cccc"}))
+
+				services, err := backend.GetServices(ctx, "/skydns/com/example")
+				require.NoError(t, err)
+				assert.Equal(t, []string{"/skydns/com/example/www/aaaa", "/skydns/com/example/www/cccc"}, keysOf(services))
+
+				raw, err := backend.GetServicesWithOptions(ctx, "/skydns/com/example", GetServicesOptions{Raw: true})
+				require.NoError(t, err)
+				assert.Equal(t, []string{"/skydns/com/example/www/aaaa", "/skydns/com/example/www/bbbb", "/skydns/com/example/www/cccc"}, keysOf(raw))
+			},
+		},
+		{
+			name: "dedup across zones",
+			run: func(t *testing.T, ctx context.Context, backend Backend) {
+				var want []string
+				for z := 0; z < 20; z++ {
+					name := fmt.Sprintf("/skydns/com/zone%02d/www", z)
+					for _, suffix := range []string{"/x1/aaaa", "/x1/bbbb", "/x2/cccc"} {
+						require.NoError(t, backend.SaveService(ctx, &Service{Host: "1.2.3.4", TargetStrip: 2, Key: name + suffix}))
+					}
+					want = append(want, name+"/x1/aaaa")
+				}
+
+				services, err := backend.GetServices(ctx, "/skydns/com")
+				require.NoError(t, err)
+				assert.Equal(t, want, keysOf(services))
+
+				// Returned services are independent copies
+				services[0].Host = "9.9.9.9"
+				assert.Equal(t, "1.2.3.4", services[1].Host)
+				again, err := backend.GetServices(ctx, "/skydns/com")
+				require.NoError(t, err)
+				assert.Equal(t, "1.2.3.4", again[0].Host)
+			},
+		},
+		{
+			name: "defaults",
+			run: func(t *testing.T, ctx context.Context, backend Backend) {
+				require.NoError(t, backend.SaveService(ctx, &Service{Host: "1.2.3.4", Key: "/skydns/com/example/a"}))
+				require.NoError(t, backend.SaveService(ctx, &Service{Host: "mail.example.com", Mail: true, Key: "/skydns/com/example/b"}))
+				require.NoError(t, backend.SaveService(ctx, &Service{Host: "target.example.com", Port: 443, Key: "/skydns/com/example/c"}))
+
+				services, err := backend.GetServices(ctx, "/skydns/")
+				require.NoError(t, err)
+				require.Len(t, services, 3)
+				assert.Zero(t, services[0].Priority, "A records get no default priority")
+				assert.Equal(t, priority, services[1].Priority, "MX")
+				assert.Equal(t, priority, services[2].Priority, "SRV")
+
+				raw, err := backend.GetServicesWithOptions(ctx, "/skydns/", GetServicesOptions{Raw: true})
+				require.NoError(t, err)
+				require.Len(t, raw, 3)
+				assert.Zero(t, raw[2].Priority, "raw records have no default priority")
+			},
+		},
+		{
+			name: "raw record",
+			run: func(t *testing.T, ctx context.Context, backend Backend) {
+				want := Service{RawType: "CAA", RawData: `0 issue "letsencrypt.org"`, TTL: 300, Key: "/skydns/com/example/caa"}
+				saved := want
+				require.NoError(t, backend.SaveService(ctx, &saved))
+				require.NoError(t, backend.SaveService(ctx, &Service{RawType: "SRV", RawData: "0 0 443 target.example.com.", Key: "/skydns/com/example/srv"}))
+
+				services, err := backend.GetServices(ctx, "/skydns/com/example")
+				require.NoError(t, err)
+				require.Len(t, services, 2)
+				assert.Equal(t, want, *services[0])
+				assert.Equal(t, "CAA", services[0].RecordType())
+				assert.Zero(t, services[1].Priority, "raw records get no defaults")
+				assert.Equal(t, "0 0 443 target.example.com.", services[1].RawData)
+			},
+		},
+		{
+			name: "mx priorities",
+			run: func(t *testing.T, ctx context.Context, backend Backend) {
+				for _, svc := range []*Service{
+					{Host: "mx20.example.com", Mail: true, Priority: 20, TargetStrip: 1, Key: "/skydns/com/example/a"},
+					{Host: "mx0.example.com", Mail: true, Priority: 0, TargetStrip: 1, Key: "/skydns/com/example/b"},
+					{Host: "mx10.example.com", Mail: true, Priority: 10, TargetStrip: 1, Key: "/skydns/com/example/c"},
+				} {
+					require.NoError(t, backend.SaveService(ctx, svc))
+				}
+
+				services, err := backend.GetServices(ctx, "/skydns/com/example")
+				require.NoError(t, err)
+				require.Len(t, services, 3)
+				for i, want := range []int{0, 10, 20} {
+					assert.Equal(t, want, services[i].Priority)
+					assert.Equal(t, fmt.Sprintf("mx%d.example.com", want), services[i].Host)
+				}
+			},
+		},
+		{
+			name: "ttl",
+			run: func(t *testing.T, ctx context.Context, backend Backend) {
+				require.NoError(t, backend.SaveService(ctx, &Service{Host: "1.2.3.4", TTL: 3600, Key: "/skydns/com/example/www"}))
+				require.NoError(t, backend.SaveService(ctx, &Service{Host: "1.2.3.5", TTL: math.MaxUint32, Key: "/skydns/com/example/www2"}))
+
+				services, err := backend.GetServices(ctx, "/skydns/")
+				require.NoError(t, err)
+				require.Len(t, services, 2)
+				assert.Equal(t, uint32(3600), services[0].TTL)
+				assert.Equal(t, uint32(math.MaxUint32), services[1].TTL)
+			},
+		},
+		{
+			name: "count",
+			run: func(t *testing.T, ctx context.Context, backend Backend) {
+				for i := 0; i < 5; i++ {
+					require.NoError(t, backend.SaveService(ctx, &Service{Host: "1.2.3.4", Key: fmt.Sprintf("/skydns/com/example/host%d", i)}))
+				}
+				require.NoError(t, backend.DeleteService(ctx, "/skydns/com/example/host0"))
+
+				snapshot, err := backend.Snapshot(ctx)
+				require.NoError(t, err)
+				assert.Len(t, snapshot, 4)
+				for key, svc := range snapshot {
+					assert.Empty(t, svc.Key, key)
+				}
+			},
+		},
+		{
+			name: "snapshot is scoped to the root prefix",
+			run: func(t *testing.T, ctx context.Context, backend Backend) {
+				require.NoError(t, backend.SaveService(ctx, &Service{Host: "1.2.3.4", Key: "/skydns/com/example/www"}))
+				require.NoError(t, backend.SaveService(ctx, &Service{Host: "5.6.7.8", Key: "/other/com/example/www"}))
+				require.NoError(t, backend.SaveService(ctx, &Service{Host: "9.9.9.9", Key: "/skydnsx/com/example/www"}))
+
+				snapshot, err := backend.Snapshot(ctx)
+				require.NoError(t, err)
+				assert.Equal(t, map[string]Service{"/skydns/com/example/www": {Host: "1.2.3.4"}}, snapshot)
+			},
+		},
+		{
+			name: "relative keys",
+			run: func(t *testing.T, ctx context.Context, backend Backend) {
+				require.NoError(t, backend.SaveService(ctx, &Service{Host: "1.2.3.4", Key: "com/example/www"}))
+
+				services, err := backend.GetServices(ctx, "com/example")
+				require.NoError(t, err)
+				assert.Equal(t, []string{"/skydns/com/example/www"}, keysOf(services))
+
+				require.NoError(t, backend.DeleteService(ctx, "com/example"))
+				services, err = backend.GetServices(ctx, "/skydns/")
+				require.NoError(t, err)
+				assert.Empty(t, services)
+			},
+		},
+		{
+			name: "empty prefix",
+			run: func(t *testing.T, ctx context.Context, backend Backend) {
+				require.NoError(t, backend.SaveService(ctx, &Service{Host: "1.2.3.4", Key: "/skydns/com/example/www"}))
+
+				calls := map[string]func() error{
+					"GetServices": func() error { _, err := backend.GetServices(ctx, ""); return err },
+					"GetServicesWithOptions": func() error {
+						_, err := backend.GetServicesWithOptions(ctx, "", GetServicesOptions{Raw: true})
+						return err
+					},
+					"GetServicesByType":   func() error { _, err := backend.GetServicesByType(ctx, "", "A"); return err },
+					"GetServicesBySource": func() error { _, err := backend.GetServicesBySource(ctx, "", "service"); return err },
+					"GetServicesPage":     func() error { _, _, err := backend.GetServicesPage(ctx, "", "", 10); return err },
+					"Exists":              func() error { _, err := backend.Exists(ctx, ""); return err },
+					"ForEach": func() error {
+						return backend.ForEach(ctx, "", func(string, *Service) error { return nil })
+					},
+					"DeleteService": func() error { return backend.DeleteService(ctx, "") },
+				}
+				if streamer, ok := backend.(interface {
+					StreamKeys(ctx context.Context, prefix string, fn func(key string) error) error
+				}); ok {
+					calls["StreamKeys"] = func() error {
+						return streamer.StreamKeys(ctx, "", func(string) error { return nil })
+					}
+				}
+				for name, call := range calls {
+					assert.ErrorIs(t, call(), ErrInvalidPrefix, name)
+				}
+
+				services, err := backend.GetServices(ctx, "/skydns/")
+				require.NoError(t, err)
+				assert.Len(t, services, 1, "nothing was deleted")
+			},
+		},
+		{
+			name: "get by type",
+			run: func(t *testing.T, ctx context.Context, backend Backend) {
+				for _, svc := range []*Service{
+					{Host: "1.1.1.1", Key: "/skydns/com/example/www/a"},
+					{Host: "2.2.2.2", Key: "/skydns/com/example/www/b"},
+					{Text: "heritage=external-dns", Key: "/skydns/com/example/www/c"},
+					{Host: "3.3.3.3", Text: "heritage=external-dns", Key: "/skydns/com/example/api/d"},
+					{Host: "target.example.org", Key: "/skydns/com/example/alias/e"},
+					{Text: "other-zone", Key: "/skydns/org/other/f"},
+				} {
+					require.NoError(t, backend.SaveService(ctx, svc))
+				}
+
+				txt, err := backend.GetServicesByType(ctx, "/skydns/com/example", endpoint.RecordTypeTXT)
+				require.NoError(t, err)
+				assert.ElementsMatch(t, []string{"/skydns/com/example/www/c", "/skydns/com/example/api/d"}, keysOf(txt))
+
+				a, err := backend.GetServicesByType(ctx, "/skydns/com/example", endpoint.RecordTypeA)
+				require.NoError(t, err)
+				assert.ElementsMatch(t, []string{"/skydns/com/example/www/a", "/skydns/com/example/www/b", "/skydns/com/example/api/d"}, keysOf(a))
+
+				cname, err := backend.GetServicesByType(ctx, "/skydns/com/example", "cname")
+				require.NoError(t, err)
+				assert.ElementsMatch(t, []string{"/skydns/com/example/alias/e"}, keysOf(cname))
+
+				mx, err := backend.GetServicesByType(ctx, "/skydns/com/example", endpoint.RecordTypeMX)
+				require.NoError(t, err)
+				assert.Empty(t, mx)
+			},
+		},
+		{
+			name: "for each",
+			run: func(t *testing.T, ctx context.Context, backend Backend) {
+				for _, svc := range []*Service{
+					{Host: "1.1.1.1", Key: "/skydns/com/example/www"},
+					{Host: "2.2.2.2", Key: "/skydns/com/example/api"},
+					{Host: "3.3.3.3", Key: "/skydns/org/other/www"},
+				} {
+					require.NoError(t, backend.SaveService(ctx, svc))
+				}
+
+				visited := make(map[string]string)
+				err := backend.ForEach(ctx, "/skydns/com/example", func(key string, svc *Service) error {
+					assert.Equal(t, key, svc.Key)
+					visited[key] = svc.Host
+					return nil
+				})
+				require.NoError(t, err)
+				assert.Equal(t, map[string]string{
+					"/skydns/com/example/www": "1.1.1.1",
+					"/skydns/com/example/api": "2.2.2.2",
+				}, visited)
+			},
+		},
+		{
+			name: "for each stops on error",
+			run: func(t *testing.T, ctx context.Context, backend Backend) {
+				for i := 0; i < 5; i++ {
+					require.NoError(t, backend.SaveService(ctx, &Service{Host: "1.2.3.4", Key: fmt.Sprintf("/skydns/com/example/svc%d", i)}))
+				}
+
+				errStop := errors.New("stop")
+				calls := 0
+				err := backend.ForEach(ctx, "/skydns/", func(_ string, _ *Service) error {
+					calls++
+					if calls == 2 {
+						return errStop
+					}
+					return nil
+				})
+				assert.ErrorIs(t, err, errStop)
+				assert.Equal(t, 2, calls)
+
+				cancelled, cancel := context.WithCancel(ctx)
+				cancel()
+				err = backend.ForEach(cancelled, "/skydns/", func(_ string, _ *Service) error {
+					t.Fatal("fn must not be called with a cancelled context")
+					return nil
+				})
+				assert.ErrorIs(t, err, context.Canceled)
+			},
+		},
+		{
+			name: "prefix normalization",
+			run: func(t *testing.T, ctx context.Context, backend Backend) {
+				for _, key := range []string{"/skydns/com/example", "/skydns/com/example/www", "/skydns//com/example/api/", "/skydns/com/example2/www", "/skydns/com/example-2"} {
+					require.NoError(t, backend.SaveService(ctx, &Service{Host: "1.2.3.4", Key: key}))
+				}
+				// Keys are stored cleaned and prefixes address whole labels
+				want := []string{"/skydns/com/example", "/skydns/com/example/api", "/skydns/com/example/www"}
+				for _, prefix := range []string{"/skydns/com/example", "/skydns/com/example/", "/skydns//com/example/", "com/example/"} {
+					services, err := backend.GetServicesWithOptions(ctx, prefix, GetServicesOptions{Raw: true})
+					require.NoError(t, err, prefix)
+					assert.Equal(t, want, keysOf(services), prefix)
+
+					page, _, err := backend.GetServicesPage(ctx, prefix, "", 10)
+					require.NoError(t, err, prefix)
+					assert.Equal(t, want, keysOf(page), prefix)
+
+					exists, err := backend.Exists(ctx, prefix)
+					require.NoError(t, err, prefix)
+					assert.True(t, exists, prefix)
+				}
+
+				exists, err := backend.Exists(ctx, "/skydns/com/exam")
+				require.NoError(t, err)
+				assert.False(t, exists)
+
+				require.NoError(t, backend.DeleteService(ctx, "/skydns//com/example/"))
+				services, err := backend.GetServicesWithOptions(ctx, "/skydns/", GetServicesOptions{Raw: true})
+				require.NoError(t, err)
+				assert.Equal(t, []string{"/skydns/com/example-2", "/skydns/com/example2/www"}, keysOf(services))
+			},
+		},
+		{
+			name: "clear prefix",
+			run: func(t *testing.T, ctx context.Context, backend Backend) {
+				for _, key := range []string{"/skydns/com/example", "/skydns/com/example/www", "/skydns/com/example/api/v1", "/skydns/com/example2/www", "/skydns/org/example/www"} {
+					require.NoError(t, backend.SaveService(ctx, &Service{Host: "1.2.3.4", Key: key}))
+				}
+
+				// The root and the prefixes above it can't be cleared
+				for _, prefix := range []string{"", "/", "/skydns", "/skydns/"} {
+					assert.ErrorIs(t, backend.ClearPrefix(ctx, prefix), ErrInvalidPrefix, prefix)
+				}
+
+				require.NoError(t, backend.ClearPrefix(ctx, "/skydns/com/example"))
+				services, err := backend.GetServicesWithOptions(ctx, "/skydns/", GetServicesOptions{Raw: true})
+				require.NoError(t, err)
+				assert.Equal(t, []string{"/skydns/com/example2/www", "/skydns/org/example/www"}, keysOf(services))
+
+				require.NoError(t, backend.ClearPrefix(ctx, "org/example"))
+				services, err = backend.GetServicesWithOptions(ctx, "/skydns/", GetServicesOptions{Raw: true})
+				require.NoError(t, err)
+				assert.Equal(t, []string{"/skydns/com/example2/www"}, keysOf(services))
+			},
+		},
+		{
+			name: "update service",
+			run: func(t *testing.T, ctx context.Context, backend Backend) {
+				updater, ok := backend.(interface {
+					UpdateService(ctx context.Context, service *Service) error
+				})
+				require.True(t, ok, "backend should implement UpdateService")
+
+				err := updater.UpdateService(ctx, &Service{Host: "1.2.3.4", Key: "/skydns/com/example/www"})
+				assert.ErrorIs(t, err, ErrNotFound)
+				exists, err := backend.Exists(ctx, "/skydns/com/example/www")
+				require.NoError(t, err)
+				assert.False(t, exists, "a failed update must not insert")
+
+				require.NoError(t, backend.SaveService(ctx, &Service{Host: "1.2.3.4", Key: "/skydns/com/example/www"}))
+				require.NoError(t, updater.UpdateService(ctx, &Service{Host: "5.6.7.8", TTL: 60, Key: "com/example/www"}))
+				services, err := backend.GetServices(ctx, "/skydns/com/example")
+				require.NoError(t, err)
+				require.Len(t, services, 1)
+				assert.Equal(t, "5.6.7.8", services[0].Host)
+				assert.Equal(t, uint32(60), services[0].TTL)
+
+				// A deleted record can't be updated back into existence
+				require.NoError(t, backend.DeleteService(ctx, "/skydns/com/example/www"))
+				assert.ErrorIs(t, updater.UpdateService(ctx, &Service{Host: "9.9.9.9", Key: "/skydns/com/example/www"}), ErrNotFound)
+				assert.ErrorIs(t, updater.UpdateService(ctx, &Service{Key: "/skydns/com/example/www"}), ErrInvalidService)
+			},
+		},
+		{
+			name: "stream keys",
+			run: func(t *testing.T, ctx context.Context, backend Backend) {
+				streamer, ok := backend.(interface {
+					StreamKeys(ctx context.Context, prefix string, fn func(key string) error) error
+				})
+				require.True(t, ok, "backend should implement StreamKeys")
+
+				for _, key := range []string{"/skydns/com/example/www", "/skydns/org/example/www", "/skydns/com/example/api", "/skydns/com/other/www"} {
+					require.NoError(t, backend.SaveService(ctx, &Service{Host: "1.2.3.4", Key: key}))
+				}
+
+				var keys []string
+				require.NoError(t, streamer.StreamKeys(ctx, "/skydns/com/", func(key string) error {
+					keys = append(keys, key)
+					return nil
+				}))
+				assert.Equal(t, []string{"/skydns/com/example/api", "/skydns/com/example/www", "/skydns/com/other/www"}, keys)
+
+				errStop := errors.New("stop")
+				keys = nil
+				err := streamer.StreamKeys(ctx, "/skydns/", func(key string) error {
+					keys = append(keys, key)
+					return errStop
+				})
+				assert.ErrorIs(t, err, errStop)
+				assert.Equal(t, []string{"/skydns/com/example/api"}, keys)
+
+				cancelled, cancel := context.WithCancel(ctx)
+				cancel()
+				err = streamer.StreamKeys(cancelled, "/skydns/", func(_ string) error {
+					t.Fatal("fn must not be called with a cancelled context")
+					return nil
+				})
+				assert.ErrorIs(t, err, context.Canceled)
+			},
+		},
+		{
+			name: "pagination",
+			run: func(t *testing.T, ctx context.Context, backend Backend) {
+				const total = 250
+				for i := 0; i < total; i++ {
+					require.NoError(t, backend.SaveService(ctx, &Service{
+						Host: fmt.Sprintf("10.0.%d.%d", i/256, i%256),
+						Key:  fmt.Sprintf("/skydns/com/example/host%03d", i),
+					}))
+				}
+				// Outside the paginated prefix
+				require.NoError(t, backend.SaveService(ctx, &Service{Host: "1.1.1.1", Key: "/skydns/org/example/www"}))
+
+				var keys []string
+				var sizes []int
+				cursor := ""
+				for {
+					page, next, err := backend.GetServicesPage(ctx, "/skydns/com/example", cursor, 100)
+					require.NoError(t, err)
+					sizes = append(sizes, len(page))
+					keys = append(keys, keysOf(page)...)
+					if next == "" {
+						break
+					}
+					cursor = next
+				}
+
+				assert.Equal(t, []int{100, 100, 50}, sizes)
+				require.Len(t, keys, total)
+				for i, key := range keys {
+					assert.Equal(t, fmt.Sprintf("/skydns/com/example/host%03d", i), key)
+				}
+
+				_, _, err := backend.GetServicesPage(ctx, "/skydns/", "", 0)
+				assert.ErrorIs(t, err, ErrInvalidPageLimit)
+			},
+		},
+		{
+			name: "empty results are non-nil",
+			run: func(t *testing.T, ctx context.Context, backend Backend) {
+				require.NoError(t, backend.SaveService(ctx, &Service{Host: "1.2.3.4", Key: "/skydns/com/example/www"}))
+
+				services, err := backend.GetServices(ctx, "/skydns/org")
+				require.NoError(t, err)
+				assert.True(t, services != nil && len(services) == 0, "GetServices: %#v", services)
+
+				services, err = backend.GetServicesWithOptions(ctx, "/skydns/org", GetServicesOptions{Raw: true})
+				require.NoError(t, err)
+				assert.True(t, services != nil && len(services) == 0, "GetServicesWithOptions: %#v", services)
+
+				services, err = backend.GetServicesByType(ctx, "/skydns/", endpoint.RecordTypeTXT)
+				require.NoError(t, err)
+				assert.True(t, services != nil && len(services) == 0, "GetServicesByType: %#v", services)
+
+				services, _, err = backend.GetServicesPage(ctx, "/skydns/org", "", 10)
+				require.NoError(t, err)
+				assert.True(t, services != nil && len(services) == 0, "GetServicesPage: %#v", services)
+			},
+		},
+		{
+			name: "exists",
+			run: func(t *testing.T, ctx context.Context, backend Backend) {
+				exists, err := backend.Exists(ctx, "/skydns/")
+				require.NoError(t, err)
+				assert.False(t, exists)
+
+				require.NoError(t, backend.SaveService(ctx, &Service{Host: "1.2.3.4", Key: "/skydns/com/example/www"}))
+
+				for prefix, want := range map[string]bool{
+					"/skydns/":                true,
+					"/skydns/com/example":     true,
+					"/skydns/com/example/www": true,
+					"/skydns/org":             false,
+					"/skydns/com/example/api": false,
+				} {
+					exists, err := backend.Exists(ctx, prefix)
+					require.NoError(t, err)
+					assert.Equal(t, want, exists, prefix)
+				}
+			},
+		},
+		{
+			name: "is empty",
+			run: func(t *testing.T, ctx context.Context, backend Backend) {
+				emptier, ok := backend.(interface {
+					IsEmpty(ctx context.Context) (bool, error)
+				})
+				require.True(t, ok, "backend should implement IsEmpty")
+
+				empty, err := emptier.IsEmpty(ctx)
+				require.NoError(t, err)
+				assert.True(t, empty)
+
+				require.NoError(t, backend.SaveService(ctx, &Service{Host: "1.2.3.4", Key: "/skydns/com/example/www"}))
+				empty, err = emptier.IsEmpty(ctx)
+				require.NoError(t, err)
+				assert.False(t, empty)
+
+				require.NoError(t, backend.DeleteService(ctx, "/skydns/com/example/www"))
+				empty, err = emptier.IsEmpty(ctx)
+				require.NoError(t, err)
+				assert.True(t, empty)
+			},
+		},
+		{
+			name: "services by source",
+			run: func(t *testing.T, ctx context.Context, backend Backend) {
+				for _, svc := range []*Service{
+					{Host: "1.2.3.4", Key: "/skydns/com/example/www", Source: "service"},
+					{Host: "5.6.7.8", Key: "/skydns/com/example/api", Source: "ingress"},
+					{Host: "9.9.9.9", Key: "/skydns/com/example/ftp"},
+				} {
+					require.NoError(t, backend.SaveService(ctx, svc))
+				}
+
+				services, err := backend.GetServices(ctx, "/skydns/com/example/www")
+				require.NoError(t, err)
+				require.Len(t, services, 1)
+				assert.Equal(t, "service", services[0].Source, "source is persisted")
+
+				services, err = backend.GetServicesBySource(ctx, "/skydns/", "ingress")
+				require.NoError(t, err)
+				require.Len(t, services, 1)
+				assert.Equal(t, "5.6.7.8", services[0].Host)
+
+				services, err = backend.GetServicesBySource(ctx, "/skydns/", "")
+				require.NoError(t, err)
+				require.Len(t, services, 1)
+				assert.Equal(t, "9.9.9.9", services[0].Host)
+
+				services, err = backend.GetServicesBySource(ctx, "/skydns/", "gateway")
+				require.NoError(t, err)
+				assert.Empty(t, services)
+			},
+		},
+		{
+			name: "source is not part of the answer",
+			run: func(t *testing.T, ctx context.Context, backend Backend) {
+				require.NoError(t, backend.SaveService(ctx, &Service{Host: "1.2.3.4", Key: "/skydns/com/example/www/a1", TargetStrip: 1, Source: "service"}))
+				require.NoError(t, backend.SaveService(ctx, &Service{Host: "1.2.3.4", Key: "/skydns/com/example/www/b2", TargetStrip: 1, Source: "ingress"}))
+
+				services, err := backend.GetServices(ctx, "/skydns/com/example/www")
+				require.NoError(t, err)
+				assert.Len(t, services, 1, "services differing only by source are duplicates")
+			},
+		},
+		{
+			name: "target strip round trip",
+			run: func(t *testing.T, ctx context.Context, backend Backend) {
+				key := "/skydns/com/example/www/x1/y2"
+				require.NoError(t, backend.SaveService(ctx, &Service{Host: "1.2.3.4", Key: key, TargetStrip: 2}))
+
+				services, err := backend.GetServices(ctx, "/skydns/com/example/www")
+				require.NoError(t, err)
+				require.Len(t, services, 1)
+				assert.Equal(t, 2, services[0].TargetStrip)
+
+				page, _, err := backend.GetServicesPage(ctx, "/skydns/", "", 10)
+				require.NoError(t, err)
+				require.Len(t, page, 1)
+				assert.Equal(t, 2, page[0].TargetStrip)
+
+				require.NoError(t, backend.ForEach(ctx, "/skydns/", func(_ string, svc *Service) error {
+					assert.Equal(t, 2, svc.TargetStrip)
+					return nil
+				}))
+
+				snapshot, err := backend.Snapshot(ctx)
+				require.NoError(t, err)
+				assert.Equal(t, 2, snapshot[key].TargetStrip)
+
+				dnsName, prefix := ParseKey("/skydns/", services[0].Key, services[0].TargetStrip)
+				assert.Equal(t, "www.example.com", dnsName)
+				assert.Equal(t, "y2.x1", prefix)
+			},
+		},
+		{
+			name: "flush",
+			run: func(t *testing.T, ctx context.Context, backend Backend) {
+				require.NoError(t, backend.SaveService(ctx, &Service{Host: "1.2.3.4", Key: "/skydns/com/example/www"}))
+				require.NoError(t, backend.Flush(ctx))
+
+				services, err := backend.GetServices(ctx, "/skydns/")
+				require.NoError(t, err)
+				assert.Len(t, services, 1)
+			},
+		},
+		{
+			name: "invalid service",
+			run: func(t *testing.T, ctx context.Context, backend Backend) {
+				err := backend.SaveService(ctx, &Service{Host: "target.example.com", Port: 70000, Key: "/skydns/com/example/_sip/_tcp"})
+				assert.ErrorIs(t, err, ErrInvalidService)
+				err = backend.SaveService(ctx, &Service{Host: "1.2.3.999", Key: "/skydns/com/example/www"})
+				assert.ErrorIs(t, err, ErrInvalidService)
+
+				snapshot, err := backend.Snapshot(ctx)
+				require.NoError(t, err)
+				assert.Empty(t, snapshot)
+			},
+		},
+		{
+			name: "empty service",
+			run: func(t *testing.T, ctx context.Context, backend Backend) {
+				err := backend.SaveService(ctx, &Service{TTL: 60, Key: "/skydns/com/example/www/a"})
+				assert.ErrorIs(t, err, ErrInvalidService)
+				assert.ErrorContains(t, err, "neither host nor text")
+
+				require.NoError(t, backend.SaveService(ctx, &Service{Text: "hello", Key: "/skydns/com/example/www/b"}))
+				require.NoError(t, backend.SaveService(ctx, &Service{Host: "1.2.3.4", Key: "/skydns/com/example/www/c"}))
+
+				snapshot, err := backend.Snapshot(ctx)
+				require.NoError(t, err)
+				assert.Len(t, snapshot, 2)
+				assert.Contains(t, snapshot, "/skydns/com/example/www/b")
+				assert.Contains(t, snapshot, "/skydns/com/example/www/c")
+			},
+		},
+		{
+			name: "delete if covered",
+			run: func(t *testing.T, ctx context.Context, backend Backend) {
+				for _, key := range []string{"/skydns/com/example/a/x", "/skydns/com/example/a/y", "/skydns/com/example/a/z", "/skydns/com/example/ab"} {
+					require.NoError(t, backend.SaveService(ctx, &Service{Host: "1.2.3.4", Key: key}))
+				}
+				coveredBy := func(keys ...string) func(string) bool {
+					return func(key string) bool { return slices.Contains(keys, key) }
+				}
+
+				// A key that isn't covered keeps everything
+				deleted, err := deleteIfCovered(ctx, backend, "/skydns/com/example/a", coveredBy("/skydns/com/example/a/x", "/skydns/com/example/a/y"))
+				require.NoError(t, err)
+				assert.False(t, deleted)
+				services, err := backend.GetServices(ctx, "/skydns/com/example")
+				require.NoError(t, err)
+				assert.Len(t, services, 4)
+
+				deleted, err = deleteIfCovered(ctx, backend, "/skydns/com/example/a", coveredBy("/skydns/com/example/a/x", "/skydns/com/example/a/y", "/skydns/com/example/a/z"))
+				require.NoError(t, err)
+				assert.True(t, deleted)
+				services, err = backend.GetServices(ctx, "/skydns/com/example")
+				require.NoError(t, err)
+				assert.Equal(t, []string{"/skydns/com/example/ab"}, keysOf(services))
+			},
+		},
+		{
+			name: "close",
+			run: func(t *testing.T, ctx context.Context, backend Backend) {
+				require.NoError(t, backend.SaveService(ctx, &Service{Host: "1.2.3.4", Key: "/skydns/com/example/www"}))
+				require.NoError(t, backend.Close())
+				require.NoError(t, backend.Close(), "Close is idempotent")
+
+				calls := map[string]func() error{
+					"GetServices": func() error { _, err := backend.GetServices(ctx, "/skydns/"); return err },
+					"GetServicesWithOptions": func() error {
+						_, err := backend.GetServicesWithOptions(ctx, "/skydns/", GetServicesOptions{Raw: true})
+						return err
+					},
+					"GetServicesByType":   func() error { _, err := backend.GetServicesByType(ctx, "/skydns/", "A"); return err },
+					"GetServicesBySource": func() error { _, err := backend.GetServicesBySource(ctx, "/skydns/", "service"); return err },
+					"GetServicesPage":     func() error { _, _, err := backend.GetServicesPage(ctx, "/skydns/", "", 10); return err },
+					"Exists":              func() error { _, err := backend.Exists(ctx, "/skydns/"); return err },
+					"ForEach": func() error {
+						return backend.ForEach(ctx, "/skydns/", func(string, *Service) error { return nil })
+					},
+					"Snapshot": func() error { _, err := backend.Snapshot(ctx); return err },
+					"SaveService": func() error {
+						return backend.SaveService(ctx, &Service{Host: "5.6.7.8", Key: "/skydns/com/example/api"})
+					},
+					"DeleteService": func() error { return backend.DeleteService(ctx, "/skydns/com/example/www") },
+					"ClearPrefix":   func() error { return backend.ClearPrefix(ctx, "/skydns/com/example") },
+					"Flush":         func() error { return backend.Flush(ctx) },
+				}
+				for name, call := range calls {
+					assert.ErrorIs(t, call(), ErrBackendClosed, name)
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := newBackend()
+			defer backend.Close()
+			tt.run(t, context.Background(), backend)
+		})
+	}
+}
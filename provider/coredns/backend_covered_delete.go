@@ -0,0 +1,54 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package coredns
+
+import "context"
+
+// coveredDeleter is implemented by backends that can delete a key and its
+// children only if every key stored there is covered, checking and deleting
+// atomically, so that a key written concurrently is never removed along
+// with the others. Decorators implement it by forwarding to the backend they
+// wrap, applying their own checks.
+type coveredDeleter interface {
+	// deleteIfCovered deletes key and its children and reports true if
+	// covered accepts every key stored there, and reports false without
+	// deleting anything otherwise.
+	deleteIfCovered(ctx context.Context, key string, covered func(key string) bool) (bool, error)
+}
+
+// deleteIfCovered deletes key and its children from backend if covered
+// accepts every key stored there, atomically. It reports false without
+// deleting anything if some key isn't covered or backend can't check and
+// delete atomically.
+func deleteIfCovered(ctx context.Context, backend Backend, key string, covered func(key string) bool) (bool, error) {
+	if d, ok := backend.(coveredDeleter); ok {
+		return d.deleteIfCovered(ctx, key, covered)
+	}
+	return false, nil
+}
+
+// innermostBackend returns the backend at the bottom of a chain of
+// decorators, which sees every stored record.
+func innermostBackend(backend Backend) Backend {
+	for {
+		wrapper, ok := backend.(interface{ Unwrap() Backend })
+		if !ok {
+			return backend
+		}
+		backend = wrapper.Unwrap()
+	}
+}
@@ -0,0 +1,108 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package coredns
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	etcdcv3 "go.etcd.io/etcd/client/v3"
+)
+
+// etcdCompactor compacts the etcd revision history every interval, so that
+// repeatedly updating the same keys doesn't fill the keyspace. Each run
+// compacts up to the revision observed on the previous run, keeping one
+// interval of history for watchers and never going past the current revision.
+type etcdCompactor struct {
+	client *etcdcv3.Client
+
+	// lastRevision is the revision observed on the previous run (0 before the first)
+	lastRevision int64
+}
+
+// startCompactor starts compacting every interval in the background. The
+// returned function stops the compactor and waits for it to exit (see
+// backgroundTask.stop).
+func (c *etcdClient) startCompactor(interval time.Duration) func() {
+	compactor := &etcdCompactor{client: c.client}
+	task := startBackgroundTask("etcd compactor", func(ctx context.Context) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := compactor.compact(ctx); err != nil && ctx.Err() == nil {
+					log.Warnf("etcd compaction failed: %v", err)
+				}
+			}
+		}
+	})
+	return task.stop
+}
+
+// compact compacts up to the revision observed on the previous call and
+// records the current revision for the next one.
+func (e *etcdCompactor) compact(ctx context.Context) error {
+	// Any key works: the response header carries the store revision
+	resp, err := e.client.Get(ctx, "compact", etcdcv3.WithCountOnly())
+	if err != nil {
+		return etcdError(err)
+	}
+	if resp.Header == nil {
+		return nil
+	}
+	current := resp.Header.Revision
+
+	target := e.lastRevision
+	e.lastRevision = current
+	if target <= 0 || target > current {
+		return nil
+	}
+
+	before := e.dbSizeInUse(ctx)
+	if _, err := e.client.Compact(ctx, target); err != nil {
+		if errors.Is(err, rpctypes.ErrCompacted) {
+			// Another member or client already compacted past target
+			log.Debugf("etcd revision %d already compacted", target)
+			return nil
+		}
+		return etcdError(err)
+	}
+	after := e.dbSizeInUse(ctx)
+
+	log.Infof("Compacted etcd history up to revision %d (current %d, db size in use %d -> %d bytes)", target, current, before, after)
+	return nil
+}
+
+// dbSizeInUse returns the database size in use reported by the first
+// reachable endpoint, or -1 if none is.
+func (e *etcdCompactor) dbSizeInUse(ctx context.Context) int64 {
+	if e.client.Maintenance == nil {
+		return -1
+	}
+	for _, endpoint := range e.client.Endpoints() {
+		status, err := e.client.Status(ctx, endpoint)
+		if err == nil {
+			return status.DbSizeInUse
+		}
+	}
+	return -1
+}
@@ -0,0 +1,113 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package coredns
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	etcdcv3 "go.etcd.io/etcd/client/v3"
+
+	"sigs.k8s.io/external-dns/internal/testutils"
+)
+
+// fakeCompactEtcd is an etcd KV tracking the store revision and the
+// compactions requested.
+type fakeCompactEtcd struct {
+	etcdcv3.KV
+
+	mu         sync.Mutex
+	revision   int64
+	compacted  []int64
+	compactErr error
+}
+
+func (f *fakeCompactEtcd) Get(_ context.Context, _ string, _ ...etcdcv3.OpOption) (*etcdcv3.GetResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.revision++ // simulate concurrent writes between runs
+	return &etcdcv3.GetResponse{Header: &etcdserverpb.ResponseHeader{Revision: f.revision}}, nil
+}
+
+func (f *fakeCompactEtcd) Compact(_ context.Context, rev int64, _ ...etcdcv3.CompactOption) (*etcdcv3.CompactResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.compactErr != nil {
+		return nil, f.compactErr
+	}
+	f.compacted = append(f.compacted, rev)
+	return &etcdcv3.CompactResponse{}, nil
+}
+
+func (f *fakeCompactEtcd) compactions() []int64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]int64(nil), f.compacted...)
+}
+
+func TestEtcdCompactor_CompactsPreviousRevision(t *testing.T) {
+	fake := &fakeCompactEtcd{}
+	compactor := &etcdCompactor{client: &etcdcv3.Client{KV: fake}}
+	ctx := context.Background()
+
+	// The first run only records the current revision
+	require.NoError(t, compactor.compact(ctx))
+	assert.Empty(t, fake.compactions())
+
+	require.NoError(t, compactor.compact(ctx))
+	require.NoError(t, compactor.compact(ctx))
+	assert.Equal(t, []int64{1, 2}, fake.compactions())
+	for _, rev := range fake.compactions() {
+		assert.Less(t, rev, fake.revision, "never compact past the current revision")
+	}
+}
+
+func TestEtcdCompactor_AlreadyCompacted(t *testing.T) {
+	fake := &fakeCompactEtcd{compactErr: rpctypes.ErrCompacted}
+	compactor := &etcdCompactor{client: &etcdcv3.Client{KV: fake}}
+	ctx := context.Background()
+
+	require.NoError(t, compactor.compact(ctx))
+	assert.NoError(t, compactor.compact(ctx))
+}
+
+func TestEtcdClient_CompactorRunsUntilClose(t *testing.T) {
+	fake := &fakeCompactEtcd{}
+	c := &etcdClient{client: &etcdcv3.Client{KV: fake}}
+	c.stopCompactor = c.startCompactor(10 * time.Millisecond)
+
+	assert.Eventually(t, func() bool {
+		return len(fake.compactions()) >= 2
+	}, time.Second, 5*time.Millisecond)
+
+	c.stopCompactor()
+	c.stopCompactor = nil
+	runs := len(fake.compactions())
+	time.Sleep(30 * time.Millisecond)
+	assert.Len(t, fake.compactions(), runs, "compactor should stop")
+}
+
+func TestGetBackendConfig_EtcdCompactInterval(t *testing.T) {
+	testutils.TestHelperEnvSetter(t, map[string]string{"COREDNS_ETCD_COMPACT_INTERVAL": "1h"})
+	assert.Equal(t, time.Hour, GetBackendConfig().EtcdCompactInterval)
+}
@@ -0,0 +1,118 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package coredns
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	etcdcv3 "go.etcd.io/etcd/client/v3"
+)
+
+// etcdLease attaches written keys to a single etcd lease that is kept alive
+// for as long as the process runs. If external-dns stops refreshing the lease
+// (crash, scale down), etcd removes every key attached to it once the TTL
+// elapses, so stale records don't outlive their owner.
+//
+// Records that are not rewritten after a restart keep the previous, no longer
+// refreshed lease and expire; the next reconcile recreates them. The TTL should
+// therefore comfortably exceed the reconcile interval.
+type etcdLease struct {
+	ttl int64 // seconds
+
+	mu     sync.Mutex
+	id     etcdcv3.LeaseID
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// newETCDLease creates a lease manager for the given TTL. The TTL is rounded
+// up to whole seconds, the granularity etcd supports.
+func newETCDLease(ttl time.Duration) *etcdLease {
+	seconds := int64((ttl + time.Second - 1) / time.Second)
+	return &etcdLease{ttl: seconds}
+}
+
+// leaseID returns the active lease, granting one and starting its keepalive
+// if needed.
+func (l *etcdLease) leaseID(ctx context.Context, lease etcdcv3.Lease) (etcdcv3.LeaseID, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.id != 0 {
+		return l.id, nil
+	}
+
+	resp, err := lease.Grant(ctx, l.ttl)
+	if err != nil {
+		return 0, err
+	}
+
+	keepAliveCtx, cancel := context.WithCancel(context.Background())
+	ch, err := lease.KeepAlive(keepAliveCtx, resp.ID)
+	if err != nil {
+		cancel()
+		return 0, err
+	}
+
+	log.Infof("Granted etcd lease %x with TTL %ds", resp.ID, l.ttl)
+	l.id = resp.ID
+	l.cancel = cancel
+	l.done = make(chan struct{})
+	go l.keepAlive(resp.ID, ch, l.done)
+
+	return l.id, nil
+}
+
+// keepAlive drains keepalive responses until the channel closes, which
+// happens when the lease is stopped or lost.
+func (l *etcdLease) keepAlive(id etcdcv3.LeaseID, ch <-chan *etcdcv3.LeaseKeepAliveResponse, done chan struct{}) {
+	defer close(done)
+
+	for range ch {
+		// Responses only confirm the refresh; nothing to do with them.
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.id == id {
+		// The lease was lost (e.g. it expired during a network partition);
+		// the next write grants a new one.
+		log.Warnf("etcd lease %x is no longer kept alive", id)
+		l.id = 0
+		l.cancel()
+	}
+}
+
+// stop ends the keepalive and waits for its goroutine to exit, for at most
+// stopTimeout. The lease itself is not revoked, so records stay until the
+// TTL elapses.
+func (l *etcdLease) stop() {
+	l.mu.Lock()
+	cancel, done := l.cancel, l.done
+	l.id = 0
+	l.cancel = nil
+	l.done = nil
+	l.mu.Unlock()
+
+	if cancel == nil {
+		return
+	}
+	cancel()
+	awaitStop("etcd lease keepalive", done)
+}
@@ -0,0 +1,213 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package coredns
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	etcdcv3 "go.etcd.io/etcd/client/v3"
+
+	"sigs.k8s.io/external-dns/internal/testutils"
+)
+
+// fakeLeaseEtcd is an in-memory etcd KV and Lease that expires keys attached
+// to leases that are not kept alive. One second of lease TTL is scaled down to
+// leaseUnit so tests run quickly.
+type fakeLeaseEtcd struct {
+	etcdcv3.KV
+	etcdcv3.Lease
+
+	leaseUnit time.Duration
+
+	mu      sync.Mutex
+	nextID  etcdcv3.LeaseID
+	kvs     map[string]fakeLeaseEntry
+	expires map[etcdcv3.LeaseID]time.Time
+	ttls    map[etcdcv3.LeaseID]int64
+}
+
+type fakeLeaseEntry struct {
+	value string
+	lease etcdcv3.LeaseID
+}
+
+func newFakeLeaseEtcd(leaseUnit time.Duration) *fakeLeaseEtcd {
+	return &fakeLeaseEtcd{
+		leaseUnit: leaseUnit,
+		kvs:       make(map[string]fakeLeaseEntry),
+		expires:   make(map[etcdcv3.LeaseID]time.Time),
+		ttls:      make(map[etcdcv3.LeaseID]int64),
+	}
+}
+
+// expireLocked drops every key whose lease has expired.
+func (f *fakeLeaseEtcd) expireLocked() {
+	now := time.Now()
+	for key, entry := range f.kvs {
+		if entry.lease == 0 {
+			continue
+		}
+		if exp, ok := f.expires[entry.lease]; !ok || now.After(exp) {
+			delete(f.kvs, key)
+		}
+	}
+}
+
+func (f *fakeLeaseEtcd) Put(_ context.Context, key, val string, opts ...etcdcv3.OpOption) (*etcdcv3.PutResponse, error) {
+	op := etcdcv3.OpPut(key, val, opts...)
+	// The lease is not exposed through Op's exported API
+	lease := etcdcv3.LeaseID(reflect.ValueOf(op).FieldByName("leaseID").Int())
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.kvs[key] = fakeLeaseEntry{value: val, lease: lease}
+	return &etcdcv3.PutResponse{}, nil
+}
+
+func (f *fakeLeaseEtcd) Get(_ context.Context, key string, _ ...etcdcv3.OpOption) (*etcdcv3.GetResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.expireLocked()
+
+	resp := &etcdcv3.GetResponse{}
+	for k, entry := range f.kvs {
+		if strings.HasPrefix(k, key) {
+			resp.Kvs = append(resp.Kvs, &mvccpb.KeyValue{Key: []byte(k), Value: []byte(entry.value), Lease: int64(entry.lease)})
+		}
+	}
+	return resp, nil
+}
+
+func (f *fakeLeaseEtcd) Grant(_ context.Context, ttl int64) (*etcdcv3.LeaseGrantResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.nextID++
+	f.ttls[f.nextID] = ttl
+	f.expires[f.nextID] = time.Now().Add(time.Duration(ttl) * f.leaseUnit)
+	return &etcdcv3.LeaseGrantResponse{ID: f.nextID, TTL: ttl}, nil
+}
+
+func (f *fakeLeaseEtcd) KeepAlive(ctx context.Context, id etcdcv3.LeaseID) (<-chan *etcdcv3.LeaseKeepAliveResponse, error) {
+	ch := make(chan *etcdcv3.LeaseKeepAliveResponse)
+	go func() {
+		defer close(ch)
+		ticker := time.NewTicker(f.leaseUnit / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				f.mu.Lock()
+				ttl := f.ttls[id]
+				f.expires[id] = time.Now().Add(time.Duration(ttl) * f.leaseUnit)
+				f.mu.Unlock()
+				select {
+				case ch <- &etcdcv3.LeaseKeepAliveResponse{ID: id, TTL: ttl}:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return ch, nil
+}
+
+func TestEtcdClient_LeaseExpiresWithoutRefresh(t *testing.T) {
+	fake := newFakeLeaseEtcd(100 * time.Millisecond)
+	c := &etcdClient{
+		client: &etcdcv3.Client{KV: fake, Lease: fake},
+		lease:  newETCDLease(time.Second),
+	}
+
+	ctx := context.Background()
+	require.NoError(t, c.SaveService(ctx, &Service{Host: "1.2.3.4", Key: "/skydns/com/example/www"}))
+
+	// While the keepalive runs, the record outlives its TTL
+	time.Sleep(250 * time.Millisecond)
+	services, err := c.GetServices(ctx, "/skydns/")
+	require.NoError(t, err)
+	require.Len(t, services, 1)
+
+	// Stopping the keepalive (as Close does) lets the lease lapse
+	c.lease.stop()
+	time.Sleep(250 * time.Millisecond)
+	services, err = c.GetServices(ctx, "/skydns/")
+	require.NoError(t, err)
+	assert.Empty(t, services)
+}
+
+func TestEtcdClient_LeaseReused(t *testing.T) {
+	fake := newFakeLeaseEtcd(time.Second)
+	c := &etcdClient{
+		client: &etcdcv3.Client{KV: fake, Lease: fake},
+		lease:  newETCDLease(30 * time.Second),
+	}
+	defer c.lease.stop()
+
+	ctx := context.Background()
+	require.NoError(t, c.SaveService(ctx, &Service{Host: "1.1.1.1", Key: "/skydns/com/example/a"}))
+	require.NoError(t, c.SaveService(ctx, &Service{Host: "2.2.2.2", Key: "/skydns/com/example/b"}))
+
+	resp, err := fake.Get(ctx, "/skydns/")
+	require.NoError(t, err)
+	require.Len(t, resp.Kvs, 2)
+	assert.Equal(t, resp.Kvs[0].Lease, resp.Kvs[1].Lease)
+	assert.Equal(t, etcdcv3.LeaseID(1), fake.nextID, "a single lease should be granted")
+	assert.Equal(t, int64(30), fake.ttls[1])
+}
+
+func TestEtcdClient_NoLeaseByDefault(t *testing.T) {
+	fake := newFakeLeaseEtcd(time.Millisecond)
+	c := etcdClient{client: &etcdcv3.Client{KV: fake, Lease: fake}}
+
+	ctx := context.Background()
+	require.NoError(t, c.SaveService(ctx, &Service{Host: "1.2.3.4", Key: "/skydns/com/example/www"}))
+
+	time.Sleep(10 * time.Millisecond)
+	services, err := c.GetServices(ctx, "/skydns/")
+	require.NoError(t, err)
+	assert.Len(t, services, 1)
+	assert.Zero(t, fake.nextID)
+}
+
+func TestGetBackendConfig_EtcdLeaseTTL(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected time.Duration
+	}{
+		{"60", time.Minute},
+		{"90s", 90 * time.Second},
+		{"invalid", 0},
+		{"", 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			testutils.TestHelperEnvSetter(t, map[string]string{"COREDNS_ETCD_LEASE_TTL": tt.value})
+			assert.Equal(t, tt.expected, GetBackendConfig().EtcdLeaseTTL)
+		})
+	}
+}
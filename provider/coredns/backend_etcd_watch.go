@@ -0,0 +1,138 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package coredns
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"time"
+
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	etcdcv3 "go.etcd.io/etcd/client/v3"
+)
+
+// Compile-time check that etcdClient implements Watcher
+var _ Watcher = (*etcdClient)(nil)
+
+var (
+	// etcdWatchBackoff is the delay before re-establishing a dropped watch,
+	// doubled after each consecutive failure up to etcdWatchMaxBackoff.
+	etcdWatchBackoff    = 500 * time.Millisecond
+	etcdWatchMaxBackoff = 30 * time.Second
+)
+
+// Watch streams the changes made to the keys under prefix using an etcd watch.
+// Values that can't be decoded are logged and skipped.
+//
+// A watch dropped by the server or the network is re-established with
+// jittered exponential backoff, from the revision after the last one
+// observed, so that no event is lost or sent twice. The watch fails if
+// that revision has been compacted away.
+func (c *etcdClient) Watch(ctx context.Context, prefix string) (<-chan WatchEvent, error) {
+	if c.closed.Load() {
+		return nil, ErrBackendClosed
+	}
+	key := c.resolve(prefix)
+	wch := c.client.Watch(ctx, key, etcdWatchOptions(0)...)
+	events := make(chan WatchEvent)
+
+	go func() {
+		defer close(events)
+
+		send := func(event WatchEvent) bool {
+			select {
+			case events <- event:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+
+		codec := codecOrDefault(c.codec)
+		var rev int64 // last revision observed, 0 until the watch is created
+		backoff := etcdWatchBackoff
+		for {
+			err := errors.New("watch channel closed")
+			for resp := range wch {
+				if resp.CompactRevision != 0 {
+					// The events to resume from are gone
+					send(WatchEvent{Err: etcdError(resp.Err())})
+					return
+				}
+				if err = resp.Err(); err != nil {
+					break
+				}
+				backoff = etcdWatchBackoff
+
+				switch {
+				case resp.Created:
+					// The watch starts after the header revision, unless resumed
+					if rev == 0 {
+						rev = resp.Header.Revision
+					}
+				case resp.IsProgressNotify():
+					rev = resp.Header.Revision
+				}
+				for _, ev := range resp.Events {
+					rev = ev.Kv.ModRevision
+					if !c.keys.inPrefix(string(ev.Kv.Key), key) {
+						continue
+					}
+					event := WatchEvent{Type: WatchEventDelete, Key: string(ev.Kv.Key)}
+					if ev.Type == mvccpb.PUT {
+						svc := new(Service)
+						if err := codec.Unmarshal(ev.Kv.Value, svc); err != nil {
+							log.Warnf("Failed to unmarshal service at %s: %v", event.Key, err)
+							continue
+						}
+						svc.Key = event.Key
+						event.Type, event.Service = WatchEventPut, svc
+					}
+					if !send(event) {
+						return
+					}
+				}
+			}
+			if ctx.Err() != nil {
+				return
+			}
+
+			delay := backoff/2 + time.Duration(rand.Int63n(int64(backoff)))
+			log.Warnf("etcd watch of %s dropped, resuming after revision %d in %s: %v", key, rev, delay, etcdError(err))
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(delay):
+			}
+			backoff = min(2*backoff, etcdWatchMaxBackoff)
+			wch = c.client.Watch(ctx, key, etcdWatchOptions(rev)...)
+		}
+	}()
+
+	return events, nil
+}
+
+// etcdWatchOptions returns the options of a prefix watch resuming after rev,
+// or starting at the current revision if rev is 0.
+func etcdWatchOptions(rev int64) []etcdcv3.OpOption {
+	opts := []etcdcv3.OpOption{etcdcv3.WithPrefix(), etcdcv3.WithCreatedNotify()}
+	if rev > 0 {
+		opts = append(opts, etcdcv3.WithRev(rev+1))
+	}
+	return opts
+}
@@ -0,0 +1,143 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package coredns
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	etcdcv3 "go.etcd.io/etcd/client/v3"
+)
+
+// fakeEtcdWatcher serves successive watches from prepared channels and
+// records the revision each one starts from.
+type fakeEtcdWatcher struct {
+	mu   sync.Mutex
+	chs  []chan etcdcv3.WatchResponse
+	key  string
+	revs []int64
+}
+
+func (w *fakeEtcdWatcher) Watch(_ context.Context, key string, opts ...etcdcv3.OpOption) etcdcv3.WatchChan {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	op := etcdcv3.OpGet(key, opts...)
+	w.key = key
+	w.revs = append(w.revs, op.Rev())
+	return w.chs[len(w.revs)-1]
+}
+
+func (w *fakeEtcdWatcher) startRevs() []int64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return slices.Clone(w.revs)
+}
+
+func (w *fakeEtcdWatcher) RequestProgress(context.Context) error { return nil }
+
+func (w *fakeEtcdWatcher) Close() error { return nil }
+
+func TestEtcdClient_Watch(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ch := make(chan etcdcv3.WatchResponse, 2)
+	watcher := &fakeEtcdWatcher{chs: []chan etcdcv3.WatchResponse{ch}}
+	c := etcdClient{client: &etcdcv3.Client{Watcher: watcher}, prefix: "/skydns"}
+
+	events, err := c.Watch(ctx, "com/example")
+	require.NoError(t, err)
+	assert.Equal(t, "/skydns/com/example", watcher.key)
+
+	ch <- etcdcv3.WatchResponse{Events: []*etcdcv3.Event{
+		{Type: mvccpb.PUT, Kv: &mvccpb.KeyValue{Key: []byte("/skydns/com/example/www"), Value: []byte(`{"host":"1.2.3.4"}`)}},
+		{Type: mvccpb.PUT, Kv: &mvccpb.KeyValue{Key: []byte("/skydns/com/example/bad"), Value: []byte(`{`)}},
+		{Type: mvccpb.DELETE, Kv: &mvccpb.KeyValue{Key: []byte("/skydns/com/example/old")}},
+	}}
+
+	event := <-events
+	assert.Equal(t, WatchEventPut, event.Type)
+	assert.Equal(t, "/skydns/com/example/www", event.Key)
+	assert.Equal(t, &Service{Host: "1.2.3.4", Key: "/skydns/com/example/www"}, event.Service)
+
+	// The undecodable value is skipped
+	event = <-events
+	assert.Equal(t, WatchEvent{Type: WatchEventDelete, Key: "/skydns/com/example/old"}, event)
+
+	ch <- etcdcv3.WatchResponse{Canceled: true, CompactRevision: 5}
+	event = <-events
+	assert.ErrorIs(t, event.Err, rpctypes.ErrCompacted)
+
+	_, ok := <-events
+	assert.False(t, ok, "the channel is closed after an error")
+}
+
+func TestEtcdClient_WatchReconnect(t *testing.T) {
+	defer func(backoff time.Duration) { etcdWatchBackoff = backoff }(etcdWatchBackoff)
+	etcdWatchBackoff = time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	chs := []chan etcdcv3.WatchResponse{
+		make(chan etcdcv3.WatchResponse, 2),
+		make(chan etcdcv3.WatchResponse, 2),
+		make(chan etcdcv3.WatchResponse, 2),
+	}
+	watcher := &fakeEtcdWatcher{chs: chs}
+	c := etcdClient{client: &etcdcv3.Client{Watcher: watcher}, prefix: "/skydns"}
+
+	events, err := c.Watch(ctx, "com/example")
+	require.NoError(t, err)
+
+	put := func(key string, rev int64) *etcdcv3.Event {
+		return &etcdcv3.Event{Type: mvccpb.PUT, Kv: &mvccpb.KeyValue{Key: []byte(key), Value: []byte(`{"host":"1.2.3.4"}`), ModRevision: rev}}
+	}
+
+	// The first watch is dropped before any event, it resumes after the creation revision
+	chs[0] <- etcdcv3.WatchResponse{Header: etcdserverpb.ResponseHeader{Revision: 10}, Created: true}
+	close(chs[0])
+
+	chs[1] <- etcdcv3.WatchResponse{Header: etcdserverpb.ResponseHeader{Revision: 12}, Created: true}
+	chs[1] <- etcdcv3.WatchResponse{Events: []*etcdcv3.Event{put("/skydns/com/example/a", 11), put("/skydns/com/example/b", 12)}}
+	assert.Equal(t, "/skydns/com/example/a", (<-events).Key)
+	assert.Equal(t, "/skydns/com/example/b", (<-events).Key)
+
+	// The second watch is canceled by the server, it resumes after the last event
+	chs[1] <- etcdcv3.WatchResponse{Canceled: true}
+	chs[2] <- etcdcv3.WatchResponse{Header: etcdserverpb.ResponseHeader{Revision: 14}, Created: true}
+	chs[2] <- etcdcv3.WatchResponse{Events: []*etcdcv3.Event{put("/skydns/com/example/c", 13)}}
+	event := <-events
+	require.NoError(t, event.Err)
+	assert.Equal(t, "/skydns/com/example/c", event.Key)
+
+	assert.Equal(t, []int64{0, 11, 13}, watcher.startRevs())
+
+	// Like the etcd client, the watch channel is closed when the context is done
+	cancel()
+	close(chs[2])
+	_, ok := <-events
+	assert.False(t, ok, "the channel is closed when the context is done")
+}
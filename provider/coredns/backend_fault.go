@@ -0,0 +1,296 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package coredns
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Operation names a Backend method for fault injection.
+type Operation string
+
+// Operations that can be made to fail or slow down.
+const (
+	OpGetServices            Operation = "GetServices"
+	OpGetServicesWithOptions Operation = "GetServicesWithOptions"
+	OpGetServicesByType      Operation = "GetServicesByType"
+	OpGetServicesBySource    Operation = "GetServicesBySource"
+	OpGetServicesPage        Operation = "GetServicesPage"
+	OpExists                 Operation = "Exists"
+	OpIsEmpty                Operation = "IsEmpty"
+	OpSaveService            Operation = "SaveService"
+	OpUpdateService          Operation = "UpdateService"
+	OpSaveServiceWithPolicy  Operation = "SaveServiceWithPolicy"
+	OpForEach                Operation = "ForEach"
+	OpStreamKeys             Operation = "StreamKeys"
+	OpSnapshot               Operation = "Snapshot"
+	OpDeleteService          Operation = "DeleteService"
+	OpClearPrefix            Operation = "ClearPrefix"
+	OpFlush                  Operation = "Flush"
+	OpHealth                 Operation = "Health"
+	OpClose                  Operation = "Close"
+)
+
+// FaultInjectingBackend wraps a Backend and makes chosen calls fail or slow
+// down, so that retry, timeout and failover logic can be tested
+// deterministically. It is meant for tests only.
+type FaultInjectingBackend struct {
+	backend Backend
+
+	mu      sync.Mutex
+	calls   map[Operation]int
+	faults  map[Operation]map[int]error // keyed by call number, 0 for every call
+	latency map[Operation]time.Duration
+}
+
+// Compile-time check that FaultInjectingBackend implements Backend
+var _ Backend = (*FaultInjectingBackend)(nil)
+
+// NewFaultInjectingBackend wraps backend without any fault configured.
+func NewFaultInjectingBackend(backend Backend) *FaultInjectingBackend {
+	return &FaultInjectingBackend{
+		backend: backend,
+		calls:   make(map[Operation]int),
+		faults:  make(map[Operation]map[int]error),
+		latency: make(map[Operation]time.Duration),
+	}
+}
+
+// FailOn makes the nth call (starting at 1) to op return err instead of
+// reaching the wrapped backend. If n is zero or negative, every call fails.
+func (f *FaultInjectingBackend) FailOn(op Operation, n int, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.faults[op] == nil {
+		f.faults[op] = make(map[int]error)
+	}
+	f.faults[op][max(n, 0)] = err
+}
+
+// SetLatency delays every call to op by d. Calls given a context return
+// early with the context error if it is done before d elapses.
+func (f *FaultInjectingBackend) SetLatency(op Operation, d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.latency[op] = d
+}
+
+// Reset removes every configured fault and latency. Call counts are kept.
+func (f *FaultInjectingBackend) Reset() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.faults = make(map[Operation]map[int]error)
+	f.latency = make(map[Operation]time.Duration)
+}
+
+// Calls returns how many times op was called, including failed calls.
+func (f *FaultInjectingBackend) Calls(op Operation) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls[op]
+}
+
+// inject records a call to op, waits for its latency and returns the fault
+// configured for it, if any.
+func (f *FaultInjectingBackend) inject(ctx context.Context, op Operation) error {
+	f.mu.Lock()
+	f.calls[op]++
+	n := f.calls[op]
+	latency := f.latency[op]
+	err, ok := f.faults[op][n]
+	if !ok {
+		err = f.faults[op][0]
+	}
+	f.mu.Unlock()
+
+	if latency > 0 {
+		timer := time.NewTimer(latency)
+		defer timer.Stop()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+	return err
+}
+
+// GetServices delegates to the wrapped backend unless a fault is injected.
+func (f *FaultInjectingBackend) GetServices(ctx context.Context, prefix string) ([]*Service, error) {
+	if err := f.inject(ctx, OpGetServices); err != nil {
+		return nil, err
+	}
+	return f.backend.GetServices(ctx, prefix)
+}
+
+// GetServicesWithOptions delegates to the wrapped backend unless a fault is injected.
+func (f *FaultInjectingBackend) GetServicesWithOptions(ctx context.Context, prefix string, opts GetServicesOptions) ([]*Service, error) {
+	if err := f.inject(ctx, OpGetServicesWithOptions); err != nil {
+		return nil, err
+	}
+	return f.backend.GetServicesWithOptions(ctx, prefix, opts)
+}
+
+// GetServicesByType delegates to the wrapped backend unless a fault is injected.
+func (f *FaultInjectingBackend) GetServicesByType(ctx context.Context, prefix, recordType string) ([]*Service, error) {
+	if err := f.inject(ctx, OpGetServicesByType); err != nil {
+		return nil, err
+	}
+	return f.backend.GetServicesByType(ctx, prefix, recordType)
+}
+
+// GetServicesBySource delegates to the wrapped backend unless a fault is injected.
+func (f *FaultInjectingBackend) GetServicesBySource(ctx context.Context, prefix, source string) ([]*Service, error) {
+	if err := f.inject(ctx, OpGetServicesBySource); err != nil {
+		return nil, err
+	}
+	return f.backend.GetServicesBySource(ctx, prefix, source)
+}
+
+// GetServicesPage delegates to the wrapped backend unless a fault is injected.
+func (f *FaultInjectingBackend) GetServicesPage(ctx context.Context, prefix, afterKey string, limit int) ([]*Service, string, error) {
+	if err := f.inject(ctx, OpGetServicesPage); err != nil {
+		return nil, "", err
+	}
+	return f.backend.GetServicesPage(ctx, prefix, afterKey, limit)
+}
+
+// Exists delegates to the wrapped backend unless a fault is injected.
+func (f *FaultInjectingBackend) Exists(ctx context.Context, prefix string) (bool, error) {
+	if err := f.inject(ctx, OpExists); err != nil {
+		return false, err
+	}
+	return f.backend.Exists(ctx, prefix)
+}
+
+// IsEmpty delegates to the wrapped backend unless a fault is injected.
+func (f *FaultInjectingBackend) IsEmpty(ctx context.Context) (bool, error) {
+	if err := f.inject(ctx, OpIsEmpty); err != nil {
+		return false, err
+	}
+	return IsEmpty(ctx, f.backend)
+}
+
+// SaveService delegates to the wrapped backend unless a fault is injected.
+func (f *FaultInjectingBackend) SaveService(ctx context.Context, service *Service) error {
+	if err := f.inject(ctx, OpSaveService); err != nil {
+		return err
+	}
+	return f.backend.SaveService(ctx, service)
+}
+
+// ForEach delegates to the wrapped backend unless a fault is injected.
+func (f *FaultInjectingBackend) ForEach(ctx context.Context, prefix string, fn func(key string, svc *Service) error) error {
+	if err := f.inject(ctx, OpForEach); err != nil {
+		return err
+	}
+	return f.backend.ForEach(ctx, prefix, fn)
+}
+
+// StreamKeys delegates to the wrapped backend unless a fault is injected.
+func (f *FaultInjectingBackend) StreamKeys(ctx context.Context, prefix string, fn func(key string) error) error {
+	if err := f.inject(ctx, OpStreamKeys); err != nil {
+		return err
+	}
+	return StreamKeys(ctx, f.backend, prefix, fn)
+}
+
+// Snapshot delegates to the wrapped backend unless a fault is injected.
+func (f *FaultInjectingBackend) Snapshot(ctx context.Context) (map[string]Service, error) {
+	if err := f.inject(ctx, OpSnapshot); err != nil {
+		return nil, err
+	}
+	return f.backend.Snapshot(ctx)
+}
+
+// DeleteService delegates to the wrapped backend unless a fault is injected.
+func (f *FaultInjectingBackend) DeleteService(ctx context.Context, key string) error {
+	if err := f.inject(ctx, OpDeleteService); err != nil {
+		return err
+	}
+	return f.backend.DeleteService(ctx, key)
+}
+
+// deleteIfCovered delegates to the wrapped backend unless a fault is
+// injected for DeleteService.
+func (f *FaultInjectingBackend) deleteIfCovered(ctx context.Context, key string, covered func(key string) bool) (bool, error) {
+	if err := f.inject(ctx, OpDeleteService); err != nil {
+		return false, err
+	}
+	return deleteIfCovered(ctx, f.backend, key, covered)
+}
+
+// SaveServiceWithPolicy delegates to the wrapped backend unless a fault is
+// injected.
+func (f *FaultInjectingBackend) SaveServiceWithPolicy(ctx context.Context, service *Service, policy ConflictPolicy) (bool, error) {
+	if err := f.inject(ctx, OpSaveServiceWithPolicy); err != nil {
+		return false, err
+	}
+	return SaveServiceWithPolicy(ctx, f.backend, service, policy)
+}
+
+// UpdateService delegates to the wrapped backend unless a fault is injected.
+func (f *FaultInjectingBackend) UpdateService(ctx context.Context, service *Service) error {
+	if err := f.inject(ctx, OpUpdateService); err != nil {
+		return err
+	}
+	return UpdateService(ctx, f.backend, service)
+}
+
+// ClearPrefix delegates to the wrapped backend unless a fault is injected.
+func (f *FaultInjectingBackend) ClearPrefix(ctx context.Context, prefix string) error {
+	if err := f.inject(ctx, OpClearPrefix); err != nil {
+		return err
+	}
+	return f.backend.ClearPrefix(ctx, prefix)
+}
+
+// Flush flushes the wrapped backend unless a fault is injected.
+func (f *FaultInjectingBackend) Flush(ctx context.Context) error {
+	if err := f.inject(ctx, OpFlush); err != nil {
+		return err
+	}
+	return f.backend.Flush(ctx)
+}
+
+// Health reports the health of the wrapped backend unless a fault is injected.
+func (f *FaultInjectingBackend) Health(ctx context.Context) error {
+	if err := f.inject(ctx, OpHealth); err != nil {
+		return err
+	}
+	return checkHealth(ctx, f.backend)
+}
+
+// Close closes the wrapped backend unless a fault is injected.
+func (f *FaultInjectingBackend) Close() error {
+	if err := f.inject(context.Background(), OpClose); err != nil {
+		return err
+	}
+	return f.backend.Close()
+}
+
+// Capabilities reports the capabilities of the wrapped backend, except Watch.
+func (f *FaultInjectingBackend) Capabilities() BackendCapabilities {
+	return decoratorCapabilities(f.backend)
+}
+
+// Unwrap returns the wrapped backend.
+func (f *FaultInjectingBackend) Unwrap() Backend {
+	return f.backend
+}
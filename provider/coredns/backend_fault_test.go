@@ -0,0 +1,113 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package coredns
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFaultInjectingBackend_FailOn(t *testing.T) {
+	backend := NewFaultInjectingBackend(NewMemoryBackend())
+	defer backend.Close()
+
+	errBoom := errors.New("boom")
+	backend.FailOn(OpSaveService, 2, errBoom)
+
+	ctx := context.Background()
+	svc := &Service{Host: "1.2.3.4", Key: "/skydns/com/example/www"}
+	assert.NoError(t, backend.SaveService(ctx, svc))
+	assert.ErrorIs(t, backend.SaveService(ctx, svc), errBoom)
+	assert.NoError(t, backend.SaveService(ctx, svc))
+	assert.Equal(t, 3, backend.Calls(OpSaveService))
+
+	// Other operations are unaffected
+	services, err := backend.GetServices(ctx, "/skydns/")
+	require.NoError(t, err)
+	assert.Len(t, services, 1)
+
+	backend.FailOn(OpGetServices, 0, ErrUnavailable)
+	for range 3 {
+		_, err := backend.GetServices(ctx, "/skydns/")
+		assert.ErrorIs(t, err, ErrUnavailable)
+	}
+
+	backend.Reset()
+	_, err = backend.GetServices(ctx, "/skydns/")
+	assert.NoError(t, err)
+	assert.Equal(t, 5, backend.Calls(OpGetServices))
+}
+
+func TestFaultInjectingBackend_Latency(t *testing.T) {
+	backend := NewFaultInjectingBackend(NewMemoryBackend())
+	defer backend.Close()
+
+	backend.SetLatency(OpGetServices, time.Minute)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err := backend.GetServices(ctx, "/skydns/")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), time.Minute)
+
+	backend.SetLatency(OpExists, 10*time.Millisecond)
+	start = time.Now()
+	_, err = backend.Exists(context.Background(), "/skydns/")
+	assert.NoError(t, err)
+	assert.GreaterOrEqual(t, time.Since(start), 10*time.Millisecond)
+}
+
+func TestFaultInjectingBackend_MultiBackendFailover(t *testing.T) {
+	primary := NewFaultInjectingBackend(NewMemoryBackend())
+	secondary := NewMemoryBackend()
+
+	multi, err := NewMultiBackend([]Backend{primary, secondary}, MultiBackendOptions{HealthInterval: 5 * time.Millisecond})
+	require.NoError(t, err)
+	defer multi.Close()
+
+	ctx := context.Background()
+	require.NoError(t, multi.SaveService(ctx, &Service{Host: "1.2.3.4", Key: "/skydns/com/example/www"}))
+	// Only the secondary holds this record, telling which backend served a read
+	require.NoError(t, secondary.SaveService(ctx, &Service{Host: "5.6.7.8", Key: "/skydns/com/example/api"}))
+
+	countServices := func() int {
+		services, err := multi.GetServices(ctx, "/skydns/")
+		require.NoError(t, err)
+		return len(services)
+	}
+	assert.Equal(t, 1, countServices())
+
+	// Reads fail over while the primary is unhealthy
+	primary.FailOn(OpHealth, 0, ErrUnavailable)
+	assert.Eventually(t, func() bool { return countServices() == 2 }, time.Second, 5*time.Millisecond)
+
+	// Writes still reach the primary and report its failure
+	primary.FailOn(OpSaveService, primary.Calls(OpSaveService)+1, ErrUnavailable)
+	err = multi.SaveService(ctx, &Service{Host: "9.9.9.9", Key: "/skydns/com/example/mail"})
+	assert.ErrorIs(t, err, ErrUnavailable)
+
+	// Reads return to the primary once it recovers
+	primary.Reset()
+	assert.Eventually(t, func() bool { return countServices() == 1 }, time.Second, 5*time.Millisecond)
+}
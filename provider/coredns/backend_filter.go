@@ -0,0 +1,288 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package coredns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"sigs.k8s.io/external-dns/endpoint"
+)
+
+// ErrOutOfZone is returned when a write targets a name outside the domain filter
+var ErrOutOfZone = errors.New("record is outside the domain filter")
+
+// errStopIteration stops a ForEach iteration early without reporting an error
+var errStopIteration = errors.New("stop iteration")
+
+// FilteringBackend wraps a Backend and confines it to the names matched by a
+// DomainFilter. Writes and deletes for keys whose DNS name falls outside the
+// filter are rejected with ErrOutOfZone, preventing accidental cross-zone
+// writes to a shared store. Reads defensively drop out-of-zone records.
+type FilteringBackend struct {
+	backend      Backend
+	prefix       string
+	keys         KeyScheme
+	domainFilter *endpoint.DomainFilter
+}
+
+// Compile-time check that FilteringBackend implements Backend
+var _ Backend = (*FilteringBackend)(nil)
+
+// FilteringOptions configures a FilteringBackend.
+type FilteringOptions struct {
+	// Prefix is the root of the keys DNS names are parsed from.
+	// If empty, DefaultPrefix is used.
+	Prefix string
+
+	// Keys is the scheme of stored keys. The zero value separates labels with "/".
+	Keys KeyScheme
+}
+
+// NewFilteringBackend wraps backend so that only keys under prefix whose DNS
+// name matches domainFilter can be read or written.
+func NewFilteringBackend(backend Backend, prefix string, domainFilter *endpoint.DomainFilter) *FilteringBackend {
+	return NewFilteringBackendWithOptions(backend, domainFilter, FilteringOptions{Prefix: prefix})
+}
+
+// NewFilteringBackendWithOptions is NewFilteringBackend with the prefix and
+// key scheme given by opts.
+func NewFilteringBackendWithOptions(backend Backend, domainFilter *endpoint.DomainFilter, opts FilteringOptions) *FilteringBackend {
+	return &FilteringBackend{
+		backend:      backend,
+		prefix:       opts.Keys.normalizePrefix(opts.Prefix),
+		keys:         opts.Keys,
+		domainFilter: domainFilter,
+	}
+}
+
+// inZone reports whether the DNS name stored at key, after stripping
+// targetStrip labels, matches the domain filter.
+func (f *FilteringBackend) inZone(key string, targetStrip int) (string, bool) {
+	key = f.keys.resolveKey(f.prefix, key)
+	if !f.keys.isUnder(key, f.prefix) {
+		return key, false
+	}
+	dnsName, _ := f.keys.ParseKey(f.prefix, key, targetStrip)
+	return dnsName, f.domainFilter.Match(dnsName)
+}
+
+// filter drops the services whose DNS name is outside the domain filter.
+func (f *FilteringBackend) filter(services []*Service) []*Service {
+	filtered := make([]*Service, 0, len(services))
+	for _, svc := range services {
+		if dnsName, ok := f.inZone(svc.Key, svc.TargetStrip); !ok {
+			log.Debugf("Ignoring service %s: %q is outside the domain filter", svc.Key, dnsName)
+			continue
+		}
+		filtered = append(filtered, svc)
+	}
+	return filtered
+}
+
+// GetServices returns the in-zone services under the given prefix.
+func (f *FilteringBackend) GetServices(ctx context.Context, prefix string) ([]*Service, error) {
+	services, err := f.backend.GetServices(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	return f.filter(services), nil
+}
+
+// GetServicesWithOptions returns the in-zone services under the given prefix.
+func (f *FilteringBackend) GetServicesWithOptions(ctx context.Context, prefix string, opts GetServicesOptions) ([]*Service, error) {
+	services, err := f.backend.GetServicesWithOptions(ctx, prefix, opts)
+	if err != nil {
+		return nil, err
+	}
+	return f.filter(services), nil
+}
+
+// GetServicesByType returns the in-zone services of the given type under the given prefix.
+func (f *FilteringBackend) GetServicesByType(ctx context.Context, prefix, recordType string) ([]*Service, error) {
+	services, err := f.backend.GetServicesByType(ctx, prefix, recordType)
+	if err != nil {
+		return nil, err
+	}
+	return f.filter(services), nil
+}
+
+// GetServicesBySource returns the in-zone services of the given source under the given prefix.
+func (f *FilteringBackend) GetServicesBySource(ctx context.Context, prefix, source string) ([]*Service, error) {
+	services, err := f.backend.GetServicesBySource(ctx, prefix, source)
+	if err != nil {
+		return nil, err
+	}
+	return f.filter(services), nil
+}
+
+// ForEach calls fn for each in-zone service under the given prefix.
+func (f *FilteringBackend) ForEach(ctx context.Context, prefix string, fn func(key string, svc *Service) error) error {
+	return f.backend.ForEach(ctx, prefix, func(key string, svc *Service) error {
+		if _, ok := f.inZone(key, svc.TargetStrip); !ok {
+			return nil
+		}
+		return fn(key, svc)
+	})
+}
+
+// StreamKeys calls fn with the in-zone keys under the given prefix. Whether
+// a key is in zone depends on the TargetStrip of its service, so the
+// services are read with ForEach.
+func (f *FilteringBackend) StreamKeys(ctx context.Context, prefix string, fn func(key string) error) error {
+	return f.ForEach(ctx, prefix, func(key string, _ *Service) error {
+		return fn(key)
+	})
+}
+
+// GetServicesPage returns the in-zone services of a page of the wrapped
+// backend. Pages may be shorter than limit once filtered, but the cursor
+// still advances over the whole underlying page.
+func (f *FilteringBackend) GetServicesPage(ctx context.Context, prefix, afterKey string, limit int) ([]*Service, string, error) {
+	page, next, err := f.backend.GetServicesPage(ctx, prefix, afterKey, limit)
+	if err != nil {
+		return nil, "", err
+	}
+	return f.filter(page), next, nil
+}
+
+// Exists reports whether any in-zone service is stored under the given prefix.
+// Out-of-zone services are skipped, stopping at the first in-zone one.
+func (f *FilteringBackend) Exists(ctx context.Context, prefix string) (bool, error) {
+	exists := false
+	err := f.ForEach(ctx, prefix, func(string, *Service) error {
+		exists = true
+		return errStopIteration
+	})
+	if err != nil && !errors.Is(err, errStopIteration) {
+		return false, err
+	}
+	return exists, nil
+}
+
+// IsEmpty reports whether no in-zone service is stored.
+func (f *FilteringBackend) IsEmpty(ctx context.Context) (bool, error) {
+	exists, err := f.Exists(ctx, rootPrefixOf(f.backend))
+	if err != nil {
+		return false, err
+	}
+	return !exists, nil
+}
+
+// Snapshot returns a copy of the in-zone stored services.
+func (f *FilteringBackend) Snapshot(ctx context.Context) (map[string]Service, error) {
+	snapshot, err := f.backend.Snapshot(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for key, svc := range snapshot {
+		if _, ok := f.inZone(key, svc.TargetStrip); !ok {
+			delete(snapshot, key)
+		}
+	}
+	return snapshot, nil
+}
+
+// SaveService persists the service if its DNS name matches the domain filter.
+func (f *FilteringBackend) SaveService(ctx context.Context, service *Service) error {
+	if err := f.checkWrite(service); err != nil {
+		return err
+	}
+	return f.backend.SaveService(ctx, service)
+}
+
+// SaveServiceWithPolicy saves the service according to policy if its DNS
+// name matches the domain filter.
+func (f *FilteringBackend) SaveServiceWithPolicy(ctx context.Context, service *Service, policy ConflictPolicy) (bool, error) {
+	if err := f.checkWrite(service); err != nil {
+		return false, err
+	}
+	return SaveServiceWithPolicy(ctx, f.backend, service, policy)
+}
+
+// UpdateService updates the service if its DNS name matches the domain filter.
+func (f *FilteringBackend) UpdateService(ctx context.Context, service *Service) error {
+	if err := f.checkWrite(service); err != nil {
+		return err
+	}
+	return UpdateService(ctx, f.backend, service)
+}
+
+// checkWrite rejects with ErrOutOfZone the writes of services whose DNS name
+// is outside the domain filter.
+func (f *FilteringBackend) checkWrite(service *Service) error {
+	if dnsName, ok := f.inZone(service.Key, service.TargetStrip); !ok {
+		return fmt.Errorf("%w: refusing to save %s (%s)", ErrOutOfZone, service.Key, dnsName)
+	}
+	return nil
+}
+
+// DeleteService removes the key and its children if the key's DNS name
+// matches the domain filter. Deleting a parent of the filtered zones
+// (e.g. /skydns/com) is rejected since it would remove out-of-zone records.
+func (f *FilteringBackend) DeleteService(ctx context.Context, key string) error {
+	if dnsName, ok := f.inZone(key, 0); !ok {
+		return fmt.Errorf("%w: refusing to delete %s (%s)", ErrOutOfZone, key, dnsName)
+	}
+	return f.backend.DeleteService(ctx, key)
+}
+
+// deleteIfCovered deletes the key and its children if its DNS name matches
+// the domain filter and covered accepts all of them. Out-of-zone keys are
+// reported as not deleted rather than rejected, so that callers fall back to
+// deleting the keys below.
+func (f *FilteringBackend) deleteIfCovered(ctx context.Context, key string, covered func(key string) bool) (bool, error) {
+	if _, ok := f.inZone(key, 0); !ok {
+		return false, nil
+	}
+	return deleteIfCovered(ctx, f.backend, key, covered)
+}
+
+// ClearPrefix clears the prefix if its DNS name matches the domain filter,
+// rejecting parents of the filtered zones as DeleteService does.
+func (f *FilteringBackend) ClearPrefix(ctx context.Context, prefix string) error {
+	if dnsName, ok := f.inZone(prefix, 0); !ok {
+		return fmt.Errorf("%w: refusing to clear %s (%s)", ErrOutOfZone, prefix, dnsName)
+	}
+	return f.backend.ClearPrefix(ctx, prefix)
+}
+
+// Flush flushes the wrapped backend.
+func (f *FilteringBackend) Flush(ctx context.Context) error {
+	return f.backend.Flush(ctx)
+}
+
+// Close closes the wrapped backend.
+func (f *FilteringBackend) Close() error {
+	return f.backend.Close()
+}
+
+// Health reports the health of the wrapped backend.
+func (f *FilteringBackend) Health(ctx context.Context) error {
+	return checkHealth(ctx, f.backend)
+}
+
+// Capabilities reports the capabilities of the wrapped backend, except Watch.
+func (f *FilteringBackend) Capabilities() BackendCapabilities {
+	return decoratorCapabilities(f.backend)
+}
+
+// Unwrap returns the wrapped backend.
+func (f *FilteringBackend) Unwrap() Backend {
+	return f.backend
+}
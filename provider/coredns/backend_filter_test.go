@@ -0,0 +1,151 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package coredns
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"sigs.k8s.io/external-dns/endpoint"
+	"sigs.k8s.io/external-dns/internal/testutils"
+)
+
+func TestFilteringBackend_RejectsOutOfZoneWrites(t *testing.T) {
+	inner := NewMemoryBackend()
+	backend := NewFilteringBackend(inner, "/skydns/", endpoint.NewDomainFilter([]string{"example.com"}))
+	defer backend.Close()
+
+	ctx := context.Background()
+
+	err := backend.SaveService(ctx, &Service{Host: "1.2.3.4", Key: "/skydns/org/other/www"})
+	assert.ErrorIs(t, err, ErrOutOfZone)
+	assert.Contains(t, err.Error(), "/skydns/org/other/www")
+	assert.Equal(t, 0, inner.Count())
+
+	// Keys outside the prefix are out of zone too
+	err = backend.SaveService(ctx, &Service{Host: "1.2.3.4", Key: "/other/com/example/www"})
+	assert.ErrorIs(t, err, ErrOutOfZone)
+
+	require.NoError(t, backend.SaveService(ctx, &Service{Host: "1.2.3.4", Key: "/skydns/com/example/www"}))
+	require.NoError(t, backend.SaveService(ctx, &Service{Host: "1.2.3.4", TargetStrip: 1, Key: "/skydns/com/example/api/1a2b3c4d"}))
+	assert.Equal(t, 2, inner.Count())
+}
+
+func TestFilteringBackend_RejectsOutOfZoneDeletes(t *testing.T) {
+	inner := NewMemoryBackend()
+	backend := NewFilteringBackend(inner, "/skydns/", endpoint.NewDomainFilter([]string{"example.com"}))
+	defer backend.Close()
+
+	ctx := context.Background()
+	require.NoError(t, inner.SaveService(ctx, &Service{Host: "1.1.1.1", Key: "/skydns/com/example/www"}))
+	require.NoError(t, inner.SaveService(ctx, &Service{Host: "2.2.2.2", Key: "/skydns/com/other/www"}))
+
+	// Deleting the parent zone would remove other.com as well
+	assert.ErrorIs(t, backend.DeleteService(ctx, "/skydns/com"), ErrOutOfZone)
+	assert.ErrorIs(t, backend.DeleteService(ctx, "/skydns/com/other/www"), ErrOutOfZone)
+	assert.ErrorIs(t, backend.ClearPrefix(ctx, "/skydns/com"), ErrOutOfZone)
+	assert.Equal(t, 2, inner.Count())
+
+	require.NoError(t, backend.DeleteService(ctx, "/skydns/com/example/www"))
+	assert.Equal(t, []string{"/skydns/com/other/www"}, inner.Keys())
+}
+
+func TestFilteringBackend_WithOptions(t *testing.T) {
+	keys := KeyScheme{Separator: ':'}
+	inner := NewMemoryBackendWithOptions(MemoryOptions{Prefix: ":dns", Keys: keys})
+	backend := NewFilteringBackendWithOptions(inner, endpoint.NewDomainFilter([]string{"example.com"}), FilteringOptions{Prefix: ":dns:", Keys: keys})
+	defer backend.Close()
+
+	ctx := context.Background()
+	require.NoError(t, backend.SaveService(ctx, &Service{Host: "1.2.3.4", Key: ":dns:com:example:www"}))
+	require.NoError(t, backend.SaveService(ctx, &Service{Host: "1.2.3.4", Key: "com:example:api"}))
+	assert.ErrorIs(t, backend.SaveService(ctx, &Service{Host: "1.2.3.4", Key: ":dns:org:other:www"}), ErrOutOfZone)
+	assert.ErrorIs(t, backend.SaveService(ctx, &Service{Host: "1.2.3.4", Key: "/dns/com/example/www"}), ErrOutOfZone)
+	assert.Equal(t, []string{":dns:com:example:api", ":dns:com:example:www"}, inner.Keys())
+}
+
+func TestFilteringBackend_FiltersReads(t *testing.T) {
+	inner := NewMemoryBackend()
+	backend := NewFilteringBackend(inner, "/skydns/", endpoint.NewDomainFilter([]string{"example.com"}))
+	defer backend.Close()
+
+	ctx := context.Background()
+	require.NoError(t, inner.SaveService(ctx, &Service{Host: "1.1.1.1", Key: "/skydns/com/example/www"}))
+	require.NoError(t, inner.SaveService(ctx, &Service{Text: "txt", Key: "/skydns/com/example/txt"}))
+	require.NoError(t, inner.SaveService(ctx, &Service{Host: "2.2.2.2", Key: "/skydns/org/other/www"}))
+
+	services, err := backend.GetServices(ctx, "/skydns/")
+	require.NoError(t, err)
+	require.Len(t, services, 2)
+	for _, svc := range services {
+		assert.NotEqual(t, "/skydns/org/other/www", svc.Key)
+	}
+
+	txt, err := backend.GetServicesByType(ctx, "/skydns/", endpoint.RecordTypeTXT)
+	require.NoError(t, err)
+	require.Len(t, txt, 1)
+
+	var visited []string
+	require.NoError(t, backend.ForEach(ctx, "/skydns/", func(key string, _ *Service) error {
+		visited = append(visited, key)
+		return nil
+	}))
+	assert.ElementsMatch(t, []string{"/skydns/com/example/www", "/skydns/com/example/txt"}, visited)
+
+	visited = nil
+	require.NoError(t, backend.StreamKeys(ctx, "/skydns/", func(key string) error {
+		visited = append(visited, key)
+		return nil
+	}))
+	assert.ElementsMatch(t, []string{"/skydns/com/example/www", "/skydns/com/example/txt"}, visited)
+}
+
+func TestFilteringBackend_Exists(t *testing.T) {
+	inner := NewMemoryBackend()
+	backend := NewFilteringBackend(inner, "/skydns/", endpoint.NewDomainFilter([]string{"example.com"}))
+	defer backend.Close()
+
+	ctx := context.Background()
+	require.NoError(t, inner.SaveService(ctx, &Service{Host: "2.2.2.2", Key: "/skydns/com/other/www"}))
+
+	exists, err := backend.Exists(ctx, "/skydns/com")
+	require.NoError(t, err)
+	assert.False(t, exists, "out-of-zone services are ignored")
+	empty, err := backend.IsEmpty(ctx)
+	require.NoError(t, err)
+	assert.True(t, empty, "out-of-zone services are ignored")
+
+	require.NoError(t, inner.SaveService(ctx, &Service{Host: "1.1.1.1", Key: "/skydns/com/example/www"}))
+	exists, err = backend.Exists(ctx, "/skydns/com")
+	require.NoError(t, err)
+	assert.True(t, exists)
+}
+
+func TestNewCoreDNSProvider_WrapsFilteringBackend(t *testing.T) {
+	testutils.TestHelperEnvSetter(t, map[string]string{"COREDNS_BACKEND": "memory"})
+
+	p, err := NewCoreDNSProvider(endpoint.NewDomainFilter([]string{"example.com"}), "/skydns/", false)
+	require.NoError(t, err)
+
+	cp, ok := p.(coreDNSProvider)
+	require.True(t, ok)
+	_, ok = cp.client.(*FilteringBackend)
+	assert.True(t, ok)
+}
@@ -0,0 +1,303 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package coredns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// ErrLimitExceeded is returned when a write would cross a configured limit
+var ErrLimitExceeded = errors.New("backend limit exceeded")
+
+// Limits configures a LimitedBackend. Zero values disable the corresponding limit.
+type Limits struct {
+	// MaxRecords caps the total number of stored records.
+	MaxRecords int
+
+	// MaxValueBytes caps the encoded size of a single record.
+	MaxValueBytes int
+
+	// Codec measures the encoded size of records. If nil, DefaultCodec is used.
+	Codec Codec
+
+	// Prefix is the root relative keys are resolved against.
+	// If empty, DefaultPrefix is used.
+	Prefix string
+
+	// Keys is the scheme of stored keys. The zero value separates labels with "/".
+	Keys KeyScheme
+}
+
+// LimitedBackend wraps a Backend and rejects writes that would exceed a
+// maximum number of records or a maximum record size, protecting shared
+// stores from a runaway source.
+//
+// The stored keys are loaded from a snapshot on the first write and tracked
+// from then on; writes are serialized so concurrent saves can't both take
+// the last free slot. Records written by other processes after the snapshot
+// aren't counted.
+type LimitedBackend struct {
+	backend Backend
+	limits  Limits
+	codec   Codec
+	prefix  string
+
+	mu   sync.Mutex
+	keys map[string]struct{} // nil until loaded
+}
+
+// Compile-time check that LimitedBackend implements Backend
+var _ Backend = (*LimitedBackend)(nil)
+
+// NewLimitedBackend wraps backend so that writes are checked against limits.
+func NewLimitedBackend(backend Backend, limits Limits) *LimitedBackend {
+	return &LimitedBackend{
+		backend: backend,
+		limits:  limits,
+		codec:   codecOrDefault(limits.Codec),
+		prefix:  limits.Keys.normalizePrefix(limits.Prefix),
+	}
+}
+
+// loadKeys fetches the stored keys if they haven't been loaded yet.
+// The caller must hold l.mu.
+func (l *LimitedBackend) loadKeys(ctx context.Context) error {
+	if l.keys != nil {
+		return nil
+	}
+	snapshot, err := l.backend.Snapshot(ctx)
+	if err != nil {
+		return err
+	}
+	l.keys = make(map[string]struct{}, len(snapshot))
+	for key := range snapshot {
+		l.keys[key] = struct{}{}
+	}
+	return nil
+}
+
+// GetServices delegates to the wrapped backend.
+func (l *LimitedBackend) GetServices(ctx context.Context, prefix string) ([]*Service, error) {
+	return l.backend.GetServices(ctx, prefix)
+}
+
+// GetServicesWithOptions delegates to the wrapped backend.
+func (l *LimitedBackend) GetServicesWithOptions(ctx context.Context, prefix string, opts GetServicesOptions) ([]*Service, error) {
+	return l.backend.GetServicesWithOptions(ctx, prefix, opts)
+}
+
+// GetServicesByType delegates to the wrapped backend.
+func (l *LimitedBackend) GetServicesByType(ctx context.Context, prefix, recordType string) ([]*Service, error) {
+	return l.backend.GetServicesByType(ctx, prefix, recordType)
+}
+
+// GetServicesBySource delegates to the wrapped backend.
+func (l *LimitedBackend) GetServicesBySource(ctx context.Context, prefix, source string) ([]*Service, error) {
+	return l.backend.GetServicesBySource(ctx, prefix, source)
+}
+
+// ForEach delegates to the wrapped backend.
+func (l *LimitedBackend) ForEach(ctx context.Context, prefix string, fn func(key string, svc *Service) error) error {
+	return l.backend.ForEach(ctx, prefix, fn)
+}
+
+// StreamKeys delegates to the wrapped backend.
+func (l *LimitedBackend) StreamKeys(ctx context.Context, prefix string, fn func(key string) error) error {
+	return StreamKeys(ctx, l.backend, prefix, fn)
+}
+
+// GetServicesPage delegates to the wrapped backend.
+func (l *LimitedBackend) GetServicesPage(ctx context.Context, prefix, afterKey string, limit int) ([]*Service, string, error) {
+	return l.backend.GetServicesPage(ctx, prefix, afterKey, limit)
+}
+
+// Exists delegates to the wrapped backend.
+func (l *LimitedBackend) Exists(ctx context.Context, prefix string) (bool, error) {
+	return l.backend.Exists(ctx, prefix)
+}
+
+// IsEmpty delegates to the wrapped backend.
+func (l *LimitedBackend) IsEmpty(ctx context.Context) (bool, error) {
+	return IsEmpty(ctx, l.backend)
+}
+
+// Snapshot delegates to the wrapped backend.
+func (l *LimitedBackend) Snapshot(ctx context.Context) (map[string]Service, error) {
+	return l.backend.Snapshot(ctx)
+}
+
+// SaveService saves the service unless it is larger than MaxValueBytes or
+// it is a new record and MaxRecords are already stored.
+func (l *LimitedBackend) SaveService(ctx context.Context, service *Service) error {
+	_, err := l.save(ctx, service, func() (bool, error) {
+		return true, l.backend.SaveService(ctx, service)
+	})
+	return err
+}
+
+// SaveServiceWithPolicy saves the service according to policy, with the
+// limits of SaveService.
+func (l *LimitedBackend) SaveServiceWithPolicy(ctx context.Context, service *Service, policy ConflictPolicy) (bool, error) {
+	return l.save(ctx, service, func() (bool, error) {
+		return SaveServiceWithPolicy(ctx, l.backend, service, policy)
+	})
+}
+
+// save checks the limits for service, then calls write, tracking the key if
+// it reports the service written.
+func (l *LimitedBackend) save(ctx context.Context, service *Service, write func() (bool, error)) (bool, error) {
+	if err := l.checkSize(service); err != nil {
+		return false, err
+	}
+
+	if l.limits.MaxRecords <= 0 {
+		return write()
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.loadKeys(ctx); err != nil {
+		return false, err
+	}
+	key := l.limits.Keys.resolveKey(l.prefix, service.Key)
+	_, exists := l.keys[key]
+	if !exists && len(l.keys) >= l.limits.MaxRecords {
+		return false, fmt.Errorf("%w: refusing to save %s, %d records stored", ErrLimitExceeded, key, len(l.keys))
+	}
+	written, err := write()
+	if err != nil {
+		return false, err
+	}
+	if written {
+		l.keys[key] = struct{}{}
+	}
+	return written, nil
+}
+
+// UpdateService updates the service if its encoded size is within the limit.
+// The key is already stored, so the record count doesn't change.
+func (l *LimitedBackend) UpdateService(ctx context.Context, service *Service) error {
+	if err := l.checkSize(service); err != nil {
+		return err
+	}
+	return UpdateService(ctx, l.backend, service)
+}
+
+// checkSize rejects with ErrLimitExceeded the services whose encoded size
+// exceeds MaxValueBytes.
+func (l *LimitedBackend) checkSize(service *Service) error {
+	if l.limits.MaxValueBytes <= 0 {
+		return nil
+	}
+	value, err := l.codec.Marshal(service)
+	if err != nil {
+		return err
+	}
+	if len(value) > l.limits.MaxValueBytes {
+		return fmt.Errorf("%w: value of %s is %d bytes, limit is %d", ErrLimitExceeded, service.Key, len(value), l.limits.MaxValueBytes)
+	}
+	return nil
+}
+
+// DeleteService deletes the key and its children from the wrapped backend.
+func (l *LimitedBackend) DeleteService(ctx context.Context, key string) error {
+	if l.limits.MaxRecords <= 0 {
+		return l.backend.DeleteService(ctx, key)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.backend.DeleteService(ctx, key); err != nil {
+		return err
+	}
+	l.forgetLocked(key)
+	return nil
+}
+
+// ClearPrefix clears the prefix in the wrapped backend.
+func (l *LimitedBackend) ClearPrefix(ctx context.Context, prefix string) error {
+	if l.limits.MaxRecords <= 0 {
+		return l.backend.ClearPrefix(ctx, prefix)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.backend.ClearPrefix(ctx, prefix); err != nil {
+		return err
+	}
+	l.forgetLocked(prefix)
+	return nil
+}
+
+// deleteIfCovered deletes the key and its children from the wrapped backend
+// if covered accepts all of them.
+func (l *LimitedBackend) deleteIfCovered(ctx context.Context, key string, covered func(key string) bool) (bool, error) {
+	if l.limits.MaxRecords <= 0 {
+		return deleteIfCovered(ctx, l.backend, key, covered)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	deleted, err := deleteIfCovered(ctx, l.backend, key, covered)
+	if deleted {
+		l.forgetLocked(key)
+	}
+	return deleted, err
+}
+
+// forgetLocked stops counting the deleted key and its children.
+// The caller must hold l.mu.
+func (l *LimitedBackend) forgetLocked(key string) {
+	key = l.limits.Keys.resolveKey(l.prefix, key)
+	for k := range l.keys {
+		if l.limits.Keys.isUnder(k, key) {
+			delete(l.keys, k)
+		}
+	}
+}
+
+// Flush flushes the wrapped backend.
+func (l *LimitedBackend) Flush(ctx context.Context) error {
+	return l.backend.Flush(ctx)
+}
+
+// Close closes the wrapped backend.
+func (l *LimitedBackend) Close() error {
+	return l.backend.Close()
+}
+
+// Health reports the health of the wrapped backend.
+func (l *LimitedBackend) Health(ctx context.Context) error {
+	return checkHealth(ctx, l.backend)
+}
+
+// Capabilities reports the capabilities of the wrapped backend, except Watch.
+func (l *LimitedBackend) Capabilities() BackendCapabilities {
+	return decoratorCapabilities(l.backend)
+}
+
+// Unwrap returns the wrapped backend.
+func (l *LimitedBackend) Unwrap() Backend {
+	return l.backend
+}
@@ -0,0 +1,138 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package coredns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"sigs.k8s.io/external-dns/internal/testutils"
+)
+
+func TestLimitedBackend_MaxRecords(t *testing.T) {
+	inner := NewMemoryBackend()
+	ctx := context.Background()
+	require.NoError(t, inner.SaveService(ctx, &Service{Host: "1.1.1.1", Key: "/skydns/com/example/existing"}))
+
+	backend := NewLimitedBackend(inner, Limits{MaxRecords: 2})
+	defer backend.Close()
+
+	require.NoError(t, backend.SaveService(ctx, &Service{Host: "2.2.2.2", Key: "/skydns/com/example/www"}))
+
+	err := backend.SaveService(ctx, &Service{Host: "3.3.3.3", Key: "/skydns/com/example/api"})
+	assert.ErrorIs(t, err, ErrLimitExceeded)
+	assert.Equal(t, 2, inner.Count())
+
+	// Overwriting an existing record doesn't take a new slot
+	require.NoError(t, backend.SaveService(ctx, &Service{Host: "4.4.4.4", Key: "/skydns/com/example/www"}))
+
+	// Deleting frees a slot
+	require.NoError(t, backend.DeleteService(ctx, "/skydns/com/example/existing"))
+	require.NoError(t, backend.SaveService(ctx, &Service{Host: "3.3.3.3", Key: "/skydns/com/example/api"}))
+	assert.Equal(t, []string{"/skydns/com/example/api", "/skydns/com/example/www"}, inner.Keys())
+}
+
+func TestLimitedBackend_SaveServiceWithPolicy(t *testing.T) {
+	inner := NewMemoryBackend()
+	backend := NewLimitedBackend(inner, Limits{MaxRecords: 1, MaxValueBytes: 64})
+	defer backend.Close()
+
+	ctx := context.Background()
+	skip := ConflictPolicy{Mode: ConflictSkipIfExists}
+	written, err := backend.SaveServiceWithPolicy(ctx, &Service{Host: "1.1.1.1", Key: "/skydns/com/example/www"}, skip)
+	require.NoError(t, err)
+	assert.True(t, written)
+
+	// A skipped write to a stored key is within the limits
+	written, err = backend.SaveServiceWithPolicy(ctx, &Service{Host: "2.2.2.2", Key: "/skydns/com/example/www"}, skip)
+	require.NoError(t, err)
+	assert.False(t, written)
+
+	_, err = backend.SaveServiceWithPolicy(ctx, &Service{Host: "3.3.3.3", Key: "/skydns/com/example/api"}, skip)
+	assert.ErrorIs(t, err, ErrLimitExceeded)
+
+	_, err = backend.SaveServiceWithPolicy(ctx, &Service{Host: "1.1.1.1", Key: "/skydns/com/example/www", Text: strings.Repeat("x", 64)}, ConflictPolicy{})
+	assert.ErrorIs(t, err, ErrLimitExceeded)
+	assert.Equal(t, []string{"/skydns/com/example/www"}, inner.Keys())
+}
+
+func TestLimitedBackend_MaxRecordsConcurrent(t *testing.T) {
+	inner := NewMemoryBackend()
+	backend := NewLimitedBackend(inner, Limits{MaxRecords: 5})
+	defer backend.Close()
+
+	ctx := context.Background()
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var rejected int
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			err := backend.SaveService(ctx, &Service{Host: "1.2.3.4", Key: fmt.Sprintf("/skydns/com/example/host%d", i)})
+			if errors.Is(err, ErrLimitExceeded) {
+				mu.Lock()
+				rejected++
+				mu.Unlock()
+			} else {
+				assert.NoError(t, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	assert.Equal(t, 5, inner.Count())
+	assert.Equal(t, 15, rejected)
+}
+
+func TestLimitedBackend_MaxValueBytes(t *testing.T) {
+	inner := NewMemoryBackend()
+	backend := NewLimitedBackend(inner, Limits{MaxValueBytes: 64})
+	defer backend.Close()
+
+	ctx := context.Background()
+	require.NoError(t, backend.SaveService(ctx, &Service{Text: "small", Key: "/skydns/com/example/small"}))
+
+	err := backend.SaveService(ctx, &Service{Text: strings.Repeat("x", 100), Key: "/skydns/com/example/large"})
+	assert.ErrorIs(t, err, ErrLimitExceeded)
+	assert.Contains(t, err.Error(), "/skydns/com/example/large")
+	assert.Equal(t, []string{"/skydns/com/example/small"}, inner.Keys())
+}
+
+func TestNewBackend_LimitsFromEnv(t *testing.T) {
+	testutils.TestHelperEnvSetter(t, map[string]string{
+		"COREDNS_BACKEND":         "memory",
+		"COREDNS_MAX_RECORDS":     "10",
+		"COREDNS_MAX_VALUE_BYTES": "512",
+	})
+
+	backend, err := NewBackend(nil)
+	require.NoError(t, err)
+	defer backend.Close()
+
+	limited, ok := backend.(*LimitedBackend)
+	require.True(t, ok)
+	assert.Equal(t, 10, limited.limits.MaxRecords)
+	assert.Equal(t, 512, limited.limits.MaxValueBytes)
+}
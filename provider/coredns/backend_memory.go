@@ -18,13 +18,47 @@ package coredns
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"maps"
+	"os"
+	"path/filepath"
 	"sort"
-	"strings"
 	"sync"
-
-	log "github.com/sirupsen/logrus"
+	"sync/atomic"
+	"time"
+	"unsafe"
 )
 
+// memoryShardCount is the number of independently locked shards of a MemoryBackend.
+const memoryShardCount = 16
+
+// memoryShardDepth is the number of labels below the backend prefix that
+// select a key's shard. With a depth of 2, every key under
+// /skydns/com/example lives in the same shard, so a zone is served by a
+// single lock while unrelated zones don't contend.
+const memoryShardDepth = 2
+
+// memoryShard holds the services whose shard key hashes to it.
+type memoryShard struct {
+	mu       sync.RWMutex
+	services map[string]Service
+
+	// modTimes records when each key was last saved
+	modTimes map[string]time.Time
+
+	// usage is the estimated size of the services (see MemoryUsage)
+	usage int64
+}
+
+// memoryEntry is a stored key along with the shard holding it.
+type memoryEntry struct {
+	key   string
+	shard *memoryShard
+}
+
 // MemoryBackend implements Backend using an in-memory map.
 // This is ideal for:
 //   - Testing: Fast, no external dependencies
@@ -32,27 +66,151 @@ import (
 //   - Ephemeral deployments: When persistence isn't needed
 //   - CI/CD pipelines: Isolated, reproducible tests
 //
-// Note: Data is lost when the process exits.
+// The map is sharded by zone, each shard with its own lock, so that a long
+// read of one zone doesn't block writes to another.
+//
+// Note: Data is lost when the process exits, unless the backend was created
+// with NewPersistentMemoryBackend.
 type MemoryBackend struct {
-	mu       sync.RWMutex
-	services map[string]Service
+	shards [memoryShardCount]memoryShard
+	closed atomic.Bool
+
+	// prefix is the root relative keys are resolved against
+	prefix string
+
+	// keys is the scheme of stored keys
+	keys KeyScheme
+
+	// defaults applied to read services, DefaultServiceDefaults if nil
+	defaults ServiceDefaults
+
+	// clock tells the time saves are stamped with, SystemClock if nil
+	clock Clock
+
+	// persistPath is the snapshot file written on Close (empty disables persistence)
+	persistPath string
+
+	// collapsed counts the duplicates reads dropped, per prefix read
+	collapsedMu sync.Mutex
+	collapsed   map[string]uint64
 }
 
 // Compile-time check that MemoryBackend implements Backend
 var _ Backend = (*MemoryBackend)(nil)
 
+// MemoryOptions configures a MemoryBackend.
+type MemoryOptions struct {
+	// Prefix is the root relative keys are resolved against.
+	// If empty, DefaultPrefix is used.
+	Prefix string
+
+	// Keys is the scheme of stored keys. The zero value separates labels with "/".
+	Keys KeyScheme
+
+	// Defaults are applied to the services read, unless
+	// GetServicesOptions.Raw is set. If nil, DefaultServiceDefaults is used.
+	Defaults ServiceDefaults
+
+	// Clock tells the time saves are stamped with, which Reap and
+	// GetChangedSince go by. If nil, SystemClock is used.
+	Clock Clock
+}
+
 // NewMemoryBackend creates a new in-memory backend.
 func NewMemoryBackend() *MemoryBackend {
+	return NewMemoryBackendWithPrefix(DefaultPrefix)
+}
+
+// NewMemoryBackendWithPrefix creates a new in-memory backend that resolves
+// relative keys against prefix (DefaultPrefix if empty).
+func NewMemoryBackendWithPrefix(prefix string) *MemoryBackend {
+	return NewMemoryBackendWithOptions(MemoryOptions{Prefix: prefix})
+}
+
+// NewMemoryBackendWithClock creates a new in-memory backend that stamps
+// saves with the time told by clock, which Reap and GetChangedSince go by.
+func NewMemoryBackendWithClock(clock Clock) *MemoryBackend {
+	return NewMemoryBackendWithOptions(MemoryOptions{Clock: clock})
+}
+
+// NewMemoryBackendWithOptions creates a new in-memory backend configured by opts.
+func NewMemoryBackendWithOptions(opts MemoryOptions) *MemoryBackend {
 	log.Info("Memory backend initialized (data will not persist)")
-	return &MemoryBackend{
-		services: make(map[string]Service),
+	return newMemoryBackend(opts)
+}
+
+// NewPersistentMemoryBackend creates an in-memory backend that is loaded from
+// the JSON snapshot at path and written back to it on Close.
+// If the file doesn't exist, the backend starts empty.
+func NewPersistentMemoryBackend(path string) (*MemoryBackend, error) {
+	return NewPersistentMemoryBackendWithOptions(path, MemoryOptions{})
+}
+
+// NewPersistentMemoryBackendWithOptions is NewPersistentMemoryBackend with
+// the backend configured by opts.
+func NewPersistentMemoryBackendWithOptions(path string, opts MemoryOptions) (*MemoryBackend, error) {
+	services := make(map[string]Service)
+
+	data, err := os.ReadFile(path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		// Nothing persisted yet
+	case err != nil:
+		return nil, err
+	default:
+		if err := json.Unmarshal(data, &services); err != nil {
+			return nil, err
+		}
+	}
+
+	m := newMemoryBackend(opts)
+	m.persistPath = path
+
+	// Loaded services count as changed at load time
+	now := m.now()
+	for key, svc := range services {
+		shard := m.shardFor(key)
+		shard.services[key] = svc
+		shard.modTimes[key] = now
+		shard.usage += memoryEntrySize(key, svc)
 	}
+
+	log.Infof("Memory backend initialized from %s (%d services)", path, len(services))
+	return m, nil
+}
+
+// newMemoryBackend returns an empty backend with its shards allocated.
+func newMemoryBackend(opts MemoryOptions) *MemoryBackend {
+	m := &MemoryBackend{
+		prefix:   opts.Keys.normalizePrefix(opts.Prefix),
+		keys:     opts.Keys,
+		defaults: opts.Defaults,
+		clock:    opts.Clock,
+	}
+	m.resetShards()
+	return m
 }
 
-// GetServices retrieves all services matching the given key prefix.
+// now returns the current time as told by the backend's clock.
+func (m *MemoryBackend) now() time.Time {
+	return clockOrDefault(m.clock).Now()
+}
+
+// GetServices retrieves all services matching the given key prefix, in key order.
 func (m *MemoryBackend) GetServices(ctx context.Context, prefix string) ([]*Service, error) {
-	m.mu.RLock()
-	defer m.mu.RUnlock()
+	return m.GetServicesWithOptions(ctx, prefix, GetServicesOptions{})
+}
+
+// GetServicesWithOptions retrieves all services matching the given key prefix
+// in key order, deduplicated and with default priorities unless opts.Raw is set.
+func (m *MemoryBackend) GetServicesWithOptions(ctx context.Context, prefix string, opts GetServicesOptions) ([]*Service, error) {
+	if m.closed.Load() {
+		return nil, ErrBackendClosed
+	}
+
+	if err := m.keys.validatePrefix(m.prefix, prefix); err != nil {
+		return nil, err
+	}
 
 	// Check context cancellation
 	select {
@@ -61,48 +219,36 @@ func (m *MemoryBackend) GetServices(ctx context.Context, prefix string) ([]*Serv
 	default:
 	}
 
-	// Deduplication map (same logic as etcd/sqlite backends)
-	seen := make(map[Service]bool)
-	var services []*Service
-
-	for key, svc := range m.services {
-		if !strings.HasPrefix(key, prefix) {
-			continue
-		}
-
-		// Create a copy with the key set
-		svcCopy := svc
-		svcCopy.Key = key
-
-		// Deduplicate based on content
-		dedupKey := Service{
-			Host:     svc.Host,
-			Port:     svc.Port,
-			Priority: svc.Priority,
-			Weight:   svc.Weight,
-			Text:     svc.Text,
-			Key:      key,
-		}
-		if seen[dedupKey] {
-			continue
-		}
-		seen[dedupKey] = true
+	// Collected in key order so results, and the surviving duplicate, are deterministic
+	prefix = m.keys.resolveKey(m.prefix, prefix)
+	all := m.collect(prefix, nil)
+	if opts.Raw {
+		return all, nil
+	}
 
-		// Default priority if not set
-		if svcCopy.Priority == 0 {
-			svcCopy.Priority = priority
-		}
+	// Deduplicate based on the DNS answer the service produces
+	services := m.keys.dedupServices(all)
+	m.recordCollapsed(prefix, len(all)-len(services))
 
-		services = append(services, &svcCopy)
-	}
+	// Default priority and weight if not set
+	serviceDefaultsOrDefault(m.defaults).applyTo(m.keys, services)
 
 	return services, nil
 }
 
 // SaveService persists a service record to memory.
 func (m *MemoryBackend) SaveService(ctx context.Context, service *Service) error {
-	m.mu.Lock()
-	defer m.mu.Unlock()
+	if m.closed.Load() {
+		return ErrBackendClosed
+	}
+	if err := service.Validate(); err != nil {
+		return err
+	}
+
+	key := m.keys.resolveKey(m.prefix, service.Key)
+	shard := m.shardFor(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
 
 	// Check context cancellation
 	select {
@@ -111,18 +257,245 @@ func (m *MemoryBackend) SaveService(ctx context.Context, service *Service) error
 	default:
 	}
 
+	shard.storeLocked(key, service, m.now())
+	return nil
+}
+
+// UpdateService replaces the service stored at the service's key, failing
+// with ErrNotFound if there is none, unlike SaveService.
+func (m *MemoryBackend) UpdateService(ctx context.Context, service *Service) error {
+	if m.closed.Load() {
+		return ErrBackendClosed
+	}
+	if err := service.Validate(); err != nil {
+		return err
+	}
+
+	key := m.keys.resolveKey(m.prefix, service.Key)
+	shard := m.shardFor(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if _, exists := shard.services[key]; !exists {
+		return fmt.Errorf("%w: no service stored at %s", ErrNotFound, key)
+	}
+	shard.storeLocked(key, service, m.now())
+	return nil
+}
+
+// SaveServiceWithPolicy saves the service unless policy says the stored one
+// wins, and reports whether it was written. Newest-wins compares the policy
+// timestamp with the time the key was last saved.
+func (m *MemoryBackend) SaveServiceWithPolicy(ctx context.Context, service *Service, policy ConflictPolicy) (bool, error) {
+	if err := policy.validate(); err != nil {
+		return false, err
+	}
+	if policy.Mode == ConflictOverwrite {
+		return true, m.SaveService(ctx, service)
+	}
+	if m.closed.Load() {
+		return false, ErrBackendClosed
+	}
+	if err := service.Validate(); err != nil {
+		return false, err
+	}
+
+	key := m.keys.resolveKey(m.prefix, service.Key)
+	shard := m.shardFor(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+
+	ts := policy.timestamp(m.now)
+	if _, exists := shard.services[key]; exists {
+		if policy.Mode == ConflictSkipIfExists || !ts.After(shard.modTimes[key]) {
+			return false, nil
+		}
+	}
+	shard.storeLocked(key, service, ts)
+	return true, nil
+}
+
+// storeLocked stores a copy of service under key. The caller must hold s.mu.
+func (s *memoryShard) storeLocked(key string, service *Service, modTime time.Time) {
 	// Store a copy without the Key field (Key is metadata, not data)
 	svcCopy := *service
 	svcCopy.Key = ""
-	m.services[service.Key] = svcCopy
+	if previous, ok := s.services[key]; ok {
+		s.usage -= memoryEntrySize(key, previous)
+	}
+	s.services[key] = svcCopy
+	s.modTimes[key] = modTime
+	s.usage += memoryEntrySize(key, svcCopy)
+}
+
+// GetChangedSince returns the services matching the given key prefix that
+// were saved after since, in key order. Services are returned as stored,
+// without deduplication, so that every changed key is reported.
+func (m *MemoryBackend) GetChangedSince(ctx context.Context, prefix string, since time.Time) ([]*Service, error) {
+	if m.closed.Load() {
+		return nil, ErrBackendClosed
+	}
+	if err := m.keys.validatePrefix(m.prefix, prefix); err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	return m.collect(m.keys.resolveKey(m.prefix, prefix), func(key string, shard *memoryShard) bool {
+		return shard.modTimes[key].After(since)
+	}), nil
+}
+
+// GetServicesByType retrieves the services matching the given key prefix that
+// produce a record of the given type.
+func (m *MemoryBackend) GetServicesByType(ctx context.Context, prefix, recordType string) ([]*Service, error) {
+	services, err := m.GetServices(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	return filterServicesByType(services, recordType), nil
+}
+
+// GetServicesBySource retrieves the services matching the given key prefix
+// that were created by the given source.
+func (m *MemoryBackend) GetServicesBySource(ctx context.Context, prefix, source string) ([]*Service, error) {
+	services, err := m.GetServices(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	return filterServicesBySource(services, source), nil
+}
+
+// ForEach calls fn for each service matching the given key prefix, in key
+// order. The read locks of the shards the prefix spans are held for the
+// whole iteration.
+func (m *MemoryBackend) ForEach(ctx context.Context, prefix string, fn func(key string, svc *Service) error) error {
+	if m.closed.Load() {
+		return ErrBackendClosed
+	}
+	if err := m.keys.validatePrefix(m.prefix, prefix); err != nil {
+		return err
+	}
+
+	prefix = m.keys.resolveKey(m.prefix, prefix)
+	shards := m.shardsFor(prefix)
+	for _, shard := range shards {
+		shard.mu.RLock()
+		defer shard.mu.RUnlock()
+	}
+
+	for _, entry := range sortedEntries(m.keys, shards, prefix) {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		svcCopy := entry.shard.services[entry.key]
+		svcCopy.Key = entry.key
+		if err := fn(entry.key, &svcCopy); err != nil {
+			return err
+		}
+	}
 
 	return nil
 }
 
+// StreamKeys calls fn with each key under prefix in key order, stopping at
+// the first error or when ctx is done. The keys are sorted before the first
+// call, so fn may use the backend.
+func (m *MemoryBackend) StreamKeys(ctx context.Context, prefix string, fn func(key string) error) error {
+	if m.closed.Load() {
+		return ErrBackendClosed
+	}
+	if err := m.keys.validatePrefix(m.prefix, prefix); err != nil {
+		return err
+	}
+
+	prefix = m.keys.resolveKey(m.prefix, prefix)
+	shards := m.shardsFor(prefix)
+	for _, shard := range shards {
+		shard.mu.RLock()
+	}
+	entries := sortedEntries(m.keys, shards, prefix)
+	for _, shard := range shards {
+		shard.mu.RUnlock()
+	}
+
+	for _, entry := range entries {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fn(entry.key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetServicesPage returns up to limit services matching the given key prefix
+// whose key sorts after afterKey, in key order.
+func (m *MemoryBackend) GetServicesPage(ctx context.Context, prefix, afterKey string, limit int) ([]*Service, string, error) {
+	if m.closed.Load() {
+		return nil, "", ErrBackendClosed
+	}
+	if err := m.keys.validatePrefix(m.prefix, prefix); err != nil {
+		return nil, "", err
+	}
+	if limit <= 0 {
+		return nil, "", ErrInvalidPageLimit
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, "", err
+	}
+
+	page := m.collect(m.keys.resolveKey(m.prefix, prefix), func(key string, _ *memoryShard) bool {
+		return key > afterKey
+	})
+	if len(page) > limit {
+		page = page[:limit]
+	}
+
+	return page, nextCursor(page, limit), nil
+}
+
+// Exists reports whether any service matches the given key prefix,
+// stopping at the first match.
+func (m *MemoryBackend) Exists(ctx context.Context, prefix string) (bool, error) {
+	if m.closed.Load() {
+		return false, ErrBackendClosed
+	}
+	if err := m.keys.validatePrefix(m.prefix, prefix); err != nil {
+		return false, err
+	}
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+
+	prefix = m.keys.resolveKey(m.prefix, prefix)
+	for _, shard := range m.shardsFor(prefix) {
+		if shard.hasPrefix(m.keys, prefix) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
 // DeleteService removes all services matching the key prefix.
 func (m *MemoryBackend) DeleteService(ctx context.Context, key string) error {
-	m.mu.Lock()
-	defer m.mu.Unlock()
+	if m.closed.Load() {
+		return ErrBackendClosed
+	}
+
+	if err := m.keys.validatePrefix(m.prefix, key); err != nil {
+		return err
+	}
 
 	// Check context cancellation
 	select {
@@ -131,56 +504,429 @@ func (m *MemoryBackend) DeleteService(ctx context.Context, key string) error {
 	default:
 	}
 
-	// Delete exact match and all children (prefix-based delete like etcd)
-	for k := range m.services {
-		if k == key || strings.HasPrefix(k, key+"/") {
-			delete(m.services, k)
+	// Delete exact match and all children (prefix-based delete like etcd).
+	// The exact key always lives in the same shard as its children.
+	key = m.keys.resolveKey(m.prefix, key)
+	for _, shard := range m.shardsFor(key + m.keys.sep()) {
+		shard.mu.Lock()
+		for k := range shard.services {
+			if m.keys.isUnder(k, key) {
+				shard.usage -= memoryEntrySize(k, shard.services[k])
+				delete(shard.services, k)
+				delete(shard.modTimes, k)
+			}
 		}
+		shard.mu.Unlock()
 	}
 
 	return nil
 }
 
-// Close is a no-op for memory backend but satisfies the Backend interface.
+// deleteIfCovered deletes key and its children if covered accepts all of
+// them, holding the locks of the shards involved across the check and the
+// delete.
+func (m *MemoryBackend) deleteIfCovered(ctx context.Context, key string, covered func(key string) bool) (bool, error) {
+	if m.closed.Load() {
+		return false, ErrBackendClosed
+	}
+	if err := m.keys.validatePrefix(m.prefix, key); err != nil {
+		return false, err
+	}
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+
+	key = m.keys.resolveKey(m.prefix, key)
+	shards := m.shardsFor(key + m.keys.sep())
+	// shardsFor lists shards in a fixed order, so the locks can't deadlock
+	for _, shard := range shards {
+		shard.mu.Lock()
+		defer shard.mu.Unlock()
+	}
+	for _, shard := range shards {
+		for k := range shard.services {
+			if m.keys.isUnder(k, key) && !covered(k) {
+				return false, nil
+			}
+		}
+	}
+	for _, shard := range shards {
+		for k := range shard.services {
+			if m.keys.isUnder(k, key) {
+				shard.usage -= memoryEntrySize(k, shard.services[k])
+				delete(shard.services, k)
+				delete(shard.modTimes, k)
+			}
+		}
+	}
+	return true, nil
+}
+
+// ClearPrefix removes every service under prefix, refusing the root prefix.
+func (m *MemoryBackend) ClearPrefix(ctx context.Context, prefix string) error {
+	if err := m.keys.validateClearPrefix(m.prefix, prefix); err != nil {
+		return err
+	}
+	return m.DeleteService(ctx, prefix)
+}
+
+// Flush writes the snapshot file of a persistent backend, so that writes
+// survive a crash before Close. It is a no-op for non-persistent backends.
+func (m *MemoryBackend) Flush(ctx context.Context) error {
+	if m.closed.Load() {
+		return ErrBackendClosed
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if m.persistPath == "" {
+		return nil
+	}
+	return m.persist()
+}
+
+// Capabilities reports that the memory backend has no optional features.
+// It is persistent only when created with NewPersistentMemoryBackend.
+func (m *MemoryBackend) Capabilities() BackendCapabilities {
+	return BackendCapabilities{Persistent: m.persistPath != ""}
+}
+
+// shardKey returns the part of key that selects its shard: the backend
+// prefix and up to memoryShardDepth labels below it (see zoneKey).
+func (m *MemoryBackend) shardKey(key string) (shardKey string, complete bool) {
+	return m.keys.zoneKey(m.prefix, key, memoryShardDepth)
+}
+
+// shardFor returns the shard holding key.
+func (m *MemoryBackend) shardFor(key string) *memoryShard {
+	shardKey, _ := m.shardKey(key)
+	h := fnv.New32a()
+	h.Write([]byte(shardKey))
+	return &m.shards[h.Sum32()%memoryShardCount]
+}
+
+// shardsFor returns the shards that may hold keys addressed by prefix:
+// a single shard when the prefix is below the shard depth, all of them otherwise.
+func (m *MemoryBackend) shardsFor(prefix string) []*memoryShard {
+	if _, complete := m.shardKey(m.keys.childPrefix(prefix)); complete {
+		return []*memoryShard{m.shardFor(prefix)}
+	}
+	shards := make([]*memoryShard, memoryShardCount)
+	for i := range m.shards {
+		shards[i] = &m.shards[i]
+	}
+	return shards
+}
+
+// collect returns copies of the services whose key is addressed by prefix and
+// that satisfy keep (all of them if nil), in key order. Each shard is read
+// under its own lock, so a scan over the whole store never blocks writers
+// of more than one shard at a time.
+func (m *MemoryBackend) collect(prefix string, keep func(key string, shard *memoryShard) bool) []*Service {
+	var services []*Service
+	for _, shard := range m.shardsFor(prefix) {
+		shard.mu.RLock()
+		matches := func(key string) bool {
+			return m.keys.inPrefix(key, prefix) && (keep == nil || keep(key, shard))
+		}
+		// Copied into one slice per shard, sized by a first pass, rather
+		// than allocated one by one
+		n := 0
+		for key := range shard.services {
+			if matches(key) {
+				n++
+			}
+		}
+		values := make([]Service, 0, n)
+		for key, svc := range shard.services {
+			if matches(key) {
+				svc.Key = key
+				values = append(values, svc)
+			}
+		}
+		shard.mu.RUnlock()
+		for i := range values {
+			services = append(services, &values[i])
+		}
+	}
+	if services == nil {
+		services = []*Service{}
+	}
+	sort.Slice(services, func(i, j int) bool {
+		return services[i].Key < services[j].Key
+	})
+	return services
+}
+
+// sortedEntries returns the keys addressed by prefix stored in shards,
+// sorted. The caller must hold the shards' locks.
+func sortedEntries(keys KeyScheme, shards []*memoryShard, prefix string) []memoryEntry {
+	var entries []memoryEntry
+	for _, shard := range shards {
+		for key := range shard.services {
+			if keys.inPrefix(key, prefix) {
+				entries = append(entries, memoryEntry{key: key, shard: shard})
+			}
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].key < entries[j].key
+	})
+	return entries
+}
+
+// hasPrefix reports whether the shard holds a key addressed by prefix.
+func (s *memoryShard) hasPrefix(keys KeyScheme, prefix string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for key := range s.services {
+		if keys.inPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// resetShards replaces the maps of every shard with empty ones.
+func (m *MemoryBackend) resetShards() {
+	for i := range m.shards {
+		shard := &m.shards[i]
+		shard.mu.Lock()
+		shard.services = make(map[string]Service)
+		shard.modTimes = make(map[string]time.Time)
+		shard.usage = 0
+		shard.mu.Unlock()
+	}
+}
+
+// Health reports whether the backend is still open.
+func (m *MemoryBackend) Health(_ context.Context) error {
+	if m.closed.Load() {
+		return ErrBackendClosed
+	}
+	return nil
+}
+
+// Close marks the memory backend as closed. Stored data is kept so that
+// debugging helpers (Count, Keys) keep working after Close.
+// For persistent backends, the snapshot is written to disk.
 func (m *MemoryBackend) Close() error {
+	if !m.closed.CompareAndSwap(false, true) {
+		return nil
+	}
+	if m.persistPath == "" {
+		return nil
+	}
+	return m.persist()
+}
+
+// persist atomically writes a snapshot of all services to persistPath.
+// The snapshot is written to a temporary file in the same directory and
+// renamed into place so a crash never leaves a partially-written file.
+func (m *MemoryBackend) persist() error {
+	snapshot := m.snapshot("")
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(m.persistPath)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, filepath.Base(m.persistPath)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), m.persistPath); err != nil {
+		return err
+	}
+
+	log.Infof("Memory backend persisted %d services to %s", len(snapshot), m.persistPath)
 	return nil
 }
 
 // Count returns the number of services stored (useful for testing/debugging).
 func (m *MemoryBackend) Count() int {
-	m.mu.RLock()
-	defer m.mu.RUnlock()
-	return len(m.services)
+	count := 0
+	for i := range m.shards {
+		shard := &m.shards[i]
+		shard.mu.RLock()
+		count += len(shard.services)
+		shard.mu.RUnlock()
+	}
+	return count
+}
+
+// MemoryStats describes the contents of a MemoryBackend.
+type MemoryStats struct {
+	// Services is the number of stored services.
+	Services int
+
+	// MemoryUsage is the estimated size of the stored data in bytes (see
+	// MemoryBackend.MemoryUsage).
+	MemoryUsage int64
+
+	// DedupCollapsed is the number of services reads dropped as duplicates
+	// of another service's DNS answer, per prefix read.
+	DedupCollapsed map[string]uint64
+}
+
+// Stats returns the number of stored services, their estimated size and the
+// duplicates dropped by reads.
+func (m *MemoryBackend) Stats() MemoryStats {
+	m.collapsedMu.Lock()
+	collapsed := maps.Clone(m.collapsed)
+	m.collapsedMu.Unlock()
+	return MemoryStats{
+		Services:       m.Count(),
+		MemoryUsage:    m.MemoryUsage(),
+		DedupCollapsed: collapsed,
+	}
+}
+
+// recordCollapsed reports that a read of prefix dropped n duplicates.
+func (m *MemoryBackend) recordCollapsed(prefix string, n int) {
+	if n <= 0 {
+		return
+	}
+	recordCollapsed(prefix, n)
+	m.collapsedMu.Lock()
+	defer m.collapsedMu.Unlock()
+	if m.collapsed == nil {
+		m.collapsed = make(map[string]uint64)
+	}
+	m.collapsed[prefix] += uint64(n)
+}
+
+// MemoryUsage returns a rough estimate in bytes of the memory used by the
+// stored services: the sum of the key lengths, of the sizes of the Service
+// structs and of the lengths of their strings. It is maintained on every
+// write rather than computed from the stored services.
+func (m *MemoryBackend) MemoryUsage() int64 {
+	var usage int64
+	for i := range m.shards {
+		shard := &m.shards[i]
+		shard.mu.RLock()
+		usage += shard.usage
+		shard.mu.RUnlock()
+	}
+	return usage
+}
+
+// memoryEntrySize estimates the memory used by the service stored at key
+// from the lengths of its fields, so that writes don't pay for encoding it.
+func memoryEntrySize(key string, svc Service) int64 {
+	return int64(len(key)) + int64(unsafe.Sizeof(svc)) +
+		int64(len(svc.Host)+len(svc.Text)+len(svc.Group)+len(svc.Source)+len(svc.SetIdentifier)+len(svc.RawType)+len(svc.RawData))
+}
+
+// IsEmpty reports whether no service is stored.
+func (m *MemoryBackend) IsEmpty(ctx context.Context) (bool, error) {
+	if m.closed.Load() {
+		return false, ErrBackendClosed
+	}
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	return m.Count() == 0, nil
+}
+
+// rootPrefix returns the prefix addressing every stored service.
+func (m *MemoryBackend) rootPrefix() string {
+	return m.prefix + m.keys.sep()
+}
+
+// keyScheme returns the scheme of the stored keys.
+func (m *MemoryBackend) keyScheme() KeyScheme {
+	return m.keys
 }
 
 // Keys returns all stored keys sorted (useful for testing/debugging).
 func (m *MemoryBackend) Keys() []string {
-	m.mu.RLock()
-	defer m.mu.RUnlock()
-
-	keys := make([]string, 0, len(m.services))
-	for k := range m.services {
-		keys = append(keys, k)
+	services := m.collect("", nil)
+	keys := make([]string, len(services))
+	for i, svc := range services {
+		keys[i] = svc.Key
 	}
-	sort.Strings(keys)
 	return keys
 }
 
+// Reap deletes the services whose TTL has elapsed since they were last saved
+// and returns how many were deleted. Services with a zero TTL never expire.
+func (m *MemoryBackend) Reap(ctx context.Context) (int, error) {
+	if m.closed.Load() {
+		return 0, ErrBackendClosed
+	}
+
+	now := m.now()
+	reaped := 0
+	for i := range m.shards {
+		if err := ctx.Err(); err != nil {
+			return reaped, err
+		}
+		shard := &m.shards[i]
+		shard.mu.Lock()
+		for key, svc := range shard.services {
+			if svc.TTL == 0 || !shard.modTimes[key].Add(time.Duration(svc.TTL)*time.Second).Before(now) {
+				continue
+			}
+			shard.usage -= memoryEntrySize(key, svc)
+			delete(shard.services, key)
+			delete(shard.modTimes, key)
+			reaped++
+		}
+		shard.mu.Unlock()
+	}
+	return reaped, nil
+}
+
 // Clear removes all services (useful for testing).
 func (m *MemoryBackend) Clear() {
-	m.mu.Lock()
-	defer m.mu.Unlock()
-	m.services = make(map[string]Service)
+	m.resetShards()
 }
 
-// Snapshot returns a copy of all services (useful for debugging).
-func (m *MemoryBackend) Snapshot() map[string]Service {
-	m.mu.RLock()
-	defer m.mu.RUnlock()
+// Snapshot returns a point-in-time copy of the services stored under the
+// backend's root prefix, keyed by their key. The copy is taken under the
+// read locks of all shards.
+func (m *MemoryBackend) Snapshot(ctx context.Context) (map[string]Service, error) {
+	if m.closed.Load() {
+		return nil, ErrBackendClosed
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return m.snapshot(m.rootPrefix()), nil
+}
 
-	snapshot := make(map[string]Service, len(m.services))
-	for k, v := range m.services {
-		snapshot[k] = v
+// snapshot copies the services stored under prefix, all of them if it is
+// empty, holding the read locks of all shards so that the copy is consistent.
+func (m *MemoryBackend) snapshot(prefix string) map[string]Service {
+	for i := range m.shards {
+		m.shards[i].mu.RLock()
+		defer m.shards[i].mu.RUnlock()
+	}
+
+	snapshot := make(map[string]Service)
+	for i := range m.shards {
+		for k, v := range m.shards[i].services {
+			if m.keys.inPrefix(k, prefix) {
+				snapshot[k] = v
+			}
+		}
 	}
 	return snapshot
 }
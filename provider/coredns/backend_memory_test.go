@@ -18,9 +18,16 @@ package coredns
 
 import (
 	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
@@ -194,18 +201,16 @@ func TestMemoryBackend_DefaultPriority(t *testing.T) {
 
 	ctx := context.Background()
 
-	// Save a service without priority
-	svc := &Service{
-		Host: "1.2.3.4",
-		Key:  "/skydns/com/example/www",
-	}
-	require.NoError(t, backend.SaveService(ctx, svc))
+	// Save SRV and A services without priority
+	require.NoError(t, backend.SaveService(ctx, &Service{Host: "target.example.com", Port: 443, Key: "/skydns/com/example/_https/_tcp"}))
+	require.NoError(t, backend.SaveService(ctx, &Service{Host: "1.2.3.4", Key: "/skydns/com/example/www"}))
 
-	// Retrieve and verify default priority is set
+	// Retrieve and verify the default priority is only set on the SRV record
 	services, err := backend.GetServices(ctx, "/skydns/com/example")
 	require.NoError(t, err)
-	require.Len(t, services, 1)
+	require.Len(t, services, 2)
 	assert.Equal(t, priority, services[0].Priority) // priority = 10
+	assert.Zero(t, services[1].Priority)
 }
 
 func TestMemoryBackend_TXTRecords(t *testing.T) {
@@ -278,8 +283,10 @@ func TestMemoryBackend_Snapshot(t *testing.T) {
 	require.NoError(t, backend.SaveService(ctx, svc))
 
 	// Get snapshot
-	snapshot := backend.Snapshot()
+	snapshot, err := backend.Snapshot(ctx)
+	require.NoError(t, err)
 	assert.Len(t, snapshot, 1)
+	assert.Equal(t, "1.2.3.4", snapshot["/skydns/com/example/www"].Host)
 
 	// Verify snapshot is a copy (modifying it doesn't affect backend)
 	delete(snapshot, "/skydns/com/example/www")
@@ -370,7 +377,7 @@ func TestMemoryBackend_ContextCancellation(t *testing.T) {
 	_, err := backend.GetServices(ctx, "/skydns/")
 	assert.ErrorIs(t, err, context.Canceled)
 
-	err = backend.SaveService(ctx, &Service{Key: "/test"})
+	err = backend.SaveService(ctx, &Service{Host: "1.2.3.4", Key: "/test"})
 	assert.ErrorIs(t, err, context.Canceled)
 
 	err = backend.DeleteService(ctx, "/test")
@@ -445,3 +452,466 @@ func TestGetBackendType_Memory(t *testing.T) {
 		})
 	}
 }
+
+func TestMemoryBackend_CloseIdempotent(t *testing.T) {
+	backend := NewMemoryBackend()
+
+	assert.NoError(t, backend.Close())
+	assert.NoError(t, backend.Close())
+}
+
+func TestMemoryBackend_UseAfterClose(t *testing.T) {
+	backend := NewMemoryBackend()
+	require.NoError(t, backend.Close())
+
+	ctx := context.Background()
+
+	_, err := backend.GetServices(ctx, "/skydns/")
+	assert.ErrorIs(t, err, ErrBackendClosed)
+
+	err = backend.SaveService(ctx, &Service{Host: "1.2.3.4", Key: "/skydns/com/example/www"})
+	assert.ErrorIs(t, err, ErrBackendClosed)
+
+	err = backend.DeleteService(ctx, "/skydns/com/example/www")
+	assert.ErrorIs(t, err, ErrBackendClosed)
+}
+
+func TestPersistentMemoryBackend_MissingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "memory.json")
+
+	backend, err := NewPersistentMemoryBackend(path)
+	require.NoError(t, err)
+	assert.Equal(t, 0, backend.Count())
+	require.NoError(t, backend.Close())
+
+	// Close writes a snapshot even if the store is empty
+	_, err = os.Stat(path)
+	assert.NoError(t, err)
+}
+
+func TestPersistentMemoryBackend_RestoreOnReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "memory.json")
+	ctx := context.Background()
+
+	backend, err := NewPersistentMemoryBackend(path)
+	require.NoError(t, err)
+
+	services := []*Service{
+		{Host: "1.1.1.1", TTL: 300, Group: "blue", Key: "/skydns/com/example/www"},
+		{Text: "heritage=external-dns", TTL: 60, Key: "/skydns/com/example/txt"},
+	}
+	for _, svc := range services {
+		require.NoError(t, backend.SaveService(ctx, svc))
+	}
+	before, err := backend.Snapshot(ctx)
+	require.NoError(t, err)
+	require.NoError(t, backend.Close())
+
+	// No temporary files are left behind
+	entries, err := os.ReadDir(filepath.Dir(path))
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+
+	reopened, err := NewPersistentMemoryBackend(path)
+	require.NoError(t, err)
+	defer reopened.Close()
+
+	after, err := reopened.Snapshot(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, before, after)
+
+	result, err := reopened.GetServices(ctx, "/skydns/com/example/www")
+	require.NoError(t, err)
+	require.Len(t, result, 1)
+	assert.Equal(t, "1.1.1.1", result[0].Host)
+	assert.Equal(t, uint32(300), result[0].TTL)
+	assert.Equal(t, "blue", result[0].Group)
+}
+
+func TestPersistentMemoryBackend_CorruptFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "memory.json")
+	require.NoError(t, os.WriteFile(path, []byte("not-json"), 0644))
+
+	_, err := NewPersistentMemoryBackend(path)
+	assert.Error(t, err)
+}
+
+func TestNewBackend_PersistentMemory(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "memory.json")
+
+	backend, err := NewBackend(&BackendConfig{Type: BackendTypeMemory, MemoryPath: path})
+	require.NoError(t, err)
+	require.NoError(t, backend.SaveService(context.Background(), &Service{Host: "1.2.3.4", Key: "/skydns/com/example/www"}))
+	require.NoError(t, backend.Close())
+
+	_, err = os.Stat(path)
+	assert.NoError(t, err)
+}
+
+func TestMemoryBackend_DedupSameAnswerDifferentSuffix(t *testing.T) {
+	backend := NewMemoryBackend()
+	defer backend.Close()
+
+	ctx := context.Background()
+
+	// Same Host stored under two suffix keys of www.example.com
+	for _, key := range []string{"/skydns/com/example/www/aaaa", "/skydns/com/example/www/bbbb"} {
+		require.NoError(t, backend.SaveService(ctx, &Service{Host: "1.2.3.4", TargetStrip: 1, Key: key}))
+	}
+
+	provider := NewCoreDNSProviderWithBackend(&endpoint.DomainFilter{}, "/skydns/", false, backend)
+	records, err := provider.Records(ctx)
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	assert.Equal(t, "www.example.com", records[0].DNSName)
+	assert.Equal(t, []string{"1.2.3.4"}, []string(records[0].Targets))
+
+	// A distinct target under the same name must survive
+	require.NoError(t, backend.SaveService(ctx, &Service{Host: "5.6.7.8", TargetStrip: 1, Key: "/skydns/com/example/www/cccc"}))
+	// The same Host under a different name must survive
+	require.NoError(t, backend.SaveService(ctx, &Service{Host: "1.2.3.4", TargetStrip: 1, Key: "/skydns/com/example/api/dddd"}))
+
+	services, err := backend.GetServices(ctx, "/skydns/com/example/www")
+	require.NoError(t, err)
+	require.Len(t, services, 2)
+	assert.Equal(t, "/skydns/com/example/www/aaaa", services[0].Key, "the first key in order survives")
+	assert.Equal(t, "1.2.3.4", services[0].Host)
+	assert.Equal(t, "5.6.7.8", services[1].Host)
+
+	records, err = provider.Records(ctx)
+	require.NoError(t, err)
+
+	targets := make(map[string][]string)
+	for _, ep := range records {
+		targets[ep.DNSName] = ep.Targets
+	}
+	assert.ElementsMatch(t, []string{"1.2.3.4", "5.6.7.8"}, targets["www.example.com"])
+	assert.Equal(t, []string{"1.2.3.4"}, []string(targets["api.example.com"]))
+}
+
+func TestMemoryBackend_GetChangedSince(t *testing.T) {
+	backend := NewMemoryBackend()
+	defer backend.Close()
+
+	ctx := context.Background()
+	require.NoError(t, backend.SaveService(ctx, &Service{Host: "1.1.1.1", Key: "/skydns/com/example/a"}))
+	require.NoError(t, backend.SaveService(ctx, &Service{Host: "2.2.2.2", Key: "/skydns/com/example/b"}))
+	require.NoError(t, backend.SaveService(ctx, &Service{Host: "3.3.3.3", Key: "/skydns/com/example/c"}))
+
+	since := time.Now()
+	require.NoError(t, backend.SaveService(ctx, &Service{Host: "4.4.4.4", Key: "/skydns/com/example/d"}))
+	require.NoError(t, backend.SaveService(ctx, &Service{Host: "1.1.1.2", Key: "/skydns/com/example/a"}))
+	require.NoError(t, backend.SaveService(ctx, &Service{Host: "5.5.5.5", Key: "/skydns/org/other/e"}))
+	require.NoError(t, backend.DeleteService(ctx, "/skydns/com/example/c"))
+
+	changed, err := backend.GetChangedSince(ctx, "/skydns/com", since)
+	require.NoError(t, err)
+	require.Len(t, changed, 2)
+	assert.Equal(t, "/skydns/com/example/a", changed[0].Key)
+	assert.Equal(t, "1.1.1.2", changed[0].Host)
+	assert.Equal(t, "/skydns/com/example/d", changed[1].Key)
+
+	all, err := backend.GetChangedSince(ctx, "/skydns/", time.Time{})
+	require.NoError(t, err)
+	assert.Len(t, all, 4)
+
+	none, err := backend.GetChangedSince(ctx, "/skydns/", time.Now())
+	require.NoError(t, err)
+	assert.Empty(t, none)
+}
+
+func TestMemoryBackend_Reap(t *testing.T) {
+	clock := newFakeClock()
+	backend := NewMemoryBackendWithClock(clock)
+	defer backend.Close()
+
+	ctx := context.Background()
+	require.NoError(t, backend.SaveService(ctx, &Service{Host: "1.1.1.1", TTL: 60, Key: "/skydns/com/example/short"}))
+	require.NoError(t, backend.SaveService(ctx, &Service{Host: "2.2.2.2", TTL: 3600, Key: "/skydns/com/example/long"}))
+	require.NoError(t, backend.SaveService(ctx, &Service{Host: "3.3.3.3", Key: "/skydns/com/example/forever"}))
+
+	clock.Advance(time.Minute)
+	reaped, err := backend.Reap(ctx)
+	require.NoError(t, err)
+	assert.Zero(t, reaped, "a TTL that just elapsed hasn't expired yet")
+
+	clock.Advance(time.Second)
+	reaped, err = backend.Reap(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, reaped)
+	assert.Equal(t, []string{"/skydns/com/example/forever", "/skydns/com/example/long"}, backend.Keys())
+
+	// Saving again restarts the TTL
+	require.NoError(t, backend.SaveService(ctx, &Service{Host: "2.2.2.3", TTL: 3600, Key: "/skydns/com/example/long"}))
+	clock.Advance(time.Hour)
+	reaped, err = backend.Reap(ctx)
+	require.NoError(t, err)
+	assert.Zero(t, reaped)
+
+	clock.Advance(time.Second)
+	reaped, err = backend.Reap(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, reaped)
+	assert.Equal(t, []string{"/skydns/com/example/forever"}, backend.Keys())
+	assert.Equal(t, memoryEntrySize("/skydns/com/example/forever", Service{Host: "3.3.3.3"}), backend.MemoryUsage())
+
+	changed, err := backend.GetChangedSince(ctx, "/skydns/", clock.Now())
+	require.NoError(t, err)
+	assert.Empty(t, changed)
+
+	require.NoError(t, backend.Close())
+	_, err = backend.Reap(ctx)
+	assert.ErrorIs(t, err, ErrBackendClosed)
+}
+
+func TestMemoryBackend_DeterministicOrder(t *testing.T) {
+	backend := NewMemoryBackend()
+	defer backend.Close()
+
+	ctx := context.Background()
+	keys := []string{
+		"/skydns/org/other/www",
+		"/skydns/com/example/www",
+		"/skydns/com/example/api/b",
+		"/skydns/com/example/api/a",
+		"/skydns/net/example/mail",
+		"/skydns/com/example/_sip/_tcp",
+	}
+	for i, key := range keys {
+		require.NoError(t, backend.SaveService(ctx, &Service{Host: fmt.Sprintf("10.0.0.%d", i+1), Key: key}))
+	}
+
+	first, err := backend.GetServices(ctx, "/skydns/")
+	require.NoError(t, err)
+	second, err := backend.GetServices(ctx, "/skydns/")
+	require.NoError(t, err)
+	assert.Equal(t, first, second)
+
+	sorted := slices.Clone(keys)
+	slices.Sort(sorted)
+	got := make([]string, 0, len(first))
+	for _, svc := range first {
+		got = append(got, svc.Key)
+	}
+	assert.Equal(t, sorted, got)
+
+	var visited []string
+	require.NoError(t, backend.ForEach(ctx, "/skydns/", func(key string, _ *Service) error {
+		visited = append(visited, key)
+		return nil
+	}))
+	assert.Equal(t, sorted, visited)
+}
+
+func TestMemoryBackend_ShardedConcurrentWrites(t *testing.T) {
+	ctx := context.Background()
+	backend := NewMemoryBackend()
+	defer backend.Close()
+
+	zones := []string{"com/example", "com/other", "org/example", "net/example", "io/test"}
+	const perZone = 200
+
+	var wg sync.WaitGroup
+	for _, zone := range zones {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < perZone; i++ {
+				key := fmt.Sprintf("/skydns/%s/host%03d", zone, i)
+				assert.NoError(t, backend.SaveService(ctx, &Service{Key: key, Host: "10.0.0.1"}))
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for i := 0; i < perZone; i++ {
+				_, err := backend.GetServices(ctx, "/skydns/")
+				assert.NoError(t, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, len(zones)*perZone, backend.Count())
+	for _, zone := range zones {
+		services, err := backend.GetServicesWithOptions(ctx, "/skydns/"+zone+"/", GetServicesOptions{Raw: true})
+		require.NoError(t, err)
+		assert.Len(t, services, perZone, zone)
+	}
+}
+
+func TestMemoryBackend_PrefixSpanningShards(t *testing.T) {
+	ctx := context.Background()
+	backend := NewMemoryBackend()
+	defer backend.Close()
+
+	keys := []string{
+		"/skydns/com",
+		"/skydns/com/example",
+		"/skydns/com/example/www",
+		"/skydns/com/example2/www",
+		"/skydns/com/other/www",
+		"/skydns/org/example/www",
+	}
+	for _, key := range keys {
+		require.NoError(t, backend.SaveService(ctx, &Service{Key: key, Text: key}))
+	}
+
+	for _, tc := range []struct {
+		prefix string
+		want   []string
+	}{
+		{"/skydns/", keys},
+		{"/skydns/com", keys[:5]},
+		{"/skydns/com/example", keys[1:3]},
+		{"/skydns/com/example/", keys[1:3]},
+		{"/skydns//com/example/", keys[1:3]},
+		{"/skydns/org/", keys[5:]},
+	} {
+		services, err := backend.GetServicesWithOptions(ctx, tc.prefix, GetServicesOptions{Raw: true})
+		require.NoError(t, err)
+		got := make([]string, 0, len(services))
+		for _, svc := range services {
+			got = append(got, svc.Key)
+		}
+		assert.Equal(t, tc.want, got, tc.prefix)
+
+		exists, err := backend.Exists(ctx, tc.prefix)
+		require.NoError(t, err)
+		assert.True(t, exists, tc.prefix)
+	}
+
+	require.NoError(t, backend.DeleteService(ctx, "/skydns/com/example"))
+	assert.Equal(t, []string{
+		"/skydns/com",
+		"/skydns/com/example2/www",
+		"/skydns/com/other/www",
+		"/skydns/org/example/www",
+	}, backend.Keys())
+
+	require.NoError(t, backend.DeleteService(ctx, "/skydns/com"))
+	assert.Equal(t, []string{"/skydns/org/example/www"}, backend.Keys())
+}
+
+func BenchmarkMemoryBackend_ConcurrentZones(b *testing.B) {
+	ctx := context.Background()
+	backend := NewMemoryBackend()
+	defer backend.Close()
+
+	const zones = 64
+	for z := 0; z < zones; z++ {
+		for i := 0; i < 100; i++ {
+			key := fmt.Sprintf("/skydns/com/zone%02d/host%03d", z, i)
+			require.NoError(b, backend.SaveService(ctx, &Service{Key: key, Host: "10.0.0.1"}))
+		}
+	}
+
+	var next atomic.Int64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		zone := fmt.Sprintf("/skydns/com/zone%02d/", next.Add(1)%zones)
+		i := 0
+		for pb.Next() {
+			if i%4 == 0 {
+				_ = backend.SaveService(ctx, &Service{Key: fmt.Sprintf("%shost%03d", zone, i%100), Host: "10.0.0.2"})
+			} else {
+				_, _ = backend.GetServices(ctx, zone)
+			}
+			i++
+		}
+	})
+}
+
+func TestPersistentMemoryBackend_Flush(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dns.json")
+	backend, err := NewPersistentMemoryBackend(path)
+	require.NoError(t, err)
+	defer backend.Close()
+
+	ctx := context.Background()
+	require.NoError(t, backend.SaveService(ctx, &Service{Host: "1.2.3.4", Key: "/skydns/com/example/www"}))
+	_, err = os.Stat(path)
+	require.ErrorIs(t, err, os.ErrNotExist, "writes are buffered until Flush")
+
+	require.NoError(t, backend.Flush(ctx))
+
+	// A crash now loses nothing: the file holds every write
+	restored, err := NewPersistentMemoryBackend(path)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"/skydns/com/example/www"}, restored.Keys())
+}
+
+func TestMemoryBackend_FlushNonPersistent(t *testing.T) {
+	backend := NewMemoryBackend()
+	require.NoError(t, backend.Flush(context.Background()))
+	require.NoError(t, backend.Close())
+	assert.ErrorIs(t, backend.Flush(context.Background()), ErrBackendClosed)
+}
+
+func TestMemoryBackend_MemoryUsage(t *testing.T) {
+	backend := NewMemoryBackend()
+	defer backend.Close()
+
+	ctx := context.Background()
+	assert.Zero(t, backend.MemoryUsage())
+
+	www := &Service{Host: "1.2.3.4", Key: "/skydns/com/example/www"}
+	require.NoError(t, backend.SaveService(ctx, www))
+	one := backend.MemoryUsage()
+	assert.Equal(t, memoryEntrySize(www.Key, Service{Host: "1.2.3.4"}), one)
+
+	require.NoError(t, backend.SaveService(ctx, &Service{Host: "5.6.7.8", Key: "/skydns/org/example/api"}))
+	two := backend.MemoryUsage()
+	assert.Greater(t, two, one)
+
+	// Overwriting a key replaces its size instead of adding to it
+	require.NoError(t, backend.SaveService(ctx, &Service{Host: "1.2.3.4", Text: "a longer value", Key: "/skydns/com/example/www"}))
+	three := backend.MemoryUsage()
+	assert.Equal(t, two+int64(len("a longer value")), three)
+
+	require.NoError(t, backend.DeleteService(ctx, "/skydns/org"))
+	assert.Less(t, backend.MemoryUsage(), three)
+	require.NoError(t, backend.DeleteService(ctx, "/skydns/com"))
+	assert.Zero(t, backend.MemoryUsage())
+
+	require.NoError(t, backend.SaveService(ctx, www))
+	assert.Equal(t, MemoryStats{Services: 1, MemoryUsage: one}, backend.Stats())
+	backend.Clear()
+	assert.Equal(t, MemoryStats{}, backend.Stats())
+}
+
+func TestMemoryBackend_DedupCollapsedStats(t *testing.T) {
+	backend := NewMemoryBackend()
+	defer backend.Close()
+
+	ctx := context.Background()
+	require.NoError(t, backend.SaveService(ctx, &Service{Host: "1.2.3.4", Key: "/skydns/com/example/www/a", TargetStrip: 1}))
+	require.NoError(t, backend.SaveService(ctx, &Service{Host: "1.2.3.4", Key: "/skydns/com/example/www/b", TargetStrip: 1}))
+	require.NoError(t, backend.SaveService(ctx, &Service{Host: "5.6.7.8", Key: "/skydns/com/example/www/c", TargetStrip: 1}))
+
+	before := testutil.ToFloat64(dedupCollapsedTotal.Counter)
+	services, err := backend.GetServices(ctx, "/skydns/com/example/www")
+	require.NoError(t, err)
+	assert.Len(t, services, 2)
+
+	assert.Equal(t, map[string]uint64{"/skydns/com/example/www": 1}, backend.Stats().DedupCollapsed)
+	assert.InDelta(t, before+1, testutil.ToFloat64(dedupCollapsedTotal.Counter), 0)
+
+	// Raw reads don't collapse anything
+	_, err = backend.GetServicesWithOptions(ctx, "/skydns/com/example/www", GetServicesOptions{Raw: true})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]uint64{"/skydns/com/example/www": 1}, backend.Stats().DedupCollapsed)
+}
+
+func TestPersistentMemoryBackend_MemoryUsageAfterLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshot.json")
+	backend, err := NewPersistentMemoryBackend(path)
+	require.NoError(t, err)
+	require.NoError(t, backend.SaveService(context.Background(), &Service{Host: "1.2.3.4", Key: "/skydns/com/example/www"}))
+	usage := backend.MemoryUsage()
+	require.NoError(t, backend.Close())
+
+	reloaded, err := NewPersistentMemoryBackend(path)
+	require.NoError(t, err)
+	defer reloaded.Close()
+	assert.Equal(t, usage, reloaded.MemoryUsage())
+}
@@ -0,0 +1,360 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package coredns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultHealthInterval is how often MultiBackend checks its backends when
+// no interval is configured.
+const DefaultHealthInterval = 10 * time.Second
+
+// HealthChecker is implemented by backends that can report whether their
+// underlying store is reachable. Backends that don't implement it are
+// assumed to be healthy.
+type HealthChecker interface {
+	Health(ctx context.Context) error
+}
+
+// checkHealth returns the health of backend, or nil if it can't report it.
+func checkHealth(ctx context.Context, backend Backend) error {
+	if hc, ok := backend.(HealthChecker); ok {
+		return hc.Health(ctx)
+	}
+	return nil
+}
+
+// MultiBackendOptions configures a MultiBackend.
+type MultiBackendOptions struct {
+	// HealthInterval is the delay between health checks of the backends.
+	// Defaults to DefaultHealthInterval.
+	HealthInterval time.Duration
+
+	// MaxConcurrency caps how many backends are called at once by fan-out
+	// operations, the health checks and GetServicesFromAll. Zero or less
+	// calls every backend at once.
+	MaxConcurrency int
+}
+
+// MultiBackend mirrors writes to several backends and serves reads from the
+// first healthy one, in order. The first backend is the primary: reads fail
+// over to the next backends while its health check fails and return to it
+// once it recovers. If no backend is healthy, reads go to the primary.
+type MultiBackend struct {
+	backends       []Backend
+	healthy        []atomic.Bool
+	maxConcurrency int
+
+	health    *backgroundTask
+	closeOnce sync.Once
+}
+
+// Compile-time check that MultiBackend implements Backend
+var _ Backend = (*MultiBackend)(nil)
+
+// NewMultiBackend mirrors writes to backends and routes reads to the first
+// healthy one. At least one backend is required. A background loop checks
+// the health of every backend each opts.HealthInterval until Close.
+func NewMultiBackend(backends []Backend, opts MultiBackendOptions) (*MultiBackend, error) {
+	if len(backends) == 0 {
+		return nil, errors.New("multi backend requires at least one backend")
+	}
+
+	interval := opts.HealthInterval
+	if interval <= 0 {
+		interval = DefaultHealthInterval
+	}
+
+	maxConcurrency := opts.MaxConcurrency
+	if maxConcurrency <= 0 || maxConcurrency > len(backends) {
+		maxConcurrency = len(backends)
+	}
+
+	m := &MultiBackend{
+		backends:       backends,
+		healthy:        make([]atomic.Bool, len(backends)),
+		maxConcurrency: maxConcurrency,
+	}
+	for i := range m.healthy {
+		m.healthy[i].Store(true)
+	}
+
+	m.health = startBackgroundTask("MultiBackend health checker", func(ctx context.Context) {
+		m.healthLoop(ctx, interval)
+	})
+	return m, nil
+}
+
+// healthLoop checks the backends every interval until ctx is done.
+func (m *MultiBackend) healthLoop(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		m.checkBackends(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// checkBackends refreshes the health state of every backend.
+func (m *MultiBackend) checkBackends(ctx context.Context) {
+	m.fanOut(ctx, func(ctx context.Context, i int, backend Backend) error {
+		err := checkHealth(ctx, backend)
+		if ctx.Err() != nil {
+			return nil
+		}
+		wasHealthy := m.healthy[i].Swap(err == nil)
+		switch {
+		case err != nil && wasHealthy:
+			log.Warnf("Backend %d is unhealthy: %v", i, err)
+		case err == nil && !wasHealthy:
+			log.Infof("Backend %d recovered", i)
+		}
+		return nil
+	})
+}
+
+// fanOut calls fn for every backend concurrently, with at most
+// maxConcurrency calls running at once, and returns the error of each call
+// in backend order. Calls that haven't started when ctx is done are skipped
+// and fail with the context's error.
+func (m *MultiBackend) fanOut(ctx context.Context, fn func(ctx context.Context, i int, backend Backend) error) []error {
+	errs := make([]error, len(m.backends))
+	sem := make(chan struct{}, m.maxConcurrency)
+	var wg sync.WaitGroup
+	for i, backend := range m.backends {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if err := ctx.Err(); err != nil {
+			for j := i; j < len(errs); j++ {
+				errs[j] = err
+			}
+			break
+		}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			errs[i] = fn(ctx, i, backend)
+		}()
+	}
+	wg.Wait()
+	return errs
+}
+
+// reader returns the backend reads are routed to.
+func (m *MultiBackend) reader() Backend {
+	for i, backend := range m.backends {
+		if m.healthy[i].Load() {
+			return backend
+		}
+	}
+	return m.backends[0]
+}
+
+// GetServices retrieves services from the first healthy backend.
+func (m *MultiBackend) GetServices(ctx context.Context, prefix string) ([]*Service, error) {
+	return m.reader().GetServices(ctx, prefix)
+}
+
+// GetServicesWithOptions retrieves services from the first healthy backend.
+func (m *MultiBackend) GetServicesWithOptions(ctx context.Context, prefix string, opts GetServicesOptions) ([]*Service, error) {
+	return m.reader().GetServicesWithOptions(ctx, prefix, opts)
+}
+
+// GetServicesByType retrieves services of the given type from the first healthy backend.
+func (m *MultiBackend) GetServicesByType(ctx context.Context, prefix, recordType string) ([]*Service, error) {
+	return m.reader().GetServicesByType(ctx, prefix, recordType)
+}
+
+// GetServicesBySource retrieves services of the given source from the first healthy backend.
+func (m *MultiBackend) GetServicesBySource(ctx context.Context, prefix, source string) ([]*Service, error) {
+	return m.reader().GetServicesBySource(ctx, prefix, source)
+}
+
+// GetServicesFromAll retrieves services from every backend, healthy or not,
+// calling at most MaxConcurrency backends at once. The services of each
+// backend are returned in backend order, with the errors of the failed
+// backends joined.
+func (m *MultiBackend) GetServicesFromAll(ctx context.Context, prefix string) ([][]*Service, error) {
+	results := make([][]*Service, len(m.backends))
+	errs := m.fanOut(ctx, func(ctx context.Context, i int, backend Backend) error {
+		services, err := backend.GetServices(ctx, prefix)
+		if err != nil {
+			return fmt.Errorf("backend %d: %w", i, err)
+		}
+		results[i] = services
+		return nil
+	})
+	return results, errors.Join(errs...)
+}
+
+// ForEach iterates the services of the first healthy backend.
+func (m *MultiBackend) ForEach(ctx context.Context, prefix string, fn func(key string, svc *Service) error) error {
+	return m.reader().ForEach(ctx, prefix, fn)
+}
+
+// StreamKeys streams the keys of the first healthy backend.
+func (m *MultiBackend) StreamKeys(ctx context.Context, prefix string, fn func(key string) error) error {
+	return StreamKeys(ctx, m.reader(), prefix, fn)
+}
+
+// GetServicesPage returns a page of services from the first healthy backend.
+func (m *MultiBackend) GetServicesPage(ctx context.Context, prefix, afterKey string, limit int) ([]*Service, string, error) {
+	return m.reader().GetServicesPage(ctx, prefix, afterKey, limit)
+}
+
+// Exists reports whether the first healthy backend stores services under prefix.
+func (m *MultiBackend) Exists(ctx context.Context, prefix string) (bool, error) {
+	return m.reader().Exists(ctx, prefix)
+}
+
+// IsEmpty reports whether the first healthy backend stores no service.
+func (m *MultiBackend) IsEmpty(ctx context.Context) (bool, error) {
+	return IsEmpty(ctx, m.reader())
+}
+
+// Snapshot returns a copy of the services of the first healthy backend.
+func (m *MultiBackend) Snapshot(ctx context.Context) (map[string]Service, error) {
+	return m.reader().Snapshot(ctx)
+}
+
+// SaveService writes the service to every backend, returning the joined errors.
+func (m *MultiBackend) SaveService(ctx context.Context, service *Service) error {
+	var errs []error
+	for _, backend := range m.backends {
+		if err := backend.SaveService(ctx, service); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// DeleteService deletes the key from every backend, returning the joined errors.
+func (m *MultiBackend) DeleteService(ctx context.Context, key string) error {
+	var errs []error
+	for _, backend := range m.backends {
+		if err := backend.DeleteService(ctx, key); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// SaveServiceWithPolicy saves the service in every backend according to
+// policy, reporting whether any of them wrote it and returning the joined
+// errors.
+func (m *MultiBackend) SaveServiceWithPolicy(ctx context.Context, service *Service, policy ConflictPolicy) (bool, error) {
+	var errs []error
+	written := false
+	for _, backend := range m.backends {
+		ok, err := SaveServiceWithPolicy(ctx, backend, service, policy)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		written = written || ok
+	}
+	return written, errors.Join(errs...)
+}
+
+// UpdateService updates the service in every backend, returning the joined
+// errors.
+func (m *MultiBackend) UpdateService(ctx context.Context, service *Service) error {
+	var errs []error
+	for _, backend := range m.backends {
+		if err := UpdateService(ctx, backend, service); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// ClearPrefix clears the prefix in every backend, returning the joined errors.
+func (m *MultiBackend) ClearPrefix(ctx context.Context, prefix string) error {
+	var errs []error
+	for _, backend := range m.backends {
+		if err := backend.ClearPrefix(ctx, prefix); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Flush flushes every backend, returning the joined errors.
+func (m *MultiBackend) Flush(ctx context.Context) error {
+	var errs []error
+	for _, backend := range m.backends {
+		if err := backend.Flush(ctx); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Health returns nil if at least one backend is healthy.
+func (m *MultiBackend) Health(ctx context.Context) error {
+	var errs []error
+	for _, backend := range m.backends {
+		err := checkHealth(ctx, backend)
+		if err == nil {
+			return nil
+		}
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// Capabilities reports lease support if every backend supports leases, and
+// persistence if any backend is persistent. Writes mirrored to several
+// backends can't be applied atomically, so CAS and transactions are not
+// supported, and Watch is not forwarded.
+func (m *MultiBackend) Capabilities() BackendCapabilities {
+	caps := BackendCapabilities{SupportsLease: true}
+	for _, backend := range m.backends {
+		c := backend.Capabilities()
+		caps.SupportsLease = caps.SupportsLease && c.SupportsLease
+		caps.Persistent = caps.Persistent || c.Persistent
+	}
+	return caps
+}
+
+// Close stops the health checks and closes every backend.
+func (m *MultiBackend) Close() error {
+	m.closeOnce.Do(m.health.stop)
+
+	var errs []error
+	for _, backend := range m.backends {
+		if err := backend.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,165 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package coredns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// unhealthyBackend is a MemoryBackend whose health can be toggled.
+type unhealthyBackend struct {
+	*MemoryBackend
+	down atomic.Bool
+}
+
+func (b *unhealthyBackend) Health(_ context.Context) error {
+	if b.down.Load() {
+		return errors.New("primary is down")
+	}
+	return nil
+}
+
+// countingBackend is a MemoryBackend that tracks how many GetServices calls
+// are running across all backends sharing its counters.
+type countingBackend struct {
+	*MemoryBackend
+	active, peak *atomic.Int32
+}
+
+func (b *countingBackend) GetServices(ctx context.Context, prefix string) ([]*Service, error) {
+	n := b.active.Add(1)
+	defer b.active.Add(-1)
+	for {
+		peak := b.peak.Load()
+		if n <= peak || b.peak.CompareAndSwap(peak, n) {
+			break
+		}
+	}
+	time.Sleep(20 * time.Millisecond)
+	return b.MemoryBackend.GetServices(ctx, prefix)
+}
+
+func TestMultiBackend_FanOutConcurrency(t *testing.T) {
+	ctx := context.Background()
+	var active, peak atomic.Int32
+	backends := make([]Backend, 5)
+	for i := range backends {
+		memory := NewMemoryBackend()
+		require.NoError(t, memory.SaveService(ctx, &Service{Host: fmt.Sprintf("10.0.0.%d", i), Key: "/skydns/com/example/www"}))
+		backends[i] = &countingBackend{MemoryBackend: memory, active: &active, peak: &peak}
+	}
+
+	backend, err := NewMultiBackend(backends, MultiBackendOptions{MaxConcurrency: 2})
+	require.NoError(t, err)
+	defer backend.Close()
+
+	results, err := backend.GetServicesFromAll(ctx, "/skydns/com/example")
+	require.NoError(t, err)
+	require.Len(t, results, len(backends))
+	for i, services := range results {
+		require.Len(t, services, 1)
+		assert.Equal(t, fmt.Sprintf("10.0.0.%d", i), services[0].Host)
+	}
+	assert.LessOrEqual(t, peak.Load(), int32(2))
+	assert.Zero(t, active.Load())
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	peak.Store(0)
+	_, err = backend.GetServicesFromAll(cancelled, "/skydns/com/example")
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Zero(t, peak.Load(), "no backend is called once the context is done")
+}
+
+func TestMultiBackend_FailoverAndFailback(t *testing.T) {
+	primary := &unhealthyBackend{MemoryBackend: NewMemoryBackend()}
+	secondary := NewMemoryBackend()
+
+	backend, err := NewMultiBackend([]Backend{primary, secondary}, MultiBackendOptions{HealthInterval: 10 * time.Millisecond})
+	require.NoError(t, err)
+	defer backend.Close()
+
+	ctx := context.Background()
+	require.NoError(t, backend.SaveService(ctx, &Service{Host: "1.2.3.4", Key: "/skydns/com/example/www"}))
+	assert.Equal(t, 1, primary.Count())
+	assert.Equal(t, 1, secondary.Count())
+
+	// Make the stores diverge so the read source is observable
+	require.NoError(t, primary.SaveService(ctx, &Service{Host: "1.1.1.1", Key: "/skydns/com/example/primary"}))
+	require.NoError(t, secondary.SaveService(ctx, &Service{Host: "2.2.2.2", Key: "/skydns/com/example/secondary"}))
+
+	readsFrom := func(key string) func() bool {
+		return func() bool {
+			services, err := backend.GetServices(ctx, key)
+			return err == nil && len(services) == 1
+		}
+	}
+
+	assert.Eventually(t, readsFrom("/skydns/com/example/primary"), time.Second, 5*time.Millisecond)
+
+	primary.down.Store(true)
+	assert.Eventually(t, readsFrom("/skydns/com/example/secondary"), time.Second, 5*time.Millisecond)
+	require.NoError(t, backend.Health(ctx))
+
+	// Writes still go to every backend while the primary is unhealthy
+	require.NoError(t, backend.SaveService(ctx, &Service{Host: "3.3.3.3", Key: "/skydns/com/example/api"}))
+	assert.Equal(t, 3, primary.Count())
+	assert.Equal(t, 3, secondary.Count())
+
+	primary.down.Store(false)
+	assert.Eventually(t, readsFrom("/skydns/com/example/primary"), time.Second, 5*time.Millisecond)
+}
+
+func TestMultiBackend_WriteErrorsAreJoined(t *testing.T) {
+	closed := NewMemoryBackend()
+	require.NoError(t, closed.Close())
+	open := NewMemoryBackend()
+
+	backend, err := NewMultiBackend([]Backend{closed, open}, MultiBackendOptions{})
+	require.NoError(t, err)
+	defer backend.Close()
+
+	ctx := context.Background()
+	err = backend.SaveService(ctx, &Service{Host: "1.2.3.4", Key: "/skydns/com/example/www"})
+	assert.ErrorIs(t, err, ErrBackendClosed)
+	assert.Equal(t, 1, open.Count())
+
+	assert.ErrorIs(t, backend.DeleteService(ctx, "/skydns/com/example/www"), ErrBackendClosed)
+	assert.Equal(t, 0, open.Count())
+}
+
+func TestMultiBackend_Close(t *testing.T) {
+	_, err := NewMultiBackend(nil, MultiBackendOptions{})
+	require.Error(t, err)
+
+	first, second := NewMemoryBackend(), NewMemoryBackend()
+	backend, err := NewMultiBackend([]Backend{first, second}, MultiBackendOptions{})
+	require.NoError(t, err)
+
+	require.NoError(t, backend.Close())
+	require.NoError(t, backend.Close())
+	assert.ErrorIs(t, first.Health(context.Background()), ErrBackendClosed)
+	assert.ErrorIs(t, second.Health(context.Background()), ErrBackendClosed)
+}
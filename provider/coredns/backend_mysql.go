@@ -0,0 +1,488 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package coredns
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"sync/atomic"
+
+	// Pure Go MySQL driver, registered as "mysql"
+	"github.com/go-sql-driver/mysql"
+)
+
+// mysqlDriverName is the database/sql driver MySQLBackend opens databases with.
+const mysqlDriverName = "mysql"
+
+// MySQLBackend implements Backend on a MySQL or MariaDB database, for
+// deployments that already run one for their stateful services. Services are
+// stored as JSON, in the format of the etcd backend.
+type MySQLBackend struct {
+	db     *sql.DB
+	codec  Codec
+	prefix string
+	keys   KeyScheme
+	closed atomic.Bool
+
+	// defaults applied to read services, DefaultServiceDefaults if nil
+	defaults ServiceDefaults
+}
+
+// MySQLOptions configures a MySQLBackend.
+type MySQLOptions struct {
+	// Prefix is the root relative keys are resolved against.
+	// If empty, DefaultPrefix is used.
+	Prefix string
+
+	// Keys is the scheme of stored keys. The zero value separates labels with "/".
+	Keys KeyScheme
+
+	// Defaults are applied to the services read, unless
+	// GetServicesOptions.Raw is set. If nil, DefaultServiceDefaults is used.
+	Defaults ServiceDefaults
+
+	// Codec used to serialize stored values. If nil, DefaultCodec is used.
+	// The value column is JSON, so the codec must encode services as JSON.
+	Codec Codec
+}
+
+// Compile-time check that MySQLBackend implements Backend
+var _ Backend = (*MySQLBackend)(nil)
+
+// mysqlSchema creates the services table. Keys use a binary collation so
+// they compare and sort byte-wise, like in the other backends.
+const mysqlSchema = "CREATE TABLE IF NOT EXISTS services (" +
+	"`key` VARCHAR(512) CHARACTER SET utf8mb4 COLLATE utf8mb4_bin PRIMARY KEY, " +
+	"value JSON NOT NULL)"
+
+// NewMySQLBackend connects to the database at dsn, in the format of
+// github.com/go-sql-driver/mysql (user:password@tcp(host:3306)/dbname), and
+// creates the services table if it doesn't exist.
+func NewMySQLBackend(dsn string, opts MySQLOptions) (*MySQLBackend, error) {
+	db, err := sql.Open(mysqlDriverName, dsn)
+	if err != nil {
+		return nil, err
+	}
+	return newMySQLBackend(db, opts)
+}
+
+// redactDSN returns dsn with its password masked, for error messages.
+// DSNs that can't be parsed are withheld entirely, as the password can't be
+// located in them.
+func redactDSN(dsn string) string {
+	cfg, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		return "(invalid DSN)"
+	}
+	if cfg.Passwd != "" {
+		cfg.Passwd = "***"
+	}
+	return cfg.FormatDSN()
+}
+
+// newMySQLBackend initializes the schema of an open database and wraps it.
+// The database is closed if initialization fails.
+func newMySQLBackend(db *sql.DB, opts MySQLOptions) (*MySQLBackend, error) {
+	if _, err := db.Exec(mysqlSchema); err != nil {
+		db.Close()
+		return nil, mysqlError(err)
+	}
+
+	log.Info("MySQL backend initialized")
+
+	return &MySQLBackend{
+		db:       db,
+		codec:    codecOrDefault(opts.Codec),
+		prefix:   opts.Keys.normalizePrefix(opts.Prefix),
+		keys:     opts.Keys,
+		defaults: opts.Defaults,
+	}, nil
+}
+
+// mysqlPrefixMatch matches the keys addressed by a prefix, given the
+// arguments returned by prefixArgs.
+const mysqlPrefixMatch = "(`key` = ? OR (`key` >= ? AND `key` < ?))"
+
+// mysqlPrefixQuery selects the rows addressed by a prefix.
+const mysqlPrefixQuery = "SELECT `key`, value FROM services WHERE " + mysqlPrefixMatch
+
+// GetServices retrieves all services matching the given key prefix.
+func (m *MySQLBackend) GetServices(ctx context.Context, prefix string) ([]*Service, error) {
+	return m.GetServicesWithOptions(ctx, prefix, GetServicesOptions{})
+}
+
+// GetServicesWithOptions retrieves all services matching the given key prefix,
+// deduplicated and with default priorities unless opts.Raw is set.
+func (m *MySQLBackend) GetServicesWithOptions(ctx context.Context, prefix string, opts GetServicesOptions) ([]*Service, error) {
+	if m.closed.Load() {
+		return nil, ErrBackendClosed
+	}
+	if err := m.keys.validatePrefix(m.prefix, prefix); err != nil {
+		return nil, err
+	}
+
+	prefix = m.keys.resolveKey(m.prefix, prefix)
+	rows, err := m.db.QueryContext(ctx, mysqlPrefixQuery+" ORDER BY `key`", m.keys.prefixArgs(prefix)...)
+	if err != nil {
+		return nil, mysqlError(err)
+	}
+	defer rows.Close()
+
+	services, err := decodeServiceRows(rows, m.codec, m.keys, m.defaults, opts, prefix)
+	return services, mysqlError(err)
+}
+
+// GetServicesByType retrieves the services under the given key prefix that
+// produce a record of the given type (A, AAAA, CNAME, TXT, SRV, MX).
+func (m *MySQLBackend) GetServicesByType(ctx context.Context, prefix, recordType string) ([]*Service, error) {
+	services, err := m.GetServices(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	return filterServicesByType(services, strings.ToUpper(recordType)), nil
+}
+
+// GetServicesBySource retrieves the services under the given key prefix that
+// were created by the given source.
+func (m *MySQLBackend) GetServicesBySource(ctx context.Context, prefix, source string) ([]*Service, error) {
+	services, err := m.GetServices(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	return filterServicesBySource(services, source), nil
+}
+
+// SaveService persists a service record, replacing the one stored at its key.
+func (m *MySQLBackend) SaveService(ctx context.Context, service *Service) error {
+	if m.closed.Load() {
+		return ErrBackendClosed
+	}
+	if err := service.Validate(); err != nil {
+		return err
+	}
+
+	value, err := m.codec.Marshal(service)
+	if err != nil {
+		return err
+	}
+
+	query := "INSERT INTO services (`key`, value) VALUES (?, ?) ON DUPLICATE KEY UPDATE value = VALUES(value)"
+	_, err = m.db.ExecContext(ctx, query, m.keys.resolveKey(m.prefix, service.Key), string(value))
+	return mysqlError(err)
+}
+
+// ForEach calls fn for each service matching the given key prefix.
+// Rows are decoded one at a time as they are read from the database.
+func (m *MySQLBackend) ForEach(ctx context.Context, prefix string, fn func(key string, svc *Service) error) error {
+	if err := m.keys.validatePrefix(m.prefix, prefix); err != nil {
+		return err
+	}
+	return m.scanRecords(ctx, prefix, func(key string, svc *Service, err error) error {
+		if err != nil {
+			log.Warnf("Failed to unmarshal service at %s: %v", key, err)
+			return nil
+		}
+		return fn(key, svc)
+	})
+}
+
+// StreamKeys calls fn with each key under prefix in key order, as the rows
+// are read, stopping at the first error or when ctx is done.
+func (m *MySQLBackend) StreamKeys(ctx context.Context, prefix string, fn func(key string) error) error {
+	if m.closed.Load() {
+		return ErrBackendClosed
+	}
+	if err := m.keys.validatePrefix(m.prefix, prefix); err != nil {
+		return err
+	}
+
+	query := "SELECT `key` FROM services WHERE " + mysqlPrefixMatch + " ORDER BY `key`"
+	rows, err := m.db.QueryContext(ctx, query, m.keys.prefixArgs(m.keys.resolveKey(m.prefix, prefix))...)
+	if err != nil {
+		return mysqlError(err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return mysqlError(err)
+		}
+		if err := fn(key); err != nil {
+			return err
+		}
+	}
+	return mysqlError(rows.Err())
+}
+
+// scanRecords calls fn for each record under prefix, in key order, with the
+// decoded service or the error decoding it.
+func (m *MySQLBackend) scanRecords(ctx context.Context, prefix string, fn func(key string, svc *Service, err error) error) error {
+	if m.closed.Load() {
+		return ErrBackendClosed
+	}
+
+	rows, err := m.db.QueryContext(ctx, mysqlPrefixQuery+" ORDER BY `key`", m.keys.prefixArgs(m.keys.resolveKey(m.prefix, prefix))...)
+	if err != nil {
+		return mysqlError(err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		var key, value string
+		if err := rows.Scan(&key, &value); err != nil {
+			return mysqlError(err)
+		}
+
+		svc := new(Service)
+		if err := m.codec.Unmarshal([]byte(value), svc); err != nil {
+			if err := fn(key, nil, err); err != nil {
+				return err
+			}
+			continue
+		}
+		svc.Key = key
+
+		if err := fn(key, svc, nil); err != nil {
+			return err
+		}
+	}
+
+	return mysqlError(rows.Err())
+}
+
+// GetServicesPage returns up to limit services matching the given key prefix
+// whose key sorts after afterKey, in key order.
+func (m *MySQLBackend) GetServicesPage(ctx context.Context, prefix, afterKey string, limit int) ([]*Service, string, error) {
+	if m.closed.Load() {
+		return nil, "", ErrBackendClosed
+	}
+	if err := m.keys.validatePrefix(m.prefix, prefix); err != nil {
+		return nil, "", err
+	}
+	if limit <= 0 {
+		return nil, "", ErrInvalidPageLimit
+	}
+
+	query := mysqlPrefixQuery + " AND `key` > ? ORDER BY `key` LIMIT ?"
+	rows, err := m.db.QueryContext(ctx, query, append(m.keys.prefixArgs(m.keys.resolveKey(m.prefix, prefix)), afterKey, limit)...)
+	if err != nil {
+		return nil, "", mysqlError(err)
+	}
+	defer rows.Close()
+
+	page, err := decodeServiceRows(rows, m.codec, m.keys, m.defaults, GetServicesOptions{Raw: true}, prefix)
+	if err != nil {
+		return nil, "", mysqlError(err)
+	}
+	return page, nextCursor(page, limit), nil
+}
+
+// Exists reports whether any service matches the given key prefix.
+func (m *MySQLBackend) Exists(ctx context.Context, prefix string) (bool, error) {
+	if m.closed.Load() {
+		return false, ErrBackendClosed
+	}
+	if err := m.keys.validatePrefix(m.prefix, prefix); err != nil {
+		return false, err
+	}
+
+	var exists bool
+	query := "SELECT EXISTS(SELECT 1 FROM services WHERE " + mysqlPrefixMatch + ")"
+	if err := m.db.QueryRowContext(ctx, query, m.keys.prefixArgs(m.keys.resolveKey(m.prefix, prefix))...).Scan(&exists); err != nil {
+		return false, mysqlError(err)
+	}
+	return exists, nil
+}
+
+// IsEmpty reports whether no service is stored under the backend's root
+// prefix, without counting them.
+func (m *MySQLBackend) IsEmpty(ctx context.Context) (bool, error) {
+	exists, err := m.Exists(ctx, m.rootPrefix())
+	if err != nil {
+		return false, err
+	}
+	return !exists, nil
+}
+
+// rootPrefix returns the prefix addressing every stored service.
+func (m *MySQLBackend) rootPrefix() string {
+	return m.prefix + m.keys.sep()
+}
+
+// keyScheme returns the scheme of the stored keys.
+func (m *MySQLBackend) keyScheme() KeyScheme {
+	return m.keys
+}
+
+// Snapshot returns a copy of all services stored under the backend's root
+// prefix, read inside a single read-only transaction so concurrent writes
+// can't produce a torn view. It fails if a stored value can't be decoded.
+func (m *MySQLBackend) Snapshot(ctx context.Context) (map[string]Service, error) {
+	if m.closed.Load() {
+		return nil, ErrBackendClosed
+	}
+
+	tx, err := m.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return nil, mysqlError(err)
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, mysqlPrefixQuery, m.keys.prefixArgs(m.rootPrefix())...)
+	if err != nil {
+		return nil, mysqlError(err)
+	}
+	defer rows.Close()
+
+	snapshot := make(map[string]Service)
+	for rows.Next() {
+		var key, value string
+		if err := rows.Scan(&key, &value); err != nil {
+			return nil, mysqlError(err)
+		}
+
+		var svc Service
+		if err := m.codec.Unmarshal([]byte(value), &svc); err != nil {
+			return nil, fmt.Errorf("%s: %w", key, err)
+		}
+		snapshot[key] = svc
+	}
+	if err := rows.Err(); err != nil {
+		return nil, mysqlError(err)
+	}
+
+	return snapshot, nil
+}
+
+// DeleteService removes the service at key and all services under it.
+// Children are selected as a key range, which is served by the primary key.
+func (m *MySQLBackend) DeleteService(ctx context.Context, key string) error {
+	if m.closed.Load() {
+		return ErrBackendClosed
+	}
+	if err := m.keys.validatePrefix(m.prefix, key); err != nil {
+		return err
+	}
+
+	query := "DELETE FROM services WHERE " + mysqlPrefixMatch
+	_, err := m.db.ExecContext(ctx, query, m.keys.prefixArgs(m.keys.resolveKey(m.prefix, key))...)
+	return mysqlError(err)
+}
+
+// deleteIfCovered deletes key and its children if covered accepts all of
+// them. The keys are read with SELECT ... FOR UPDATE and deleted in the same
+// transaction; the locks InnoDB takes on the key range block concurrent
+// writes to it until the transaction ends.
+func (m *MySQLBackend) deleteIfCovered(ctx context.Context, key string, covered func(key string) bool) (bool, error) {
+	if m.closed.Load() {
+		return false, ErrBackendClosed
+	}
+	if err := m.keys.validatePrefix(m.prefix, key); err != nil {
+		return false, err
+	}
+
+	args := m.keys.prefixArgs(m.keys.resolveKey(m.prefix, key))
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, mysqlError(err)
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, "SELECT `key` FROM services WHERE "+mysqlPrefixMatch+" FOR UPDATE", args...)
+	if err != nil {
+		return false, mysqlError(err)
+	}
+	all := true
+	for rows.Next() {
+		var k string
+		if err := rows.Scan(&k); err != nil {
+			rows.Close()
+			return false, mysqlError(err)
+		}
+		if !covered(k) {
+			all = false
+			break
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return false, mysqlError(err)
+	}
+	if !all {
+		return false, nil
+	}
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM services WHERE "+mysqlPrefixMatch, args...); err != nil {
+		return false, mysqlError(err)
+	}
+	if err := tx.Commit(); err != nil {
+		return false, mysqlError(err)
+	}
+	return true, nil
+}
+
+// ClearPrefix removes every service under prefix, refusing the root prefix.
+func (m *MySQLBackend) ClearPrefix(ctx context.Context, prefix string) error {
+	if err := m.keys.validateClearPrefix(m.prefix, prefix); err != nil {
+		return err
+	}
+	return m.DeleteService(ctx, prefix)
+}
+
+// Health pings the database.
+func (m *MySQLBackend) Health(ctx context.Context) error {
+	if m.closed.Load() {
+		return ErrBackendClosed
+	}
+	return mysqlError(m.db.PingContext(ctx))
+}
+
+// Flush is a no-op: every write is committed when SaveService or
+// DeleteService returns.
+func (m *MySQLBackend) Flush(_ context.Context) error {
+	if m.closed.Load() {
+		return ErrBackendClosed
+	}
+	return nil
+}
+
+// Capabilities reports that MySQL applies writes in transactions and persists them.
+func (m *MySQLBackend) Capabilities() BackendCapabilities {
+	return BackendCapabilities{
+		SupportsTransactions: true,
+		Persistent:           true,
+	}
+}
+
+// Close closes the database connections. Subsequent calls are no-ops and
+// return nil.
+func (m *MySQLBackend) Close() error {
+	if !m.closed.CompareAndSwap(false, true) {
+		return nil
+	}
+	return m.db.Close()
+}
@@ -0,0 +1,128 @@
+//go:build mysql
+
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package coredns
+
+// Integration tests against a real MySQL or MariaDB server, run with
+//
+//	COREDNS_MYSQL_DSN='user:password@tcp(localhost:3306)/test' go test -tags mysql ./provider/coredns/
+//
+// The services table of the database is emptied by the tests.
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testMySQLDSN returns COREDNS_MYSQL_DSN, skipping the test if it isn't set.
+func testMySQLDSN(t *testing.T) string {
+	dsn := os.Getenv("COREDNS_MYSQL_DSN")
+	if dsn == "" {
+		t.Skip("COREDNS_MYSQL_DSN is not set")
+	}
+	return dsn
+}
+
+// newTestMySQLBackend returns a backend on an empty services table of the
+// database at dsn.
+func newTestMySQLBackend(t *testing.T, dsn string) *MySQLBackend {
+	backend, err := NewMySQLBackend(dsn, MySQLOptions{})
+	require.NoError(t, err)
+	_, err = backend.db.Exec("TRUNCATE TABLE services")
+	require.NoError(t, err)
+	return backend
+}
+
+func TestMySQLBackend_Conformance(t *testing.T) {
+	dsn := testMySQLDSN(t)
+	runBackendConformance(t, func() Backend {
+		return newTestMySQLBackend(t, dsn)
+	})
+}
+
+func TestMySQLBackend_PrefixWildcards(t *testing.T) {
+	backend := newTestMySQLBackend(t, testMySQLDSN(t))
+	defer backend.Close()
+	ctx := context.Background()
+
+	// "_" and "%" in a prefix must match literally
+	require.NoError(t, backend.SaveService(ctx, &Service{Key: "/skydns/com/example/_sip/_tcp", Host: "sip.example.com", Port: 5060}))
+	require.NoError(t, backend.SaveService(ctx, &Service{Key: "/skydns/com/example/xsip/xtcp", Host: "other.example.com", Port: 5060}))
+
+	services, err := backend.GetServices(ctx, "/skydns/com/example/_sip")
+	require.NoError(t, err)
+	require.Len(t, services, 1)
+	assert.Equal(t, "sip.example.com", services[0].Host)
+
+	services, err = backend.GetServices(ctx, "/skydns/com/%")
+	require.NoError(t, err)
+	assert.Empty(t, services)
+}
+
+func TestMySQLBackend_Upsert(t *testing.T) {
+	backend := newTestMySQLBackend(t, testMySQLDSN(t))
+	defer backend.Close()
+	ctx := context.Background()
+
+	require.NoError(t, backend.SaveService(ctx, &Service{Key: "/skydns/com/example/www", Host: "1.1.1.1"}))
+	require.NoError(t, backend.SaveService(ctx, &Service{Key: "/skydns/com/example/www", Host: "2.2.2.2"}))
+
+	snapshot, err := backend.Snapshot(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]Service{"/skydns/com/example/www": {Host: "2.2.2.2"}}, snapshot)
+}
+
+func TestMySQLBackend_Codec(t *testing.T) {
+	backend, err := NewMySQLBackend(testMySQLDSN(t), MySQLOptions{Codec: upperHostCodec{}})
+	require.NoError(t, err)
+	defer backend.Close()
+	_, err = backend.db.Exec("TRUNCATE TABLE services")
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	require.NoError(t, backend.SaveService(ctx, &Service{Key: "/skydns/com/example/www", Host: "www.example.com"}))
+
+	services, err := backend.GetServices(ctx, "/skydns/com/example/www")
+	require.NoError(t, err)
+	require.Len(t, services, 1)
+	assert.Equal(t, "WWW.EXAMPLE.COM", services[0].Host)
+}
+
+func TestMySQLBackend_Snapshot(t *testing.T) {
+	backend := newTestMySQLBackend(t, testMySQLDSN(t))
+	defer backend.Close()
+	ctx := context.Background()
+
+	require.NoError(t, backend.SaveService(ctx, &Service{Key: "/skydns/com/example/www", Host: "1.1.1.1"}))
+	_, err := backend.db.Exec("INSERT INTO services (`key`, value) VALUES (?, ?)", "/other/com/example/www", `{"host":"2.2.2.2"}`)
+	require.NoError(t, err)
+
+	// Keys outside the root prefix belong to other users of the table
+	snapshot, err := backend.Snapshot(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]Service{"/skydns/com/example/www": {Host: "1.1.1.1"}}, snapshot)
+
+	_, err = backend.db.Exec("INSERT INTO services (`key`, value) VALUES (?, ?)", "/skydns/com/example/bad", `{"port":"x"}`)
+	require.NoError(t, err)
+	_, err = backend.Snapshot(ctx)
+	assert.ErrorContains(t, err, "/skydns/com/example/bad")
+}
@@ -0,0 +1,71 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package coredns
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"testing"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRedactDSN(t *testing.T) {
+	assert.Equal(t, "dns:***@tcp(db:3306)/externaldns", redactDSN("dns:secret@tcp(db:3306)/externaldns"))
+	assert.Equal(t, "dns:***@tcp(db:3306)/externaldns", redactDSN("dns:p@ss@tcp(db:3306)/externaldns"))
+	assert.Equal(t, "dns@tcp(db:3306)/externaldns", redactDSN("dns@tcp(db:3306)/externaldns"))
+	// The target is shown with the driver's defaults filled in
+	assert.Equal(t, "tcp(127.0.0.1:3306)/externaldns", redactDSN("/externaldns"))
+	assert.Equal(t, "(invalid DSN)", redactDSN("dns:secret@tcp(db:3306)"))
+}
+
+func TestNewBackend_MySQL(t *testing.T) {
+	// Nothing listens on port 1
+	_, err := NewBackend(&BackendConfig{Type: BackendTypeMySQL, MySQLDSN: "dns:secret@tcp(127.0.0.1:1)/externaldns?timeout=1s"})
+	var backendErr *BackendError
+	require.ErrorAs(t, err, &backendErr)
+	assert.Equal(t, "dns:***@tcp(127.0.0.1:1)/externaldns?timeout=1s", backendErr.Target)
+	assert.ErrorIs(t, err, ErrUnavailable)
+	assert.ErrorContains(t, err, "COREDNS_MYSQL_DSN")
+	assert.NotContains(t, err.Error(), "secret")
+
+	_, err = NewBackend(&BackendConfig{Type: BackendTypeMySQL})
+	assert.ErrorContains(t, err, "set COREDNS_MYSQL_DSN")
+}
+
+func TestMySQLError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want error
+	}{
+		{&mysql.MySQLError{Number: 1062, Message: "Duplicate entry"}, ErrConflict},
+		{&mysql.MySQLError{Number: 1213, Message: "Deadlock found"}, ErrUnavailable},
+		{driver.ErrBadConn, ErrUnavailable},
+		{sql.ErrNoRows, ErrNotFound},
+	}
+	for _, tt := range tests {
+		err := mysqlError(tt.err)
+		assert.ErrorIs(t, err, tt.want)
+		assert.ErrorIs(t, err, tt.err)
+	}
+
+	syntax := &mysql.MySQLError{Number: 1064, Message: "You have an error in your SQL syntax"}
+	assert.Equal(t, syntax, mysqlError(syntax))
+	assert.NoError(t, mysqlError(nil))
+}
@@ -0,0 +1,100 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package coredns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// ServiceUpdater is implemented by backends that can replace a stored
+// service, failing with ErrNotFound if the key isn't stored. Decorators
+// implement it by forwarding to the backend they wrap, applying the checks
+// of their writes.
+type ServiceUpdater interface {
+	UpdateService(ctx context.Context, service *Service) error
+}
+
+// UpdateService replaces the service stored at the service's key in b,
+// failing with ErrNotFound if there is none, or with errors.ErrUnsupported
+// if b can't update services.
+func UpdateService(ctx context.Context, b Backend, service *Service) error {
+	if updater, ok := b.(ServiceUpdater); ok {
+		return updater.UpdateService(ctx, service)
+	}
+	return fmt.Errorf("%w: %T can't update services", errors.ErrUnsupported, b)
+}
+
+// PolicySaver is implemented by backends that can resolve a conflicting
+// write to a stored key according to a ConflictPolicy.
+type PolicySaver interface {
+	SaveServiceWithPolicy(ctx context.Context, service *Service, policy ConflictPolicy) (bool, error)
+}
+
+// SaveServiceWithPolicy saves the service to b unless policy says the stored
+// one wins, and reports whether it was written. Backends that don't resolve
+// conflicts only support ConflictOverwrite, which saves like SaveService;
+// other modes fail with errors.ErrUnsupported.
+func SaveServiceWithPolicy(ctx context.Context, b Backend, service *Service, policy ConflictPolicy) (bool, error) {
+	if saver, ok := b.(PolicySaver); ok {
+		return saver.SaveServiceWithPolicy(ctx, service, policy)
+	}
+	if err := policy.validate(); err != nil {
+		return false, err
+	}
+	if policy.Mode != ConflictOverwrite {
+		return false, fmt.Errorf("%w: %T can't resolve write conflicts", errors.ErrUnsupported, b)
+	}
+	return true, b.SaveService(ctx, service)
+}
+
+// KeyStreamer is implemented by backends that can list keys without decoding
+// the services stored at them.
+type KeyStreamer interface {
+	StreamKeys(ctx context.Context, prefix string, fn func(key string) error) error
+}
+
+// StreamKeys calls fn with each key of b under prefix, stopping at the first
+// error. Backends that can't stream keys are read with ForEach.
+func StreamKeys(ctx context.Context, b Backend, prefix string, fn func(key string) error) error {
+	if streamer, ok := b.(KeyStreamer); ok {
+		return streamer.StreamKeys(ctx, prefix, fn)
+	}
+	return b.ForEach(ctx, prefix, func(key string, _ *Service) error {
+		return fn(key)
+	})
+}
+
+// EmptinessChecker is implemented by backends that can report whether they
+// store no service without reading them.
+type EmptinessChecker interface {
+	IsEmpty(ctx context.Context) (bool, error)
+}
+
+// IsEmpty reports whether b stores no service. Backends that can't report it
+// are asked whether any service exists under their root prefix.
+func IsEmpty(ctx context.Context, b Backend) (bool, error) {
+	if checker, ok := b.(EmptinessChecker); ok {
+		return checker.IsEmpty(ctx)
+	}
+	exists, err := b.Exists(ctx, rootPrefixOf(b))
+	if err != nil {
+		return false, err
+	}
+	return !exists, nil
+}
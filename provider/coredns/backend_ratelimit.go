@@ -0,0 +1,218 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package coredns
+
+import (
+	"context"
+
+	"golang.org/x/time/rate"
+)
+
+// RateLimitedBackend wraps a Backend and caps the number of operations per
+// second sent to it. This protects shared stores (e.g. an etcd cluster) from
+// being overwhelmed during large initial syncs.
+//
+// Operations block until a token is available or the context is done.
+type RateLimitedBackend struct {
+	backend Backend
+	reads   *rate.Limiter
+	writes  *rate.Limiter
+}
+
+// Compile-time check that RateLimitedBackend implements Backend
+var _ Backend = (*RateLimitedBackend)(nil)
+
+// NewRateLimitedBackend wraps backend so that reads and writes share a single
+// limit of opsPerSecond operations per second.
+func NewRateLimitedBackend(backend Backend, opsPerSecond float64) *RateLimitedBackend {
+	limiter := newLimiter(opsPerSecond)
+	return &RateLimitedBackend{
+		backend: backend,
+		reads:   limiter,
+		writes:  limiter,
+	}
+}
+
+// NewRateLimitedBackendWithLimits wraps backend with separate limits for
+// reads (GetServices) and writes (SaveService, DeleteService).
+func NewRateLimitedBackendWithLimits(backend Backend, readsPerSecond, writesPerSecond float64) *RateLimitedBackend {
+	return &RateLimitedBackend{
+		backend: backend,
+		reads:   newLimiter(readsPerSecond),
+		writes:  newLimiter(writesPerSecond),
+	}
+}
+
+// newLimiter creates a limiter allowing opsPerSecond operations per second
+// with a burst of one, so operations are evenly paced.
+func newLimiter(opsPerSecond float64) *rate.Limiter {
+	return rate.NewLimiter(rate.Limit(opsPerSecond), 1)
+}
+
+// GetServices waits for a read token, then delegates to the wrapped backend.
+func (r *RateLimitedBackend) GetServices(ctx context.Context, prefix string) ([]*Service, error) {
+	if err := r.reads.Wait(ctx); err != nil {
+		return nil, err
+	}
+	return r.backend.GetServices(ctx, prefix)
+}
+
+// GetServicesWithOptions waits for a read token, then delegates to the wrapped backend.
+func (r *RateLimitedBackend) GetServicesWithOptions(ctx context.Context, prefix string, opts GetServicesOptions) ([]*Service, error) {
+	if err := r.reads.Wait(ctx); err != nil {
+		return nil, err
+	}
+	return r.backend.GetServicesWithOptions(ctx, prefix, opts)
+}
+
+// GetServicesByType waits for a read token, then delegates to the wrapped backend.
+func (r *RateLimitedBackend) GetServicesByType(ctx context.Context, prefix, recordType string) ([]*Service, error) {
+	if err := r.reads.Wait(ctx); err != nil {
+		return nil, err
+	}
+	return r.backend.GetServicesByType(ctx, prefix, recordType)
+}
+
+// GetServicesBySource waits for a read token, then delegates to the wrapped backend.
+func (r *RateLimitedBackend) GetServicesBySource(ctx context.Context, prefix, source string) ([]*Service, error) {
+	if err := r.reads.Wait(ctx); err != nil {
+		return nil, err
+	}
+	return r.backend.GetServicesBySource(ctx, prefix, source)
+}
+
+// ForEach waits for a read token, then delegates to the wrapped backend.
+func (r *RateLimitedBackend) ForEach(ctx context.Context, prefix string, fn func(key string, svc *Service) error) error {
+	if err := r.reads.Wait(ctx); err != nil {
+		return err
+	}
+	return r.backend.ForEach(ctx, prefix, fn)
+}
+
+// StreamKeys waits for a read token, then delegates to the wrapped backend.
+func (r *RateLimitedBackend) StreamKeys(ctx context.Context, prefix string, fn func(key string) error) error {
+	if err := r.reads.Wait(ctx); err != nil {
+		return err
+	}
+	return StreamKeys(ctx, r.backend, prefix, fn)
+}
+
+// GetServicesPage waits for a read token, then delegates to the wrapped backend.
+func (r *RateLimitedBackend) GetServicesPage(ctx context.Context, prefix, afterKey string, limit int) ([]*Service, string, error) {
+	if err := r.reads.Wait(ctx); err != nil {
+		return nil, "", err
+	}
+	return r.backend.GetServicesPage(ctx, prefix, afterKey, limit)
+}
+
+// Exists waits for a read token, then delegates to the wrapped backend.
+func (r *RateLimitedBackend) Exists(ctx context.Context, prefix string) (bool, error) {
+	if err := r.reads.Wait(ctx); err != nil {
+		return false, err
+	}
+	return r.backend.Exists(ctx, prefix)
+}
+
+// IsEmpty waits for a read token, then delegates to the wrapped backend.
+func (r *RateLimitedBackend) IsEmpty(ctx context.Context) (bool, error) {
+	if err := r.reads.Wait(ctx); err != nil {
+		return false, err
+	}
+	return IsEmpty(ctx, r.backend)
+}
+
+// Snapshot waits for a read token, then delegates to the wrapped backend.
+func (r *RateLimitedBackend) Snapshot(ctx context.Context) (map[string]Service, error) {
+	if err := r.reads.Wait(ctx); err != nil {
+		return nil, err
+	}
+	return r.backend.Snapshot(ctx)
+}
+
+// SaveService waits for a write token, then delegates to the wrapped backend.
+func (r *RateLimitedBackend) SaveService(ctx context.Context, service *Service) error {
+	if err := r.writes.Wait(ctx); err != nil {
+		return err
+	}
+	return r.backend.SaveService(ctx, service)
+}
+
+// DeleteService waits for a write token, then delegates to the wrapped backend.
+func (r *RateLimitedBackend) DeleteService(ctx context.Context, key string) error {
+	if err := r.writes.Wait(ctx); err != nil {
+		return err
+	}
+	return r.backend.DeleteService(ctx, key)
+}
+
+// deleteIfCovered waits for a write token, then delegates to the wrapped backend.
+func (r *RateLimitedBackend) deleteIfCovered(ctx context.Context, key string, covered func(key string) bool) (bool, error) {
+	if err := r.writes.Wait(ctx); err != nil {
+		return false, err
+	}
+	return deleteIfCovered(ctx, r.backend, key, covered)
+}
+
+// SaveServiceWithPolicy waits for a write token, then delegates to the
+// wrapped backend.
+func (r *RateLimitedBackend) SaveServiceWithPolicy(ctx context.Context, service *Service, policy ConflictPolicy) (bool, error) {
+	if err := r.writes.Wait(ctx); err != nil {
+		return false, err
+	}
+	return SaveServiceWithPolicy(ctx, r.backend, service, policy)
+}
+
+// UpdateService waits for a write token, then delegates to the wrapped backend.
+func (r *RateLimitedBackend) UpdateService(ctx context.Context, service *Service) error {
+	if err := r.writes.Wait(ctx); err != nil {
+		return err
+	}
+	return UpdateService(ctx, r.backend, service)
+}
+
+// ClearPrefix waits for a write token, then delegates to the wrapped backend.
+func (r *RateLimitedBackend) ClearPrefix(ctx context.Context, prefix string) error {
+	if err := r.writes.Wait(ctx); err != nil {
+		return err
+	}
+	return r.backend.ClearPrefix(ctx, prefix)
+}
+
+// Flush flushes the wrapped backend. It is not rate limited.
+func (r *RateLimitedBackend) Flush(ctx context.Context) error {
+	return r.backend.Flush(ctx)
+}
+
+// Close closes the wrapped backend. It is not rate limited.
+func (r *RateLimitedBackend) Close() error {
+	return r.backend.Close()
+}
+
+// Health reports the health of the wrapped backend.
+func (r *RateLimitedBackend) Health(ctx context.Context) error {
+	return checkHealth(ctx, r.backend)
+}
+
+// Capabilities reports the capabilities of the wrapped backend, except Watch.
+func (r *RateLimitedBackend) Capabilities() BackendCapabilities {
+	return decoratorCapabilities(r.backend)
+}
+
+// Unwrap returns the wrapped backend.
+func (r *RateLimitedBackend) Unwrap() Backend {
+	return r.backend
+}
@@ -0,0 +1,117 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package coredns
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"sigs.k8s.io/external-dns/internal/testutils"
+)
+
+func TestRateLimitedBackend_Throttles(t *testing.T) {
+	backend := NewRateLimitedBackend(NewMemoryBackend(), 20)
+	defer backend.Close()
+
+	ctx := context.Background()
+
+	// With a limit of 20/s and a burst of 1, the first operation is immediate
+	// and each of the remaining 4 waits ~50ms.
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		svc := &Service{Host: "1.2.3.4", Key: "/skydns/com/example/svc" + string(rune('a'+i))}
+		require.NoError(t, backend.SaveService(ctx, svc))
+	}
+	elapsed := time.Since(start)
+
+	assert.GreaterOrEqual(t, elapsed, 190*time.Millisecond)
+}
+
+func TestRateLimitedBackend_SeparateLimits(t *testing.T) {
+	backend := NewRateLimitedBackendWithLimits(NewMemoryBackend(), 1000, 20)
+	defer backend.Close()
+
+	ctx := context.Background()
+
+	// Exhaust the write token; reads must not be affected by it
+	require.NoError(t, backend.SaveService(ctx, &Service{Host: "1.2.3.4", Key: "/skydns/com/example/www"}))
+
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		_, err := backend.GetServices(ctx, "/skydns/")
+		require.NoError(t, err)
+	}
+	assert.Less(t, time.Since(start), 40*time.Millisecond)
+}
+
+func TestRateLimitedBackend_ContextCancellation(t *testing.T) {
+	inner := NewMemoryBackend()
+	backend := NewRateLimitedBackend(inner, 0.1) // one operation every 10s
+	defer backend.Close()
+
+	// Consume the only token
+	require.NoError(t, backend.SaveService(context.Background(), &Service{Host: "1.2.3.4", Key: "/skydns/a"}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- backend.SaveService(ctx, &Service{Host: "1.2.3.4", Key: "/skydns/b"})
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+
+	select {
+	case err := <-done:
+		assert.ErrorIs(t, err, context.Canceled)
+	case <-time.After(time.Second):
+		t.Fatal("rate limited operation did not abort on context cancellation")
+	}
+	assert.Equal(t, 1, inner.Count())
+}
+
+func TestNewBackend_RateLimit(t *testing.T) {
+	testutils.TestHelperEnvSetter(t, map[string]string{
+		"COREDNS_BACKEND":            "memory",
+		"COREDNS_BACKEND_RATE_LIMIT": "50",
+	})
+
+	cfg := GetBackendConfig()
+	assert.InDelta(t, 50, cfg.RateLimit, 0)
+
+	backend, err := NewBackend(&cfg)
+	require.NoError(t, err)
+	defer backend.Close()
+
+	limited, ok := backend.(*RateLimitedBackend)
+	require.True(t, ok)
+	_, ok = limited.Unwrap().(*MemoryBackend)
+	assert.True(t, ok)
+}
+
+func TestGetBackendConfig_InvalidRateLimit(t *testing.T) {
+	testutils.TestHelperEnvSetter(t, map[string]string{
+		"COREDNS_BACKEND_RATE_LIMIT": "fast",
+	})
+
+	cfg := GetBackendConfig()
+	assert.Zero(t, cfg.RateLimit)
+}
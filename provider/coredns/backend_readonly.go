@@ -0,0 +1,174 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package coredns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// ErrReadOnly is returned by the writes of a ReadOnlyBackend
+var ErrReadOnly = errors.New("backend is read-only")
+
+// ReadOnlyBackend wraps a Backend and rejects every write with ErrReadOnly,
+// for deployments where external-dns observes a store that is managed by
+// hand. Reads are passed through.
+type ReadOnlyBackend struct {
+	backend Backend
+}
+
+// Compile-time check that ReadOnlyBackend implements Backend
+var _ Backend = (*ReadOnlyBackend)(nil)
+
+// NewReadOnlyBackend wraps backend so that it can't be written to.
+func NewReadOnlyBackend(backend Backend) *ReadOnlyBackend {
+	return &ReadOnlyBackend{backend: backend}
+}
+
+// GetServices delegates to the wrapped backend.
+func (r *ReadOnlyBackend) GetServices(ctx context.Context, prefix string) ([]*Service, error) {
+	return r.backend.GetServices(ctx, prefix)
+}
+
+// GetServicesWithOptions delegates to the wrapped backend.
+func (r *ReadOnlyBackend) GetServicesWithOptions(ctx context.Context, prefix string, opts GetServicesOptions) ([]*Service, error) {
+	return r.backend.GetServicesWithOptions(ctx, prefix, opts)
+}
+
+// GetServicesByType delegates to the wrapped backend.
+func (r *ReadOnlyBackend) GetServicesByType(ctx context.Context, prefix, recordType string) ([]*Service, error) {
+	return r.backend.GetServicesByType(ctx, prefix, recordType)
+}
+
+// GetServicesBySource delegates to the wrapped backend.
+func (r *ReadOnlyBackend) GetServicesBySource(ctx context.Context, prefix, source string) ([]*Service, error) {
+	return r.backend.GetServicesBySource(ctx, prefix, source)
+}
+
+// ForEach delegates to the wrapped backend.
+func (r *ReadOnlyBackend) ForEach(ctx context.Context, prefix string, fn func(key string, svc *Service) error) error {
+	return r.backend.ForEach(ctx, prefix, fn)
+}
+
+// StreamKeys delegates to the wrapped backend.
+func (r *ReadOnlyBackend) StreamKeys(ctx context.Context, prefix string, fn func(key string) error) error {
+	return StreamKeys(ctx, r.backend, prefix, fn)
+}
+
+// GetServicesPage delegates to the wrapped backend.
+func (r *ReadOnlyBackend) GetServicesPage(ctx context.Context, prefix, afterKey string, limit int) ([]*Service, string, error) {
+	return r.backend.GetServicesPage(ctx, prefix, afterKey, limit)
+}
+
+// Exists delegates to the wrapped backend.
+func (r *ReadOnlyBackend) Exists(ctx context.Context, prefix string) (bool, error) {
+	return r.backend.Exists(ctx, prefix)
+}
+
+// IsEmpty delegates to the wrapped backend.
+func (r *ReadOnlyBackend) IsEmpty(ctx context.Context) (bool, error) {
+	return IsEmpty(ctx, r.backend)
+}
+
+// Snapshot delegates to the wrapped backend.
+func (r *ReadOnlyBackend) Snapshot(ctx context.Context) (map[string]Service, error) {
+	return r.backend.Snapshot(ctx)
+}
+
+// Count returns the number of stored services, from the wrapped backend if
+// it can count them, or else from a snapshot.
+func (r *ReadOnlyBackend) Count(ctx context.Context) (int, error) {
+	if counter, ok := r.backend.(interface {
+		Count(ctx context.Context) (int, error)
+	}); ok {
+		return counter.Count(ctx)
+	}
+	snapshot, err := r.backend.Snapshot(ctx)
+	return len(snapshot), err
+}
+
+// Keys returns the stored keys in order, from the wrapped backend if it can
+// list them, or else from a snapshot.
+func (r *ReadOnlyBackend) Keys(ctx context.Context) ([]string, error) {
+	if lister, ok := r.backend.(interface {
+		Keys(ctx context.Context) ([]string, error)
+	}); ok {
+		return lister.Keys(ctx)
+	}
+	snapshot, err := r.backend.Snapshot(ctx)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(snapshot))
+	for key := range snapshot {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// SaveService returns ErrReadOnly.
+func (r *ReadOnlyBackend) SaveService(_ context.Context, service *Service) error {
+	return fmt.Errorf("%w: refusing to save %s", ErrReadOnly, service.Key)
+}
+
+// SaveServiceWithPolicy returns ErrReadOnly.
+func (r *ReadOnlyBackend) SaveServiceWithPolicy(_ context.Context, service *Service, _ ConflictPolicy) (bool, error) {
+	return false, fmt.Errorf("%w: refusing to save %s", ErrReadOnly, service.Key)
+}
+
+// UpdateService returns ErrReadOnly.
+func (r *ReadOnlyBackend) UpdateService(_ context.Context, service *Service) error {
+	return fmt.Errorf("%w: refusing to update %s", ErrReadOnly, service.Key)
+}
+
+// DeleteService returns ErrReadOnly.
+func (r *ReadOnlyBackend) DeleteService(_ context.Context, key string) error {
+	return fmt.Errorf("%w: refusing to delete %s", ErrReadOnly, key)
+}
+
+// ClearPrefix returns ErrReadOnly.
+func (r *ReadOnlyBackend) ClearPrefix(_ context.Context, prefix string) error {
+	return fmt.Errorf("%w: refusing to clear %s", ErrReadOnly, prefix)
+}
+
+// Flush flushes the wrapped backend.
+func (r *ReadOnlyBackend) Flush(ctx context.Context) error {
+	return r.backend.Flush(ctx)
+}
+
+// Close closes the wrapped backend.
+func (r *ReadOnlyBackend) Close() error {
+	return r.backend.Close()
+}
+
+// Health reports the health of the wrapped backend.
+func (r *ReadOnlyBackend) Health(ctx context.Context) error {
+	return checkHealth(ctx, r.backend)
+}
+
+// Capabilities reports the capabilities of the wrapped backend, except Watch.
+func (r *ReadOnlyBackend) Capabilities() BackendCapabilities {
+	return decoratorCapabilities(r.backend)
+}
+
+// Unwrap returns the wrapped backend.
+func (r *ReadOnlyBackend) Unwrap() Backend {
+	return r.backend
+}
@@ -0,0 +1,107 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package coredns
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"sigs.k8s.io/external-dns/endpoint"
+	"sigs.k8s.io/external-dns/plan"
+)
+
+func TestReadOnlyBackend(t *testing.T) {
+	sqliteBackend, err := NewSQLiteBackend(":memory:")
+	require.NoError(t, err)
+
+	for name, inner := range map[string]Backend{
+		"memory": NewMemoryBackend(),
+		"sqlite": sqliteBackend,
+	} {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			require.NoError(t, inner.SaveService(ctx, &Service{Key: "/skydns/com/example/www", Host: "1.2.3.4"}))
+			require.NoError(t, inner.SaveService(ctx, &Service{Key: "/skydns/com/example/api", Host: "5.6.7.8"}))
+
+			backend := NewReadOnlyBackend(inner)
+			defer backend.Close()
+
+			services, err := backend.GetServices(ctx, "/skydns/com/example")
+			require.NoError(t, err)
+			assert.Len(t, services, 2)
+
+			count, err := backend.Count(ctx)
+			require.NoError(t, err)
+			assert.Equal(t, 2, count)
+
+			keys, err := backend.Keys(ctx)
+			require.NoError(t, err)
+			assert.Equal(t, []string{"/skydns/com/example/api", "/skydns/com/example/www"}, keys)
+
+			err = backend.SaveService(ctx, &Service{Key: "/skydns/com/example/www", Host: "9.9.9.9"})
+			assert.ErrorIs(t, err, ErrReadOnly)
+			_, err = SaveServiceWithPolicy(ctx, backend, &Service{Key: "/skydns/com/example/www", Host: "9.9.9.9"}, ConflictPolicy{Mode: ConflictNewestWins})
+			assert.ErrorIs(t, err, ErrReadOnly)
+			err = backend.DeleteService(ctx, "/skydns/com/example")
+			assert.ErrorIs(t, err, ErrReadOnly)
+			err = backend.ClearPrefix(ctx, "/skydns/com/example")
+			assert.ErrorIs(t, err, ErrReadOnly)
+
+			snapshot, err := inner.Snapshot(ctx)
+			require.NoError(t, err)
+			assert.Equal(t, map[string]Service{
+				"/skydns/com/example/api": {Host: "5.6.7.8"},
+				"/skydns/com/example/www": {Host: "1.2.3.4"},
+			}, snapshot)
+		})
+	}
+}
+
+func TestNewBackend_ReadOnly(t *testing.T) {
+	backend, err := NewBackend(&BackendConfig{Type: BackendTypeMemory, ReadOnly: true, CoalesceWindow: time.Minute})
+	require.NoError(t, err)
+	defer backend.Close()
+
+	// Rejected synchronously, not buffered by the coalescing layer
+	require.IsType(t, &ReadOnlyBackend{}, backend)
+	assert.ErrorIs(t, backend.SaveService(context.Background(), &Service{Key: "/skydns/com/example", Host: "1.2.3.4"}), ErrReadOnly)
+}
+
+func TestApplyChanges_ReadOnly(t *testing.T) {
+	inner := NewMemoryBackend()
+	ctx := context.Background()
+	require.NoError(t, inner.SaveService(ctx, &Service{Key: "/skydns/com/example/www", Host: "1.2.3.4"}))
+
+	provider := NewCoreDNSProviderWithBackend(&endpoint.DomainFilter{}, defaultCoreDNSPrefix, false, NewReadOnlyBackend(inner))
+
+	records, err := provider.Records(ctx)
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+
+	err = provider.ApplyChanges(ctx, &plan.Changes{
+		Create: []*endpoint.Endpoint{endpoint.NewEndpoint("api.example.com", endpoint.RecordTypeA, "5.6.7.8")},
+		Delete: records,
+	})
+	assert.ErrorIs(t, err, ErrReadOnly)
+	assert.ErrorContains(t, err, "CoreDNS store is read-only, not applying 2 changes")
+
+	assert.Equal(t, 1, inner.Count())
+}
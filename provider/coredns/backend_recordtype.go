@@ -0,0 +1,240 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package coredns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"sigs.k8s.io/external-dns/endpoint"
+)
+
+// ErrRecordTypeNotAllowed is returned when a write makes a record of a type
+// missing from the allowlist of a RecordTypeBackend
+var ErrRecordTypeNotAllowed = errors.New("record type not allowed")
+
+// supportedRecordTypes are the record types the provider can write.
+var supportedRecordTypes = []string{
+	endpoint.RecordTypeA,
+	endpoint.RecordTypeAAAA,
+	endpoint.RecordTypeCNAME,
+	endpoint.RecordTypeMX,
+	endpoint.RecordTypePTR,
+	endpoint.RecordTypeSRV,
+	endpoint.RecordTypeTXT,
+}
+
+// ParseRecordTypes returns the set of record types named by types, which
+// must be among the types the provider supports. Names are case-insensitive.
+// An empty list yields nil, allowing every supported type.
+func ParseRecordTypes(types []string) (map[string]bool, error) {
+	if len(types) == 0 {
+		return nil, nil
+	}
+	allowed := make(map[string]bool, len(types))
+	for _, recordType := range types {
+		recordType = strings.ToUpper(strings.TrimSpace(recordType))
+		if !slices.Contains(supportedRecordTypes, recordType) {
+			return nil, fmt.Errorf("unsupported record type %q, valid options are: %s", recordType, strings.Join(supportedRecordTypes, ", "))
+		}
+		allowed[recordType] = true
+	}
+	return allowed, nil
+}
+
+// RecordTypeBackend wraps a Backend and rejects with ErrRecordTypeNotAllowed
+// the writes of records whose type is not in an allowlist, for CoreDNS
+// deployments where external-dns must only manage some types. Reads and
+// deletes are passed through.
+type RecordTypeBackend struct {
+	backend Backend
+	allowed map[string]bool
+	prefix  string
+	keys    KeyScheme
+}
+
+// Compile-time check that RecordTypeBackend implements Backend
+var _ Backend = (*RecordTypeBackend)(nil)
+
+// RecordTypeOptions configures a RecordTypeBackend.
+type RecordTypeOptions struct {
+	// Prefix is the root of the keys DNS names are parsed from, to tell
+	// reverse zone records apart. If empty, DefaultPrefix is used.
+	Prefix string
+
+	// Keys is the scheme of stored keys. The zero value separates labels with "/".
+	Keys KeyScheme
+}
+
+// NewRecordTypeBackend wraps backend so that only records of the allowed
+// types, stored under prefix, can be written.
+func NewRecordTypeBackend(backend Backend, prefix string, allowed map[string]bool) *RecordTypeBackend {
+	return NewRecordTypeBackendWithOptions(backend, allowed, RecordTypeOptions{Prefix: prefix})
+}
+
+// NewRecordTypeBackendWithOptions is NewRecordTypeBackend with the prefix
+// and key scheme given by opts.
+func NewRecordTypeBackendWithOptions(backend Backend, allowed map[string]bool, opts RecordTypeOptions) *RecordTypeBackend {
+	return &RecordTypeBackend{
+		backend: backend,
+		allowed: allowed,
+		prefix:  opts.Keys.normalizePrefix(opts.Prefix),
+		keys:    opts.Keys,
+	}
+}
+
+// recordType returns the type of the record service makes. Hostnames stored
+// under reverse zones are PTR records rather than CNAMEs.
+func (r *RecordTypeBackend) recordType(service *Service) string {
+	recordType := service.RecordType()
+	if recordType == endpoint.RecordTypeCNAME && !service.ForceCNAME {
+		dnsName, _ := r.keys.ParseKey(r.prefix, r.keys.resolveKey(r.prefix, service.Key), service.TargetStrip)
+		if isReverseName(dnsName) {
+			return endpoint.RecordTypePTR
+		}
+	}
+	return recordType
+}
+
+// GetServices delegates to the wrapped backend.
+func (r *RecordTypeBackend) GetServices(ctx context.Context, prefix string) ([]*Service, error) {
+	return r.backend.GetServices(ctx, prefix)
+}
+
+// GetServicesWithOptions delegates to the wrapped backend.
+func (r *RecordTypeBackend) GetServicesWithOptions(ctx context.Context, prefix string, opts GetServicesOptions) ([]*Service, error) {
+	return r.backend.GetServicesWithOptions(ctx, prefix, opts)
+}
+
+// GetServicesByType delegates to the wrapped backend.
+func (r *RecordTypeBackend) GetServicesByType(ctx context.Context, prefix, recordType string) ([]*Service, error) {
+	return r.backend.GetServicesByType(ctx, prefix, recordType)
+}
+
+// GetServicesBySource delegates to the wrapped backend.
+func (r *RecordTypeBackend) GetServicesBySource(ctx context.Context, prefix, source string) ([]*Service, error) {
+	return r.backend.GetServicesBySource(ctx, prefix, source)
+}
+
+// ForEach delegates to the wrapped backend.
+func (r *RecordTypeBackend) ForEach(ctx context.Context, prefix string, fn func(key string, svc *Service) error) error {
+	return r.backend.ForEach(ctx, prefix, fn)
+}
+
+// StreamKeys delegates to the wrapped backend.
+func (r *RecordTypeBackend) StreamKeys(ctx context.Context, prefix string, fn func(key string) error) error {
+	return StreamKeys(ctx, r.backend, prefix, fn)
+}
+
+// GetServicesPage delegates to the wrapped backend.
+func (r *RecordTypeBackend) GetServicesPage(ctx context.Context, prefix, afterKey string, limit int) ([]*Service, string, error) {
+	return r.backend.GetServicesPage(ctx, prefix, afterKey, limit)
+}
+
+// Exists delegates to the wrapped backend.
+func (r *RecordTypeBackend) Exists(ctx context.Context, prefix string) (bool, error) {
+	return r.backend.Exists(ctx, prefix)
+}
+
+// IsEmpty delegates to the wrapped backend.
+func (r *RecordTypeBackend) IsEmpty(ctx context.Context) (bool, error) {
+	return IsEmpty(ctx, r.backend)
+}
+
+// Snapshot delegates to the wrapped backend.
+func (r *RecordTypeBackend) Snapshot(ctx context.Context) (map[string]Service, error) {
+	return r.backend.Snapshot(ctx)
+}
+
+// SaveService saves the service unless the record it makes is of a type
+// that is not allowed.
+func (r *RecordTypeBackend) SaveService(ctx context.Context, service *Service) error {
+	if err := r.checkWrite(service); err != nil {
+		return err
+	}
+	return r.backend.SaveService(ctx, service)
+}
+
+// SaveServiceWithPolicy saves the service according to policy if its record
+// type is allowed.
+func (r *RecordTypeBackend) SaveServiceWithPolicy(ctx context.Context, service *Service, policy ConflictPolicy) (bool, error) {
+	if err := r.checkWrite(service); err != nil {
+		return false, err
+	}
+	return SaveServiceWithPolicy(ctx, r.backend, service, policy)
+}
+
+// UpdateService updates the service if its record type is allowed.
+func (r *RecordTypeBackend) UpdateService(ctx context.Context, service *Service) error {
+	if err := r.checkWrite(service); err != nil {
+		return err
+	}
+	return UpdateService(ctx, r.backend, service)
+}
+
+// checkWrite rejects with ErrRecordTypeNotAllowed the writes of services
+// whose record type isn't allowed.
+func (r *RecordTypeBackend) checkWrite(service *Service) error {
+	if recordType := r.recordType(service); r.allowed != nil && recordType != "" && !r.allowed[recordType] {
+		return fmt.Errorf("%w: refusing to save %s record %s", ErrRecordTypeNotAllowed, recordType, service.Key)
+	}
+	return nil
+}
+
+// DeleteService delegates to the wrapped backend, so that records of any
+// type can be cleaned up.
+func (r *RecordTypeBackend) DeleteService(ctx context.Context, key string) error {
+	return r.backend.DeleteService(ctx, key)
+}
+
+// deleteIfCovered delegates to the wrapped backend.
+func (r *RecordTypeBackend) deleteIfCovered(ctx context.Context, key string, covered func(key string) bool) (bool, error) {
+	return deleteIfCovered(ctx, r.backend, key, covered)
+}
+
+// ClearPrefix delegates to the wrapped backend.
+func (r *RecordTypeBackend) ClearPrefix(ctx context.Context, prefix string) error {
+	return r.backend.ClearPrefix(ctx, prefix)
+}
+
+// Flush flushes the wrapped backend.
+func (r *RecordTypeBackend) Flush(ctx context.Context) error {
+	return r.backend.Flush(ctx)
+}
+
+// Close closes the wrapped backend.
+func (r *RecordTypeBackend) Close() error {
+	return r.backend.Close()
+}
+
+// Health reports the health of the wrapped backend.
+func (r *RecordTypeBackend) Health(ctx context.Context) error {
+	return checkHealth(ctx, r.backend)
+}
+
+// Capabilities reports the capabilities of the wrapped backend, except Watch.
+func (r *RecordTypeBackend) Capabilities() BackendCapabilities {
+	return decoratorCapabilities(r.backend)
+}
+
+// Unwrap returns the wrapped backend.
+func (r *RecordTypeBackend) Unwrap() Backend {
+	return r.backend
+}
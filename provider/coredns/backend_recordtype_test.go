@@ -0,0 +1,73 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package coredns
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"sigs.k8s.io/external-dns/endpoint"
+)
+
+func TestParseRecordTypes(t *testing.T) {
+	allowed, err := ParseRecordTypes(nil)
+	require.NoError(t, err)
+	assert.Nil(t, allowed)
+
+	allowed, err = ParseRecordTypes([]string{"a", " TXT "})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]bool{endpoint.RecordTypeA: true, endpoint.RecordTypeTXT: true}, allowed)
+
+	_, err = ParseRecordTypes([]string{"A", "NS"})
+	assert.EqualError(t, err, `unsupported record type "NS", valid options are: A, AAAA, CNAME, MX, PTR, SRV, TXT`)
+}
+
+func TestRecordTypeBackend(t *testing.T) {
+	memory := NewMemoryBackend()
+	defer memory.Close()
+	allowed, err := ParseRecordTypes([]string{"A", "TXT"})
+	require.NoError(t, err)
+	backend := NewRecordTypeBackend(memory, "/skydns/", allowed)
+
+	ctx := context.Background()
+	require.NoError(t, backend.SaveService(ctx, &Service{Key: "/skydns/com/example/www/a", Host: "10.0.0.1", TargetStrip: 1}))
+	require.NoError(t, backend.SaveService(ctx, &Service{Key: "/skydns/com/example/www/t", Text: "hello", TargetStrip: 1}))
+
+	err = backend.SaveService(ctx, &Service{Key: "/skydns/com/example/alias/c", Host: "www.example.com", TargetStrip: 1})
+	assert.ErrorIs(t, err, ErrRecordTypeNotAllowed)
+	assert.ErrorContains(t, err, "CNAME record /skydns/com/example/alias/c")
+
+	err = backend.SaveService(ctx, &Service{Key: "/skydns/com/example/www/f", Host: "10.0.0.2", ForceCNAME: true, TargetStrip: 1})
+	assert.ErrorIs(t, err, ErrRecordTypeNotAllowed)
+
+	// Hostnames under reverse zones are PTR records
+	err = backend.SaveService(ctx, &Service{Key: "/skydns/arpa/in-addr/10/0/0/1/p", Host: "www.example.com", TargetStrip: 1})
+	assert.ErrorContains(t, err, "PTR record")
+
+	services, err := backend.GetServices(ctx, "/skydns/")
+	require.NoError(t, err)
+	assert.Len(t, services, 2)
+
+	// Deletes of any type are passed through
+	require.NoError(t, backend.DeleteService(ctx, "/skydns/com/example/www"))
+	services, err = backend.GetServices(ctx, "/skydns/")
+	require.NoError(t, err)
+	assert.Empty(t, services)
+}
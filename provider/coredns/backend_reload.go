@@ -0,0 +1,231 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package coredns
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// ReloadableBackend wraps a Backend that Swap can replace at runtime, e.g.
+// to point the provider at another SQLite file without a restart.
+//
+// Operations run against the backend current when they start. Swap waits for
+// the operations running against the old backend to complete before closing
+// it, so none of them observes it closed; later operations use the new one.
+type ReloadableBackend struct {
+	mu      sync.RWMutex
+	current *backendGeneration
+	closed  bool
+}
+
+// backendGeneration is a backend and the operations running against it.
+type backendGeneration struct {
+	backend  Backend
+	inflight sync.WaitGroup
+}
+
+// Compile-time check that ReloadableBackend implements Backend
+var _ Backend = (*ReloadableBackend)(nil)
+
+// NewReloadableBackend wraps backend so that it can be swapped for another.
+func NewReloadableBackend(backend Backend) *ReloadableBackend {
+	return &ReloadableBackend{current: &backendGeneration{backend: backend}}
+}
+
+// acquire returns the current generation, counting an operation against it
+// until the returned release function is called.
+func (r *ReloadableBackend) acquire() (*backendGeneration, func()) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	g := r.current
+	g.inflight.Add(1)
+	return g, g.inflight.Done
+}
+
+// Swap replaces the wrapped backend with backend, then waits for the
+// operations running against the old one to complete and closes it.
+// It fails, leaving backend unused, if the ReloadableBackend is closed.
+func (r *ReloadableBackend) Swap(backend Backend) error {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return fmt.Errorf("%w: can't swap it", ErrBackendClosed)
+	}
+	old := r.current
+	r.current = &backendGeneration{backend: backend}
+	r.mu.Unlock()
+
+	old.inflight.Wait()
+	if err := old.backend.Close(); err != nil {
+		log.Warnf("Failed to close replaced backend: %v", err)
+	}
+	return nil
+}
+
+// GetServices delegates to the current backend.
+func (r *ReloadableBackend) GetServices(ctx context.Context, prefix string) ([]*Service, error) {
+	g, release := r.acquire()
+	defer release()
+	return g.backend.GetServices(ctx, prefix)
+}
+
+// GetServicesWithOptions delegates to the current backend.
+func (r *ReloadableBackend) GetServicesWithOptions(ctx context.Context, prefix string, opts GetServicesOptions) ([]*Service, error) {
+	g, release := r.acquire()
+	defer release()
+	return g.backend.GetServicesWithOptions(ctx, prefix, opts)
+}
+
+// GetServicesByType delegates to the current backend.
+func (r *ReloadableBackend) GetServicesByType(ctx context.Context, prefix, recordType string) ([]*Service, error) {
+	g, release := r.acquire()
+	defer release()
+	return g.backend.GetServicesByType(ctx, prefix, recordType)
+}
+
+// GetServicesBySource delegates to the current backend.
+func (r *ReloadableBackend) GetServicesBySource(ctx context.Context, prefix, source string) ([]*Service, error) {
+	g, release := r.acquire()
+	defer release()
+	return g.backend.GetServicesBySource(ctx, prefix, source)
+}
+
+// ForEach delegates to the current backend.
+func (r *ReloadableBackend) ForEach(ctx context.Context, prefix string, fn func(key string, svc *Service) error) error {
+	g, release := r.acquire()
+	defer release()
+	return g.backend.ForEach(ctx, prefix, fn)
+}
+
+// StreamKeys delegates to the current backend.
+func (r *ReloadableBackend) StreamKeys(ctx context.Context, prefix string, fn func(key string) error) error {
+	g, release := r.acquire()
+	defer release()
+	return StreamKeys(ctx, g.backend, prefix, fn)
+}
+
+// GetServicesPage delegates to the current backend.
+func (r *ReloadableBackend) GetServicesPage(ctx context.Context, prefix, afterKey string, limit int) ([]*Service, string, error) {
+	g, release := r.acquire()
+	defer release()
+	return g.backend.GetServicesPage(ctx, prefix, afterKey, limit)
+}
+
+// Exists delegates to the current backend.
+func (r *ReloadableBackend) Exists(ctx context.Context, prefix string) (bool, error) {
+	g, release := r.acquire()
+	defer release()
+	return g.backend.Exists(ctx, prefix)
+}
+
+// IsEmpty delegates to the current backend.
+func (r *ReloadableBackend) IsEmpty(ctx context.Context) (bool, error) {
+	g, release := r.acquire()
+	defer release()
+	return IsEmpty(ctx, g.backend)
+}
+
+// Snapshot delegates to the current backend.
+func (r *ReloadableBackend) Snapshot(ctx context.Context) (map[string]Service, error) {
+	g, release := r.acquire()
+	defer release()
+	return g.backend.Snapshot(ctx)
+}
+
+// SaveService delegates to the current backend.
+func (r *ReloadableBackend) SaveService(ctx context.Context, service *Service) error {
+	g, release := r.acquire()
+	defer release()
+	return g.backend.SaveService(ctx, service)
+}
+
+// DeleteService delegates to the current backend.
+func (r *ReloadableBackend) DeleteService(ctx context.Context, key string) error {
+	g, release := r.acquire()
+	defer release()
+	return g.backend.DeleteService(ctx, key)
+}
+
+// deleteIfCovered delegates to the current backend.
+func (r *ReloadableBackend) deleteIfCovered(ctx context.Context, key string, covered func(key string) bool) (bool, error) {
+	g, release := r.acquire()
+	defer release()
+	return deleteIfCovered(ctx, g.backend, key, covered)
+}
+
+// SaveServiceWithPolicy delegates to the current backend.
+func (r *ReloadableBackend) SaveServiceWithPolicy(ctx context.Context, service *Service, policy ConflictPolicy) (bool, error) {
+	g, release := r.acquire()
+	defer release()
+	return SaveServiceWithPolicy(ctx, g.backend, service, policy)
+}
+
+// UpdateService delegates to the current backend.
+func (r *ReloadableBackend) UpdateService(ctx context.Context, service *Service) error {
+	g, release := r.acquire()
+	defer release()
+	return UpdateService(ctx, g.backend, service)
+}
+
+// ClearPrefix delegates to the current backend.
+func (r *ReloadableBackend) ClearPrefix(ctx context.Context, prefix string) error {
+	g, release := r.acquire()
+	defer release()
+	return g.backend.ClearPrefix(ctx, prefix)
+}
+
+// Flush flushes the current backend.
+func (r *ReloadableBackend) Flush(ctx context.Context) error {
+	g, release := r.acquire()
+	defer release()
+	return g.backend.Flush(ctx)
+}
+
+// Close closes the current backend, once the operations running against it
+// have completed. Later swaps fail.
+func (r *ReloadableBackend) Close() error {
+	r.mu.Lock()
+	r.closed = true
+	g := r.current
+	r.mu.Unlock()
+
+	g.inflight.Wait()
+	return g.backend.Close()
+}
+
+// Health reports the health of the current backend.
+func (r *ReloadableBackend) Health(ctx context.Context) error {
+	g, release := r.acquire()
+	defer release()
+	return checkHealth(ctx, g.backend)
+}
+
+// Capabilities reports the capabilities of the current backend, except Watch.
+func (r *ReloadableBackend) Capabilities() BackendCapabilities {
+	g, release := r.acquire()
+	defer release()
+	return decoratorCapabilities(g.backend)
+}
+
+// Unwrap returns the current backend.
+func (r *ReloadableBackend) Unwrap() Backend {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.current.backend
+}
@@ -0,0 +1,97 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package coredns
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReloadableBackend_Swap(t *testing.T) {
+	ctx := context.Background()
+	old := NewMemoryBackend()
+	require.NoError(t, old.SaveService(ctx, &Service{Key: "/skydns/com/example/old", Host: "10.0.0.1"}))
+	backend := NewReloadableBackend(old)
+	defer backend.Close()
+
+	next := NewMemoryBackend()
+	require.NoError(t, next.SaveService(ctx, &Service{Key: "/skydns/com/example/new", Host: "10.0.0.2"}))
+	require.NoError(t, backend.Swap(next))
+
+	services, err := backend.GetServices(ctx, "/skydns/")
+	require.NoError(t, err)
+	require.Len(t, services, 1)
+	assert.Equal(t, "10.0.0.2", services[0].Host)
+
+	_, err = old.GetServices(ctx, "/skydns/")
+	assert.ErrorIs(t, err, ErrBackendClosed, "the replaced backend is closed")
+	assert.Same(t, next, backend.Unwrap())
+}
+
+func TestReloadableBackend_SwapWaitsForInflight(t *testing.T) {
+	ctx := context.Background()
+	old := NewMemoryBackend()
+	require.NoError(t, old.SaveService(ctx, &Service{Key: "/skydns/com/example/www", Host: "10.0.0.1"}))
+	backend := NewReloadableBackend(old)
+	defer backend.Close()
+
+	started := make(chan struct{})
+	resume := make(chan struct{})
+	iterated := make(chan error)
+	go func() {
+		iterated <- backend.ForEach(ctx, "/skydns/", func(string, *Service) error {
+			close(started)
+			<-resume
+			return nil
+		})
+	}()
+	<-started
+
+	swapped := make(chan error)
+	go func() { swapped <- backend.Swap(NewMemoryBackend()) }()
+
+	// Operations started after the swap use the new backend right away
+	assert.Eventually(t, func() bool {
+		services, err := backend.GetServices(ctx, "/skydns/")
+		return err == nil && len(services) == 0
+	}, time.Second, 10*time.Millisecond)
+
+	select {
+	case <-swapped:
+		t.Fatal("Swap returned while an operation was running against the old backend")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(resume)
+	require.NoError(t, <-iterated)
+	require.NoError(t, <-swapped)
+	_, err := old.GetServices(ctx, "/skydns/")
+	assert.ErrorIs(t, err, ErrBackendClosed)
+}
+
+func TestReloadableBackend_SwapAfterClose(t *testing.T) {
+	backend := NewReloadableBackend(NewMemoryBackend())
+	require.NoError(t, backend.Close())
+
+	next := NewMemoryBackend()
+	defer next.Close()
+	assert.ErrorIs(t, backend.Swap(next), ErrBackendClosed)
+}
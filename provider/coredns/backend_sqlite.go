@@ -19,24 +19,109 @@ package coredns
 import (
 	"context"
 	"database/sql"
-	"encoding/json"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"math/rand"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	sqlite3 "modernc.org/sqlite/lib"
+
+	"sigs.k8s.io/external-dns/endpoint"
 
-	log "github.com/sirupsen/logrus"
 	// Pure Go SQLite driver - no CGO required
 	_ "modernc.org/sqlite"
 )
 
+// ErrSQLiteUnavailable is returned when the SQLite database/sql driver isn't
+// compiled into the binary
+var ErrSQLiteUnavailable = errors.New("sqlite backend is not available in this build")
+
+// sqliteDriverName is the database/sql driver SQLiteBackend opens databases
+// with. It is registered by the modernc.org/sqlite import.
+var sqliteDriverName = "sqlite"
+
+// checkSQLiteDriver returns ErrSQLiteUnavailable if the SQLite driver isn't
+// registered, so that callers don't get database/sql's opaque unknown driver
+// error on first use.
+func checkSQLiteDriver() error {
+	if !slices.Contains(sql.Drivers(), sqliteDriverName) {
+		return fmt.Errorf("%w: database/sql driver %q is not registered", ErrSQLiteUnavailable, sqliteDriverName)
+	}
+	return nil
+}
+
 // SQLiteBackend implements Backend using SQLite for storage.
 // This provides a simpler alternative to etcd for single-node deployments
 // or when a distributed key-value store isn't needed.
 type SQLiteBackend struct {
-	db   *sql.DB
-	mu   sync.RWMutex
-	path string
+	db     *sql.DB
+	mu     sync.RWMutex
+	path   string
+	codec  Codec
+	prefix string
+	keys   KeyScheme
+	closed atomic.Bool
+
+	// defaults applied to read services, DefaultServiceDefaults if nil
+	defaults ServiceDefaults
+
+	// now returns the current time, as told by the Clock of SQLiteOptions
+	now func() time.Time
+
+	// stopReaper stops the TTL reaper goroutine, if any, and waits for it
+	stopReaper func()
+
+	// snapshotDB is a read-only connection to the same file, so Snapshot's
+	// read transaction doesn't hold the only connection writers use. It is
+	// nil for in-memory databases, whose Snapshot uses db.
+	snapshotDB *sql.DB
+}
+
+// SQLiteOptions configures a SQLiteBackend.
+type SQLiteOptions struct {
+	// Codec used to serialize stored values. If nil, DefaultCodec is used.
+	Codec Codec
+
+	// Prefix is the root relative keys are resolved against.
+	// If empty, DefaultPrefix is used.
+	Prefix string
+
+	// Keys is the scheme of stored keys. The zero value separates labels with "/".
+	Keys KeyScheme
+
+	// ReapInterval enables the TTL reaper: every ReapInterval, the services
+	// whose TTL has elapsed since they were last saved are deleted. Services
+	// with a zero TTL never expire. Zero disables the reaper.
+	ReapInterval time.Duration
+
+	// Clock tells the time saves are stamped with and the reaper expires
+	// services by. If nil, SystemClock is used.
+	Clock Clock
+
+	// Now returns the current time, overriding Clock.
+	//
+	// Deprecated: use Clock.
+	Now func() time.Time
+
+	// Defaults are the priority and weight applied to read services per
+	// record type. If nil, DefaultServiceDefaults is used.
+	Defaults ServiceDefaults
+
+	// ConnMaxLifetime and ConnMaxIdleTime recycle database connections that
+	// are older, or have been idle longer, than the given duration, and
+	// MaxIdleConns caps the idle connections kept open (see the matching
+	// sql.DB setters). Zero keeps the database/sql defaults. They are ignored
+	// for ":memory:" databases, which are lost when their connection closes.
+	ConnMaxLifetime time.Duration
+	ConnMaxIdleTime time.Duration
+	MaxIdleConns    int
 }
 
 // Compile-time check that SQLiteBackend implements Backend
@@ -51,12 +136,38 @@ CREATE TABLE IF NOT EXISTS services (
 );
 
 CREATE INDEX IF NOT EXISTS idx_services_key_prefix ON services(key);
+CREATE INDEX IF NOT EXISTS idx_services_updated_at ON services(updated_at);
 `
 
+// sqliteTimeFormat is the layout updated_at is written with. It extends the
+// CURRENT_TIMESTAMP layout with fixed-width nanoseconds so that timestamps,
+// including those written by older versions, sort lexicographically.
+const sqliteTimeFormat = "2006-01-02 15:04:05.000000000"
+
+// sqliteTime formats t as stored in the updated_at column.
+func sqliteTime(t time.Time) string {
+	return t.UTC().Format(sqliteTimeFormat)
+}
+
 // NewSQLiteBackend creates a new SQLite-based backend.
 // The database file will be created if it doesn't exist.
 // Path can be ":memory:" for an in-memory database (useful for testing).
 func NewSQLiteBackend(path string) (*SQLiteBackend, error) {
+	return NewSQLiteBackendWithCodec(path, nil)
+}
+
+// NewSQLiteBackendWithCodec creates a new SQLite-based backend that stores
+// values using the given codec. A nil codec selects DefaultCodec.
+func NewSQLiteBackendWithCodec(path string, codec Codec) (*SQLiteBackend, error) {
+	return NewSQLiteBackendWithOptions(path, SQLiteOptions{Codec: codec})
+}
+
+// NewSQLiteBackendWithOptions creates a new SQLite-based backend configured by opts.
+func NewSQLiteBackendWithOptions(path string, opts SQLiteOptions) (*SQLiteBackend, error) {
+	if err := checkSQLiteDriver(); err != nil {
+		return nil, err
+	}
+
 	// Ensure parent directory exists (unless in-memory)
 	if path != ":memory:" {
 		dir := filepath.Dir(path)
@@ -68,16 +179,34 @@ func NewSQLiteBackend(path string) (*SQLiteBackend, error) {
 	// Open with WAL mode for better concurrent read performance
 	dsn := path
 	if path != ":memory:" {
-		dsn = path + "?_journal_mode=WAL&_busy_timeout=5000&_synchronous=NORMAL"
+		dsn = path + "?_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)&_pragma=synchronous(NORMAL)"
 	}
 
-	db, err := sql.Open("sqlite", dsn)
+	db, err := sql.Open(sqliteDriverName, dsn)
 	if err != nil {
 		return nil, err
 	}
+	s, err := newSQLiteBackend(db, path, opts)
+	if err != nil || path == ":memory:" {
+		return s, err
+	}
 
+	// In WAL mode readers see a fixed snapshot and don't block the writer
+	s.snapshotDB, err = sql.Open(sqliteDriverName, path+"?_pragma=busy_timeout(5000)&_pragma=query_only(1)")
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	s.snapshotDB.SetMaxOpenConns(1)
+	return s, nil
+}
+
+// newSQLiteBackend initializes the schema of an open database and wraps it.
+// The database is closed if initialization fails.
+func newSQLiteBackend(db *sql.DB, path string, opts SQLiteOptions) (*SQLiteBackend, error) {
 	// Limit connections for SQLite (it doesn't handle high concurrency well)
 	db.SetMaxOpenConns(1)
+	applyConnLimits(db, path, opts)
 
 	// Initialize schema
 	if _, err := db.Exec(sqliteSchema); err != nil {
@@ -87,106 +216,863 @@ func NewSQLiteBackend(path string) (*SQLiteBackend, error) {
 
 	log.Infof("SQLite backend initialized at %s", path)
 
-	return &SQLiteBackend{
-		db:   db,
-		path: path,
-	}, nil
+	s := &SQLiteBackend{
+		db:     db,
+		path:   path,
+		codec:  codecOrDefault(opts.Codec),
+		prefix: opts.Keys.normalizePrefix(opts.Prefix),
+		keys:   opts.Keys,
+		now:    opts.Now,
+
+		defaults: opts.Defaults,
+	}
+	if s.now == nil {
+		s.now = clockOrDefault(opts.Clock).Now
+	}
+	if opts.ReapInterval > 0 {
+		log.Infof("Reaping expired SQLite services every %s", opts.ReapInterval)
+		s.stopReaper = s.startReaper(opts.ReapInterval)
+	}
+	return s, nil
+}
+
+// applyConnLimits applies the connection recycling settings of opts to db.
+func applyConnLimits(db *sql.DB, path string, opts SQLiteOptions) {
+	if opts.ConnMaxLifetime == 0 && opts.ConnMaxIdleTime == 0 && opts.MaxIdleConns == 0 {
+		return
+	}
+	if path == ":memory:" {
+		log.Warnf("Ignoring SQLite connection lifetime settings for in-memory database")
+		return
+	}
+	if opts.ConnMaxLifetime > 0 {
+		db.SetConnMaxLifetime(opts.ConnMaxLifetime)
+	}
+	if opts.ConnMaxIdleTime > 0 {
+		db.SetConnMaxIdleTime(opts.ConnMaxIdleTime)
+	}
+	if opts.MaxIdleConns > 0 {
+		db.SetMaxIdleConns(opts.MaxIdleConns)
+	}
 }
 
 // GetServices retrieves all services matching the given key prefix.
 func (s *SQLiteBackend) GetServices(ctx context.Context, prefix string) ([]*Service, error) {
+	return s.GetServicesWithOptions(ctx, prefix, GetServicesOptions{})
+}
+
+// GetServicesWithOptions retrieves all services matching the given key prefix,
+// deduplicated and with default priorities unless opts.Raw is set.
+func (s *SQLiteBackend) GetServicesWithOptions(ctx context.Context, prefix string, opts GetServicesOptions) ([]*Service, error) {
+	if s.closed.Load() {
+		return nil, ErrBackendClosed
+	}
+	if err := s.keys.validatePrefix(s.prefix, prefix); err != nil {
+		return nil, err
+	}
+
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
 	// Query for all keys that start with the prefix
-	query := `SELECT key, value FROM services WHERE key LIKE ? || '%'`
-	rows, err := s.db.QueryContext(ctx, query, prefix)
+	query := `SELECT key, value FROM services WHERE ` + sqlitePrefixMatch + ` ORDER BY key`
+	return s.queryServices(ctx, opts, query, s.keys.resolveKey(s.prefix, prefix))
+}
+
+// sqliteTypeFilters narrows GetServicesByType queries in SQL for the default
+// JSON codec. Results are still checked with HasRecordType afterwards.
+var sqliteTypeFilters = map[string]string{
+	endpoint.RecordTypeTXT:   `json_extract(value, '$.text') <> ''`,
+	endpoint.RecordTypeMX:    `json_extract(value, '$.mail') = 1`,
+	endpoint.RecordTypeSRV:   `json_extract(value, '$.port') > 0`,
+	endpoint.RecordTypeA:     `json_extract(value, '$.host') <> ''`,
+	endpoint.RecordTypeAAAA:  `json_extract(value, '$.host') <> ''`,
+	endpoint.RecordTypeCNAME: `json_extract(value, '$.host') <> ''`,
+}
+
+// GetServicesByType retrieves the services under the given key prefix that
+// produce a record of the given type (A, AAAA, CNAME, TXT, SRV, MX).
+// With the default JSON codec the filtering is pushed down into SQL.
+func (s *SQLiteBackend) GetServicesByType(ctx context.Context, prefix, recordType string) ([]*Service, error) {
+	if s.closed.Load() {
+		return nil, ErrBackendClosed
+	}
+	if err := s.keys.validatePrefix(s.prefix, prefix); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	recordType = strings.ToUpper(recordType)
+	query := `SELECT key, value FROM services WHERE ` + sqlitePrefixMatch
+	if _, ok := s.codec.(JSONCodec); ok {
+		if filter, ok := sqliteTypeFilters[recordType]; ok {
+			query += " AND " + filter
+		}
+	}
+	query += " ORDER BY key"
+
+	services, err := s.queryServices(ctx, GetServicesOptions{}, query, s.keys.resolveKey(s.prefix, prefix))
 	if err != nil {
 		return nil, err
 	}
+	return filterServicesByType(services, recordType), nil
+}
+
+// GetServicesBySource retrieves the services under the given key prefix that
+// were created by the given source. With the default JSON codec the
+// filtering is pushed down into SQL.
+func (s *SQLiteBackend) GetServicesBySource(ctx context.Context, prefix, source string) ([]*Service, error) {
+	if s.closed.Load() {
+		return nil, ErrBackendClosed
+	}
+	if err := s.keys.validatePrefix(s.prefix, prefix); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	query := `SELECT key, value FROM services WHERE ` + sqlitePrefixMatch
+	var args []any
+	if _, ok := s.codec.(JSONCodec); ok {
+		query += ` AND coalesce(json_extract(value, '$.source'), '') = ?`
+		args = append(args, source)
+	}
+	query += " ORDER BY key"
+
+	services, err := s.queryServices(ctx, GetServicesOptions{}, query, s.keys.resolveKey(s.prefix, prefix), args...)
+	if err != nil {
+		return nil, err
+	}
+	return filterServicesBySource(services, source), nil
+}
+
+// queryServices runs a query returning (key, value) rows under prefix, its
+// sqlitePrefixMatch parameters followed by args, and decodes them into
+// services, deduplicated and with default priorities applied unless opts.Raw
+// is set.
+// The caller must hold s.mu.
+func (s *SQLiteBackend) queryServices(ctx context.Context, opts GetServicesOptions, query, prefix string, args ...any) ([]*Service, error) {
+	rows, err := s.db.QueryContext(ctx, query, append(s.keys.prefixArgs(prefix), args...)...)
+	if err != nil {
+		return nil, sqliteError(err)
+	}
 	defer rows.Close()
 
+	services, err := decodeServiceRows(rows, s.codec, s.keys, s.defaults, opts, prefix)
+	return services, sqliteError(err)
+}
+
+// decodeServiceRows decodes (key, value) rows read under prefix into
+// services, deduplicated and with default priorities applied unless opts.Raw
+// is set. Rows that can't be decoded are logged and skipped.
+func decodeServiceRows(rows *sql.Rows, codec Codec, keys KeyScheme, defaults ServiceDefaults, opts GetServicesOptions, prefix string) ([]*Service, error) {
 	// Deduplication map (same logic as etcd backend)
-	seen := make(map[Service]bool)
-	var services []*Service
+	seen := make(map[serviceDedupKey]bool)
+	services := []*Service{}
+	collapsed := 0
 
 	for rows.Next() {
-		var key, value string
+		// The value is only decoded, so it's read without copying it
+		var key string
+		var value sql.RawBytes
 		if err := rows.Scan(&key, &value); err != nil {
 			return nil, err
 		}
 
 		svc := new(Service)
-		if err := json.Unmarshal([]byte(value), svc); err != nil {
+		if err := codec.Unmarshal(value, svc); err != nil {
 			log.Warnf("Failed to unmarshal service at %s: %v", key, err)
 			continue
 		}
 		svc.Key = key
-
-		// Deduplicate based on content (same as etcd implementation)
-		dedupKey := Service{
-			Host:     svc.Host,
-			Port:     svc.Port,
-			Priority: svc.Priority,
-			Weight:   svc.Weight,
-			Text:     svc.Text,
-			Key:      key,
+		if opts.Raw {
+			services = append(services, svc)
+			continue
 		}
+
+		// Deduplicate based on the DNS answer (same as etcd implementation)
+		dedupKey := keys.dedupKeyFor(svc)
 		if seen[dedupKey] {
+			collapsed++
 			continue
 		}
 		seen[dedupKey] = true
 
-		// Default priority if not set
-		if svc.Priority == 0 {
-			svc.Priority = priority
-		}
-
 		services = append(services, svc)
 	}
 
 	if err := rows.Err(); err != nil {
 		return nil, err
 	}
+	if !opts.Raw {
+		recordCollapsed(prefix, collapsed)
+		// Default priority and weight if not set
+		serviceDefaultsOrDefault(defaults).applyTo(keys, services)
+	}
 
 	return services, nil
 }
 
 // SaveService persists a service record to SQLite.
 func (s *SQLiteBackend) SaveService(ctx context.Context, service *Service) error {
+	if s.closed.Load() {
+		return ErrBackendClosed
+	}
+	if err := service.Validate(); err != nil {
+		return err
+	}
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	value, err := json.Marshal(service)
+	value, err := s.codec.Marshal(service)
 	if err != nil {
 		return err
 	}
 
-	query := `
+	return s.execWithRetry(ctx, sqliteSaveQueries[ConflictOverwrite], s.keys.resolveKey(s.prefix, service.Key), string(value), sqliteTime(s.now()))
+}
+
+// sqliteSaveQueries are the upserts implementing each ConflictMode.
+// updated_at is stored in a fixed-width format, so comparing it as text
+// orders it by time.
+var sqliteSaveQueries = map[ConflictMode]string{
+	ConflictOverwrite: `
 		INSERT INTO services (key, value, updated_at)
-		VALUES (?, ?, CURRENT_TIMESTAMP)
+		VALUES (?, ?, ?)
 		ON CONFLICT(key) DO UPDATE SET
 			value = excluded.value,
-			updated_at = CURRENT_TIMESTAMP
-	`
+			updated_at = excluded.updated_at
+	`,
+	ConflictSkipIfExists: `
+		INSERT INTO services (key, value, updated_at)
+		VALUES (?, ?, ?)
+		ON CONFLICT(key) DO NOTHING
+	`,
+	ConflictNewestWins: `
+		INSERT INTO services (key, value, updated_at)
+		VALUES (?, ?, ?)
+		ON CONFLICT(key) DO UPDATE SET
+			value = excluded.value,
+			updated_at = excluded.updated_at
+		WHERE excluded.updated_at > services.updated_at
+	`,
+}
 
-	_, err = s.db.ExecContext(ctx, query, service.Key, string(value))
-	return err
+// UpdateService replaces the service stored at the service's key, failing
+// with ErrNotFound if there is none, unlike SaveService. The existence check
+// and the write are a single UPDATE.
+func (s *SQLiteBackend) UpdateService(ctx context.Context, service *Service) error {
+	if s.closed.Load() {
+		return ErrBackendClosed
+	}
+	if err := service.Validate(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	value, err := s.codec.Marshal(service)
+	if err != nil {
+		return err
+	}
+
+	key := s.keys.resolveKey(s.prefix, service.Key)
+	result, err := s.execResultWithRetry(ctx, "UPDATE services SET value = ?, updated_at = ? WHERE key = ?", string(value), sqliteTime(s.now()), key)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return sqliteError(err)
+	}
+	if n == 0 {
+		return fmt.Errorf("%w: no service stored at %s", ErrNotFound, key)
+	}
+	return nil
+}
+
+// SaveServiceWithPolicy saves the service unless policy says the stored one
+// wins, and reports whether it was written. Newest-wins compares the policy
+// timestamp with the updated_at column, and the check and write happen in a
+// single statement.
+func (s *SQLiteBackend) SaveServiceWithPolicy(ctx context.Context, service *Service, policy ConflictPolicy) (bool, error) {
+	if s.closed.Load() {
+		return false, ErrBackendClosed
+	}
+	if err := service.Validate(); err != nil {
+		return false, err
+	}
+	if err := policy.validate(); err != nil {
+		return false, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	value, err := s.codec.Marshal(service)
+	if err != nil {
+		return false, err
+	}
+
+	result, err := s.execResultWithRetry(ctx, sqliteSaveQueries[policy.Mode], s.keys.resolveKey(s.prefix, service.Key), string(value), sqliteTime(policy.timestamp(s.now)))
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, sqliteError(err)
+	}
+	return n > 0, nil
+}
+
+// GetChangedSince returns the services matching the given key prefix that
+// were saved after since, in key order. Services are returned as stored,
+// without deduplication, so that every changed key is reported.
+func (s *SQLiteBackend) GetChangedSince(ctx context.Context, prefix string, since time.Time) ([]*Service, error) {
+	if s.closed.Load() {
+		return nil, ErrBackendClosed
+	}
+	if err := s.keys.validatePrefix(s.prefix, prefix); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	query := `SELECT key, value FROM services WHERE ` + sqlitePrefixMatch + ` AND updated_at > ? ORDER BY key`
+	return s.queryServices(ctx, GetServicesOptions{Raw: true}, query, s.keys.resolveKey(s.prefix, prefix), sqliteTime(since))
+}
+
+// ForEach calls fn for each service matching the given key prefix.
+// Rows are decoded one at a time as they are read from the database.
+func (s *SQLiteBackend) ForEach(ctx context.Context, prefix string, fn func(key string, svc *Service) error) error {
+	if err := s.keys.validatePrefix(s.prefix, prefix); err != nil {
+		return err
+	}
+	return s.scanRecords(ctx, prefix, func(key string, svc *Service, err error) error {
+		if err != nil {
+			log.Warnf("Failed to unmarshal service at %s: %v", key, err)
+			return nil
+		}
+		return fn(key, svc)
+	})
+}
+
+// scanRecords calls fn for each record under prefix, in key order, with the
+// decoded service or the error decoding it.
+func (s *SQLiteBackend) scanRecords(ctx context.Context, prefix string, fn func(key string, svc *Service, err error) error) error {
+	if s.closed.Load() {
+		return ErrBackendClosed
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	query := `SELECT key, value FROM services WHERE ` + sqlitePrefixMatch + ` ORDER BY key`
+	rows, err := s.db.QueryContext(ctx, query, s.keys.prefixArgs(s.keys.resolveKey(s.prefix, prefix))...)
+	if err != nil {
+		return sqliteError(err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		var key, value string
+		if err := rows.Scan(&key, &value); err != nil {
+			return sqliteError(err)
+		}
+
+		svc := new(Service)
+		if err := s.codec.Unmarshal([]byte(value), svc); err != nil {
+			if err := fn(key, nil, err); err != nil {
+				return err
+			}
+			continue
+		}
+		svc.Key = key
+
+		if err := fn(key, svc, nil); err != nil {
+			return err
+		}
+	}
+
+	return sqliteError(rows.Err())
+}
+
+// StreamKeys calls fn with each key under prefix in key order, as the rows
+// are read, stopping at the first error or when ctx is done.
+func (s *SQLiteBackend) StreamKeys(ctx context.Context, prefix string, fn func(key string) error) error {
+	if s.closed.Load() {
+		return ErrBackendClosed
+	}
+	if err := s.keys.validatePrefix(s.prefix, prefix); err != nil {
+		return err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	query := `SELECT key FROM services WHERE ` + sqlitePrefixMatch + ` ORDER BY key`
+	rows, err := s.db.QueryContext(ctx, query, s.keys.prefixArgs(s.keys.resolveKey(s.prefix, prefix))...)
+	if err != nil {
+		return sqliteError(err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return sqliteError(err)
+		}
+		if err := fn(key); err != nil {
+			return err
+		}
+	}
+	return sqliteError(rows.Err())
+}
+
+// GetServicesPage returns up to limit services matching the given key prefix
+// whose key sorts after afterKey, in key order.
+func (s *SQLiteBackend) GetServicesPage(ctx context.Context, prefix, afterKey string, limit int) ([]*Service, string, error) {
+	if s.closed.Load() {
+		return nil, "", ErrBackendClosed
+	}
+	if err := s.keys.validatePrefix(s.prefix, prefix); err != nil {
+		return nil, "", err
+	}
+	if limit <= 0 {
+		return nil, "", ErrInvalidPageLimit
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	query := `SELECT key, value FROM services WHERE ` + sqlitePrefixMatch + ` AND key > ? ORDER BY key LIMIT ?`
+	rows, err := s.db.QueryContext(ctx, query, append(s.keys.prefixArgs(s.keys.resolveKey(s.prefix, prefix)), afterKey, limit)...)
+	if err != nil {
+		return nil, "", sqliteError(err)
+	}
+	defer rows.Close()
+
+	page := make([]*Service, 0, limit)
+	for rows.Next() {
+		var key, value string
+		if err := rows.Scan(&key, &value); err != nil {
+			return nil, "", sqliteError(err)
+		}
+
+		svc := new(Service)
+		if err := s.codec.Unmarshal([]byte(value), svc); err != nil {
+			log.Warnf("Failed to unmarshal service at %s: %v", key, err)
+			continue
+		}
+		svc.Key = key
+		page = append(page, svc)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", sqliteError(err)
+	}
+
+	return page, nextCursor(page, limit), nil
+}
+
+// Exists reports whether any service matches the given key prefix.
+func (s *SQLiteBackend) Exists(ctx context.Context, prefix string) (bool, error) {
+	if s.closed.Load() {
+		return false, ErrBackendClosed
+	}
+	if err := s.keys.validatePrefix(s.prefix, prefix); err != nil {
+		return false, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var exists bool
+	query := `SELECT EXISTS(SELECT 1 FROM services WHERE ` + sqlitePrefixMatch + `)`
+	if err := s.db.QueryRowContext(ctx, query, s.keys.prefixArgs(s.keys.resolveKey(s.prefix, prefix))...).Scan(&exists); err != nil {
+		return false, sqliteError(err)
+	}
+	return exists, nil
+}
+
+// Snapshot returns a copy of the services stored under the backend's root
+// prefix, read inside a single transaction so concurrent writes can't
+// produce a torn view. It fails if a stored value can't be decoded. For file
+// databases the transaction runs on a separate read-only connection and
+// doesn't block writers while the snapshot is read.
+func (s *SQLiteBackend) Snapshot(ctx context.Context) (map[string]Service, error) {
+	if s.closed.Load() {
+		return nil, ErrBackendClosed
+	}
+
+	db := s.snapshotDB
+	if db == nil {
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+		db = s.db
+	}
+
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return nil, sqliteError(err)
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, `SELECT key, value FROM services WHERE `+sqlitePrefixMatch, s.keys.prefixArgs(s.rootPrefix())...)
+	if err != nil {
+		return nil, sqliteError(err)
+	}
+	defer rows.Close()
+
+	snapshot := make(map[string]Service)
+	for rows.Next() {
+		var key, value string
+		if err := rows.Scan(&key, &value); err != nil {
+			return nil, sqliteError(err)
+		}
+
+		var svc Service
+		if err := s.codec.Unmarshal([]byte(value), &svc); err != nil {
+			return nil, fmt.Errorf("%s: %w", key, err)
+		}
+		snapshot[key] = svc
+	}
+	if err := rows.Err(); err != nil {
+		return nil, sqliteError(err)
+	}
+
+	return snapshot, nil
 }
 
 // DeleteService removes all services matching the key prefix.
 func (s *SQLiteBackend) DeleteService(ctx context.Context, key string) error {
+	if s.closed.Load() {
+		return ErrBackendClosed
+	}
+	if err := s.keys.validatePrefix(s.prefix, key); err != nil {
+		return err
+	}
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	// Delete exact match and all children (prefix-based delete like etcd)
-	query := `DELETE FROM services WHERE key = ? OR key LIKE ? || '/%'`
-	_, err := s.db.ExecContext(ctx, query, key, key)
+	return s.execWithRetry(ctx, sqliteDeleteQuery, s.keys.prefixArgs(s.keys.resolveKey(s.prefix, key))...)
+}
+
+// deleteIfCovered deletes key and its children if covered accepts all of
+// them. The keys are read and deleted in one transaction under the write
+// lock; if another connection writes in between, SQLite fails the
+// transaction rather than deleting its write.
+func (s *SQLiteBackend) deleteIfCovered(ctx context.Context, key string, covered func(key string) bool) (bool, error) {
+	if s.closed.Load() {
+		return false, ErrBackendClosed
+	}
+	if err := s.keys.validatePrefix(s.prefix, key); err != nil {
+		return false, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	args := s.keys.prefixArgs(s.keys.resolveKey(s.prefix, key))
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, sqliteError(err)
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, "SELECT key FROM services WHERE "+sqlitePrefixMatch, args...)
+	if err != nil {
+		return false, sqliteError(err)
+	}
+	all := true
+	for rows.Next() {
+		var k string
+		if err := rows.Scan(&k); err != nil {
+			rows.Close()
+			return false, sqliteError(err)
+		}
+		if !covered(k) {
+			all = false
+			break
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return false, sqliteError(err)
+	}
+	if !all {
+		return false, nil
+	}
+
+	if _, err := tx.ExecContext(ctx, sqliteDeleteQuery, args...); err != nil {
+		return false, sqliteError(err)
+	}
+	if err := tx.Commit(); err != nil {
+		return false, sqliteError(err)
+	}
+	return true, nil
+}
+
+// ClearPrefix removes every service under prefix, refusing the root prefix.
+func (s *SQLiteBackend) ClearPrefix(ctx context.Context, prefix string) error {
+	if err := s.keys.validateClearPrefix(s.prefix, prefix); err != nil {
+		return err
+	}
+	return s.DeleteService(ctx, prefix)
+}
+
+// sqlitePrefixMatch matches the keys addressed by a prefix, given the
+// arguments returned by prefixArgs: the prefix and the keys in its child
+// range, which, unlike LIKE, is served by the primary key index.
+const sqlitePrefixMatch = `(key = ? OR (key >= ? AND key < ?))`
+
+// prefixArgs returns the arguments of a prefix match of the cleaned prefix.
+func (k KeyScheme) prefixArgs(prefix string) []any {
+	lower, upper := k.childKeyRange(prefix)
+	return []any{prefix, lower, upper}
+}
+
+// sqliteDeleteQuery deletes the keys addressed by a prefix.
+const sqliteDeleteQuery = `DELETE FROM services WHERE ` + sqlitePrefixMatch
+
+// childKeyRange returns the bounds of the half-open range [lower, upper)
+// holding exactly the keys under key, i.e. those starting with key and the
+// separator.
+func (k KeyScheme) childKeyRange(key string) (lower, upper string) {
+	lower = k.childPrefix(key)
+	return lower, lower[:len(lower)-1] + string(rune(k.sep()[0]+1))
+}
+
+const (
+	// sqliteBusyRetries bounds how many times a write is retried while the
+	// database is busy or locked, on top of the driver's busy_timeout.
+	sqliteBusyRetries = 5
+
+	// sqliteBusyBackoff is the delay before the first retry, doubled after each.
+	sqliteBusyBackoff = 10 * time.Millisecond
+)
+
+// execWithRetry runs a write statement, retrying with jittered exponential
+// backoff while it fails with SQLITE_BUSY or SQLITE_LOCKED. Other errors,
+// such as constraint violations, are returned immediately.
+func (s *SQLiteBackend) execWithRetry(ctx context.Context, query string, args ...any) error {
+	_, err := s.execResultWithRetry(ctx, query, args...)
+	return err
+}
+
+// execResultWithRetry is execWithRetry returning the statement's result.
+// If ctx carries a Durability other than the default, the statement runs on
+// a dedicated connection whose synchronous setting is changed for it and
+// restored afterwards.
+func (s *SQLiteBackend) execResultWithRetry(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	level, ok := sqliteSynchronous[durabilityFrom(ctx)]
+	if !ok || s.path == ":memory:" {
+		return execWithBusyRetry(ctx, s.db, query, args...)
+	}
+
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return nil, sqliteError(err)
+	}
+	defer conn.Close()
+
+	var previous int
+	if err := conn.QueryRowContext(ctx, "PRAGMA synchronous").Scan(&previous); err != nil {
+		return nil, sqliteError(err)
+	}
+	if _, err := conn.ExecContext(ctx, "PRAGMA synchronous = "+level); err != nil {
+		return nil, sqliteError(err)
+	}
+	result, err := execWithBusyRetry(ctx, conn, query, args...)
+	if _, restoreErr := conn.ExecContext(context.WithoutCancel(ctx), fmt.Sprintf("PRAGMA synchronous = %d", previous)); restoreErr != nil {
+		// Drop the connection rather than pool it with the write's setting
+		log.Warnf("Failed to restore SQLite synchronous setting, discarding connection: %v", restoreErr)
+		_ = conn.Raw(func(any) error { return driver.ErrBadConn })
+	}
+	return result, err
+}
+
+// sqliteSynchronous maps a Durability to the PRAGMA synchronous level of its
+// writes. DurabilityDefault keeps the connection's setting.
+var sqliteSynchronous = map[Durability]string{
+	DurabilityRelaxed: "OFF",
+	DurabilitySync:    "FULL",
+}
+
+// sqliteExecer is implemented by *sql.DB and *sql.Conn.
+type sqliteExecer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+// execWithBusyRetry runs a write statement on db, retrying while the database
+// is busy or locked.
+func execWithBusyRetry(ctx context.Context, db sqliteExecer, query string, args ...any) (sql.Result, error) {
+	backoff := sqliteBusyBackoff
+	for attempt := 0; ; attempt++ {
+		result, err := db.ExecContext(ctx, query, args...)
+		if err == nil || !isSQLiteBusy(err) || attempt == sqliteBusyRetries {
+			return result, sqliteError(err)
+		}
+
+		delay := backoff/2 + time.Duration(rand.Int63n(int64(backoff)))
+		log.Debugf("SQLite database is busy, retrying in %s: %v", delay, err)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(delay):
+		}
+		backoff *= 2
+	}
+}
+
+// isSQLiteBusy reports whether err is a transient SQLITE_BUSY or SQLITE_LOCKED error.
+func isSQLiteBusy(err error) bool {
+	var coder interface{ Code() int }
+	if !errors.As(err, &coder) {
+		return false
+	}
+	// Extended result codes keep the primary code in the low byte
+	switch coder.Code() & 0xff {
+	case sqlite3.SQLITE_BUSY, sqlite3.SQLITE_LOCKED:
+		return true
+	}
+	return false
+}
+
+// Health pings the database.
+func (s *SQLiteBackend) Health(ctx context.Context) error {
+	if s.closed.Load() {
+		return ErrBackendClosed
+	}
+	return sqliteError(s.db.PingContext(ctx))
+}
+
+// Flush checkpoints the write-ahead log into the database file, so that the
+// file alone holds every committed write. It is a no-op for in-memory databases.
+func (s *SQLiteBackend) Flush(ctx context.Context) error {
+	if s.closed.Load() {
+		return ErrBackendClosed
+	}
+	if s.path == ":memory:" {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err := s.db.ExecContext(ctx, "PRAGMA wal_checkpoint(TRUNCATE)")
+	return sqliteError(err)
+}
+
+// Backup writes a consistent copy of the database to destPath with VACUUM
+// INTO, while the backend stays open. The copy is a read transaction, so it
+// sees the database as of its start, including the write-ahead log. For file
+// databases it runs on the read-only connection Snapshot uses and doesn't
+// block writers. It is written next to destPath and linked into place once
+// complete; an existing destPath is not overwritten.
+func (s *SQLiteBackend) Backup(ctx context.Context, destPath string) error {
+	if s.closed.Load() {
+		return ErrBackendClosed
+	}
+	if _, err := os.Stat(destPath); err == nil {
+		return fmt.Errorf("backup destination %s: %w", destPath, os.ErrExist)
+	}
+
+	tmp := destPath + ".tmp"
+	if err := os.Remove(tmp); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	defer os.Remove(tmp)
+	if err := s.vacuumInto(ctx, tmp); err != nil {
+		return fmt.Errorf("backing up %s to %s: %w", s.path, destPath, sqliteError(err))
+	}
+	// Unlike a rename, a link fails if destPath was created in the meantime
+	if err := os.Link(tmp, destPath); err != nil {
+		return fmt.Errorf("backup destination %s: %w", destPath, err)
+	}
+	return nil
+}
+
+// vacuumInto runs VACUUM INTO path. For file databases it runs on the
+// snapshot connection, which is only allowed to write the new file while
+// query_only is lifted for the statement.
+func (s *SQLiteBackend) vacuumInto(ctx context.Context, path string) error {
+	if s.snapshotDB == nil {
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+		_, err := s.db.ExecContext(ctx, "VACUUM INTO ?", path)
+		return err
+	}
+
+	conn, err := s.snapshotDB.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, "PRAGMA query_only = 0"); err != nil {
+		return err
+	}
+	_, err = conn.ExecContext(ctx, "VACUUM INTO ?", path)
+	if _, restoreErr := conn.ExecContext(context.WithoutCancel(ctx), "PRAGMA query_only = 1"); restoreErr != nil {
+		// Drop the connection rather than pool it writable
+		log.Warnf("Failed to restore SQLite query_only setting, discarding connection: %v", restoreErr)
+		_ = conn.Raw(func(any) error { return driver.ErrBadConn })
+	}
 	return err
 }
 
-// Close closes the database connection.
+// Capabilities reports that SQLite applies writes in transactions and, unless
+// the database is in-memory, persists them.
+func (s *SQLiteBackend) Capabilities() BackendCapabilities {
+	return BackendCapabilities{
+		SupportsTransactions: true,
+		Persistent:           s.path != ":memory:",
+	}
+}
+
+// Close checkpoints the write-ahead log and closes the database connection.
+// Subsequent calls are no-ops and return nil.
 func (s *SQLiteBackend) Close() error {
+	if !s.closed.CompareAndSwap(false, true) {
+		return nil
+	}
+	if s.stopReaper != nil {
+		s.stopReaper()
+	}
+
+	// Wait for in-flight operations before closing the connection
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.snapshotDB != nil {
+		// Waits for in-flight snapshots, whose readers would hold back the checkpoint
+		if err := s.snapshotDB.Close(); err != nil {
+			log.Warnf("Failed to close SQLite snapshot connection to %s: %v", s.path, err)
+		}
+	}
+
+	// Merge the WAL into the database and truncate it, so no -wal file is
+	// left behind for the next start
+	if s.path != ":memory:" {
+		if _, err := s.db.Exec("PRAGMA wal_checkpoint(TRUNCATE)"); err != nil {
+			log.Warnf("Failed to checkpoint SQLite WAL at %s: %v", s.path, err)
+		}
+	}
 	return s.db.Close()
 }
 
@@ -197,22 +1083,54 @@ func (s *SQLiteBackend) Path() string {
 
 // Count returns the number of services stored (useful for testing/debugging).
 func (s *SQLiteBackend) Count(ctx context.Context) (int, error) {
+	if s.closed.Load() {
+		return 0, ErrBackendClosed
+	}
+
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
 	var count int
 	err := s.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM services").Scan(&count)
-	return count, err
+	return count, sqliteError(err)
+}
+
+// IsEmpty reports whether no service is stored, without counting them.
+func (s *SQLiteBackend) IsEmpty(ctx context.Context) (bool, error) {
+	if s.closed.Load() {
+		return false, ErrBackendClosed
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var exists bool
+	err := s.db.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM services)").Scan(&exists)
+	return !exists, sqliteError(err)
+}
+
+// rootPrefix returns the prefix addressing every stored service.
+func (s *SQLiteBackend) rootPrefix() string {
+	return s.prefix + s.keys.sep()
+}
+
+// keyScheme returns the scheme of the stored keys.
+func (s *SQLiteBackend) keyScheme() KeyScheme {
+	return s.keys
 }
 
 // Keys returns all stored keys (useful for debugging).
 func (s *SQLiteBackend) Keys(ctx context.Context) ([]string, error) {
+	if s.closed.Load() {
+		return nil, ErrBackendClosed
+	}
+
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
 	rows, err := s.db.QueryContext(ctx, "SELECT key FROM services ORDER BY key")
 	if err != nil {
-		return nil, err
+		return nil, sqliteError(err)
 	}
 	defer rows.Close()
 
@@ -220,19 +1138,9 @@ func (s *SQLiteBackend) Keys(ctx context.Context) ([]string, error) {
 	for rows.Next() {
 		var key string
 		if err := rows.Scan(&key); err != nil {
-			return nil, err
+			return nil, sqliteError(err)
 		}
 		keys = append(keys, key)
 	}
-	return keys, rows.Err()
-}
-
-// keyMatchesPrefix checks if a key matches a prefix (for hierarchical keys).
-func keyMatchesPrefix(key, prefix string) bool {
-	if !strings.HasPrefix(key, prefix) {
-		return false
-	}
-	// Ensure we're matching complete path components
-	rest := key[len(prefix):]
-	return rest == "" || strings.HasPrefix(rest, "/")
+	return keys, sqliteError(rows.Err())
 }
@@ -0,0 +1,124 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package coredns
+
+import (
+	"context"
+	"time"
+)
+
+// sqliteTimeParseLayout parses updated_at values written with
+// sqliteTimeFormat as well as second-resolution CURRENT_TIMESTAMP values.
+const sqliteTimeParseLayout = "2006-01-02 15:04:05.999999999"
+
+// startReaper runs Reap every interval until the returned function is called.
+// The function waits for the reaper goroutine to exit (see backgroundTask.stop).
+func (s *SQLiteBackend) startReaper(interval time.Duration) func() {
+	task := startBackgroundTask("SQLite reaper", func(ctx context.Context) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			reaped, err := s.Reap(ctx)
+			switch {
+			case err != nil && ctx.Err() == nil:
+				log.Warnf("Failed to reap expired SQLite services: %v", err)
+			case reaped > 0:
+				log.Infof("Reaped %d expired SQLite services", reaped)
+			}
+		}
+	})
+	return task.stop
+}
+
+// Reap deletes the services whose TTL has elapsed since they were last saved
+// and returns how many were deleted. Services with a zero TTL never expire.
+// The write lock is held for the whole pass, so no write interleaves between
+// finding an expired service and deleting it.
+func (s *SQLiteBackend) Reap(ctx context.Context) (int, error) {
+	if s.closed.Load() {
+		return 0, ErrBackendClosed
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	expired, err := s.expiredKeys(ctx, s.now())
+	if err != nil || len(expired) == 0 {
+		return 0, err
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, sqliteError(err)
+	}
+	defer tx.Rollback()
+
+	for _, key := range expired {
+		if _, err := tx.ExecContext(ctx, "DELETE FROM services WHERE key = ?", key); err != nil {
+			return 0, sqliteError(err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, sqliteError(err)
+	}
+	return len(expired), nil
+}
+
+// expiredKeys returns the keys of the services whose TTL has elapsed at now.
+// The rows are fully read before returning, since the single connection is
+// needed to delete them.
+func (s *SQLiteBackend) expiredKeys(ctx context.Context, now time.Time) ([]string, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT key, value, CAST(updated_at AS TEXT) FROM services")
+	if err != nil {
+		return nil, sqliteError(err)
+	}
+	defer rows.Close()
+
+	var expired []string
+	for rows.Next() {
+		var key, value, updatedAt string
+		if err := rows.Scan(&key, &value, &updatedAt); err != nil {
+			return nil, sqliteError(err)
+		}
+
+		var svc Service
+		if err := s.codec.Unmarshal([]byte(value), &svc); err != nil {
+			log.Warnf("Failed to unmarshal service at %s: %v", key, err)
+			continue
+		}
+		if svc.TTL == 0 {
+			continue
+		}
+
+		updated, err := time.Parse(sqliteTimeParseLayout, updatedAt)
+		if err != nil {
+			log.Warnf("Failed to parse update time %q of %s: %v", updatedAt, key, err)
+			continue
+		}
+		if updated.Add(time.Duration(svc.TTL) * time.Second).Before(now) {
+			expired = append(expired, key)
+		}
+	}
+	return expired, sqliteError(rows.Err())
+}
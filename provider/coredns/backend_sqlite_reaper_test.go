@@ -0,0 +1,115 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package coredns
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newFakeClock returns a FakeClock stopped at the start of 2024.
+func newFakeClock() *FakeClock {
+	return NewFakeClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+}
+
+func TestSQLiteBackend_Reap(t *testing.T) {
+	clock := newFakeClock()
+	backend, err := NewSQLiteBackendWithOptions(":memory:", SQLiteOptions{Clock: clock})
+	require.NoError(t, err)
+	defer backend.Close()
+
+	ctx := context.Background()
+	require.NoError(t, backend.SaveService(ctx, &Service{Host: "1.1.1.1", TTL: 60, Key: "/skydns/com/example/short"}))
+	require.NoError(t, backend.SaveService(ctx, &Service{Host: "2.2.2.2", TTL: 3600, Key: "/skydns/com/example/long"}))
+	require.NoError(t, backend.SaveService(ctx, &Service{Host: "3.3.3.3", Key: "/skydns/com/example/forever"}))
+	require.NoError(t, backend.SaveService(ctx, &Service{Host: "4.4.4.4", TTL: 60, Key: "/skydns/com/example/refreshed"}))
+
+	clock.Advance(30 * time.Second)
+	reaped, err := backend.Reap(ctx)
+	require.NoError(t, err)
+	assert.Zero(t, reaped)
+
+	// Saving again restarts the TTL
+	require.NoError(t, backend.SaveService(ctx, &Service{Host: "4.4.4.4", TTL: 60, Key: "/skydns/com/example/refreshed"}))
+
+	clock.Advance(31 * time.Second)
+	reaped, err = backend.Reap(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, reaped)
+
+	keys, err := backend.Keys(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"/skydns/com/example/forever", "/skydns/com/example/long", "/skydns/com/example/refreshed"}, keys)
+
+	clock.Advance(24 * time.Hour)
+	reaped, err = backend.Reap(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 2, reaped)
+
+	keys, err = backend.Keys(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"/skydns/com/example/forever"}, keys)
+}
+
+func TestSQLiteBackend_ReapLegacyTimestamps(t *testing.T) {
+	clock := newFakeClock()
+	backend, err := NewSQLiteBackendWithOptions(":memory:", SQLiteOptions{Clock: clock})
+	require.NoError(t, err)
+	defer backend.Close()
+
+	// Rows written by older versions carry second-resolution CURRENT_TIMESTAMP values
+	_, err = backend.db.Exec(`INSERT INTO services (key, value, updated_at) VALUES (?, ?, ?)`,
+		"/skydns/com/example/old", `{"host":"1.1.1.1","ttl":60}`, "2023-12-31 23:59:00")
+	require.NoError(t, err)
+
+	reaped, err := backend.Reap(context.Background())
+	require.NoError(t, err)
+	assert.Zero(t, reaped)
+
+	clock.Advance(time.Second)
+	reaped, err = backend.Reap(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 1, reaped)
+}
+
+func TestSQLiteBackend_ReaperRunsPeriodically(t *testing.T) {
+	clock := newFakeClock()
+	backend, err := NewSQLiteBackendWithOptions(":memory:", SQLiteOptions{
+		Clock:        clock,
+		ReapInterval: 5 * time.Millisecond,
+	})
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	require.NoError(t, backend.SaveService(ctx, &Service{Host: "1.1.1.1", TTL: 60, Key: "/skydns/com/example/www"}))
+	clock.Advance(time.Hour)
+
+	assert.Eventually(t, func() bool {
+		count, err := backend.Count(ctx)
+		require.NoError(t, err)
+		return count == 0
+	}, time.Second, 5*time.Millisecond)
+
+	// Close stops the reaper
+	require.NoError(t, backend.Close())
+	_, err = backend.Reap(ctx)
+	assert.ErrorIs(t, err, ErrBackendClosed)
+}
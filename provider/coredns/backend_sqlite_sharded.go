@@ -0,0 +1,506 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package coredns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ErrShardCountMismatch is returned when sharded SQLite databases are opened
+// with a shard count other than the one they were created with, which would
+// route keys to shards that don't hold them.
+var ErrShardCountMismatch = errors.New("SQLite shard count mismatch")
+
+// sqliteShardSchema creates the table recording the layout of the shards
+// in each shard database.
+const sqliteShardSchema = `CREATE TABLE IF NOT EXISTS shard_meta (name TEXT PRIMARY KEY, value INTEGER NOT NULL)`
+
+// sqliteShardDepth is the number of labels below the prefix that make the
+// zone a key is routed by, e.g. "com/example".
+const sqliteShardDepth = 2
+
+// ShardedSQLiteBackend spreads services over several SQLite databases, so
+// that writes to different zones don't contend for a single file. A key is
+// routed by hashing its zone, the prefix and two labels below it, so every
+// key of a zone lands in the same shard.
+//
+// Queries under a zone (e.g. "/skydns/com/example/") are served by its
+// shard; broader ones, such as the root prefix, are fanned out to every
+// shard and merged in key order. Writes to different shards are not atomic
+// with each other.
+type ShardedSQLiteBackend struct {
+	shards []*SQLiteBackend
+	prefix string
+	keys   KeyScheme
+}
+
+// Compile-time check that ShardedSQLiteBackend implements Backend
+var _ Backend = (*ShardedSQLiteBackend)(nil)
+
+// NewShardedSQLiteBackend opens n SQLite databases named after path with
+// the shard number before the extension, e.g. coredns-0.db for coredns.db.
+// With ":memory:", every shard is a separate in-memory database.
+//
+// Each database records the shard count and its shard number when first
+// opened; reopening it with another count, or as another shard, fails with
+// ErrShardCountMismatch.
+func NewShardedSQLiteBackend(path string, n int, opts SQLiteOptions) (*ShardedSQLiteBackend, error) {
+	if n < 1 {
+		return nil, fmt.Errorf("invalid SQLite shard count %d: must be at least 1", n)
+	}
+	b := &ShardedSQLiteBackend{
+		shards: make([]*SQLiteBackend, 0, n),
+		prefix: opts.Keys.normalizePrefix(opts.Prefix),
+		keys:   opts.Keys,
+	}
+	for i := 0; i < n; i++ {
+		shard, err := NewSQLiteBackendWithOptions(sqliteShardPath(path, i), opts)
+		if err != nil {
+			b.Close()
+			return nil, err
+		}
+		b.shards = append(b.shards, shard)
+		if err := checkShardLayout(shard, i, n); err != nil {
+			b.Close()
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+// checkShardLayout records in shard, if not done yet, that it is shard i of
+// n, and checks that it was not recorded as part of another layout.
+func checkShardLayout(shard *SQLiteBackend, i, n int) error {
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	ctx := context.Background()
+	if _, err := shard.db.ExecContext(ctx, sqliteShardSchema); err != nil {
+		return sqliteError(err)
+	}
+	if _, err := shard.db.ExecContext(ctx, `INSERT OR IGNORE INTO shard_meta (name, value) VALUES ('shard_count', ?), ('shard_index', ?)`, n, i); err != nil {
+		return sqliteError(err)
+	}
+
+	var count, index int
+	if err := shard.db.QueryRowContext(ctx, `SELECT value FROM shard_meta WHERE name = 'shard_count'`).Scan(&count); err != nil {
+		return sqliteError(err)
+	}
+	if err := shard.db.QueryRowContext(ctx, `SELECT value FROM shard_meta WHERE name = 'shard_index'`).Scan(&index); err != nil {
+		return sqliteError(err)
+	}
+	if count != n || index != i {
+		return fmt.Errorf("%w: %s is shard %d of %d, opened as shard %d of %d", ErrShardCountMismatch, shard.path, index, count, i, n)
+	}
+	return nil
+}
+
+// sqliteShardPath returns the database file of shard i of path.
+func sqliteShardPath(path string, i int) string {
+	if path == ":memory:" {
+		return path
+	}
+	ext := filepath.Ext(path)
+	return fmt.Sprintf("%s-%d%s", strings.TrimSuffix(path, ext), i, ext)
+}
+
+// shardFor returns the shard holding the resolved key.
+func (b *ShardedSQLiteBackend) shardFor(key string) *SQLiteBackend {
+	zone, _ := b.keys.zoneKey(b.prefix, key, sqliteShardDepth)
+	h := fnv.New32a()
+	h.Write([]byte(zone))
+	return b.shards[h.Sum32()%uint32(len(b.shards))]
+}
+
+// shardsFor resolves prefix and returns the shards that may hold keys
+// addressed by it: its zone's shard if the prefix is within a zone, all of
+// them otherwise.
+func (b *ShardedSQLiteBackend) shardsFor(prefix string) (string, []*SQLiteBackend) {
+	prefix = b.keys.resolveKey(b.prefix, prefix)
+	if _, complete := b.keys.zoneKey(b.prefix, b.keys.childPrefix(prefix), sqliteShardDepth); complete {
+		return prefix, []*SQLiteBackend{b.shardFor(prefix)}
+	}
+	return prefix, b.shards
+}
+
+// gatherShards calls get on each shard and returns the services in key order.
+func gatherShards(shards []*SQLiteBackend, get func(shard *SQLiteBackend) ([]*Service, error)) ([]*Service, error) {
+	services := []*Service{}
+	for _, shard := range shards {
+		found, err := get(shard)
+		if err != nil {
+			return nil, err
+		}
+		services = append(services, found...)
+	}
+	if len(shards) > 1 {
+		sort.SliceStable(services, func(i, j int) bool {
+			return services[i].Key < services[j].Key
+		})
+	}
+	return services, nil
+}
+
+// GetServices retrieves all services matching the given key prefix.
+func (b *ShardedSQLiteBackend) GetServices(ctx context.Context, prefix string) ([]*Service, error) {
+	return b.GetServicesWithOptions(ctx, prefix, GetServicesOptions{})
+}
+
+// GetServicesWithOptions retrieves all services matching the given key
+// prefix, in key order. Services of several shards are deduplicated and
+// defaulted once merged, unless opts.Raw is set.
+func (b *ShardedSQLiteBackend) GetServicesWithOptions(ctx context.Context, prefix string, opts GetServicesOptions) ([]*Service, error) {
+	if err := b.keys.validatePrefix(b.prefix, prefix); err != nil {
+		return nil, err
+	}
+	prefix, shards := b.shardsFor(prefix)
+	if len(shards) == 1 {
+		return shards[0].GetServicesWithOptions(ctx, prefix, opts)
+	}
+	all, err := gatherShards(shards, func(shard *SQLiteBackend) ([]*Service, error) {
+		return shard.GetServicesWithOptions(ctx, prefix, GetServicesOptions{Raw: true})
+	})
+	if err != nil || opts.Raw {
+		return all, err
+	}
+	services := b.keys.dedupServices(all)
+	recordCollapsed(prefix, len(all)-len(services))
+	serviceDefaultsOrDefault(b.shards[0].defaults).applyTo(b.keys, services)
+	return services, nil
+}
+
+// GetServicesByType retrieves the services under the given key prefix that
+// produce a record of the given type.
+func (b *ShardedSQLiteBackend) GetServicesByType(ctx context.Context, prefix, recordType string) ([]*Service, error) {
+	if err := b.keys.validatePrefix(b.prefix, prefix); err != nil {
+		return nil, err
+	}
+	prefix, shards := b.shardsFor(prefix)
+	if len(shards) == 1 {
+		return shards[0].GetServicesByType(ctx, prefix, recordType)
+	}
+	services, err := b.GetServices(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	return filterServicesByType(services, recordType), nil
+}
+
+// GetServicesBySource retrieves the services under the given key prefix
+// that were created by the given source.
+func (b *ShardedSQLiteBackend) GetServicesBySource(ctx context.Context, prefix, source string) ([]*Service, error) {
+	if err := b.keys.validatePrefix(b.prefix, prefix); err != nil {
+		return nil, err
+	}
+	prefix, shards := b.shardsFor(prefix)
+	if len(shards) == 1 {
+		return shards[0].GetServicesBySource(ctx, prefix, source)
+	}
+	services, err := b.GetServices(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	return filterServicesBySource(services, source), nil
+}
+
+// GetServicesPage returns up to limit services matching the given key
+// prefix whose key sorts after afterKey, in key order, merging the pages of
+// the shards.
+func (b *ShardedSQLiteBackend) GetServicesPage(ctx context.Context, prefix, afterKey string, limit int) ([]*Service, string, error) {
+	if err := b.keys.validatePrefix(b.prefix, prefix); err != nil {
+		return nil, "", err
+	}
+	prefix, shards := b.shardsFor(prefix)
+	if len(shards) == 1 {
+		return shards[0].GetServicesPage(ctx, prefix, afterKey, limit)
+	}
+	page, err := gatherShards(shards, func(shard *SQLiteBackend) ([]*Service, error) {
+		services, _, err := shard.GetServicesPage(ctx, prefix, afterKey, limit)
+		return services, err
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	page = page[:min(len(page), limit)]
+	return page, nextCursor(page, limit), nil
+}
+
+// Exists reports whether any shard stores a service under prefix.
+func (b *ShardedSQLiteBackend) Exists(ctx context.Context, prefix string) (bool, error) {
+	if err := b.keys.validatePrefix(b.prefix, prefix); err != nil {
+		return false, err
+	}
+	prefix, shards := b.shardsFor(prefix)
+	for _, shard := range shards {
+		exists, err := shard.Exists(ctx, prefix)
+		if err != nil || exists {
+			return exists, err
+		}
+	}
+	return false, nil
+}
+
+// ForEach calls fn for every service under prefix, one shard after another.
+// Services are in key order within a shard, but not across shards.
+func (b *ShardedSQLiteBackend) ForEach(ctx context.Context, prefix string, fn func(key string, svc *Service) error) error {
+	if err := b.keys.validatePrefix(b.prefix, prefix); err != nil {
+		return err
+	}
+	prefix, shards := b.shardsFor(prefix)
+	for _, shard := range shards {
+		if err := shard.ForEach(ctx, prefix, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// StreamKeys calls fn with each key under prefix in key order. Keys of
+// several shards are read before fn is called, to be merged in order.
+func (b *ShardedSQLiteBackend) StreamKeys(ctx context.Context, prefix string, fn func(key string) error) error {
+	if err := b.keys.validatePrefix(b.prefix, prefix); err != nil {
+		return err
+	}
+	prefix, shards := b.shardsFor(prefix)
+	if len(shards) == 1 {
+		return shards[0].StreamKeys(ctx, prefix, fn)
+	}
+
+	var keys []string
+	for _, shard := range shards {
+		err := shard.StreamKeys(ctx, prefix, func(key string) error {
+			keys = append(keys, key)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fn(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scanRecords calls fn for each record under prefix, in key order. Records
+// of several shards are read before fn is called, to be merged in order.
+func (b *ShardedSQLiteBackend) scanRecords(ctx context.Context, prefix string, fn func(key string, svc *Service, err error) error) error {
+	prefix, shards := b.shardsFor(prefix)
+	if len(shards) == 1 {
+		return shards[0].scanRecords(ctx, prefix, fn)
+	}
+
+	type record struct {
+		key string
+		svc *Service
+		err error
+	}
+	var records []record
+	for _, shard := range shards {
+		err := shard.scanRecords(ctx, prefix, func(key string, svc *Service, err error) error {
+			records = append(records, record{key, svc, err})
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].key < records[j].key
+	})
+	for _, r := range records {
+		if err := fn(r.key, r.svc, r.err); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Snapshot returns a copy of the services of every shard. Each shard is
+// read consistently, but not at the same point in time as the others.
+func (b *ShardedSQLiteBackend) Snapshot(ctx context.Context) (map[string]Service, error) {
+	snapshot := make(map[string]Service)
+	for _, shard := range b.shards {
+		services, err := shard.Snapshot(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for key, svc := range services {
+			snapshot[key] = svc
+		}
+	}
+	return snapshot, nil
+}
+
+// Count returns the number of services stored in every shard.
+func (b *ShardedSQLiteBackend) Count(ctx context.Context) (int, error) {
+	total := 0
+	for _, shard := range b.shards {
+		count, err := shard.Count(ctx)
+		if err != nil {
+			return 0, err
+		}
+		total += count
+	}
+	return total, nil
+}
+
+// IsEmpty reports whether no shard stores a service.
+func (b *ShardedSQLiteBackend) IsEmpty(ctx context.Context) (bool, error) {
+	for _, shard := range b.shards {
+		empty, err := shard.IsEmpty(ctx)
+		if err != nil || !empty {
+			return empty, err
+		}
+	}
+	return true, nil
+}
+
+// rootPrefix returns the prefix addressing every stored service.
+func (b *ShardedSQLiteBackend) rootPrefix() string {
+	return b.prefix + b.keys.sep()
+}
+
+// keyScheme returns the scheme of the stored keys.
+func (b *ShardedSQLiteBackend) keyScheme() KeyScheme {
+	return b.keys
+}
+
+// Keys returns the keys stored in every shard, in order.
+func (b *ShardedSQLiteBackend) Keys(ctx context.Context) ([]string, error) {
+	var keys []string
+	for _, shard := range b.shards {
+		shardKeys, err := shard.Keys(ctx)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, shardKeys...)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// SaveService saves the service to the shard of its zone.
+func (b *ShardedSQLiteBackend) SaveService(ctx context.Context, service *Service) error {
+	return b.shardFor(b.keys.resolveKey(b.prefix, service.Key)).SaveService(ctx, service)
+}
+
+// UpdateService updates the service in the shard of its zone, as
+// SQLiteBackend.UpdateService.
+func (b *ShardedSQLiteBackend) UpdateService(ctx context.Context, service *Service) error {
+	return b.shardFor(b.keys.resolveKey(b.prefix, service.Key)).UpdateService(ctx, service)
+}
+
+// SaveServiceWithPolicy saves the service to the shard of its zone, as
+// SQLiteBackend.SaveServiceWithPolicy.
+func (b *ShardedSQLiteBackend) SaveServiceWithPolicy(ctx context.Context, service *Service, policy ConflictPolicy) (bool, error) {
+	return b.shardFor(b.keys.resolveKey(b.prefix, service.Key)).SaveServiceWithPolicy(ctx, service, policy)
+}
+
+// DeleteService removes the key and its children from the shards that may
+// hold them.
+func (b *ShardedSQLiteBackend) DeleteService(ctx context.Context, key string) error {
+	if err := b.keys.validatePrefix(b.prefix, key); err != nil {
+		return err
+	}
+	key = b.keys.resolveKey(b.prefix, key)
+	shards := b.shards
+	if _, complete := b.keys.zoneKey(b.prefix, key+b.keys.sep(), sqliteShardDepth); complete {
+		shards = []*SQLiteBackend{b.shardFor(key)}
+	}
+	var errs []error
+	for _, shard := range shards {
+		if err := shard.DeleteService(ctx, key); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// deleteIfCovered deletes key and its children if covered accepts all of
+// them, when they live in a single shard, as SQLiteBackend.deleteIfCovered.
+// Keys spanning shards can't be checked and deleted atomically.
+func (b *ShardedSQLiteBackend) deleteIfCovered(ctx context.Context, key string, covered func(key string) bool) (bool, error) {
+	if err := b.keys.validatePrefix(b.prefix, key); err != nil {
+		return false, err
+	}
+	key = b.keys.resolveKey(b.prefix, key)
+	if _, complete := b.keys.zoneKey(b.prefix, key+b.keys.sep(), sqliteShardDepth); !complete {
+		return false, nil
+	}
+	return b.shardFor(key).deleteIfCovered(ctx, key, covered)
+}
+
+// ClearPrefix removes every service under prefix, refusing the root prefix.
+func (b *ShardedSQLiteBackend) ClearPrefix(ctx context.Context, prefix string) error {
+	if err := b.keys.validateClearPrefix(b.prefix, prefix); err != nil {
+		return err
+	}
+	return b.DeleteService(ctx, prefix)
+}
+
+// Flush checkpoints every shard, returning the joined errors.
+func (b *ShardedSQLiteBackend) Flush(ctx context.Context) error {
+	var errs []error
+	for _, shard := range b.shards {
+		if err := shard.Flush(ctx); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Health pings every shard, returning the joined errors.
+func (b *ShardedSQLiteBackend) Health(ctx context.Context) error {
+	var errs []error
+	for _, shard := range b.shards {
+		if err := shard.Health(ctx); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Capabilities reports that the shards persist writes unless in-memory.
+// Writes to different shards aren't applied atomically, so transactions
+// aren't reported.
+func (b *ShardedSQLiteBackend) Capabilities() BackendCapabilities {
+	return BackendCapabilities{Persistent: b.shards[0].Capabilities().Persistent}
+}
+
+// Close closes every shard, returning the joined errors.
+func (b *ShardedSQLiteBackend) Close() error {
+	var errs []error
+	for _, shard := range b.shards {
+		if err := shard.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,147 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package coredns
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestShardedSQLiteBackend_RoutesByZone(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dns.db")
+	backend, err := NewShardedSQLiteBackend(path, 4, SQLiteOptions{})
+	require.NoError(t, err)
+	defer backend.Close()
+
+	ctx := context.Background()
+	zones := make(map[string]*SQLiteBackend)
+	for z := 0; z < 20; z++ {
+		zone := fmt.Sprintf("/skydns/com/zone%02d", z)
+		zones[zone] = backend.shardFor(zone)
+		for _, host := range []string{"www", "api/x1"} {
+			require.NoError(t, backend.SaveService(ctx, &Service{Host: "10.0.0.1", Key: zone + "/" + host}))
+		}
+	}
+
+	used := make(map[*SQLiteBackend]bool)
+	for zone, shard := range zones {
+		used[shard] = true
+		// Each shard holds the records of its zones only
+		keys, err := shard.Keys(ctx)
+		require.NoError(t, err)
+		assert.Contains(t, keys, zone+"/www")
+		assert.Contains(t, keys, zone+"/api/x1")
+		for _, other := range backend.shards {
+			if other == shard {
+				continue
+			}
+			exists, err := other.Exists(ctx, zone+"/")
+			require.NoError(t, err)
+			assert.False(t, exists, "%s found outside its shard", zone)
+		}
+	}
+	assert.Len(t, used, 4, "zones spread over every shard")
+
+	for i := range 4 {
+		assert.FileExists(t, filepath.Join(filepath.Dir(path), fmt.Sprintf("dns-%d.db", i)))
+	}
+}
+
+func TestShardedSQLiteBackend_RefusesOtherShardCount(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dns.db")
+	backend, err := NewShardedSQLiteBackend(path, 4, SQLiteOptions{})
+	require.NoError(t, err)
+	ctx := context.Background()
+	require.NoError(t, backend.SaveService(ctx, &Service{Host: "10.0.0.1", Key: "/skydns/com/example/www"}))
+	require.NoError(t, backend.Close())
+
+	for _, n := range []int{2, 8} {
+		_, err := NewShardedSQLiteBackend(path, n, SQLiteOptions{})
+		assert.ErrorIs(t, err, ErrShardCountMismatch, "%d shards", n)
+	}
+
+	reopened, err := NewShardedSQLiteBackend(path, 4, SQLiteOptions{})
+	require.NoError(t, err)
+	defer reopened.Close()
+	services, err := reopened.GetServices(ctx, "/skydns/com/example")
+	require.NoError(t, err)
+	assert.Len(t, services, 1)
+}
+
+func TestShardedSQLiteBackend_RootQueriesAggregate(t *testing.T) {
+	backend, err := NewShardedSQLiteBackend(":memory:", 3, SQLiteOptions{})
+	require.NoError(t, err)
+	defer backend.Close()
+
+	ctx := context.Background()
+	var want []string
+	for z := 0; z < 10; z++ {
+		key := fmt.Sprintf("/skydns/com/zone%02d/www", z)
+		require.NoError(t, backend.SaveService(ctx, &Service{Host: "10.0.0.1", Key: key}))
+		want = append(want, key)
+	}
+
+	services, err := backend.GetServices(ctx, "/skydns")
+	require.NoError(t, err)
+	var keys []string
+	for _, svc := range services {
+		keys = append(keys, svc.Key)
+	}
+	assert.Equal(t, want, keys, "services of every shard, in key order")
+
+	page, cursor, err := backend.GetServicesPage(ctx, "/skydns", "", 4)
+	require.NoError(t, err)
+	require.Len(t, page, 4)
+	assert.Equal(t, want[3], cursor)
+	page, _, err = backend.GetServicesPage(ctx, "/skydns", cursor, 4)
+	require.NoError(t, err)
+	assert.Equal(t, want[4], page[0].Key)
+
+	snapshot, err := backend.Snapshot(ctx)
+	require.NoError(t, err)
+	assert.Len(t, snapshot, 10)
+
+	// A zone-scoped query reads its shard only
+	zoneServices, err := backend.GetServices(ctx, "/skydns/com/zone03/")
+	require.NoError(t, err)
+	require.Len(t, zoneServices, 1)
+	assert.Equal(t, want[3], zoneServices[0].Key)
+
+	require.NoError(t, backend.DeleteService(ctx, "/skydns/com"))
+	exists, err := backend.Exists(ctx, "/skydns")
+	require.NoError(t, err)
+	assert.False(t, exists)
+}
+
+func TestNewBackend_ShardedSQLite(t *testing.T) {
+	backend, err := NewBackend(&BackendConfig{
+		Type:         BackendTypeSQLite,
+		SQLitePath:   filepath.Join(t.TempDir(), "dns.db"),
+		SQLiteShards: 2,
+	})
+	require.NoError(t, err)
+	defer backend.Close()
+
+	sharded, ok := backend.(*ShardedSQLiteBackend)
+	require.True(t, ok)
+	assert.Len(t, sharded.shards, 2)
+}
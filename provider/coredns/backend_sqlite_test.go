@@ -18,12 +18,23 @@ package coredns
 
 import (
 	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
 
 	"sigs.k8s.io/external-dns/endpoint"
 )
@@ -213,25 +224,107 @@ func TestSQLiteBackend_DeleteService_Prefix(t *testing.T) {
 	assert.Equal(t, "3.3.3.3", result[0].Host)
 }
 
-func TestSQLiteBackend_DefaultPriority(t *testing.T) {
+func TestSQLiteBackend_DeleteService_ExactSubtree(t *testing.T) {
 	backend, err := NewSQLiteBackend(":memory:")
 	require.NoError(t, err)
 	defer backend.Close()
 
 	ctx := context.Background()
+	keys := []string{
+		"/skydns/com/example",
+		"/skydns/com/example/www",
+		"/skydns/com/example/www/x1",
+		"/skydns/com/example-two/www", // '-' sorts before '/'
+		"/skydns/com/example0/www",    // '0' sorts right after '/'
+		"/skydns/com/examplez",
+		"/skydns/com/EXAMPLE/www", // LIKE would match case-insensitively
+		"/skydns/com/exampl",
+	}
+	for _, key := range keys {
+		require.NoError(t, backend.SaveService(ctx, &Service{Host: "1.2.3.4", Key: key}))
+	}
 
-	// Save a service without priority
-	svc := &Service{
-		Host: "1.2.3.4",
-		Key:  "/skydns/com/example/www",
+	require.NoError(t, backend.DeleteService(ctx, "/skydns/com/example"))
+
+	remaining, err := backend.Keys(ctx)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{
+		"/skydns/com/example-two/www",
+		"/skydns/com/example0/www",
+		"/skydns/com/examplez",
+		"/skydns/com/EXAMPLE/www",
+		"/skydns/com/exampl",
+	}, remaining)
+}
+
+func TestSQLiteBackend_DeleteService_UsesIndex(t *testing.T) {
+	backend, err := NewSQLiteBackend(":memory:")
+	require.NoError(t, err)
+	defer backend.Close()
+
+	rows, err := backend.db.Query("EXPLAIN QUERY PLAN "+sqliteDeleteQuery, "/a", "/a/", "/a0")
+	require.NoError(t, err)
+	defer rows.Close()
+
+	var plan []string
+	for rows.Next() {
+		var id, parent, unused int
+		var detail string
+		require.NoError(t, rows.Scan(&id, &parent, &unused, &detail))
+		plan = append(plan, detail)
 	}
-	require.NoError(t, backend.SaveService(ctx, svc))
+	require.NoError(t, rows.Err())
+	require.NotEmpty(t, plan)
+	for _, detail := range plan {
+		assert.NotContains(t, detail, "SCAN", "delete should not scan the table: %v", plan)
+	}
+}
+
+func BenchmarkSQLiteBackend_DeletePrefix(b *testing.B) {
+	backend, err := NewSQLiteBackend(filepath.Join(b.TempDir(), "bench.db"))
+	require.NoError(b, err)
+	defer backend.Close()
+
+	ctx := context.Background()
+	const zones, hostsPerZone = 200, 50
+	save := func(zone int) {
+		for h := 0; h < hostsPerZone; h++ {
+			key := fmt.Sprintf("/skydns/com/zone%d/host%d", zone, h)
+			require.NoError(b, backend.SaveService(ctx, &Service{Host: "10.0.0.1", Key: key}))
+		}
+	}
+	for z := 0; z < zones; z++ {
+		save(z)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		zone := i % zones
+		require.NoError(b, backend.DeleteService(ctx, fmt.Sprintf("/skydns/com/zone%d", zone)))
+
+		b.StopTimer()
+		save(zone)
+		b.StartTimer()
+	}
+}
+
+func TestSQLiteBackend_DefaultPriority(t *testing.T) {
+	backend, err := NewSQLiteBackend(":memory:")
+	require.NoError(t, err)
+	defer backend.Close()
+
+	ctx := context.Background()
+
+	// Save SRV and A services without priority
+	require.NoError(t, backend.SaveService(ctx, &Service{Host: "target.example.com", Port: 443, Key: "/skydns/com/example/_https/_tcp"}))
+	require.NoError(t, backend.SaveService(ctx, &Service{Host: "1.2.3.4", Key: "/skydns/com/example/www"}))
 
-	// Retrieve and verify default priority is set
+	// Retrieve and verify the default priority is only set on the SRV record
 	services, err := backend.GetServices(ctx, "/skydns/com/example")
 	require.NoError(t, err)
-	require.Len(t, services, 1)
+	require.Len(t, services, 2)
 	assert.Equal(t, priority, services[0].Priority) // priority = 10
+	assert.Zero(t, services[1].Priority)
 }
 
 func TestSQLiteBackend_TXTRecords(t *testing.T) {
@@ -390,8 +483,8 @@ func TestSQLiteBackend_IntegrationWithProvider(t *testing.T) {
 	assert.Len(t, records, 0)
 
 	// Add a service directly to backend
-	// Key format: /skydns/{reversed-domain-labels}/{prefix}.{dns-name}
-	// This becomes: www.example.com after reversing and stripping 1 label (the prefix)
+	// Key format: /skydns/{reversed-domain-labels}/{reversed-prefix-labels}
+	// This becomes: www.example.com after reversing and stripping TargetStrip labels (the prefix)
 	svc := &Service{
 		Host:        "1.2.3.4",
 		TTL:         300,
@@ -409,3 +502,661 @@ func TestSQLiteBackend_IntegrationWithProvider(t *testing.T) {
 	assert.Equal(t, "www.example.com", records[0].DNSName)
 	assert.Equal(t, "1.2.3.4", records[0].Targets[0])
 }
+
+func TestSQLiteBackend_CloseIdempotent(t *testing.T) {
+	backend, err := NewSQLiteBackend(filepath.Join(t.TempDir(), "close.db"))
+	require.NoError(t, err)
+
+	assert.NoError(t, backend.Close())
+	assert.NoError(t, backend.Close())
+}
+
+func TestSQLiteBackend_DriverNotRegistered(t *testing.T) {
+	defer func(name string) { sqliteDriverName = name }(sqliteDriverName)
+	sqliteDriverName = "sqlite-not-registered"
+
+	dir := filepath.Join(t.TempDir(), "data")
+	_, err := NewSQLiteBackend(filepath.Join(dir, "records.db"))
+	require.ErrorIs(t, err, ErrSQLiteUnavailable)
+	assert.NotContains(t, err.Error(), "unknown driver")
+	assert.NoDirExists(t, dir, "nothing is created without a driver")
+
+	_, err = NewShardedSQLiteBackend(filepath.Join(dir, "records.db"), 2, SQLiteOptions{})
+	assert.ErrorIs(t, err, ErrSQLiteUnavailable)
+}
+
+func TestSQLiteBackend_UseAfterClose(t *testing.T) {
+	backend, err := NewSQLiteBackend(":memory:")
+	require.NoError(t, err)
+	require.NoError(t, backend.Close())
+
+	ctx := context.Background()
+
+	_, err = backend.GetServices(ctx, "/skydns/")
+	assert.ErrorIs(t, err, ErrBackendClosed)
+
+	err = backend.SaveService(ctx, &Service{Host: "1.2.3.4", Key: "/skydns/com/example/www"})
+	assert.ErrorIs(t, err, ErrBackendClosed)
+
+	err = backend.DeleteService(ctx, "/skydns/com/example/www")
+	assert.ErrorIs(t, err, ErrBackendClosed)
+
+	_, err = backend.Count(ctx)
+	assert.ErrorIs(t, err, ErrBackendClosed)
+
+	_, err = backend.Keys(ctx)
+	assert.ErrorIs(t, err, ErrBackendClosed)
+}
+
+func TestSQLiteBackend_DedupSameAnswerDifferentSuffix(t *testing.T) {
+	backend, err := NewSQLiteBackend(":memory:")
+	require.NoError(t, err)
+	defer backend.Close()
+
+	ctx := context.Background()
+
+	// Same Host stored under two suffix keys of www.example.com
+	for _, key := range []string{"/skydns/com/example/www/aaaa", "/skydns/com/example/www/bbbb"} {
+		require.NoError(t, backend.SaveService(ctx, &Service{Host: "1.2.3.4", TargetStrip: 1, Key: key}))
+	}
+
+	provider := NewCoreDNSProviderWithBackend(&endpoint.DomainFilter{}, "/skydns/", false, backend)
+	records, err := provider.Records(ctx)
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	assert.Equal(t, "www.example.com", records[0].DNSName)
+	assert.Equal(t, []string{"1.2.3.4"}, []string(records[0].Targets))
+
+	// A distinct target under the same name must survive
+	require.NoError(t, backend.SaveService(ctx, &Service{Host: "5.6.7.8", TargetStrip: 1, Key: "/skydns/com/example/www/cccc"}))
+	// The same Host under a different name must survive
+	require.NoError(t, backend.SaveService(ctx, &Service{Host: "1.2.3.4", TargetStrip: 1, Key: "/skydns/com/example/api/dddd"}))
+
+	services, err := backend.GetServices(ctx, "/skydns/com/example/www")
+	require.NoError(t, err)
+	require.Len(t, services, 2)
+	assert.Equal(t, "/skydns/com/example/www/aaaa", services[0].Key, "the first key in order survives")
+	assert.Equal(t, "1.2.3.4", services[0].Host)
+	assert.Equal(t, "5.6.7.8", services[1].Host)
+
+	records, err = provider.Records(ctx)
+	require.NoError(t, err)
+
+	targets := make(map[string][]string)
+	for _, ep := range records {
+		targets[ep.DNSName] = ep.Targets
+	}
+	assert.ElementsMatch(t, []string{"1.2.3.4", "5.6.7.8"}, targets["www.example.com"])
+	assert.Equal(t, []string{"1.2.3.4"}, []string(targets["api.example.com"]))
+}
+
+func TestSQLiteBackend_Snapshot(t *testing.T) {
+	backend, err := NewSQLiteBackend(":memory:")
+	require.NoError(t, err)
+	defer backend.Close()
+
+	ctx := context.Background()
+	require.NoError(t, backend.SaveService(ctx, &Service{Host: "1.2.3.4", Key: "/skydns/com/example/www"}))
+	require.NoError(t, backend.SaveService(ctx, &Service{Text: "hello", Key: "/skydns/com/example/txt"}))
+
+	snapshot, err := backend.Snapshot(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]Service{
+		"/skydns/com/example/www": {Host: "1.2.3.4"},
+		"/skydns/com/example/txt": {Text: "hello"},
+	}, snapshot)
+
+	// A value that can't be decoded fails the snapshot rather than vanishing from it
+	_, err = backend.db.Exec(`INSERT INTO services (key, value) VALUES (?, ?)`, "/skydns/com/example/bad", `{"port":"x"}`)
+	require.NoError(t, err)
+	_, err = backend.Snapshot(ctx)
+	assert.ErrorContains(t, err, "/skydns/com/example/bad")
+
+	require.NoError(t, backend.Close())
+	_, err = backend.Snapshot(ctx)
+	assert.ErrorIs(t, err, ErrBackendClosed)
+}
+
+func TestSQLiteBackend_SnapshotConcurrentWrites(t *testing.T) {
+	backend, err := NewSQLiteBackend(filepath.Join(t.TempDir(), "test.db"))
+	require.NoError(t, err)
+	defer backend.Close()
+
+	ctx := context.Background()
+	const numKeys = 20
+	keyFor := func(i int) string { return fmt.Sprintf("/skydns/com/example/k%02d", i) }
+
+	// The writer rewrites every key in order with an increasing generation
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for gen := 0; ; gen++ {
+			for i := 0; i < numKeys; i++ {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				assert.NoError(t, backend.SaveService(ctx, &Service{Text: strconv.Itoa(gen), Key: keyFor(i)}))
+			}
+		}
+	}()
+
+	for n := 0; n < 50; n++ {
+		snapshot, err := backend.Snapshot(ctx)
+		require.NoError(t, err)
+
+		// A consistent view sees a prefix of the keys at generation g+1 and
+		// the rest at generation g, never an older key after a newer one.
+		first, prev := -1, -1
+		for i := 0; i < numKeys; i++ {
+			svc, ok := snapshot[keyFor(i)]
+			if !ok {
+				// Keys are written in order: none after a missing one
+				for j := i; j < numKeys; j++ {
+					assert.NotContains(t, snapshot, keyFor(j))
+				}
+				break
+			}
+			gen, err := strconv.Atoi(svc.Text)
+			require.NoError(t, err)
+			if first < 0 {
+				first = gen
+			}
+			assert.True(t, gen <= prev || prev < 0, "torn snapshot: %s at generation %d after %d", keyFor(i), gen, prev)
+			assert.GreaterOrEqual(t, gen, first-1, "torn snapshot: %s at generation %d, first key at %d", keyFor(i), gen, first)
+			prev = gen
+		}
+	}
+
+	close(done)
+	wg.Wait()
+}
+
+func TestSQLiteBackend_SnapshotDoesNotBlockWrites(t *testing.T) {
+	backend, err := NewSQLiteBackend(filepath.Join(t.TempDir(), "test.db"))
+	require.NoError(t, err)
+	defer backend.Close()
+
+	ctx := context.Background()
+	require.NoError(t, backend.SaveService(ctx, &Service{Host: "1.1.1.1", Key: "/skydns/com/example/www"}))
+
+	// Hold a read transaction open on the connection Snapshot reads from,
+	// as a long Snapshot would
+	require.NotNil(t, backend.snapshotDB)
+	tx, err := backend.snapshotDB.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	require.NoError(t, err)
+	var before int
+	require.NoError(t, tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM services").Scan(&before))
+
+	writeCtx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	require.NoError(t, backend.SaveService(writeCtx, &Service{Host: "2.2.2.2", Key: "/skydns/com/example/api"}), "write blocked by an open snapshot")
+
+	// The open transaction keeps its view
+	var during int
+	require.NoError(t, tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM services").Scan(&during))
+	assert.Equal(t, before, during)
+	require.NoError(t, tx.Rollback())
+
+	snapshot, err := backend.Snapshot(ctx)
+	require.NoError(t, err)
+	assert.Len(t, snapshot, 2)
+}
+
+func TestSQLiteBackend_SnapshotWhileWritingDoesNotDeadlock(t *testing.T) {
+	backend, err := NewSQLiteBackend(filepath.Join(t.TempDir(), "test.db"))
+	require.NoError(t, err)
+	defer backend.Close()
+
+	ctx := context.Background()
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				assert.NoError(t, backend.SaveService(ctx, &Service{Text: strconv.Itoa(i), Key: fmt.Sprintf("/skydns/com/example/k%03d", i)}))
+			}
+		}()
+		for n := 0; n < 50; n++ {
+			snapshot, err := backend.Snapshot(ctx)
+			assert.NoError(t, err)
+			// Keys are written in order: a consistent view holds a prefix of them
+			for i := 0; i < len(snapshot); i++ {
+				assert.Contains(t, snapshot, fmt.Sprintf("/skydns/com/example/k%03d", i))
+			}
+		}
+		wg.Wait()
+	}()
+
+	select {
+	case <-finished:
+	case <-time.After(30 * time.Second):
+		t.Fatal("Snapshot and SaveService deadlocked")
+	}
+
+	snapshot, err := backend.Snapshot(ctx)
+	require.NoError(t, err)
+	assert.Len(t, snapshot, 200)
+}
+
+func TestSQLiteBackend_CloseCheckpointsWAL(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "test.db")
+	backend, err := NewSQLiteBackend(dbPath)
+	require.NoError(t, err)
+
+	var mode string
+	require.NoError(t, backend.db.QueryRow("PRAGMA journal_mode").Scan(&mode))
+	assert.Equal(t, "wal", mode)
+
+	ctx := context.Background()
+	for i := 0; i < 100; i++ {
+		require.NoError(t, backend.SaveService(ctx, &Service{Host: "1.2.3.4", Key: fmt.Sprintf("/skydns/com/example/host%d", i)}))
+	}
+	require.NoError(t, backend.Close())
+
+	info, err := os.Stat(dbPath + "-wal")
+	if err == nil {
+		assert.Zero(t, info.Size(), "WAL file should be truncated")
+	} else {
+		assert.ErrorIs(t, err, os.ErrNotExist)
+	}
+
+	reopened, err := NewSQLiteBackend(dbPath)
+	require.NoError(t, err)
+	defer reopened.Close()
+	count, err := reopened.Count(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 100, count)
+}
+
+// sqliteCodeError mimics a driver error carrying an SQLite result code.
+type sqliteCodeError int
+
+func (e sqliteCodeError) Error() string { return fmt.Sprintf("sqlite error %d", int(e)) }
+func (e sqliteCodeError) Code() int     { return int(e) }
+
+// failingSQLiteDriver wraps the SQLite driver so that the next failures
+// statements executed fail with err.
+type failingSQLiteDriver struct {
+	failures atomic.Int32
+	err      error
+}
+
+func (d *failingSQLiteDriver) Open(name string) (driver.Conn, error) {
+	conn, err := (&sqlite.Driver{}).Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return failingSQLiteConn{Conn: conn, driver: d}, nil
+}
+
+type failingSQLiteConn struct {
+	driver.Conn
+	driver *failingSQLiteDriver
+}
+
+func (c failingSQLiteConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	if c.driver.failures.Add(-1) >= 0 {
+		return nil, c.driver.err
+	}
+	return c.Conn.(driver.ExecerContext).ExecContext(ctx, query, args)
+}
+
+var failingSQLiteDrivers atomic.Int32
+
+// newFailingSQLiteBackend returns an in-memory backend whose writes fail with
+// err failures times before reaching the database.
+func newFailingSQLiteBackend(t *testing.T, err error, failures int32) *SQLiteBackend {
+	d := &failingSQLiteDriver{err: err}
+	name := fmt.Sprintf("sqlite-failing-%d", failingSQLiteDrivers.Add(1))
+	sql.Register(name, d)
+
+	db, openErr := sql.Open(name, ":memory:")
+	require.NoError(t, openErr)
+	backend, openErr := newSQLiteBackend(db, ":memory:", SQLiteOptions{})
+	require.NoError(t, openErr)
+
+	d.failures.Store(failures)
+	return backend
+}
+
+// recordingSQLiteDriver wraps the SQLite driver to record the PRAGMA
+// statements executed on its connections.
+type recordingSQLiteDriver struct {
+	mu      sync.Mutex
+	pragmas []string
+}
+
+func (d *recordingSQLiteDriver) Open(name string) (driver.Conn, error) {
+	conn, err := (&sqlite.Driver{}).Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return recordingSQLiteConn{Conn: conn, driver: d}, nil
+}
+
+// takePragmas returns the recorded statements and clears them.
+func (d *recordingSQLiteDriver) takePragmas() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	pragmas := d.pragmas
+	d.pragmas = nil
+	return pragmas
+}
+
+type recordingSQLiteConn struct {
+	driver.Conn
+	driver *recordingSQLiteDriver
+}
+
+func (c recordingSQLiteConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	if strings.HasPrefix(query, "PRAGMA") {
+		c.driver.mu.Lock()
+		c.driver.pragmas = append(c.driver.pragmas, query)
+		c.driver.mu.Unlock()
+	}
+	return c.Conn.(driver.ExecerContext).ExecContext(ctx, query, args)
+}
+
+var recordingSQLiteDrivers atomic.Int32
+
+func TestSQLiteBackend_WriteDurability(t *testing.T) {
+	d := &recordingSQLiteDriver{}
+	name := fmt.Sprintf("sqlite-recording-%d", recordingSQLiteDrivers.Add(1))
+	sql.Register(name, d)
+
+	path := filepath.Join(t.TempDir(), "dns.db")
+	db, err := sql.Open(name, path)
+	require.NoError(t, err)
+	db.SetMaxOpenConns(1)
+	backend, err := newSQLiteBackend(db, path, SQLiteOptions{})
+	require.NoError(t, err)
+	defer backend.Close()
+
+	ctx := context.Background()
+	_, err = db.ExecContext(ctx, "PRAGMA synchronous = NORMAL")
+	require.NoError(t, err)
+	d.takePragmas()
+
+	svc := &Service{Host: "1.2.3.4", Key: "/skydns/com/example/www"}
+	require.NoError(t, backend.SaveService(ctx, svc))
+	assert.Empty(t, d.takePragmas(), "default durability keeps the connection setting")
+
+	require.NoError(t, backend.SaveService(WithDurability(ctx, DurabilitySync), svc))
+	assert.Equal(t, []string{"PRAGMA synchronous = FULL", "PRAGMA synchronous = 1"}, d.takePragmas())
+
+	require.NoError(t, backend.DeleteService(WithDurability(ctx, DurabilityRelaxed), svc.Key))
+	assert.Equal(t, []string{"PRAGMA synchronous = OFF", "PRAGMA synchronous = 1"}, d.takePragmas())
+
+	written, err := backend.SaveServiceWithPolicy(WithDurability(ctx, DurabilitySync), svc, ConflictPolicy{})
+	require.NoError(t, err)
+	assert.True(t, written)
+	assert.Equal(t, []string{"PRAGMA synchronous = FULL", "PRAGMA synchronous = 1"}, d.takePragmas())
+
+	var level int
+	require.NoError(t, db.QueryRowContext(ctx, "PRAGMA synchronous").Scan(&level))
+	assert.Equal(t, 1, level, "the connection is back to NORMAL")
+}
+
+func TestSQLiteBackend_RetriesBusy(t *testing.T) {
+	backend := newFailingSQLiteBackend(t, sqliteCodeError(sqlite3.SQLITE_BUSY), 3)
+	defer backend.Close()
+
+	ctx := context.Background()
+	require.NoError(t, backend.SaveService(ctx, &Service{Host: "1.2.3.4", Key: "/skydns/com/example/www"}))
+
+	count, err := backend.Count(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, count)
+}
+
+func TestSQLiteBackend_RetriesLockedDelete(t *testing.T) {
+	backend := newFailingSQLiteBackend(t, sqliteCodeError(sqlite3.SQLITE_LOCKED_SHAREDCACHE), 0)
+	defer backend.Close()
+
+	ctx := context.Background()
+	require.NoError(t, backend.SaveService(ctx, &Service{Host: "1.2.3.4", Key: "/skydns/com/example/www"}))
+
+	backend.db.Driver().(*failingSQLiteDriver).failures.Store(2)
+	require.NoError(t, backend.DeleteService(ctx, "/skydns/com/example/www"))
+
+	count, err := backend.Count(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 0, count)
+}
+
+func TestSQLiteBackend_BusyRetriesAreBounded(t *testing.T) {
+	backend := newFailingSQLiteBackend(t, sqliteCodeError(sqlite3.SQLITE_BUSY), 100)
+	defer backend.Close()
+
+	err := backend.SaveService(context.Background(), &Service{Host: "1.2.3.4", Key: "/skydns/com/example/www"})
+	assert.ErrorIs(t, err, sqliteCodeError(sqlite3.SQLITE_BUSY))
+	assert.ErrorIs(t, err, ErrUnavailable)
+	d := backend.db.Driver().(*failingSQLiteDriver)
+	assert.Equal(t, int32(100-sqliteBusyRetries-1), d.failures.Load())
+
+	// The context deadline stops retrying early
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = backend.SaveService(ctx, &Service{Host: "1.2.3.4", Key: "/skydns/com/example/www"})
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestSQLiteBackend_DoesNotRetryConstraintErrors(t *testing.T) {
+	backend := newFailingSQLiteBackend(t, sqliteCodeError(sqlite3.SQLITE_CONSTRAINT_UNIQUE), 2)
+	defer backend.Close()
+
+	err := backend.SaveService(context.Background(), &Service{Host: "1.2.3.4", Key: "/skydns/com/example/www"})
+	assert.ErrorIs(t, err, sqliteCodeError(sqlite3.SQLITE_CONSTRAINT_UNIQUE))
+	assert.ErrorIs(t, err, ErrConflict)
+	assert.Equal(t, int32(1), backend.db.Driver().(*failingSQLiteDriver).failures.Load())
+}
+
+func TestSQLiteBackend_GetChangedSince(t *testing.T) {
+	backend, err := NewSQLiteBackend(":memory:")
+	require.NoError(t, err)
+	defer backend.Close()
+
+	ctx := context.Background()
+	require.NoError(t, backend.SaveService(ctx, &Service{Host: "1.1.1.1", Key: "/skydns/com/example/a"}))
+	require.NoError(t, backend.SaveService(ctx, &Service{Host: "2.2.2.2", Key: "/skydns/com/example/b"}))
+	require.NoError(t, backend.SaveService(ctx, &Service{Host: "3.3.3.3", Key: "/skydns/com/example/c"}))
+
+	since := time.Now()
+	require.NoError(t, backend.SaveService(ctx, &Service{Host: "4.4.4.4", Key: "/skydns/com/example/d"}))
+	require.NoError(t, backend.SaveService(ctx, &Service{Host: "1.1.1.2", Key: "/skydns/com/example/a"}))
+	require.NoError(t, backend.SaveService(ctx, &Service{Host: "5.5.5.5", Key: "/skydns/org/other/e"}))
+	require.NoError(t, backend.DeleteService(ctx, "/skydns/com/example/c"))
+
+	changed, err := backend.GetChangedSince(ctx, "/skydns/com", since)
+	require.NoError(t, err)
+	require.Len(t, changed, 2)
+	assert.Equal(t, "/skydns/com/example/a", changed[0].Key)
+	assert.Equal(t, "1.1.1.2", changed[0].Host)
+	assert.Equal(t, "/skydns/com/example/d", changed[1].Key)
+
+	all, err := backend.GetChangedSince(ctx, "/skydns/", time.Time{})
+	require.NoError(t, err)
+	assert.Len(t, all, 4)
+
+	none, err := backend.GetChangedSince(ctx, "/skydns/", time.Now())
+	require.NoError(t, err)
+	assert.Empty(t, none)
+}
+
+func TestSQLiteBackend_GetChangedSinceLegacyTimestamps(t *testing.T) {
+	backend, err := NewSQLiteBackend(":memory:")
+	require.NoError(t, err)
+	defer backend.Close()
+
+	// Rows written by older versions carry second-resolution CURRENT_TIMESTAMP values
+	_, err = backend.db.Exec(`INSERT INTO services (key, value, updated_at) VALUES (?, ?, ?)`,
+		"/skydns/com/example/old", `{"host":"1.1.1.1"}`, "2020-01-02 03:04:05")
+	require.NoError(t, err)
+
+	changed, err := backend.GetChangedSince(context.Background(), "/skydns/", time.Date(2020, 1, 2, 3, 4, 4, 0, time.UTC))
+	require.NoError(t, err)
+	require.Len(t, changed, 1)
+
+	changed, err = backend.GetChangedSince(context.Background(), "/skydns/", time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC))
+	require.NoError(t, err)
+	assert.Empty(t, changed)
+}
+
+func TestSQLiteBackend_ConnMaxLifetime(t *testing.T) {
+	ctx := context.Background()
+	backend, err := NewSQLiteBackendWithOptions(filepath.Join(t.TempDir(), "test.db"), SQLiteOptions{
+		ConnMaxLifetime: 10 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	defer backend.Close()
+
+	require.NoError(t, backend.SaveService(ctx, &Service{Key: "/skydns/com/example/www", Host: "1.2.3.4"}))
+	time.Sleep(20 * time.Millisecond)
+
+	// The expired connection is closed when the next query takes it from the pool
+	_, err = backend.GetServices(ctx, "/skydns/")
+	require.NoError(t, err)
+	assert.Positive(t, backend.db.Stats().MaxLifetimeClosed)
+}
+
+func TestSQLiteBackend_ConnMaxIdleTime(t *testing.T) {
+	ctx := context.Background()
+	backend, err := NewSQLiteBackendWithOptions(filepath.Join(t.TempDir(), "test.db"), SQLiteOptions{
+		ConnMaxIdleTime: 10 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	defer backend.Close()
+
+	require.NoError(t, backend.SaveService(ctx, &Service{Key: "/skydns/com/example/www", Host: "1.2.3.4"}))
+
+	// Idle connections are closed by the database/sql cleaner, which runs at most once a second
+	assert.Eventually(t, func() bool {
+		return backend.db.Stats().MaxIdleTimeClosed > 0
+	}, 5*time.Second, 50*time.Millisecond)
+
+	services, err := backend.GetServices(ctx, "/skydns/")
+	require.NoError(t, err)
+	assert.Len(t, services, 1)
+}
+
+func TestSQLiteBackend_ConnSettingsIgnoredInMemory(t *testing.T) {
+	ctx := context.Background()
+	backend, err := NewSQLiteBackendWithOptions(":memory:", SQLiteOptions{
+		ConnMaxLifetime: time.Nanosecond,
+		ConnMaxIdleTime: time.Nanosecond,
+	})
+	require.NoError(t, err)
+	defer backend.Close()
+
+	// Recycling the only connection would drop the in-memory database
+	require.NoError(t, backend.SaveService(ctx, &Service{Key: "/skydns/com/example/www", Host: "1.2.3.4"}))
+	time.Sleep(time.Millisecond)
+	services, err := backend.GetServices(ctx, "/skydns/")
+	require.NoError(t, err)
+	assert.Len(t, services, 1)
+	assert.Zero(t, backend.db.Stats().MaxLifetimeClosed)
+}
+
+func TestSQLiteBackend_FlushCheckpointsWAL(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "test.db")
+	backend, err := NewSQLiteBackend(dbPath)
+	require.NoError(t, err)
+	defer backend.Close()
+
+	ctx := context.Background()
+	for i := 0; i < 100; i++ {
+		require.NoError(t, backend.SaveService(ctx, &Service{Host: "1.2.3.4", Key: fmt.Sprintf("/skydns/com/example/host%d", i)}))
+	}
+	info, err := os.Stat(dbPath + "-wal")
+	require.NoError(t, err)
+	require.Positive(t, info.Size())
+
+	require.NoError(t, backend.Flush(ctx))
+	info, err = os.Stat(dbPath + "-wal")
+	require.NoError(t, err)
+	assert.Zero(t, info.Size(), "WAL file should be truncated")
+
+	// The database stays usable
+	count, err := backend.Count(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 100, count)
+}
+
+func TestSQLiteBackend_Backup(t *testing.T) {
+	dir := t.TempDir()
+	backend, err := NewSQLiteBackend(filepath.Join(dir, "dns.db"))
+	require.NoError(t, err)
+	defer backend.Close()
+
+	ctx := context.Background()
+	for i := 0; i < 100; i++ {
+		require.NoError(t, backend.SaveService(ctx, &Service{Host: "1.2.3.4", Key: fmt.Sprintf("/skydns/com/example/host%d", i)}))
+	}
+	want, err := backend.Snapshot(ctx)
+	require.NoError(t, err)
+
+	// A writer keeps going while the backup is taken, outside the records checked
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			assert.NoError(t, backend.SaveService(ctx, &Service{Host: "5.6.7.8", Key: fmt.Sprintf("/skydns/org/example/host%d", i)}))
+		}
+	}()
+
+	dest := filepath.Join(dir, "backup.db")
+	err = backend.Backup(ctx, dest)
+	close(stop)
+	wg.Wait()
+	require.NoError(t, err)
+	assert.NoFileExists(t, dest+".tmp")
+
+	restored, err := NewSQLiteBackend(dest)
+	require.NoError(t, err)
+	defer restored.Close()
+	got, err := restored.Snapshot(ctx)
+	require.NoError(t, err)
+	for key := range got {
+		if !strings.HasPrefix(key, "/skydns/com/") {
+			delete(got, key)
+		}
+	}
+	assert.Equal(t, want, got)
+
+	// An existing backup is not overwritten
+	assert.ErrorIs(t, backend.Backup(ctx, dest), os.ErrExist)
+
+	// The snapshot connection the backup ran on is read-only again
+	_, err = backend.snapshotDB.ExecContext(ctx, "DELETE FROM services")
+	assert.Error(t, err)
+}
+
+func TestSQLiteBackend_DedupCollapsedMetric(t *testing.T) {
+	backend, err := NewSQLiteBackend(":memory:")
+	require.NoError(t, err)
+	defer backend.Close()
+
+	ctx := context.Background()
+	require.NoError(t, backend.SaveService(ctx, &Service{Host: "1.2.3.4", Key: "/skydns/com/example/www/a", TargetStrip: 1}))
+	require.NoError(t, backend.SaveService(ctx, &Service{Host: "1.2.3.4", Key: "/skydns/com/example/www/b", TargetStrip: 1}))
+
+	before := testutil.ToFloat64(dedupCollapsedTotal.Counter)
+	services, err := backend.GetServices(ctx, "/skydns/")
+	require.NoError(t, err)
+	assert.Len(t, services, 1)
+	assert.InDelta(t, before+1, testutil.ToFloat64(dedupCollapsedTotal.Counter), 0)
+}
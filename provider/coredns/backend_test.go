@@ -17,8 +17,15 @@ limitations under the License.
 package coredns
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
 	"path/filepath"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -57,6 +64,11 @@ func TestGetBackendType(t *testing.T) {
 			envVars:  map[string]string{"COREDNS_BACKEND": "SQLITE"},
 			expected: BackendTypeSQLite,
 		},
+		{
+			name:     "mariadb",
+			envVars:  map[string]string{"COREDNS_BACKEND": "mariadb"},
+			expected: BackendTypeMySQL,
+		},
 		{
 			name:     "unknown type preserved",
 			envVars:  map[string]string{"COREDNS_BACKEND": "consul"},
@@ -98,6 +110,106 @@ func TestGetBackendConfig(t *testing.T) {
 				SQLitePath: "/data/dns.db",
 			},
 		},
+		{
+			name: "sqlite reap interval",
+			envVars: map[string]string{
+				"COREDNS_BACKEND":              "sqlite",
+				"COREDNS_SQLITE_REAP_INTERVAL": "5m",
+			},
+			expected: BackendConfig{
+				Type:               BackendTypeSQLite,
+				SQLiteReapInterval: 5 * time.Minute,
+			},
+		},
+		{
+			name: "sqlite connection settings",
+			envVars: map[string]string{
+				"COREDNS_BACKEND":                   "sqlite",
+				"COREDNS_SQLITE_CONN_MAX_LIFETIME":  "30m",
+				"COREDNS_SQLITE_CONN_MAX_IDLE_TIME": "5m",
+				"COREDNS_SQLITE_MAX_IDLE_CONNS":     "2",
+			},
+			expected: BackendConfig{
+				Type:                  BackendTypeSQLite,
+				SQLiteConnMaxLifetime: 30 * time.Minute,
+				SQLiteConnMaxIdleTime: 5 * time.Minute,
+				SQLiteMaxIdleConns:    2,
+			},
+		},
+		{
+			name: "sqlite shards",
+			envVars: map[string]string{
+				"COREDNS_BACKEND":       "sqlite",
+				"COREDNS_SQLITE_SHARDS": "4",
+			},
+			expected: BackendConfig{
+				Type:         BackendTypeSQLite,
+				SQLiteShards: 4,
+			},
+		},
+		{
+			name:    "key separator",
+			envVars: map[string]string{"COREDNS_KEY_SEPARATOR": ":"},
+			expected: BackendConfig{
+				Type:         BackendTypeEtcd,
+				KeySeparator: ":",
+			},
+		},
+		{
+			name:    "coalesce window",
+			envVars: map[string]string{"COREDNS_COALESCE_WINDOW": "50ms"},
+			expected: BackendConfig{
+				Type:           BackendTypeEtcd,
+				CoalesceWindow: 50 * time.Millisecond,
+			},
+		},
+		{
+			name:    "read-only",
+			envVars: map[string]string{"COREDNS_BACKEND_READONLY": "true"},
+			expected: BackendConfig{
+				Type:     BackendTypeEtcd,
+				ReadOnly: true,
+			},
+		},
+		{
+			name:    "require root prefix",
+			envVars: map[string]string{"COREDNS_REQUIRE_ROOT_PREFIX": "true"},
+			expected: BackendConfig{
+				Type:              BackendTypeEtcd,
+				RequireRootPrefix: true,
+			},
+		},
+		{
+			name:    "instance id",
+			envVars: map[string]string{"COREDNS_INSTANCE_ID": "blue"},
+			expected: BackendConfig{
+				Type:       BackendTypeEtcd,
+				InstanceID: "blue",
+			},
+		},
+		{
+			name: "mysql",
+			envVars: map[string]string{
+				"COREDNS_BACKEND":   "mysql",
+				"COREDNS_MYSQL_DSN": "dns:secret@tcp(db:3306)/externaldns",
+			},
+			expected: BackendConfig{
+				Type:     BackendTypeMySQL,
+				MySQLDSN: "dns:secret@tcp(db:3306)/externaldns",
+			},
+		},
+		{
+			name: "etcd endpoints and dial timeout",
+			envVars: map[string]string{
+				"COREDNS_ETCD_ENDPOINTS":    "http://etcd-0:2379, http://etcd-1:2379,,http://etcd-2:2379",
+				"COREDNS_ETCD_DIAL_TIMEOUT": "3s",
+			},
+			expected: BackendConfig{
+				Type:            BackendTypeEtcd,
+				EtcdEndpoints:   []string{"http://etcd-0:2379", "http://etcd-1:2379", "http://etcd-2:2379"},
+				EtcdDialTimeout: 3 * time.Second,
+			},
+		},
 	}
 
 	for _, tt := range tests {
@@ -129,6 +241,134 @@ func TestNewBackend_SQLite(t *testing.T) {
 	assert.Equal(t, dbPath, sqliteBackend.Path())
 }
 
+func TestNewBackend_UpdateServiceThroughDecorators(t *testing.T) {
+	ctx := context.Background()
+	backend, err := NewBackend(&BackendConfig{
+		Type:           BackendTypeMemory,
+		MaxRecords:     10,
+		RateLimit:      1000,
+		CoalesceWindow: time.Hour,
+	})
+	require.NoError(t, err)
+	defer backend.Close()
+
+	err = UpdateService(ctx, backend, &Service{Key: "/skydns/local/a", Host: "10.0.0.1"})
+	require.ErrorIs(t, err, ErrNotFound)
+
+	require.NoError(t, backend.SaveService(ctx, &Service{Key: "/skydns/local/a", Host: "10.0.0.1"}))
+	require.NoError(t, UpdateService(ctx, backend, &Service{Key: "/skydns/local/a", Host: "10.0.0.2"}))
+
+	services, err := backend.GetServices(ctx, "/skydns/local/a")
+	require.NoError(t, err)
+	require.Len(t, services, 1)
+	assert.Equal(t, "10.0.0.2", services[0].Host)
+
+	readOnly, err := NewBackend(&BackendConfig{Type: BackendTypeMemory, ReadOnly: true})
+	require.NoError(t, err)
+	defer readOnly.Close()
+	err = UpdateService(ctx, readOnly, &Service{Key: "/skydns/local/a", Host: "10.0.0.2"})
+	assert.ErrorIs(t, err, ErrReadOnly)
+}
+
+func TestNewBackend_SaveServiceWithPolicyThroughDecorators(t *testing.T) {
+	ctx := context.Background()
+	backend, err := NewBackend(&BackendConfig{
+		Type:           BackendTypeMemory,
+		MaxRecords:     10,
+		RateLimit:      1000,
+		CoalesceWindow: time.Hour,
+	})
+	require.NoError(t, err)
+	defer backend.Close()
+
+	skip := ConflictPolicy{Mode: ConflictSkipIfExists}
+	written, err := SaveServiceWithPolicy(ctx, backend, &Service{Key: "/skydns/local/a", Host: "10.0.0.1"}, skip)
+	require.NoError(t, err)
+	assert.True(t, written)
+	written, err = SaveServiceWithPolicy(ctx, backend, &Service{Key: "/skydns/local/a", Host: "10.0.0.2"}, skip)
+	require.NoError(t, err)
+	assert.False(t, written)
+
+	services, err := backend.GetServices(ctx, "/skydns/local/a")
+	require.NoError(t, err)
+	require.Len(t, services, 1)
+	assert.Equal(t, "10.0.0.1", services[0].Host)
+}
+
+func TestNewBackend_StreamKeysThroughDecorators(t *testing.T) {
+	ctx := context.Background()
+	backend, err := NewBackend(&BackendConfig{
+		Type:           BackendTypeMemory,
+		MaxRecords:     10,
+		RateLimit:      1000,
+		CoalesceWindow: time.Hour,
+	})
+	require.NoError(t, err)
+	defer backend.Close()
+
+	// The buffered save is flushed before the keys are streamed
+	require.NoError(t, backend.SaveService(ctx, &Service{Key: "/skydns/local/a", Host: "10.0.0.1"}))
+
+	streamer, ok := backend.(KeyStreamer)
+	require.True(t, ok, "decorated backend should stream keys")
+	var keys []string
+	require.NoError(t, streamer.StreamKeys(ctx, "/skydns/", func(key string) error {
+		keys = append(keys, key)
+		return nil
+	}))
+	assert.Equal(t, []string{"/skydns/local/a"}, keys)
+}
+
+func TestNewBackend_IsEmptyThroughDecorators(t *testing.T) {
+	ctx := context.Background()
+	backend, err := NewBackend(&BackendConfig{
+		Type:           BackendTypeMemory,
+		MaxRecords:     10,
+		RateLimit:      1000,
+		CoalesceWindow: time.Hour,
+	})
+	require.NoError(t, err)
+	defer backend.Close()
+
+	empty, err := IsEmpty(ctx, backend)
+	require.NoError(t, err)
+	assert.True(t, empty)
+
+	// The buffered save is flushed before checking
+	require.NoError(t, backend.SaveService(ctx, &Service{Key: "/skydns/local/a", Host: "10.0.0.1"}))
+	_, ok := backend.(EmptinessChecker)
+	require.True(t, ok, "decorated backend should report emptiness")
+	empty, err = IsEmpty(ctx, backend)
+	require.NoError(t, err)
+	assert.False(t, empty)
+}
+
+func TestOptionalMethods_Unsupported(t *testing.T) {
+	// Embedding the interface hides the methods beyond Backend
+	backend := struct{ Backend }{NewMemoryBackend()}
+	err := UpdateService(context.Background(), backend, &Service{Key: "/skydns/local/a"})
+	assert.ErrorIs(t, err, errors.ErrUnsupported)
+
+	_, err = SaveServiceWithPolicy(context.Background(), backend, &Service{Key: "/skydns/local/a"}, ConflictPolicy{Mode: ConflictSkipIfExists})
+	assert.ErrorIs(t, err, errors.ErrUnsupported)
+	written, err := SaveServiceWithPolicy(context.Background(), backend, &Service{Key: "/skydns/local/a", Host: "10.0.0.1"}, ConflictPolicy{})
+	require.NoError(t, err)
+	assert.True(t, written)
+
+	// Emptiness is checked with Exists
+	empty, err := IsEmpty(context.Background(), backend)
+	require.NoError(t, err)
+	assert.False(t, empty)
+
+	// Keys are streamed with ForEach
+	var keys []string
+	require.NoError(t, StreamKeys(context.Background(), backend, "/skydns/", func(key string) error {
+		keys = append(keys, key)
+		return nil
+	}))
+	assert.Equal(t, []string{"/skydns/local/a"}, keys)
+}
+
 func TestNewBackend_SQLiteDefaultPath(t *testing.T) {
 	cfg := &BackendConfig{
 		Type:       BackendTypeSQLite,
@@ -141,6 +381,67 @@ func TestNewBackend_SQLiteDefaultPath(t *testing.T) {
 	// The error should be about permissions, not configuration
 	if err != nil {
 		assert.Contains(t, err.Error(), "/var/lib/external-dns")
+		assert.Contains(t, err.Error(), "COREDNS_SQLITE_PATH")
+	}
+}
+
+func TestNewBackend_SQLiteUnwritablePath(t *testing.T) {
+	// A file where the database directory should be
+	parent := filepath.Join(t.TempDir(), "file")
+	require.NoError(t, os.WriteFile(parent, nil, 0o600))
+	path := filepath.Join(parent, "coredns.db")
+
+	backend, err := NewBackend(&BackendConfig{Type: BackendTypeSQLite, SQLitePath: path})
+	require.Error(t, err)
+	assert.Nil(t, backend)
+
+	var backendErr *BackendError
+	require.ErrorAs(t, err, &backendErr)
+	assert.Equal(t, BackendTypeSQLite, backendErr.Type)
+	assert.Equal(t, path, backendErr.Target)
+	assert.ErrorIs(t, err, syscall.ENOTDIR)
+	assert.Contains(t, err.Error(), path)
+	assert.Contains(t, err.Error(), "set COREDNS_SQLITE_PATH to a writable location")
+}
+
+func TestNewBackend_CorruptMemorySnapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshot.json")
+	require.NoError(t, os.WriteFile(path, []byte("{not json"), 0o600))
+
+	_, err := NewBackend(&BackendConfig{Type: BackendTypeMemory, MemoryPath: path})
+	var backendErr *BackendError
+	require.ErrorAs(t, err, &backendErr)
+	assert.Equal(t, path, backendErr.Target)
+	var syntaxErr *json.SyntaxError
+	assert.ErrorAs(t, err, &syntaxErr)
+	assert.Contains(t, err.Error(), "COREDNS_MEMORY_PATH")
+}
+
+func TestNewBackend_InvalidEtcdEndpoint(t *testing.T) {
+	_, err := NewBackend(&BackendConfig{Type: BackendTypeEtcd, EtcdEndpoints: []string{"etcd-0:2379"}})
+	var backendErr *BackendError
+	require.ErrorAs(t, err, &backendErr)
+	assert.Equal(t, "etcd-0:2379", backendErr.Target)
+	assert.Contains(t, err.Error(), "COREDNS_ETCD_ENDPOINTS")
+}
+
+func TestNewBackend_RequireRootPrefix(t *testing.T) {
+	backend, err := NewBackend(&BackendConfig{Type: BackendTypeSQLite, SQLitePath: ":memory:", Prefix: "/dns", RequireRootPrefix: true})
+	require.NoError(t, err)
+	defer backend.Close()
+
+	ctx := context.Background()
+	require.NoError(t, backend.SaveService(ctx, &Service{Host: "1.2.3.4", Key: "/dns/com/example/www"}))
+
+	_, err = backend.GetServices(ctx, "/skydns/com/example")
+	assert.ErrorIs(t, err, ErrInvalidPrefix)
+	assert.ErrorContains(t, err, "/skydns/com/example is not under the root /dns/")
+	assert.ErrorIs(t, backend.DeleteService(ctx, "/dnsx"), ErrInvalidPrefix)
+
+	for _, prefix := range []string{"/dns/", "/dns", "/dns/com/example", "com/example"} {
+		services, err := backend.GetServices(ctx, prefix)
+		require.NoError(t, err, prefix)
+		assert.Len(t, services, 1, prefix)
 	}
 }
 
@@ -150,8 +451,35 @@ func TestNewBackend_UnknownType(t *testing.T) {
 	}
 
 	backend, err := NewBackend(cfg)
-	assert.Error(t, err)
-	assert.Equal(t, ErrUnknownBackend, err)
+	assert.ErrorIs(t, err, ErrUnknownBackend)
+	assert.Nil(t, backend)
+}
+
+func TestNewBackend_InvalidKeySeparator(t *testing.T) {
+	backend, err := NewBackend(&BackendConfig{Type: BackendTypeMemory, KeySeparator: "."})
+	assert.ErrorIs(t, err, ErrInvalidKeySeparator)
+	assert.Nil(t, backend)
+}
+
+func TestGetBackendTypeStrict(t *testing.T) {
+	testutils.TestHelperEnvSetter(t, map[string]string{"COREDNS_BACKEND": "SQLite3"})
+	got, err := GetBackendTypeStrict()
+	require.NoError(t, err)
+	assert.Equal(t, BackendTypeSQLite, got)
+
+	testutils.TestHelperEnvSetter(t, map[string]string{"COREDNS_BACKEND": "sqllite"})
+	got, err = GetBackendTypeStrict()
+	assert.ErrorIs(t, err, ErrUnknownBackend)
+	assert.EqualError(t, err, `COREDNS_BACKEND: unknown backend type "sqllite", valid options are: etcd, sqlite, memory, mysql`)
+	assert.Empty(t, got)
+}
+
+func TestNewBackend_UnknownTypeFromEnv(t *testing.T) {
+	testutils.TestHelperEnvSetter(t, map[string]string{"COREDNS_BACKEND": "etdc"})
+
+	backend, err := NewBackend(nil)
+	assert.ErrorIs(t, err, ErrUnknownBackend)
+	assert.ErrorContains(t, err, "valid options are: etcd, sqlite, memory, mysql")
 	assert.Nil(t, backend)
 }
 
@@ -175,3 +503,108 @@ func TestNewBackend_FromEnv(t *testing.T) {
 	require.True(t, ok)
 	assert.Equal(t, dbPath, sqliteBackend.Path())
 }
+
+func TestNewBackendContext_Cleanup(t *testing.T) {
+	backend, cleanup, err := NewBackendContext(context.Background(), &BackendConfig{Type: BackendTypeMemory})
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	require.NoError(t, backend.SaveService(ctx, &Service{Host: "1.2.3.4", Key: "/skydns/com/example/www"}))
+
+	cleanup()
+	_, err = backend.GetServices(ctx, "/skydns/")
+	assert.ErrorIs(t, err, ErrBackendClosed)
+
+	// Calling cleanup again is a no-op
+	assert.NotPanics(t, cleanup)
+}
+
+func TestNewBackendContext_ClosesWhenContextDone(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	backend, cleanup, err := NewBackendContext(ctx, &BackendConfig{Type: BackendTypeSQLite, SQLitePath: ":memory:"})
+	require.NoError(t, err)
+	defer cleanup()
+
+	require.NoError(t, checkHealth(context.Background(), backend))
+	cancel()
+	assert.Eventually(t, func() bool {
+		return errors.Is(checkHealth(context.Background(), backend), ErrBackendClosed)
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestNewBackendContext_Error(t *testing.T) {
+	backend, cleanup, err := NewBackendContext(context.Background(), &BackendConfig{Type: BackendType("unknown")})
+	assert.ErrorIs(t, err, ErrUnknownBackend)
+	assert.Nil(t, backend)
+	assert.Nil(t, cleanup)
+}
+
+func TestBackendCapabilities(t *testing.T) {
+	memory := NewMemoryBackend()
+	defer memory.Close()
+	assert.Equal(t, BackendCapabilities{}, memory.Capabilities())
+
+	persistent, err := NewPersistentMemoryBackend(filepath.Join(t.TempDir(), "snapshot.json"))
+	require.NoError(t, err)
+	defer persistent.Close()
+	assert.True(t, persistent.Capabilities().Persistent)
+
+	sqlite, err := NewSQLiteBackend(filepath.Join(t.TempDir(), "caps.db"))
+	require.NoError(t, err)
+	defer sqlite.Close()
+	assert.Equal(t, BackendCapabilities{SupportsTransactions: true, Persistent: true}, sqlite.Capabilities())
+
+	inMemorySQLite, err := NewSQLiteBackend(":memory:")
+	require.NoError(t, err)
+	defer inMemorySQLite.Close()
+	assert.False(t, inMemorySQLite.Capabilities().Persistent)
+
+	etcd := etcdClient{}
+	assert.Equal(t, BackendCapabilities{SupportsWatch: true, SupportsLease: true, Persistent: true}, etcd.Capabilities())
+	_, ok := Backend(&etcd).(Watcher)
+	assert.True(t, ok, "SupportsWatch matches the Watcher implementation")
+
+	// Decorators report the wrapped backend's capabilities, except Watch
+	limited := NewRateLimitedBackend(&etcd, 100)
+	assert.Equal(t, BackendCapabilities{SupportsLease: true, Persistent: true}, limited.Capabilities())
+	_, ok = Backend(limited).(Watcher)
+	assert.False(t, ok)
+
+	multi, err := NewMultiBackend([]Backend{sqlite, memory}, MultiBackendOptions{})
+	require.NoError(t, err)
+	defer multi.Close()
+	assert.Equal(t, BackendCapabilities{Persistent: true}, multi.Capabilities())
+}
+
+// BenchmarkGetServices reads a whole zone whose names each have two targets,
+// one of them stored twice, so that half of the reads are deduplicated.
+func BenchmarkGetServices(b *testing.B) {
+	backends := map[string]func() (Backend, error){
+		"memory": func() (Backend, error) { return NewMemoryBackend(), nil },
+		"sqlite": func() (Backend, error) { return NewSQLiteBackend(":memory:") },
+	}
+	for _, name := range []string{"memory", "sqlite"} {
+		for _, records := range []int{1000, 10000, 100000} {
+			b.Run(fmt.Sprintf("%s/%d", name, records), func(b *testing.B) {
+				backend, err := backends[name]()
+				require.NoError(b, err)
+				defer backend.Close()
+
+				ctx := context.Background()
+				for i := 0; i < records/2; i++ {
+					key := fmt.Sprintf("/skydns/com/example/host%06d", i)
+					require.NoError(b, backend.SaveService(ctx, &Service{Key: key + "/a", Host: "10.0.0.1", TargetStrip: 1}))
+					require.NoError(b, backend.SaveService(ctx, &Service{Key: key + "/b", Host: "10.0.0.1", TargetStrip: 1}))
+				}
+
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					services, err := backend.GetServices(ctx, "/skydns/com/example")
+					require.NoError(b, err)
+					require.Len(b, services, records/2)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,74 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package coredns
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// stopTimeout bounds how long Close waits for a background goroutine to
+// exit, so that one stuck in an operation ignoring cancellation can't hang
+// shutdown.
+var stopTimeout = 5 * time.Second
+
+// backgroundTask is a goroutine a backend runs until it is closed.
+type backgroundTask struct {
+	name   string
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// startBackgroundTask runs run in a goroutine with a context canceled when
+// the task is stopped.
+func startBackgroundTask(name string, run func(ctx context.Context)) *backgroundTask {
+	ctx, cancel := context.WithCancel(context.Background())
+	t := &backgroundTask{name: name, cancel: cancel}
+	t.wg.Add(1)
+	go func() {
+		defer t.wg.Done()
+		run(ctx)
+	}()
+	return t
+}
+
+// stop cancels the task and waits for it to exit, for at most stopTimeout.
+func (t *backgroundTask) stop() {
+	t.cancel()
+	exited := make(chan struct{})
+	go func() {
+		t.wg.Wait()
+		close(exited)
+	}()
+	awaitStop(t.name, exited)
+}
+
+// awaitStop waits for done to be closed, for at most stopTimeout. If it
+// isn't, a warning is logged and the goroutine is left to exit once its
+// current operation returns.
+func awaitStop(name string, done <-chan struct{}) bool {
+	timer := time.NewTimer(stopTimeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+		return true
+	case <-timer.C:
+		log.Warnf("Timed out after %s waiting for the %s to stop", stopTimeout, name)
+		return false
+	}
+}
@@ -0,0 +1,89 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package coredns
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+
+	"sigs.k8s.io/external-dns/internal/testutils"
+)
+
+func TestBackgroundTask_StopIsBounded(t *testing.T) {
+	defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+	hook := testutils.LogsUnderTestWithLogLevel(logrus.WarnLevel, t)
+
+	previous := stopTimeout
+	stopTimeout = 50 * time.Millisecond
+	defer func() { stopTimeout = previous }()
+
+	// The task is stuck in an operation that ignores cancellation
+	release := make(chan struct{})
+	started := make(chan struct{})
+	task := startBackgroundTask("stuck task", func(context.Context) {
+		close(started)
+		<-release
+	})
+	<-started
+
+	start := time.Now()
+	task.stop()
+	assert.Less(t, time.Since(start), time.Second)
+	testutils.TestHelperLogContains("Timed out after 50ms waiting for the stuck task to stop", hook, t)
+
+	// Once its operation returns, the goroutine exits
+	close(release)
+	task.wg.Wait()
+}
+
+func TestSQLiteBackend_CloseStopsReaperMidIteration(t *testing.T) {
+	defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+
+	var once sync.Once
+	reaping := make(chan struct{})
+	backend, err := NewSQLiteBackendWithOptions(":memory:", SQLiteOptions{
+		ReapInterval: time.Millisecond,
+		Now: func() time.Time {
+			// Reap reads the clock holding the lock, mid-iteration
+			once.Do(func() { close(reaping) })
+			time.Sleep(10 * time.Millisecond)
+			return time.Now()
+		},
+	})
+	require.NoError(t, err)
+	<-reaping
+
+	start := time.Now()
+	require.NoError(t, backend.Close())
+	assert.Less(t, time.Since(start), stopTimeout)
+}
+
+func TestMultiBackend_CloseStopsHealthChecker(t *testing.T) {
+	defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+
+	backend, err := NewMultiBackend([]Backend{NewMemoryBackend(), NewMemoryBackend()}, MultiBackendOptions{HealthInterval: time.Millisecond})
+	require.NoError(t, err)
+	time.Sleep(5 * time.Millisecond)
+	require.NoError(t, backend.Close())
+}
@@ -0,0 +1,154 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package coredns
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// ErrValueTooLarge is returned when a service encodes to more bytes than the codec allows
+var ErrValueTooLarge = errors.New("encoded value too large")
+
+// DefaultMaxValueSize is the default encoded size limit of JSONCodec. It
+// matches etcd's default request size limit (1.5 MiB).
+const DefaultMaxValueSize = 3 << 19
+
+// Codec converts a Service to and from the value stored by a backend.
+// Backends that persist serialized values (etcd, SQLite) go through a Codec
+// so the on-disk format can be changed without touching the backend itself.
+type Codec interface {
+	// Marshal encodes a service into its stored representation.
+	Marshal(service *Service) ([]byte, error)
+
+	// Unmarshal decodes a stored value into the given service.
+	Unmarshal(data []byte, service *Service) error
+}
+
+// JSONCodec encodes services as JSON, matching the SkyDNS/CoreDNS etcd format.
+type JSONCodec struct {
+	// MaxSize is the largest encoded value Marshal accepts, in bytes.
+	// Zero selects DefaultMaxValueSize and a negative value disables the check.
+	MaxSize int
+}
+
+// Compile-time check that JSONCodec implements Codec
+var _ Codec = JSONCodec{}
+
+// DefaultCodec is the codec used when a backend is not given one explicitly.
+var DefaultCodec Codec = JSONCodec{}
+
+// Marshal encodes a service as JSON, failing with ErrValueTooLarge if the
+// encoded value is larger than MaxSize.
+func (c JSONCodec) Marshal(service *Service) ([]byte, error) {
+	data, err := json.Marshal(service)
+	if err != nil {
+		return nil, err
+	}
+
+	limit := c.MaxSize
+	if limit == 0 {
+		limit = DefaultMaxValueSize
+	}
+	if limit > 0 && len(data) > limit {
+		return nil, fmt.Errorf("%w: %s encodes to %d bytes, limit is %d", ErrValueTooLarge, service.Key, len(data), limit)
+	}
+	return data, nil
+}
+
+// Unmarshal decodes a JSON value into the given service.
+func (JSONCodec) Unmarshal(data []byte, service *Service) error {
+	return json.Unmarshal(data, service)
+}
+
+// UnmarshalJSON decodes a service, reading its numeric fields as typed
+// integers. Writers that handle JSON numbers as float64 may store them in
+// floating point notation (300.0, 4.294967295e+09); such values are accepted
+// if they hold an integer in range of the field, and rejected rather than
+// truncated otherwise.
+func (s *Service) UnmarshalJSON(data []byte) error {
+	type plain Service
+	v := struct {
+		*plain
+		Port        json.Number `json:"port,omitempty"`
+		Priority    json.Number `json:"priority,omitempty"`
+		Weight      json.Number `json:"weight,omitempty"`
+		TTL         json.Number `json:"ttl,omitempty"`
+		TargetStrip json.Number `json:"targetstrip,omitempty"`
+	}{plain: (*plain)(s)}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+
+	ints := []struct {
+		name  string
+		value json.Number
+		field *int
+	}{
+		{"port", v.Port, &s.Port},
+		{"priority", v.Priority, &s.Priority},
+		{"weight", v.Weight, &s.Weight},
+		{"targetstrip", v.TargetStrip, &s.TargetStrip},
+	}
+	for _, f := range ints {
+		if f.value == "" {
+			continue
+		}
+		n, err := jsonInteger(f.name, f.value, math.MinInt, math.MaxInt)
+		if err != nil {
+			return err
+		}
+		*f.field = int(n)
+	}
+	if v.TTL != "" {
+		n, err := jsonInteger("ttl", v.TTL, 0, math.MaxUint32)
+		if err != nil {
+			return err
+		}
+		s.TTL = uint32(n)
+	}
+	return nil
+}
+
+// jsonInteger parses the JSON number of the named field as an integer
+// between lowest and highest. A number in floating point notation must hold
+// an integer exactly.
+func jsonInteger(name string, value json.Number, lowest, highest int64) (int64, error) {
+	n, err := strconv.ParseInt(string(value), 10, 64)
+	if err != nil {
+		f, ferr := strconv.ParseFloat(string(value), 64)
+		if ferr != nil || f != math.Trunc(f) || f < -0x1p63 || f >= 0x1p63 {
+			return 0, fmt.Errorf("invalid %s %s: not an integer", name, value)
+		}
+		n = int64(f)
+	}
+	if n < lowest || n > highest {
+		return 0, fmt.Errorf("invalid %s %s: out of range [%d, %d]", name, value, lowest, highest)
+	}
+	return n, nil
+}
+
+// codecOrDefault returns codec, or DefaultCodec if codec is nil.
+func codecOrDefault(codec Codec) Codec {
+	if codec == nil {
+		return DefaultCodec
+	}
+	return codec
+}
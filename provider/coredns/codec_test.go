@@ -0,0 +1,271 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package coredns
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	etcdcv3 "go.etcd.io/etcd/client/v3"
+)
+
+// upperHostCodec is a test codec that uppercases Host on the way in,
+// proving that backends route values through the configured Codec.
+type upperHostCodec struct{}
+
+func (upperHostCodec) Marshal(service *Service) ([]byte, error) {
+	svc := *service
+	svc.Host = strings.ToUpper(svc.Host)
+	return json.Marshal(&svc)
+}
+
+func (upperHostCodec) Unmarshal(data []byte, service *Service) error {
+	return json.Unmarshal(data, service)
+}
+
+func TestJSONCodec_RoundTrip(t *testing.T) {
+	svc := &Service{
+		Host:        "example.com",
+		Port:        8080,
+		Priority:    5,
+		Weight:      100,
+		Text:        "hello",
+		TTL:         300,
+		TargetStrip: 1,
+		Group:       "mygroup",
+		Key:         "/skydns/com/example/www",
+	}
+
+	data, err := JSONCodec{}.Marshal(svc)
+	require.NoError(t, err)
+	assert.NotContains(t, string(data), "/skydns/com/example/www", "Key must not be serialized")
+
+	got := new(Service)
+	require.NoError(t, JSONCodec{}.Unmarshal(data, got))
+	got.Key = svc.Key
+	assert.Equal(t, svc, got)
+}
+
+func TestJSONCodec_MaxUint32TTL(t *testing.T) {
+	data, err := JSONCodec{}.Marshal(&Service{Host: "1.2.3.4", TTL: math.MaxUint32})
+	require.NoError(t, err)
+	assert.Contains(t, string(data), `"ttl":4294967295`, "TTL must be written as an integer")
+
+	got := new(Service)
+	require.NoError(t, JSONCodec{}.Unmarshal(data, got))
+	assert.Equal(t, uint32(math.MaxUint32), got.TTL)
+}
+
+func TestJSONCodec_NumericFields(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		want  Service
+		valid bool
+	}{
+		{name: "integers", value: `{"port":443,"priority":10,"weight":-1,"ttl":300,"targetstrip":1}`, want: Service{Port: 443, Priority: 10, Weight: -1, TTL: 300, TargetStrip: 1}, valid: true},
+		{name: "max ttl as float", value: `{"ttl":4.294967295e+09}`, want: Service{TTL: math.MaxUint32}, valid: true},
+		{name: "integral floats", value: `{"port":443.0,"priority":1e1,"ttl":300.0}`, want: Service{Port: 443, Priority: 10, TTL: 300}, valid: true},
+		{name: "ttl too large", value: `{"ttl":4294967296}`},
+		{name: "negative ttl", value: `{"ttl":-1}`},
+		{name: "fractional ttl", value: `{"ttl":300.5}`},
+		{name: "fractional port", value: `{"port":1.5}`},
+		{name: "huge priority", value: `{"priority":1e300}`},
+		{name: "not a number", value: `{"ttl":true}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got Service
+			err := JSONCodec{}.Unmarshal([]byte(tt.value), &got)
+			if !tt.valid {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestJSONCodec_MaxSize(t *testing.T) {
+	// {"text":"..."} adds 11 bytes around the text
+	const overhead = len(`{"text":""}`)
+
+	codec := JSONCodec{MaxSize: 1024}
+	_, err := codec.Marshal(&Service{Text: strings.Repeat("a", 1024-overhead), Key: "/skydns/com/example/txt"})
+	assert.NoError(t, err, "exactly at the limit")
+
+	_, err = codec.Marshal(&Service{Text: strings.Repeat("a", 1024-overhead+1), Key: "/skydns/com/example/txt"})
+	assert.ErrorIs(t, err, ErrValueTooLarge)
+	assert.Contains(t, err.Error(), "/skydns/com/example/txt")
+	assert.Contains(t, err.Error(), "1025 bytes")
+
+	// The default limit matches etcd's request size limit
+	_, err = JSONCodec{}.Marshal(&Service{Text: strings.Repeat("a", DefaultMaxValueSize-overhead)})
+	assert.NoError(t, err)
+	_, err = JSONCodec{}.Marshal(&Service{Text: strings.Repeat("a", DefaultMaxValueSize-overhead+1)})
+	assert.ErrorIs(t, err, ErrValueTooLarge)
+
+	// A negative limit disables the check
+	_, err = JSONCodec{MaxSize: -1}.Marshal(&Service{Text: strings.Repeat("a", DefaultMaxValueSize)})
+	assert.NoError(t, err)
+}
+
+func TestSQLiteBackend_ValueTooLarge(t *testing.T) {
+	backend, err := NewSQLiteBackendWithCodec(":memory:", JSONCodec{MaxSize: 64})
+	require.NoError(t, err)
+	defer backend.Close()
+
+	err = backend.SaveService(context.Background(), &Service{Text: strings.Repeat("a", 64), Key: "/skydns/com/example/txt"})
+	assert.ErrorIs(t, err, ErrValueTooLarge)
+
+	count, err := backend.Count(context.Background())
+	require.NoError(t, err)
+	assert.Zero(t, count)
+}
+
+func TestJSONCodec_CoreDNSCompatibility(t *testing.T) {
+	// Value as written by CoreDNS (msg.Service) and etcdctl users
+	blob := `{"host":"10.0.0.10","port":8080,"priority":10,"weight":20,"text":"v=spf1 -all","mail":true,"ttl":60,"targetstrip":1,"group":"g1"}`
+
+	got := new(Service)
+	require.NoError(t, JSONCodec{}.Unmarshal([]byte(blob), got))
+	assert.Equal(t, &Service{
+		Host:        "10.0.0.10",
+		Port:        8080,
+		Priority:    10,
+		Weight:      20,
+		Text:        "v=spf1 -all",
+		Mail:        true,
+		TTL:         60,
+		TargetStrip: 1,
+		Group:       "g1",
+	}, got)
+
+	data, err := JSONCodec{}.Marshal(got)
+	require.NoError(t, err)
+	assert.JSONEq(t, blob, string(data))
+
+	// Zero values are omitted, as CoreDNS does
+	data, err = JSONCodec{}.Marshal(&Service{Host: "10.0.0.10", Key: "/skydns/local/skydns/x1"})
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"host":"10.0.0.10"}`, string(data))
+
+	// Field names are matched case-insensitively, like CoreDNS does, so older
+	// SkyDNS values using Go field names still decode
+	legacy := new(Service)
+	require.NoError(t, JSONCodec{}.Unmarshal([]byte(`{"Host":"10.0.0.10","TargetStrip":2,"Group":"g2"}`), legacy))
+	assert.Equal(t, &Service{Host: "10.0.0.10", TargetStrip: 2, Group: "g2"}, legacy)
+}
+
+func TestServiceJSONTags(t *testing.T) {
+	// Tags must stay in sync with CoreDNS's msg.Service
+	want := map[string]string{
+		"Host":        "host,omitempty",
+		"Port":        "port,omitempty",
+		"Priority":    "priority,omitempty",
+		"Weight":      "weight,omitempty",
+		"Text":        "text,omitempty",
+		"Mail":        "mail,omitempty",
+		"TTL":         "ttl,omitempty",
+		"TargetStrip": "targetstrip,omitempty",
+		"Group":       "group,omitempty",
+		"Key":         "-",
+	}
+
+	typ := reflect.TypeOf(Service{})
+	for name, tag := range want {
+		field, ok := typ.FieldByName(name)
+		require.True(t, ok, name)
+		assert.Equal(t, tag, field.Tag.Get("json"), name)
+	}
+}
+
+func TestSQLiteBackend_CustomCodec(t *testing.T) {
+	backend, err := NewSQLiteBackendWithCodec(":memory:", upperHostCodec{})
+	require.NoError(t, err)
+	defer backend.Close()
+
+	ctx := context.Background()
+
+	svc := &Service{Host: "target.example.com", Key: "/skydns/com/example/www"}
+	require.NoError(t, backend.SaveService(ctx, svc))
+
+	services, err := backend.GetServices(ctx, "/skydns/com/example")
+	require.NoError(t, err)
+	require.Len(t, services, 1)
+	assert.Equal(t, "TARGET.EXAMPLE.COM", services[0].Host)
+
+	// The caller's service must not be modified by the codec
+	assert.Equal(t, "target.example.com", svc.Host)
+}
+
+func TestEtcdClient_CustomCodec(t *testing.T) {
+	svc := &Service{Host: "target.example.com", Key: "/skydns/com/example/www"}
+
+	mockKV := new(MockEtcdKV)
+	mockKV.On("Put", mock.Anything, svc.Key, `{"host":"TARGET.EXAMPLE.COM"}`).
+		Return(&etcdcv3.PutResponse{}, nil)
+	mockKV.On("Get", mock.Anything, "/skydns/com/example").Return(&etcdcv3.GetResponse{
+		Kvs: []*mvccpb.KeyValue{
+			{
+				Key:   []byte(svc.Key),
+				Value: []byte(`{"host":"TARGET.EXAMPLE.COM"}`),
+			},
+		},
+	}, nil)
+
+	c := etcdClient{
+		client: &etcdcv3.Client{KV: mockKV},
+		codec:  upperHostCodec{},
+	}
+
+	require.NoError(t, c.SaveService(context.Background(), svc))
+
+	services, err := c.GetServices(context.Background(), "/skydns/com/example")
+	require.NoError(t, err)
+	require.Len(t, services, 1)
+	assert.Equal(t, "TARGET.EXAMPLE.COM", services[0].Host)
+	mockKV.AssertExpectations(t)
+}
+
+func TestNewBackend_SQLiteCodec(t *testing.T) {
+	backend, err := NewBackend(&BackendConfig{
+		Type:       BackendTypeSQLite,
+		SQLitePath: ":memory:",
+		Codec:      upperHostCodec{},
+	})
+	require.NoError(t, err)
+	defer backend.Close()
+
+	ctx := context.Background()
+	require.NoError(t, backend.SaveService(ctx, &Service{Host: "a.example.com", Key: "/skydns/com/example/a"}))
+
+	services, err := backend.GetServices(ctx, "/skydns/")
+	require.NoError(t, err)
+	require.Len(t, services, 1)
+	assert.Equal(t, "A.EXAMPLE.COM", services[0].Host)
+}
@@ -0,0 +1,70 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package coredns
+
+import (
+	"fmt"
+	"time"
+)
+
+// ConflictMode selects what SaveServiceWithPolicy does when the key is
+// already stored.
+type ConflictMode int
+
+const (
+	// ConflictOverwrite replaces the stored service, like SaveService.
+	ConflictOverwrite ConflictMode = iota
+	// ConflictSkipIfExists leaves a stored service untouched.
+	ConflictSkipIfExists
+	// ConflictNewestWins replaces the stored service only if the write is
+	// newer than it.
+	ConflictNewestWins
+)
+
+// ConflictPolicy controls how SaveServiceWithPolicy resolves a write to a key
+// that another writer may have saved concurrently.
+type ConflictPolicy struct {
+	Mode ConflictMode
+
+	// Timestamp is when the written service was produced. With
+	// ConflictNewestWins the memory and SQLite backends compare it to the
+	// stored modification time and record it as the new one. If zero, the
+	// current time is used.
+	Timestamp time.Time
+
+	// Revision is the etcd revision the written service is based on. With
+	// ConflictNewestWins etcd writes only if the key hasn't been modified
+	// after it; zero only writes keys that don't exist.
+	Revision int64
+}
+
+// timestamp returns the policy's Timestamp, or now if it isn't set.
+func (p ConflictPolicy) timestamp(now func() time.Time) time.Time {
+	if p.Timestamp.IsZero() {
+		return now()
+	}
+	return p.Timestamp
+}
+
+// validate checks that the policy's mode is known.
+func (p ConflictPolicy) validate() error {
+	switch p.Mode {
+	case ConflictOverwrite, ConflictSkipIfExists, ConflictNewestWins:
+		return nil
+	}
+	return fmt.Errorf("unknown conflict mode %d", p.Mode)
+}
@@ -0,0 +1,98 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package coredns
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// policySaver is implemented by the backends supporting SaveServiceWithPolicy.
+type policySaver interface {
+	Backend
+	SaveServiceWithPolicy(ctx context.Context, service *Service, policy ConflictPolicy) (bool, error)
+}
+
+func conflictBackends(t *testing.T) map[string]policySaver {
+	sqliteBackend, err := NewSQLiteBackend(":memory:")
+	require.NoError(t, err)
+	t.Cleanup(func() { sqliteBackend.Close() })
+
+	memoryBackend := NewMemoryBackend()
+	t.Cleanup(func() { memoryBackend.Close() })
+
+	return map[string]policySaver{
+		"memory": memoryBackend,
+		"sqlite": sqliteBackend,
+	}
+}
+
+func TestSaveServiceWithPolicy(t *testing.T) {
+	const key = "/skydns/com/example/www"
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	for name, backend := range conflictBackends(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+
+			save := func(host string, policy ConflictPolicy) bool {
+				saved, err := backend.SaveServiceWithPolicy(ctx, &Service{Key: key, Host: host}, policy)
+				require.NoError(t, err)
+				return saved
+			}
+			stored := func() string {
+				services, err := backend.GetServices(ctx, key)
+				require.NoError(t, err)
+				require.Len(t, services, 1)
+				return services[0].Host
+			}
+
+			t.Run("skip if exists", func(t *testing.T) {
+				require.NoError(t, backend.DeleteService(ctx, key))
+				assert.True(t, save("1.1.1.1", ConflictPolicy{Mode: ConflictSkipIfExists}))
+				assert.False(t, save("2.2.2.2", ConflictPolicy{Mode: ConflictSkipIfExists}))
+				assert.Equal(t, "1.1.1.1", stored())
+			})
+
+			t.Run("overwrite", func(t *testing.T) {
+				require.NoError(t, backend.DeleteService(ctx, key))
+				assert.True(t, save("1.1.1.1", ConflictPolicy{}))
+				assert.True(t, save("2.2.2.2", ConflictPolicy{Mode: ConflictOverwrite}))
+				assert.Equal(t, "2.2.2.2", stored())
+			})
+
+			t.Run("newest wins", func(t *testing.T) {
+				require.NoError(t, backend.DeleteService(ctx, key))
+				assert.True(t, save("2.2.2.2", ConflictPolicy{Mode: ConflictNewestWins, Timestamp: base.Add(2 * time.Second)}))
+				assert.False(t, save("1.1.1.1", ConflictPolicy{Mode: ConflictNewestWins, Timestamp: base.Add(time.Second)}))
+				assert.Equal(t, "2.2.2.2", stored())
+
+				assert.True(t, save("3.3.3.3", ConflictPolicy{Mode: ConflictNewestWins, Timestamp: base.Add(3 * time.Second)}))
+				assert.Equal(t, "3.3.3.3", stored())
+			})
+
+			t.Run("unknown mode", func(t *testing.T) {
+				_, err := backend.SaveServiceWithPolicy(ctx, &Service{Key: key, Host: "4.4.4.4"}, ConflictPolicy{Mode: ConflictMode(42)})
+				assert.ErrorContains(t, err, "unknown conflict mode")
+			})
+		})
+	}
+}
@@ -0,0 +1,193 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package coredns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"sigs.k8s.io/external-dns/endpoint"
+)
+
+// hostService returns the service holding target, a host of ep, under the
+// key of dnsName labeled prefix.
+func (k KeyScheme) hostService(root, dnsName, prefix, target string, ep *endpoint.Endpoint) *Service {
+	group, _ := ep.GetProviderSpecificProperty(providerSpecificGroup)
+	return &Service{
+		Host:          target,
+		Text:          ep.Labels["originalText"],
+		Key:           k.BuildKey(root, prefix+"."+dnsName),
+		TargetStrip:   strings.Count(prefix, ".") + 1,
+		TTL:           uint32(ep.RecordTTL),
+		Group:         group,
+		ForceCNAME:    ep.RecordType == endpoint.RecordTypeCNAME && guessRecordType(target) != endpoint.RecordTypeCNAME,
+		SetIdentifier: ep.SetIdentifier,
+	}
+}
+
+// textService returns a service without text for a TXT value of ep, under
+// the key of dnsName labeled prefix.
+func (k KeyScheme) textService(root, dnsName, prefix string, ep *endpoint.Endpoint) *Service {
+	return &Service{
+		Key:           k.BuildKey(root, prefix+"."+dnsName),
+		TargetStrip:   strings.Count(prefix, ".") + 1,
+		TTL:           uint32(ep.RecordTTL),
+		SetIdentifier: ep.SetIdentifier,
+	}
+}
+
+// EndpointToServices returns the services storing ep under prefix, one per
+// target, as ApplyChanges writes them with the default key scheme. See
+// KeyScheme.EndpointToServices.
+func EndpointToServices(prefix string, ep *endpoint.Endpoint) ([]*Service, error) {
+	return defaultKeyScheme.EndpointToServices(prefix, ep)
+}
+
+// EndpointToServices returns the services storing ep under prefix, one per
+// target, as ApplyChanges writes them with the key scheme k. Targets are
+// stored under the key label recorded in ep.Labels by Records; others get a
+// HashSuffixer label, so the conversion is deterministic. ep is not modified.
+func (k KeyScheme) EndpointToServices(prefix string, ep *endpoint.Endpoint) ([]*Service, error) {
+	if ep == nil || ep.DNSName == "" {
+		return nil, errors.New("endpoint has no DNS name")
+	}
+	services := make([]*Service, 0, len(ep.Targets))
+	for i, target := range ep.Targets {
+		label := ep.Labels[target]
+		if label == "" && i == 0 && ep.RecordType == endpoint.RecordTypeTXT {
+			label = ep.Labels[randomPrefixLabel]
+		}
+		if label == "" {
+			label = targetKeySuffix(HashSuffixer{}, ep.SetIdentifier, target)
+		}
+
+		var service *Service
+		if ep.RecordType == endpoint.RecordTypeTXT {
+			service = k.textService(prefix, ep.DNSName, label, ep)
+			service.Text = target
+		} else {
+			service = k.hostService(prefix, ep.DNSName, label, target, ep)
+		}
+		if err := service.Validate(); err != nil {
+			return nil, err
+		}
+		services = append(services, service)
+	}
+	return services, nil
+}
+
+// ServicesToEndpoint aggregates services, stored under prefix with the
+// default key scheme, into the endpoint Records would return for them. See
+// KeyScheme.ServicesToEndpoint.
+func ServicesToEndpoint(prefix string, svcs []*Service) (*endpoint.Endpoint, error) {
+	return defaultKeyScheme.ServicesToEndpoint(prefix, svcs)
+}
+
+// ServicesToEndpoint aggregates services, stored under prefix with the key
+// scheme k, into the endpoint Records would return for them: one target per
+// host, or one per text if none has a host. The services must belong to the
+// same DNS name, set identifier and group, and their hosts must make records
+// of the same type.
+func (k KeyScheme) ServicesToEndpoint(prefix string, svcs []*Service) (*endpoint.Endpoint, error) {
+	if len(svcs) == 0 {
+		return nil, errors.New("no services to convert")
+	}
+
+	var host, text *endpoint.Endpoint
+	firstName := ""
+	for i, service := range svcs {
+		dnsName, label := k.ParseKey(prefix, service.Key, service.TargetStrip)
+		if i == 0 {
+			firstName = dnsName
+		}
+		if dnsName != firstName || service.SetIdentifier != svcs[0].SetIdentifier {
+			return nil, fmt.Errorf("service at %s doesn't belong to the endpoint of %s (set identifier %q)", service.Key, firstName, svcs[0].SetIdentifier)
+		}
+
+		if service.Host != "" {
+			if host == nil {
+				host = newHostEndpoint(dnsName, service)
+			} else if recordType := recordTypeFor(dnsName, service); recordType != host.RecordType {
+				return nil, fmt.Errorf("service at %s makes a %s record, not %s", service.Key, recordType, host.RecordType)
+			} else if group, _ := host.GetProviderSpecificProperty(providerSpecificGroup); group != service.Group {
+				return nil, fmt.Errorf("service at %s is in group %q, not %q", service.Key, service.Group, group)
+			}
+			addHostTarget(host, service, label)
+		} else if service.Text != "" {
+			if text == nil {
+				text = newTextEndpoint(dnsName, service, label)
+			}
+			addTextTarget(text, service, label)
+		}
+	}
+
+	if host != nil {
+		return host, nil
+	}
+	if text != nil {
+		return text, nil
+	}
+	return nil, fmt.Errorf("services of %s have neither host nor text", firstName)
+}
+
+// GetEndpoints returns the endpoints of the services stored under prefix in
+// backend, grouping them in a single pass by DNS name, set identifier, group
+// and record type. Keys are parsed with the key scheme of backend. A service holding both a host and a text contributes to
+// both the host endpoint and the TXT endpoint of its name. Use GetServices
+// to read the services themselves.
+func GetEndpoints(ctx context.Context, backend Backend, prefix string) ([]*endpoint.Endpoint, error) {
+	services, err := backend.GetServices(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	keys := keySchemeOf(backend)
+
+	type groupKey struct {
+		dnsName, setIdentifier, group, recordType string
+	}
+	var order []groupKey
+	groups := make(map[groupKey][]*Service)
+	add := func(key groupKey, service *Service) {
+		if _, ok := groups[key]; !ok {
+			order = append(order, key)
+		}
+		groups[key] = append(groups[key], service)
+	}
+	for _, service := range services {
+		dnsName, _ := keys.ParseKey(prefix, service.Key, service.TargetStrip)
+		if service.Host != "" {
+			add(groupKey{dnsName, service.SetIdentifier, service.Group, recordTypeFor(dnsName, service)}, service)
+		}
+		if service.Text != "" {
+			text := *service
+			text.Host = ""
+			add(groupKey{dnsName, service.SetIdentifier, "", endpoint.RecordTypeTXT}, &text)
+		}
+	}
+
+	endpoints := make([]*endpoint.Endpoint, 0, len(order))
+	for _, key := range order {
+		ep, err := keys.ServicesToEndpoint(prefix, groups[key])
+		if err != nil {
+			return nil, err
+		}
+		endpoints = append(endpoints, ep)
+	}
+	return endpoints, nil
+}
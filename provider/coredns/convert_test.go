@@ -0,0 +1,169 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package coredns
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"sigs.k8s.io/external-dns/endpoint"
+)
+
+func TestEndpointToServices(t *testing.T) {
+	ep := endpoint.NewEndpointWithTTL("www.example.com", endpoint.RecordTypeA, 60, "10.0.0.1", "10.0.0.2")
+	ep.Labels["10.0.0.1"] = "a1"
+
+	services, err := EndpointToServices("/skydns/", ep)
+	require.NoError(t, err)
+	require.Len(t, services, 2)
+
+	assert.Equal(t, "/skydns/com/example/www/a1", services[0].Key)
+	assert.Equal(t, "10.0.0.1", services[0].Host)
+	assert.Equal(t, uint32(60), services[0].TTL)
+	assert.Equal(t, 1, services[0].TargetStrip)
+
+	// Targets without a recorded label get a deterministic one
+	assert.Equal(t, "/skydns/com/example/www/"+HashSuffixer{}.Suffix("10.0.0.2"), services[1].Key)
+	assert.Equal(t, "10.0.0.2", services[1].Host)
+	again, err := EndpointToServices("/skydns/", ep)
+	require.NoError(t, err)
+	assert.Equal(t, services, again)
+
+	assert.NotContains(t, ep.Labels, "10.0.0.2", "the endpoint is not modified")
+}
+
+func TestEndpointToServices_Errors(t *testing.T) {
+	_, err := EndpointToServices("/skydns/", nil)
+	assert.Error(t, err)
+
+	_, err = EndpointToServices("/skydns/", endpoint.NewEndpoint("", endpoint.RecordTypeA, "10.0.0.1"))
+	assert.Error(t, err)
+}
+
+func TestServicesToEndpoint(t *testing.T) {
+	ep := endpoint.NewEndpointWithTTL("www.example.com", endpoint.RecordTypeA, 60, "10.0.0.1", "10.0.0.2")
+	ep.WithProviderSpecific(providerSpecificGroup, "blue")
+	services, err := EndpointToServices("/skydns/", ep)
+	require.NoError(t, err)
+
+	got, err := ServicesToEndpoint("/skydns/", services)
+	require.NoError(t, err)
+	assert.Equal(t, "www.example.com", got.DNSName)
+	assert.Equal(t, endpoint.RecordTypeA, got.RecordType)
+	assert.Equal(t, endpoint.TTL(60), got.RecordTTL)
+	assert.ElementsMatch(t, endpoint.Targets{"10.0.0.1", "10.0.0.2"}, got.Targets)
+	group, _ := got.GetProviderSpecificProperty(providerSpecificGroup)
+	assert.Equal(t, "blue", group)
+	assert.Equal(t, HashSuffixer{}.Suffix("10.0.0.2"), got.Labels["10.0.0.2"])
+}
+
+func TestServicesToEndpoint_TXT(t *testing.T) {
+	ep := endpoint.NewEndpoint("example.com", endpoint.RecordTypeTXT, "v=spf1 -all", "hello")
+	services, err := EndpointToServices("/skydns/", ep)
+	require.NoError(t, err)
+	require.Len(t, services, 2)
+	assert.Equal(t, "v=spf1 -all", services[0].Text)
+	assert.Empty(t, services[0].Host)
+
+	got, err := ServicesToEndpoint("/skydns/", services)
+	require.NoError(t, err)
+	assert.Equal(t, endpoint.RecordTypeTXT, got.RecordType)
+	assert.ElementsMatch(t, endpoint.Targets{"v=spf1 -all", "hello"}, got.Targets)
+}
+
+func TestKeyScheme_EndpointConversion(t *testing.T) {
+	keys := KeyScheme{Separator: ':'}
+	ep := endpoint.NewEndpoint("www.example.com", endpoint.RecordTypeA, "10.0.0.1")
+	ep.Labels["10.0.0.1"] = "a1"
+
+	services, err := keys.EndpointToServices(":dns:", ep)
+	require.NoError(t, err)
+	require.Len(t, services, 1)
+	assert.Equal(t, ":dns:com:example:www:a1", services[0].Key)
+
+	got, err := keys.ServicesToEndpoint(":dns:", services)
+	require.NoError(t, err)
+	assert.Equal(t, "www.example.com", got.DNSName)
+	assert.Equal(t, endpoint.Targets{"10.0.0.1"}, got.Targets)
+	assert.Equal(t, "a1", got.Labels["10.0.0.1"])
+}
+
+func TestServicesToEndpoint_Errors(t *testing.T) {
+	_, err := ServicesToEndpoint("/skydns/", nil)
+	assert.Error(t, err)
+
+	_, err = ServicesToEndpoint("/skydns/", []*Service{
+		{Key: "/skydns/com/example/www/a", Host: "10.0.0.1", TargetStrip: 1},
+		{Key: "/skydns/com/example/api/a", Host: "10.0.0.2", TargetStrip: 1},
+	})
+	assert.ErrorContains(t, err, "doesn't belong")
+
+	_, err = ServicesToEndpoint("/skydns/", []*Service{
+		{Key: "/skydns/com/example/www/a", Host: "10.0.0.1", TargetStrip: 1},
+		{Key: "/skydns/com/example/www/b", Host: "lb.example.com", TargetStrip: 1},
+	})
+	assert.ErrorContains(t, err, "CNAME")
+}
+
+func TestGetEndpoints_KeySchemeOfBackend(t *testing.T) {
+	ctx := context.Background()
+	keys := KeyScheme{Separator: ':'}
+	inner := NewMemoryBackendWithOptions(MemoryOptions{Prefix: ":dns", Keys: keys})
+	require.NoError(t, inner.SaveService(ctx, &Service{Key: ":dns:com:example:www:a1", Host: "10.0.0.1", TargetStrip: 1}))
+
+	// The scheme is found through the decorators
+	endpoints, err := GetEndpoints(ctx, NewReadOnlyBackend(inner), ":dns:")
+	require.NoError(t, err)
+	require.Len(t, endpoints, 1)
+	assert.Equal(t, "www.example.com", endpoints[0].DNSName)
+	assert.Equal(t, "a1", endpoints[0].Labels["10.0.0.1"])
+}
+
+func TestGetEndpoints(t *testing.T) {
+	ctx := context.Background()
+	backend := NewMemoryBackend()
+	for _, svc := range []*Service{
+		{Key: "/skydns/com/example/www/a1", Host: "10.0.0.1", TargetStrip: 1},
+		{Key: "/skydns/com/example/www/a2", Host: "10.0.0.2", TargetStrip: 1},
+		{Key: "/skydns/com/example/www/a3", Host: "10.0.0.3", TargetStrip: 1},
+		{Key: "/skydns/com/example/mail/t1", Host: "10.0.1.1", Text: "hello", TargetStrip: 1},
+	} {
+		require.NoError(t, backend.SaveService(ctx, svc))
+	}
+
+	endpoints, err := GetEndpoints(ctx, backend, "/skydns/")
+	require.NoError(t, err)
+	require.Len(t, endpoints, 3)
+
+	byKey := make(map[string]*endpoint.Endpoint)
+	for _, ep := range endpoints {
+		byKey[ep.DNSName+" "+ep.RecordType] = ep
+	}
+	www := byKey["www.example.com A"]
+	require.NotNil(t, www)
+	assert.ElementsMatch(t, endpoint.Targets{"10.0.0.1", "10.0.0.2", "10.0.0.3"}, www.Targets)
+	assert.Equal(t, "a2", www.Labels["10.0.0.2"])
+
+	// The text of a host service makes a TXT endpoint as well
+	require.NotNil(t, byKey["mail.example.com A"])
+	assert.Equal(t, endpoint.Targets{"10.0.1.1"}, byKey["mail.example.com A"].Targets)
+	require.NotNil(t, byKey["mail.example.com TXT"])
+	assert.Equal(t, endpoint.Targets{"hello"}, byKey["mail.example.com TXT"].Targets)
+}
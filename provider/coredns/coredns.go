@@ -18,16 +18,18 @@ package coredns
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
-	"math/rand"
 	"net"
+	"net/url"
 	"os"
+	"slices"
+	"sort"
 	"strings"
+	"sync/atomic"
 	"time"
 
-	log "github.com/sirupsen/logrus"
+	"go.etcd.io/etcd/api/v3/mvccpb"
 	etcdcv3 "go.etcd.io/etcd/client/v3"
 
 	"sigs.k8s.io/external-dns/pkg/tlsutils"
@@ -38,9 +40,13 @@ import (
 )
 
 const (
-	priority    = 10 // default priority when nothing is set
+	priority    = 10 // default SRV and MX priority when nothing is set
 	etcdTimeout = 5 * time.Second
 
+	// defaultEtcdPageSize is the number of keys read per range request
+	// unless BackendConfig.EtcdPageSize is set.
+	defaultEtcdPageSize = 1000
+
 	randomPrefixLabel     = "prefix"
 	providerSpecificGroup = "coredns/group"
 )
@@ -59,9 +65,19 @@ type coreDNSProvider struct {
 	coreDNSPrefix string
 	domainFilter  *endpoint.DomainFilter
 	client        Backend
+	keySuffixer   KeySuffixer        // RandomSuffixer if nil
+	cache         *recordsCache      // nil disables caching of Records
+	keys          KeyScheme          // separator of coreDNSPrefix and keys
+	recordTypes   map[string]bool    // types that can be written, all if nil
+	reloadable    *ReloadableBackend // nil if the backend can't be reloaded
+	maxTargets    int                // cap on A/AAAA targets per name, 0 for none
+	strictTargets bool               // reject endpoints over maxTargets instead of truncating
 }
 
-// Service represents CoreDNS etcd record
+// Service represents CoreDNS etcd record.
+// The JSON field names and omitempty semantics match CoreDNS's msg.Service so
+// that values written by either side round-trip without losing fields.
+// ForceCNAME is an extension that CoreDNS ignores.
 type Service struct {
 	Host     string `json:"host,omitempty"`
 	Port     int    `json:"port,omitempty"`
@@ -83,92 +99,700 @@ type Service struct {
 	// answer.
 	Group string `json:"group,omitempty"`
 
+	// ForceCNAME makes Host a CNAME target even if it parses as an IP
+	// address, instead of the A/AAAA record it would otherwise produce.
+	ForceCNAME bool `json:"forcecname,omitempty"`
+
+	// Source identifies what created the record, e.g. the external-dns
+	// source (service, ingress, ...). It is not part of the DNS answer.
+	Source string `json:"source,omitempty"`
+
+	// SetIdentifier is the external-dns set identifier of the endpoint the
+	// record belongs to, keeping apart records of the same name that routing
+	// policies (weighted, failover, ...) tell apart. It is not part of the
+	// DNS answer.
+	SetIdentifier string `json:"setidentifier,omitempty"`
+
+	// RawType and RawData store a record of a type the provider doesn't
+	// model, such as CAA, NS or DS, as its type and presentation format
+	// data (e.g. `0 issue "letsencrypt.org"`). They are stored verbatim and
+	// exclude Host, Text, Port and Mail; the provider doesn't read or write
+	// raw records as endpoints and no defaults apply to them.
+	RawType string `json:"rawtype,omitempty"`
+	RawData string `json:"rawdata,omitempty"`
+
 	// Etcd key where we found this service and ignored from json un-/marshaling
 	Key string `json:"-"`
 }
 
 type etcdClient struct {
 	client *etcdcv3.Client
+	codec  Codec
+	lease  *etcdLease // nil unless lease-based writes are enabled
+	prefix string     // root for relative keys, DefaultPrefix if empty
+
+	// defaults applied to read services, DefaultServiceDefaults if nil
+	defaults ServiceDefaults
+
+	// stopCompactor stops the history compactor goroutine, if any, and waits for it
+	stopCompactor func()
+
+	// pageSize is the number of keys read per range request, defaultEtcdPageSize if zero
+	pageSize int64
+
+	// keys is the scheme of stored keys
+	keys KeyScheme
+
+	closed atomic.Bool
 }
 
-var _ coreDNSClient = etcdClient{}
+// resolve returns key scoped under the client's root prefix
+func (c *etcdClient) resolve(key string) string {
+	return c.keys.resolveKey(c.keys.normalizePrefix(c.prefix), key)
+}
+
+var _ coreDNSClient = (*etcdClient)(nil)
 var _ Backend = (*etcdClient)(nil)
 
 // GetServices GetService return all Service records stored in etcd stored anywhere under the given key (recursively)
-func (c etcdClient) GetServices(ctx context.Context, prefix string) ([]*Service, error) {
+func (c *etcdClient) GetServices(ctx context.Context, prefix string) ([]*Service, error) {
+	return c.GetServicesWithOptions(ctx, prefix, GetServicesOptions{})
+}
+
+// GetServicesWithOptions returns the Service records stored in etcd under the given key,
+// deduplicated and with default priorities unless opts.Raw is set
+func (c *etcdClient) GetServicesWithOptions(ctx context.Context, prefix string, opts GetServicesOptions) ([]*Service, error) {
+	if c.closed.Load() {
+		return nil, ErrBackendClosed
+	}
+	if err := c.keys.validatePrefix(c.keys.normalizePrefix(c.prefix), prefix); err != nil {
+		return nil, err
+	}
+	codec := codecOrDefault(c.codec)
+	defaults := serviceDefaultsOrDefault(c.defaults)
+	svcs := []*Service{}
+	bx := make(map[serviceDedupKey]bool)
+	collapsed := 0
+	err := c.rangePages(ctx, c.resolve(prefix), func(kvs []*mvccpb.KeyValue) error {
+		for _, n := range kvs {
+			svc := new(Service)
+			if err := codec.Unmarshal(n.Value, svc); err != nil {
+				return fmt.Errorf("%s: %w", n.Key, err)
+			}
+			svc.Key = string(n.Key)
+			if opts.Raw {
+				svcs = append(svcs, svc)
+				continue
+			}
+			b := c.keys.dedupKeyFor(svc)
+			if _, ok := bx[b]; ok {
+				// skip the service if already added to service list.
+				// the same service might be found in multiple etcd nodes,
+				// or stored under several suffix keys of the same name.
+				collapsed++
+				continue
+			}
+			bx[b] = true
+
+			svcs = append(svcs, svc)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !opts.Raw {
+		recordCollapsed(c.resolve(prefix), collapsed)
+		defaults.applyTo(c.keys, svcs)
+	}
+	return svcs, nil
+}
+
+// GetServicesByType returns the Service records stored in etcd under the given key
+// that produce a record of the given type
+func (c *etcdClient) GetServicesByType(ctx context.Context, prefix, recordType string) ([]*Service, error) {
+	services, err := c.GetServices(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	return filterServicesByType(services, recordType), nil
+}
+
+// GetServicesBySource returns the Service records stored in etcd under the
+// given key that were created by the given source
+func (c *etcdClient) GetServicesBySource(ctx context.Context, prefix, source string) ([]*Service, error) {
+	services, err := c.GetServices(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	return filterServicesBySource(services, source), nil
+}
+
+// SaveService persists service data into etcd
+func (c *etcdClient) SaveService(ctx context.Context, service *Service) error {
+	if c.closed.Load() {
+		return ErrBackendClosed
+	}
+	if err := service.Validate(); err != nil {
+		return err
+	}
+
 	ctx, cancel := context.WithTimeout(ctx, etcdTimeout)
 	defer cancel()
 
-	path := prefix
-	r, err := c.client.Get(ctx, path, etcdcv3.WithPrefix())
+	value, err := codecOrDefault(c.codec).Marshal(service)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	opts, err := c.putOptions(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = c.client.Put(ctx, c.resolve(service.Key), string(value), opts...)
+	if err != nil {
+		return etcdError(err)
 	}
+	return nil
+}
 
-	var svcs []*Service
-	bx := make(map[Service]bool)
-	for _, n := range r.Kvs {
+// putOptions returns the options of a put, attaching the write lease if enabled.
+func (c *etcdClient) putOptions(ctx context.Context) ([]etcdcv3.OpOption, error) {
+	if c.lease == nil {
+		return nil, nil
+	}
+	id, err := c.lease.leaseID(ctx, c.client.Lease)
+	if err != nil {
+		return nil, etcdError(err)
+	}
+	return []etcdcv3.OpOption{etcdcv3.WithLease(id)}, nil
+}
+
+// UpdateService replaces the service stored at the service's key, failing
+// with ErrNotFound if there is none, unlike SaveService. The existence check
+// and the put run in a single transaction.
+func (c *etcdClient) UpdateService(ctx context.Context, service *Service) error {
+	if c.closed.Load() {
+		return ErrBackendClosed
+	}
+	if err := service.Validate(); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, etcdTimeout)
+	defer cancel()
+
+	value, err := codecOrDefault(c.codec).Marshal(service)
+	if err != nil {
+		return err
+	}
+	opts, err := c.putOptions(ctx)
+	if err != nil {
+		return err
+	}
+
+	key := c.resolve(service.Key)
+	resp, err := c.client.Txn(ctx).
+		If(etcdcv3.Compare(etcdcv3.CreateRevision(key), ">", 0)).
+		Then(etcdcv3.OpPut(key, string(value), opts...)).
+		Commit()
+	if err != nil {
+		return etcdError(err)
+	}
+	if !resp.Succeeded {
+		return fmt.Errorf("%w: no service stored at %s", ErrNotFound, key)
+	}
+	return nil
+}
+
+// SaveServiceWithPolicy saves the service unless policy says the stored one
+// wins, and reports whether it was written. The check and the put run in a
+// single transaction; newest-wins compares the key's mod revision with
+// policy.Revision.
+func (c *etcdClient) SaveServiceWithPolicy(ctx context.Context, service *Service, policy ConflictPolicy) (bool, error) {
+	if c.closed.Load() {
+		return false, ErrBackendClosed
+	}
+	if err := policy.validate(); err != nil {
+		return false, err
+	}
+	if policy.Mode == ConflictOverwrite {
+		return true, c.SaveService(ctx, service)
+	}
+	if err := service.Validate(); err != nil {
+		return false, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, etcdTimeout)
+	defer cancel()
+
+	value, err := codecOrDefault(c.codec).Marshal(service)
+	if err != nil {
+		return false, err
+	}
+	opts, err := c.putOptions(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	key := c.resolve(service.Key)
+	cmp := etcdcv3.Compare(etcdcv3.CreateRevision(key), "=", 0)
+	if policy.Mode == ConflictNewestWins {
+		cmp = etcdcv3.Compare(etcdcv3.ModRevision(key), "<", policy.Revision+1)
+	}
+	resp, err := c.client.Txn(ctx).If(cmp).Then(etcdcv3.OpPut(key, string(value), opts...)).Commit()
+	if err != nil {
+		return false, etcdError(err)
+	}
+	return resp.Succeeded, nil
+}
+
+// ForEach calls fn for each service stored in etcd under the given prefix,
+// reading one page of keys at a time
+func (c *etcdClient) ForEach(ctx context.Context, prefix string, fn func(key string, svc *Service) error) error {
+	if c.closed.Load() {
+		return ErrBackendClosed
+	}
+	if err := c.keys.validatePrefix(c.keys.normalizePrefix(c.prefix), prefix); err != nil {
+		return err
+	}
+	return c.scanRecords(ctx, prefix, func(key string, svc *Service, err error) error {
+		if err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+		return fn(key, svc)
+	})
+}
+
+// scanRecords calls fn for each key under prefix, in key order, with the
+// decoded service or the error decoding it.
+func (c *etcdClient) scanRecords(ctx context.Context, prefix string, fn func(key string, svc *Service, err error) error) error {
+	codec := codecOrDefault(c.codec)
+	return c.rangePages(ctx, c.resolve(prefix), func(kvs []*mvccpb.KeyValue) error {
+		for _, n := range kvs {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			svc := new(Service)
+			if err := codec.Unmarshal(n.Value, svc); err != nil {
+				if err := fn(string(n.Key), nil, err); err != nil {
+					return err
+				}
+				continue
+			}
+			svc.Key = string(n.Key)
+			if err := fn(svc.Key, svc, nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// rangePages reads the keys addressed by prefix in key order, c.pageSize
+// keys per range request, and calls fn with each page. Every page after the first is
+// read at the revision of the first, so the pages form a consistent view.
+// Each request gets its own etcdTimeout and the extra options.
+func (c *etcdClient) rangePages(ctx context.Context, prefix string, fn func(kvs []*mvccpb.KeyValue) error, extra ...etcdcv3.OpOption) error {
+	_, err := c.rangePagesAt(ctx, prefix, fn, extra...)
+	return err
+}
+
+// rangePagesAt pages through prefix like rangePages and returns the
+// revision the pages were read at.
+func (c *etcdClient) rangePagesAt(ctx context.Context, prefix string, fn func(kvs []*mvccpb.KeyValue) error, extra ...etcdcv3.OpOption) (int64, error) {
+	pageSize := c.pageSize
+	if pageSize <= 0 {
+		pageSize = defaultEtcdPageSize
+	}
+	_, end := c.keys.childKeyRange(prefix)
+
+	start := prefix
+	var revision int64
+	for {
+		opts := []etcdcv3.OpOption{
+			etcdcv3.WithRange(end),
+			etcdcv3.WithSort(etcdcv3.SortByKey, etcdcv3.SortAscend),
+			etcdcv3.WithLimit(pageSize),
+		}
+		opts = append(opts, extra...)
+		if revision > 0 {
+			opts = append(opts, etcdcv3.WithRev(revision))
+		}
+
+		getCtx, cancel := context.WithTimeout(ctx, etcdTimeout)
+		r, err := c.client.Get(getCtx, start, opts...)
+		cancel()
+		if err != nil {
+			return 0, etcdError(err)
+		}
+		if revision == 0 && r.Header != nil {
+			revision = r.Header.Revision
+		}
+
+		if err := fn(c.keysInPrefix(prefix, r.Kvs)); err != nil {
+			return 0, err
+		}
+		if !r.More || len(r.Kvs) == 0 {
+			return revision, nil
+		}
+		// The smallest key sorting after the last one read
+		start = string(r.Kvs[len(r.Kvs)-1].Key) + "\x00"
+	}
+}
+
+// StreamKeys calls fn with each key under prefix in key order, reading the
+// keys without their values a page at a time, stopping at the first error
+// or when ctx is done.
+func (c *etcdClient) StreamKeys(ctx context.Context, prefix string, fn func(key string) error) error {
+	if c.closed.Load() {
+		return ErrBackendClosed
+	}
+	if err := c.keys.validatePrefix(c.keys.normalizePrefix(c.prefix), prefix); err != nil {
+		return err
+	}
+	return c.rangePages(ctx, c.resolve(prefix), func(kvs []*mvccpb.KeyValue) error {
+		for _, n := range kvs {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if err := fn(string(n.Key)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}, etcdcv3.WithKeysOnly())
+}
+
+// GetServicesPage returns up to limit Service records stored in etcd under the
+// given prefix whose key sorts after afterKey, using a range request with a limit.
+func (c *etcdClient) GetServicesPage(ctx context.Context, prefix, afterKey string, limit int) ([]*Service, string, error) {
+	if c.closed.Load() {
+		return nil, "", ErrBackendClosed
+	}
+	if err := c.keys.validatePrefix(c.keys.normalizePrefix(c.prefix), prefix); err != nil {
+		return nil, "", err
+	}
+	if limit <= 0 {
+		return nil, "", ErrInvalidPageLimit
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, etcdTimeout)
+	defer cancel()
+
+	prefix = c.resolve(prefix)
+	start := prefix
+	if afterKey != "" && afterKey >= start {
+		// The smallest key sorting after afterKey
+		start = afterKey + "\x00"
+	}
+
+	_, end := c.keys.childKeyRange(prefix)
+	r, err := c.client.Get(ctx, start,
+		etcdcv3.WithRange(end),
+		etcdcv3.WithSort(etcdcv3.SortByKey, etcdcv3.SortAscend),
+		etcdcv3.WithLimit(int64(limit)),
+	)
+	if err != nil {
+		return nil, "", etcdError(err)
+	}
+
+	codec := codecOrDefault(c.codec)
+	page := make([]*Service, 0, len(r.Kvs))
+	for _, n := range c.keysInPrefix(prefix, r.Kvs) {
 		svc := new(Service)
-		if err := json.Unmarshal(n.Value, svc); err != nil {
-			return nil, fmt.Errorf("%s: %w", n.Key, err)
+		if err := codec.Unmarshal(n.Value, svc); err != nil {
+			return nil, "", fmt.Errorf("%s: %w", n.Key, err)
 		}
-		b := Service{Host: svc.Host, Port: svc.Port, Priority: svc.Priority, Weight: svc.Weight, Text: svc.Text, Key: string(n.Key)}
-		if _, ok := bx[b]; ok {
-			// skip the service if already added to service list.
-			// the same service might be found in multiple etcd nodes.
+		svc.Key = string(n.Key)
+		page = append(page, svc)
+	}
+	// The cursor is the last key read, even if it was filtered out
+	if len(r.Kvs) < limit {
+		return page, "", nil
+	}
+	return page, string(r.Kvs[len(r.Kvs)-1].Key), nil
+}
+
+// keysInPrefix returns the kvs addressed by prefix, without the siblings
+// read along, such as "/skydns/com/example-2" for "/skydns/com/example",
+// that sort between prefix and its children.
+func (c *etcdClient) keysInPrefix(prefix string, kvs []*mvccpb.KeyValue) []*mvccpb.KeyValue {
+	for i, n := range kvs {
+		if c.keys.inPrefix(string(n.Key), prefix) {
 			continue
 		}
-		bx[b] = true
+		kept := slices.Clone(kvs[:i])
+		for _, n := range kvs[i+1:] {
+			if c.keys.inPrefix(string(n.Key), prefix) {
+				kept = append(kept, n)
+			}
+		}
+		return kept
+	}
+	return kvs
+}
 
-		svc.Key = string(n.Key)
-		if svc.Priority == 0 {
-			svc.Priority = priority
+// Snapshot returns all Service records stored in etcd under the root prefix.
+// All pages are read at the same revision, so the view is consistent.
+func (c *etcdClient) Snapshot(ctx context.Context) (map[string]Service, error) {
+	if c.closed.Load() {
+		return nil, ErrBackendClosed
+	}
+	codec := codecOrDefault(c.codec)
+	snapshot := make(map[string]Service)
+	err := c.rangePages(ctx, c.resolve(""), func(kvs []*mvccpb.KeyValue) error {
+		for _, n := range kvs {
+			var svc Service
+			if err := codec.Unmarshal(n.Value, &svc); err != nil {
+				return fmt.Errorf("%s: %w", n.Key, err)
+			}
+			snapshot[string(n.Key)] = svc
 		}
-		svcs = append(svcs, svc)
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
-	return svcs, nil
+	return snapshot, nil
 }
 
-// SaveService persists service data into etcd
-func (c etcdClient) SaveService(ctx context.Context, service *Service) error {
+// DeleteService deletes service record from etcd
+func (c *etcdClient) DeleteService(ctx context.Context, key string) error {
+	if c.closed.Load() {
+		return ErrBackendClosed
+	}
+	if err := c.keys.validatePrefix(c.keys.normalizePrefix(c.prefix), key); err != nil {
+		return err
+	}
 	ctx, cancel := context.WithTimeout(ctx, etcdTimeout)
 	defer cancel()
 
-	value, err := json.Marshal(&service)
+	// The children and the key itself, without the siblings sharing its start
+	key = c.resolve(key)
+	if _, err := c.client.Delete(ctx, c.keys.childPrefix(key), etcdcv3.WithPrefix()); err != nil {
+		return etcdError(err)
+	}
+	_, err := c.client.Delete(ctx, key)
+	return etcdError(err)
+}
+
+// deleteIfCovered deletes key and its children if covered accepts all of
+// them. The keys are paged through at one revision and deleted in a
+// transaction that fails if any key in the range was modified or created
+// after it.
+func (c *etcdClient) deleteIfCovered(ctx context.Context, key string, covered func(key string) bool) (bool, error) {
+	if c.closed.Load() {
+		return false, ErrBackendClosed
+	}
+	if err := c.keys.validatePrefix(c.keys.normalizePrefix(c.prefix), key); err != nil {
+		return false, err
+	}
+
+	key = c.resolve(key)
+	errNotCovered := errors.New("key not covered")
+	revision, err := c.rangePagesAt(ctx, key, func(kvs []*mvccpb.KeyValue) error {
+		for _, n := range kvs {
+			if !covered(string(n.Key)) {
+				return errNotCovered
+			}
+		}
+		return nil
+	}, etcdcv3.WithKeysOnly())
+	if errors.Is(err, errNotCovered) {
+		return false, nil
+	}
 	if err != nil {
-		return err
+		return false, err
 	}
-	_, err = c.client.Put(ctx, service.Key, string(value))
+
+	ctx, cancel := context.WithTimeout(ctx, etcdTimeout)
+	defer cancel()
+	children := c.keys.childPrefix(key)
+	resp, err := c.client.Txn(ctx).
+		If(
+			etcdcv3.Compare(etcdcv3.ModRevision(key), "<", revision+1),
+			etcdcv3.Compare(etcdcv3.ModRevision(children), "<", revision+1).WithPrefix(),
+		).
+		Then(etcdcv3.OpDelete(children, etcdcv3.WithPrefix()), etcdcv3.OpDelete(key)).
+		Commit()
 	if err != nil {
+		return false, etcdError(err)
+	}
+	return resp.Succeeded, nil
+}
+
+// ClearPrefix removes every key under prefix, refusing the root prefix.
+func (c *etcdClient) ClearPrefix(ctx context.Context, prefix string) error {
+	if c.closed.Load() {
+		return ErrBackendClosed
+	}
+	if err := c.keys.validateClearPrefix(c.keys.normalizePrefix(c.prefix), prefix); err != nil {
 		return err
 	}
+	return c.DeleteService(ctx, prefix)
+}
+
+// Exists reports whether any key is stored under the given prefix, using
+// count-only requests for the prefix itself and for its children.
+func (c *etcdClient) Exists(ctx context.Context, prefix string) (bool, error) {
+	if c.closed.Load() {
+		return false, ErrBackendClosed
+	}
+	if err := c.keys.validatePrefix(c.keys.normalizePrefix(c.prefix), prefix); err != nil {
+		return false, err
+	}
+	return c.exists(ctx, prefix)
+}
+
+// exists is Exists without the check of prefix, so that an empty prefix
+// addresses the root prefix.
+func (c *etcdClient) exists(ctx context.Context, prefix string) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, etcdTimeout)
+	defer cancel()
+
+	prefix = c.resolve(prefix)
+	r, err := c.client.Get(ctx, prefix, etcdcv3.WithCountOnly())
+	if err != nil {
+		return false, etcdError(err)
+	}
+	if r.Count > 0 {
+		return true, nil
+	}
+	r, err = c.client.Get(ctx, c.keys.childPrefix(prefix), etcdcv3.WithPrefix(), etcdcv3.WithCountOnly(), etcdcv3.WithLimit(1))
+	if err != nil {
+		return false, etcdError(err)
+	}
+	return r.Count > 0, nil
+}
+
+// IsEmpty reports whether no service is stored under the client's root
+// prefix, using count-only requests.
+func (c *etcdClient) IsEmpty(ctx context.Context) (bool, error) {
+	if c.closed.Load() {
+		return false, ErrBackendClosed
+	}
+	exists, err := c.exists(ctx, "")
+	return !exists, err
+}
+
+// rootPrefix returns the prefix addressing every stored service.
+func (c *etcdClient) rootPrefix() string {
+	return c.keys.normalizePrefix(c.prefix) + c.keys.sep()
+}
+
+// keyScheme returns the scheme of the stored keys.
+func (c *etcdClient) keyScheme() KeyScheme {
+	return c.keys
+}
+
+// Flush is a no-op: etcd acknowledges writes once they are durable.
+func (c *etcdClient) Flush(_ context.Context) error {
+	if c.closed.Load() {
+		return ErrBackendClosed
+	}
 	return nil
 }
 
-// DeleteService deletes service record from etcd
-func (c etcdClient) DeleteService(ctx context.Context, key string) error {
+// Capabilities reports that etcd is persistent, can be watched and supports
+// lease-based writes (see BackendConfig.EtcdLeaseTTL).
+func (c *etcdClient) Capabilities() BackendCapabilities {
+	return BackendCapabilities{
+		SupportsWatch: true,
+		SupportsLease: true,
+		Persistent:    true,
+	}
+}
+
+// Health checks that etcd answers a count-only range request on the root prefix.
+func (c *etcdClient) Health(ctx context.Context) error {
+	if c.closed.Load() {
+		return ErrBackendClosed
+	}
 	ctx, cancel := context.WithTimeout(ctx, etcdTimeout)
 	defer cancel()
 
-	_, err := c.client.Delete(ctx, key, etcdcv3.WithPrefix())
-	return err
+	_, err := c.client.Get(ctx, c.resolve(""), etcdcv3.WithPrefix(), etcdcv3.WithCountOnly())
+	return etcdError(err)
 }
 
-// Close closes the etcd client connection
+// Close stops the lease keepalive, if any, and closes the etcd client
+// connection. Calling Close more than once is a no-op.
 func (c *etcdClient) Close() error {
-	if c.client != nil {
-		return c.client.Close()
+	if !c.closed.CompareAndSwap(false, true) {
+		return nil
+	}
+	if c.stopCompactor != nil {
+		c.stopCompactor()
+		c.stopCompactor = nil
+	}
+	if c.lease != nil {
+		c.lease.stop()
+	}
+	if c.client == nil {
+		return nil
+	}
+	// A client without a connection reports the cancellation of its own
+	// context, which is how it closes
+	if err := c.client.Close(); err != nil && !errors.Is(err, context.Canceled) {
+		return err
 	}
 	return nil
 }
 
+// defaultETCDURL is the etcd endpoint used when none is configured.
+const defaultETCDURL = "http://localhost:2379"
+
 // builds etcd client config depending on connection scheme and TLS parameters
 func getETCDConfig() (*etcdcv3.Config, error) {
 	etcdURLsStr := os.Getenv("ETCD_URLS")
 	if etcdURLsStr == "" {
-		etcdURLsStr = "http://localhost:2379"
+		etcdURLsStr = defaultETCDURL
+	}
+	return buildETCDConfig(strings.Split(etcdURLsStr, ","))
+}
+
+// etcdConfigFor builds the etcd client config for backendCfg. Endpoints from
+// COREDNS_ETCD_ENDPOINTS take precedence over ETCD_URLS and are validated.
+func etcdConfigFor(backendCfg *BackendConfig) (*etcdcv3.Config, error) {
+	var cfg *etcdcv3.Config
+	var err error
+	if len(backendCfg.EtcdEndpoints) > 0 {
+		if err := validateETCDEndpoints(backendCfg.EtcdEndpoints); err != nil {
+			return nil, err
+		}
+		cfg, err = buildETCDConfig(backendCfg.EtcdEndpoints)
+	} else {
+		cfg, err = getETCDConfig()
+	}
+	if err != nil {
+		return nil, err
 	}
-	etcdURLs := strings.Split(etcdURLsStr, ",")
+	cfg.DialTimeout = backendCfg.EtcdDialTimeout
+	if backendCfg.EtcdUsername != "" {
+		cfg.Username, cfg.Password = backendCfg.EtcdUsername, backendCfg.EtcdPassword
+	}
+	if backendCfg.EtcdTLS != nil {
+		cfg.TLS = backendCfg.EtcdTLS
+	}
+	return cfg, nil
+}
+
+// validateETCDEndpoints checks that every endpoint is an http(s) URL with a host
+func validateETCDEndpoints(endpoints []string) error {
+	for _, ep := range endpoints {
+		u, err := url.Parse(ep)
+		if err != nil {
+			return fmt.Errorf("invalid etcd endpoint %q: %w", ep, err)
+		}
+		if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid etcd endpoint %q: must be an http:// or https:// URL with a host", ep)
+		}
+	}
+	return nil
+}
+
+// buildETCDConfig builds etcd client config for the given endpoints
+func buildETCDConfig(etcdURLs []string) (*etcdcv3.Config, error) {
 	firstURL := strings.ToLower(etcdURLs[0])
 	etcdUsername := os.Getenv("ETCD_USERNAME")
 	etcdPassword := os.Getenv("ETCD_PASSWORD")
@@ -193,8 +817,8 @@ func getETCDConfig() (*etcdcv3.Config, error) {
 }
 
 // newETCDClient is an etcd client constructor
-func newETCDClient() (Backend, error) {
-	cfg, err := getETCDConfig()
+func newETCDClient(backendCfg *BackendConfig, keys KeyScheme) (Backend, error) {
+	cfg, err := etcdConfigFor(backendCfg)
 	if err != nil {
 		return nil, err
 	}
@@ -202,27 +826,209 @@ func newETCDClient() (Backend, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &etcdClient{c}, nil
+	client := &etcdClient{
+		client:   c,
+		codec:    backendCfg.Codec,
+		prefix:   backendCfg.Prefix,
+		defaults: backendCfg.Defaults,
+		pageSize: int64(backendCfg.EtcdPageSize),
+		keys:     keys,
+	}
+	if backendCfg.EtcdLeaseTTL > 0 {
+		client.lease = newETCDLease(backendCfg.EtcdLeaseTTL)
+	}
+	if backendCfg.EtcdCompactInterval > 0 {
+		log.Infof("Compacting etcd history every %s", backendCfg.EtcdCompactInterval)
+		client.stopCompactor = client.startCompactor(backendCfg.EtcdCompactInterval)
+	}
+	return client, nil
 }
 
 // NewCoreDNSProvider is a CoreDNS provider constructor.
 // The backend is selected via the COREDNS_BACKEND environment variable:
 //   - "etcd" (default): Uses etcd as the storage backend
 //   - "sqlite": Uses SQLite as the storage backend (simpler, single-node)
+//   - "mysql": Uses the MySQL or MariaDB database at COREDNS_MYSQL_DSN
+//
+// COREDNS_ETCD_PREFIX, when set, overrides prefix as the root of all keys.
+// COREDNS_INSTANCE_ID, when set, isolates the keys of this instance under an
+// extra label after the root.
+// COREDNS_KEY_SEPARATOR, when set, replaces "/" between the labels of keys.
+// COREDNS_KEY_SUFFIX selects how the key suffix of each target is generated
+// (see NewKeySuffixer). COREDNS_PROVIDER_CACHE_TTL, when set, caches the
+// result of Records for that long. COREDNS_SUPPORTED_RECORD_TYPES, when set,
+// is the comma-separated list of the record types external-dns may write.
+// COREDNS_MAX_TARGETS_PER_NAME, when set, caps the targets of the A and AAAA
+// records of a name, truncating larger ones with a warning, or rejecting
+// them if COREDNS_MAX_TARGETS_STRICT is true.
 func NewCoreDNSProvider(domainFilter *endpoint.DomainFilter, prefix string, dryRun bool) (provider.Provider, error) {
-	client, err := NewBackend(nil)
+	cfg, err := GetConfig(domainFilter, prefix, dryRun)
 	if err != nil {
 		return nil, err
 	}
+	return NewCoreDNSProviderFromConfig(cfg)
+}
+
+// Config holds everything needed to build a CoreDNS provider, so that it
+// can be configured programmatically instead of through the environment.
+type Config struct {
+	// Backend selects and configures the backend: its type, SQLite path,
+	// etcd settings, key prefix and service defaults.
+	Backend BackendConfig
+
+	// DomainFilter, when configured, restricts writes to the managed zones.
+	DomainFilter *endpoint.DomainFilter
+
+	// Prefix is the root of the keys the provider manages. Backend.Prefix,
+	// when set, overrides it.
+	Prefix string
+
+	// DryRun logs changes instead of applying them.
+	DryRun bool
+
+	// KeySuffixer generates the key suffix of each target. If nil,
+	// RandomSuffixer is used.
+	KeySuffixer KeySuffixer
+
+	// CacheTTL caches the result of Records for at most this long; records
+	// with a shorter TTL expire the cache sooner. Zero disables caching.
+	CacheTTL time.Duration
+
+	// Clock tells the time cached records expire by. If nil, SystemClock
+	// is used.
+	Clock Clock
+
+	// SupportedRecordTypes lists the record types that may be written (see
+	// ParseRecordTypes). Endpoints of other types are skipped with a warning
+	// and the backend rejects their records. If empty, all types are allowed.
+	SupportedRecordTypes []string
+
+	// MaxTargetsPerName caps the targets of an A or AAAA endpoint. Larger
+	// endpoints are truncated to a stable subset (see SelectTargets) with a
+	// warning. Zero disables the cap.
+	MaxTargetsPerName int
+
+	// StrictMaxTargets makes ApplyChanges fail on endpoints over
+	// MaxTargetsPerName instead of truncating them.
+	StrictMaxTargets bool
+}
+
+// GetConfig builds a Config from the arguments and the environment variables
+// documented on NewCoreDNSProvider.
+func GetConfig(domainFilter *endpoint.DomainFilter, prefix string, dryRun bool) (Config, error) {
+	keySuffixer, err := getKeySuffixer()
+	if err != nil {
+		return Config{}, err
+	}
+	return Config{
+		Backend:      GetBackendConfig(),
+		DomainFilter: domainFilter,
+		Prefix:       prefix,
+		DryRun:       dryRun,
+		KeySuffixer:  keySuffixer,
+		CacheTTL:     getEnvDuration("COREDNS_PROVIDER_CACHE_TTL"),
+
+		SupportedRecordTypes: getEnvList("COREDNS_SUPPORTED_RECORD_TYPES"),
+		MaxTargetsPerName:    getEnvInt("COREDNS_MAX_TARGETS_PER_NAME"),
+		StrictMaxTargets:     getEnvBool("COREDNS_MAX_TARGETS_STRICT"),
+	}, nil
+}
+
+// NewCoreDNSProviderFromConfig creates a CoreDNS provider and its backend
+// from cfg, without reading environment variables, except for the etcd
+// connection settings cfg.Backend leaves unset (see BackendConfig).
+func NewCoreDNSProviderFromConfig(cfg Config) (provider.Provider, error) {
+	keys, err := NewKeyScheme(cfg.Backend.KeySeparator)
+	if err != nil {
+		return nil, err
+	}
+	recordTypes, err := ParseRecordTypes(cfg.SupportedRecordTypes)
+	if err != nil {
+		return nil, fmt.Errorf("COREDNS_SUPPORTED_RECORD_TYPES: %w", err)
+	}
+	// The backend is rooted where the provider writes, so that its
+	// snapshots and exports see the provider's keys
+	backendCfg := cfg.Backend
+	if backendCfg.Prefix == "" {
+		backendCfg.Prefix = cfg.Prefix
+	}
+	backend, err := NewBackend(&backendCfg)
+	if err != nil {
+		return nil, err
+	}
+	reloadable := NewReloadableBackend(backend)
+	var client Backend = reloadable
+	prefix := cfg.Prefix
+	if cfg.Backend.Prefix != "" {
+		prefix = keys.normalizePrefix(cfg.Backend.Prefix) + keys.sep()
+		log.Infof("Using CoreDNS key prefix %s", prefix)
+	}
+	if cfg.Backend.InstanceID != "" {
+		prefix = keys.InstancePrefix(prefix, cfg.Backend.InstanceID) + keys.sep()
+	}
+	domainFilter := cfg.DomainFilter
+	if domainFilter == nil {
+		domainFilter = &endpoint.DomainFilter{}
+	}
+	if domainFilter.IsConfigured() {
+		// Guard the store against writes outside the managed zones
+		client = NewFilteringBackendWithOptions(client, domainFilter, FilteringOptions{Prefix: prefix, Keys: keys})
+	}
+	if recordTypes != nil {
+		log.Infof("Only writing %s records", strings.ToUpper(strings.Join(cfg.SupportedRecordTypes, ", ")))
+		client = NewRecordTypeBackendWithOptions(client, recordTypes, RecordTypeOptions{Prefix: prefix, Keys: keys})
+	}
+
+	if cfg.CacheTTL > 0 {
+		log.Infof("Caching CoreDNS records for %s", cfg.CacheTTL)
+	}
+	if cfg.MaxTargetsPerName < 0 {
+		return nil, fmt.Errorf("COREDNS_MAX_TARGETS_PER_NAME: must not be negative, got %d", cfg.MaxTargetsPerName)
+	}
 
 	return coreDNSProvider{
 		client:        client,
-		dryRun:        dryRun,
+		dryRun:        cfg.DryRun,
 		coreDNSPrefix: prefix,
 		domainFilter:  domainFilter,
+		keySuffixer:   cfg.KeySuffixer,
+		cache:         newRecordsCache(cfg.CacheTTL, cfg.Clock),
+		keys:          keys,
+		recordTypes:   recordTypes,
+		reloadable:    reloadable,
+		maxTargets:    cfg.MaxTargetsPerName,
+		strictTargets: cfg.StrictMaxTargets,
 	}, nil
 }
 
+// Reloader is implemented by providers whose backend can be replaced at
+// runtime, such as the providers NewCoreDNSProvider returns.
+type Reloader interface {
+	Reload(cfg *BackendConfig) error
+}
+
+// Reload opens a new backend per cfg, or the environment if cfg is nil (see
+// NewBackend), and swaps it for the current one, which is closed once the
+// operations running against it complete. If the new backend can't be
+// opened, the current one stays in use. The key prefix and separator of the
+// provider are not reloaded.
+func (p coreDNSProvider) Reload(cfg *BackendConfig) error {
+	if p.reloadable == nil {
+		return errors.New("the CoreDNS backend can't be reloaded")
+	}
+	backend, err := NewBackend(cfg)
+	if err != nil {
+		return err
+	}
+	if err := p.reloadable.Swap(backend); err != nil {
+		backend.Close()
+		return err
+	}
+	p.cache.invalidate()
+	log.Info("Reloaded the CoreDNS backend")
+	return nil
+}
+
 // NewCoreDNSProviderWithBackend creates a CoreDNS provider with a specific backend.
 // This is useful for testing or when you want to manage the backend lifecycle manually.
 func NewCoreDNSProviderWithBackend(domainFilter *endpoint.DomainFilter, prefix string, dryRun bool, backend Backend) provider.Provider {
@@ -245,6 +1051,31 @@ func findEp(slice []*endpoint.Endpoint, dnsName string) (*endpoint.Endpoint, boo
 	return nil, false
 }
 
+// findTypedEp returns the endpoint of dnsName and setIdentifier with the
+// given record type.
+func findTypedEp(slice []*endpoint.Endpoint, dnsName, setIdentifier, recordType string) (*endpoint.Endpoint, bool) {
+	for _, item := range slice {
+		if item.DNSName == dnsName && item.SetIdentifier == setIdentifier && item.RecordType == recordType {
+			return item, true
+		}
+	}
+	return nil, false
+}
+
+// findGroupEp looks for the non-TXT endpoint of dnsName and setIdentifier
+// holding the targets of the given Group (see Service.Group).
+func findGroupEp(slice []*endpoint.Endpoint, dnsName, setIdentifier, group string) (*endpoint.Endpoint, bool) {
+	for _, item := range slice {
+		if item.DNSName != dnsName || item.SetIdentifier != setIdentifier || item.RecordType == endpoint.RecordTypeTXT {
+			continue
+		}
+		if itemGroup, _ := item.GetProviderSpecificProperty(providerSpecificGroup); itemGroup == group {
+			return item, true
+		}
+	}
+	return nil, false
+}
+
 // findLabelInTargets takes an ep.Targets string slice and looks for an element in it. If found it will
 // return its string value, otherwise it will return empty string and a bool of false.
 func findLabelInTargets(targets []string, label string) (string, bool) {
@@ -258,81 +1089,186 @@ func findLabelInTargets(targets []string, label string) (string, bool) {
 
 // Records returns all DNS records found in CoreDNS etcd backend. Depending on the record fields
 // it may be mapped to one or two records of type A, CNAME, TXT, A+TXT, CNAME+TXT
+//
+// CoreDNS answers a query with every record of the name sharing a Group, and
+// treats each group as a distinct answer set. Hosts of the same name are thus
+// merged into one endpoint per group, carrying the group as provider-specific
+// property, rather than into a single endpoint. Services with different
+// SetIdentifiers likewise make separate endpoints.
+//
+// The service TTL becomes the RecordTTL of both the host and TXT endpoints;
+// zero means unset, leaving CoreDNS to serve its default TTL.
+//
+// When COREDNS_PROVIDER_CACHE_TTL is set, the endpoints are cached for that
+// long, or the smallest TTL among their records if shorter, or until
+// ApplyChanges writes to the store.
 func (p coreDNSProvider) Records(ctx context.Context) ([]*endpoint.Endpoint, error) {
+	cached, generation, ok := p.cache.get()
+	if ok {
+		return cached, nil
+	}
+	result, err := p.records(ctx)
+	if err != nil {
+		return nil, err
+	}
+	p.cache.set(result, generation)
+	return result, nil
+}
+
+// records assembles the endpoints of the services in the store.
+func (p coreDNSProvider) records(ctx context.Context) ([]*endpoint.Endpoint, error) {
 	var result []*endpoint.Endpoint
 	services, err := p.client.GetServices(ctx, p.coreDNSPrefix)
 	if err != nil {
 		return nil, err
 	}
 	for _, service := range services {
-		domains := strings.Split(strings.TrimPrefix(service.Key, p.coreDNSPrefix), "/")
-		reverse(domains)
-		dnsName := strings.Join(domains[service.TargetStrip:], ".")
+		dnsName, prefix := p.keys.ParseKey(p.coreDNSPrefix, service.Key, service.TargetStrip)
 		if !p.domainFilter.Match(dnsName) {
 			continue
 		}
 		log.Debugf("Getting service (%v) with service host (%s)", service, service.Host)
-		prefix := strings.Join(domains[:service.TargetStrip], ".")
 		if service.Host != "" {
-			ep, found := findEp(result, dnsName)
+			ep, found := findGroupEp(result, dnsName, service.SetIdentifier, service.Group)
 			if found {
-				ep.Targets = append(ep.Targets, service.Host)
 				log.Debugf("Extending ep (%s) with new service host (%s)", ep, service.Host)
 			} else {
-				ep = endpoint.NewEndpointWithTTL(
-					dnsName,
-					guessRecordType(service.Host),
-					endpoint.TTL(service.TTL),
-					service.Host,
-				)
-				if service.Group != "" {
-					ep.WithProviderSpecific(providerSpecificGroup, service.Group)
-				}
+				ep = newHostEndpoint(dnsName, service)
 				log.Debugf("Creating new ep (%s) with new service host (%s)", ep, service.Host)
+				result = append(result, ep)
 			}
-			ep.Labels["originalText"] = service.Text
-			ep.Labels[randomPrefixLabel] = prefix
-			ep.Labels[service.Host] = prefix
-			result = append(result, ep)
+			addHostTarget(ep, service, prefix)
 		}
 		if service.Text != "" {
-			ep := endpoint.NewEndpoint(
-				dnsName,
-				endpoint.RecordTypeTXT,
-				service.Text,
-			)
-			ep.Labels[randomPrefixLabel] = prefix
-			result = append(result, ep)
+			// All TXT values of a name form one endpoint, each labeled
+			// with the prefix of the key holding it
+			ep, found := findTypedEp(result, dnsName, service.SetIdentifier, endpoint.RecordTypeTXT)
+			if !found {
+				ep = newTextEndpoint(dnsName, service, prefix)
+				result = append(result, ep)
+			}
+			addTextTarget(ep, service, prefix)
 		}
 	}
 	return result, nil
 }
 
+// newHostEndpoint returns an endpoint without targets for the host of
+// service, stored at dnsName.
+func newHostEndpoint(dnsName string, service *Service) *endpoint.Endpoint {
+	ep := endpoint.NewEndpointWithTTL(dnsName, recordTypeFor(dnsName, service), endpoint.TTL(service.TTL))
+	ep.SetIdentifier = service.SetIdentifier
+	if service.Group != "" {
+		ep.WithProviderSpecific(providerSpecificGroup, service.Group)
+	}
+	return ep
+}
+
+// addHostTarget adds the host of service, stored under the key labeled
+// prefix, to ep.
+func addHostTarget(ep *endpoint.Endpoint, service *Service, prefix string) {
+	ep.Targets = append(ep.Targets, service.Host)
+	ep.Labels["originalText"] = service.Text
+	ep.Labels[randomPrefixLabel] = prefix
+	ep.Labels[service.Host] = prefix
+}
+
+// newTextEndpoint returns a TXT endpoint without targets for the text of
+// service, stored at dnsName under the key labeled prefix.
+func newTextEndpoint(dnsName string, service *Service, prefix string) *endpoint.Endpoint {
+	ep := endpoint.NewEndpointWithTTL(dnsName, endpoint.RecordTypeTXT, endpoint.TTL(service.TTL))
+	ep.SetIdentifier = service.SetIdentifier
+	ep.Labels[randomPrefixLabel] = prefix
+	return ep
+}
+
+// addTextTarget adds the text of service, stored under the key labeled
+// prefix, to ep unless it already holds it.
+func addTextTarget(ep *endpoint.Endpoint, service *Service, prefix string) {
+	if _, ok := ep.Labels[service.Text]; !ok {
+		ep.Targets = append(ep.Targets, service.Text)
+		ep.Labels[service.Text] = prefix
+	}
+}
+
+// ApplyChanges writes the changes to the store. A store opened read-only
+// (see ReadOnlyBackend) rejects the first write, before anything is changed,
+// and ApplyChanges fails with an error wrapping ErrReadOnly.
 func (p coreDNSProvider) ApplyChanges(ctx context.Context, changes *plan.Changes) error {
+	err := p.applyChanges(ctx, changes)
+	if errors.Is(err, ErrReadOnly) {
+		return fmt.Errorf("CoreDNS store is read-only, not applying %d changes (unset COREDNS_BACKEND_READONLY to allow writes): %w",
+			len(changes.Create)+len(changes.UpdateNew)+len(changes.Delete), err)
+	}
+	return err
+}
+
+func (p coreDNSProvider) applyChanges(ctx context.Context, changes *plan.Changes) error {
+	if !p.dryRun {
+		// Also invalidated if applying fails midway, since some writes may have landed
+		defer p.cache.invalidate()
+	}
 	grouped := p.groupEndpoints(changes)
 
-	for dnsName, group := range grouped {
-		if !p.domainFilter.Match(dnsName) {
-			log.Debugf("Skipping record %q due to domain filter", dnsName)
+	for name, group := range grouped {
+		if !p.domainFilter.Match(name.dnsName) {
+			log.Debugf("Skipping record %q due to domain filter", name.dnsName)
 			continue
 		}
-		if err := p.applyGroup(ctx, dnsName, group); err != nil {
+		group = p.allowedEndpoints(group)
+		if len(group) == 0 {
+			continue
+		}
+		if err := p.applyGroup(ctx, name.dnsName, group); err != nil {
 			return err
 		}
 	}
 
-	return p.deleteEndpoints(ctx, changes.Delete)
+	if err := p.deleteEndpoints(ctx, changes.Delete); err != nil {
+		return err
+	}
+	if p.dryRun {
+		return nil
+	}
+	// Make the changes durable before reporting them applied
+	return p.client.Flush(ctx)
+}
+
+// allowedEndpoints returns the endpoints whose record type may be written,
+// warning about the others.
+func (p coreDNSProvider) allowedEndpoints(endpoints []*endpoint.Endpoint) []*endpoint.Endpoint {
+	if p.recordTypes == nil {
+		return endpoints
+	}
+	allowed := endpoints[:0:0]
+	for _, ep := range endpoints {
+		if !p.recordTypes[ep.RecordType] {
+			log.Warnf("Skipping %s record %q: type not in COREDNS_SUPPORTED_RECORD_TYPES", ep.RecordType, ep.DNSName)
+			continue
+		}
+		allowed = append(allowed, ep)
+	}
+	return allowed
+}
+
+// endpointGroup identifies the endpoints whose records are written together:
+// those of a name sharing a set identifier.
+type endpointGroup struct {
+	dnsName       string
+	setIdentifier string
 }
 
-func (p coreDNSProvider) groupEndpoints(changes *plan.Changes) map[string][]*endpoint.Endpoint {
-	grouped := make(map[string][]*endpoint.Endpoint)
+func (p coreDNSProvider) groupEndpoints(changes *plan.Changes) map[endpointGroup][]*endpoint.Endpoint {
+	grouped := make(map[endpointGroup][]*endpoint.Endpoint)
 	for _, ep := range changes.Create {
-		grouped[ep.DNSName] = append(grouped[ep.DNSName], ep)
+		name := endpointGroup{ep.DNSName, ep.SetIdentifier}
+		grouped[name] = append(grouped[name], ep)
 	}
 	for i, ep := range changes.UpdateNew {
 		log.Debugf("Updating labels (%s) with old labels (%s)", ep.Labels, changes.UpdateOld[i].Labels)
 		ep.Labels = changes.UpdateOld[i].Labels
-		grouped[ep.DNSName] = append(grouped[ep.DNSName], ep)
+		name := endpointGroup{ep.DNSName, ep.SetIdentifier}
+		grouped[name] = append(grouped[name], ep)
 	}
 	return grouped
 }
@@ -366,27 +1302,19 @@ func (p coreDNSProvider) applyGroup(ctx context.Context, dnsName string, group [
 }
 
 func (p coreDNSProvider) createServicesForEndpoint(ctx context.Context, dnsName string, ep *endpoint.Endpoint) ([]*Service, error) {
+	if err := p.capTargets(dnsName, ep); err != nil {
+		return nil, err
+	}
+
 	var services []*Service
 
 	for _, target := range ep.Targets {
 		prefix := ep.Labels[target]
 		if prefix == "" {
-			prefix = fmt.Sprintf("%08x", rand.Int31())
+			prefix = p.targetKeySuffix(ep.SetIdentifier, target)
 			log.Infof("Generating new prefix: (%s)", prefix)
 		}
-		group := ""
-		if prop, ok := ep.GetProviderSpecificProperty(providerSpecificGroup); ok {
-			group = prop
-		}
-		service := Service{
-			Host:        target,
-			Text:        ep.Labels["originalText"],
-			Key:         p.etcdKeyFor(prefix + "." + dnsName),
-			TargetStrip: strings.Count(prefix, ".") + 1,
-			TTL:         uint32(ep.RecordTTL),
-			Group:       group,
-		}
-		services = append(services, &service)
+		services = append(services, p.keys.hostService(p.coreDNSPrefix, dnsName, prefix, target, ep))
 		ep.Labels[target] = prefix
 	}
 
@@ -409,6 +1337,31 @@ func (p coreDNSProvider) createServicesForEndpoint(ctx context.Context, dnsName
 	return services, nil
 }
 
+// capTargets enforces maxTargets on the targets of an A or AAAA endpoint,
+// failing if strictTargets is set or else keeping a subset picked by
+// rendezvous hashing of the targets, so that the same subset is kept on
+// every write. The keys of the dropped targets, still labeled, are deleted
+// as outdated.
+func (p coreDNSProvider) capTargets(dnsName string, ep *endpoint.Endpoint) error {
+	if p.maxTargets <= 0 || len(ep.Targets) <= p.maxTargets ||
+		(ep.RecordType != endpoint.RecordTypeA && ep.RecordType != endpoint.RecordTypeAAAA) {
+		return nil
+	}
+	if p.strictTargets {
+		return fmt.Errorf("%w: %s record %q has %d targets, COREDNS_MAX_TARGETS_PER_NAME is %d",
+			ErrLimitExceeded, ep.RecordType, dnsName, len(ep.Targets), p.maxTargets)
+	}
+
+	log.Warnf("Truncating %s record %q from %d to %d targets (COREDNS_MAX_TARGETS_PER_NAME)", ep.RecordType, dnsName, len(ep.Targets), p.maxTargets)
+	targets := ep.Targets
+	picked := rendezvousPick(len(targets), p.maxTargets, dnsName, func(i int) string { return targets[i] })
+	ep.Targets = make(endpoint.Targets, len(picked))
+	for i, index := range picked {
+		ep.Targets[i] = targets[index]
+	}
+	return nil
+}
+
 func shouldSkipLabel(label string) bool {
 	skip := []string{"originalText", "prefix", "resource"}
 	_, ok := findLabelInTargets(skip, label)
@@ -422,19 +1375,20 @@ func (p coreDNSProvider) updateTXTRecords(dnsName string, group []*endpoint.Endp
 		if ep.RecordType != endpoint.RecordTypeTXT {
 			continue
 		}
-		if index >= len(services) {
-			prefix := ep.Labels[randomPrefixLabel]
-			if prefix == "" {
-				prefix = fmt.Sprintf("%08x", rand.Int31())
+		for i, target := range ep.Targets {
+			if index >= len(services) {
+				prefix := ep.Labels[target]
+				if prefix == "" && i == 0 {
+					prefix = ep.Labels[randomPrefixLabel]
+				}
+				if prefix == "" {
+					prefix = p.targetKeySuffix(ep.SetIdentifier, target)
+				}
+				services = append(services, p.keys.textService(p.coreDNSPrefix, dnsName, prefix, ep))
 			}
-			services = append(services, &Service{
-				Key:         p.etcdKeyFor(prefix + "." + dnsName),
-				TargetStrip: strings.Count(prefix, ".") + 1,
-				TTL:         uint32(ep.RecordTTL),
-			})
+			services[index].Text = target
+			index++
 		}
-		services[index].Text = ep.Targets[0]
-		index++
 	}
 
 	for i := index; index > 0 && i < len(services); i++ {
@@ -443,17 +1397,60 @@ func (p coreDNSProvider) updateTXTRecords(dnsName string, group []*endpoint.Endp
 	return services
 }
 
+// deleteEndpoints deletes the keys of endpoints. Keys are first merged into
+// prefix deletes of their parents where possible (see collapseDeletes), so
+// removing a whole zone takes a single delete.
 func (p coreDNSProvider) deleteEndpoints(ctx context.Context, endpoints []*endpoint.Endpoint) error {
+	var keys []string
 	for _, ep := range endpoints {
-		dnsName := ep.DNSName
-		if ep.Labels[randomPrefixLabel] != "" {
-			dnsName = ep.Labels[randomPrefixLabel] + "." + dnsName
-		}
-		key := p.etcdKeyFor(dnsName)
+		keys = append(keys, p.endpointKeys(ep)...)
+	}
+	deletes := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		deletes[key] = true
+	}
+
+	collapsed, err := p.collapseDeletes(ctx, keys)
+	if err != nil {
+		return err
+	}
+	for _, key := range collapsed {
 		log.Infof("Delete key %s", key)
 		if p.dryRun {
 			continue
 		}
+		if deletes[key] {
+			if err := p.client.DeleteService(ctx, key); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := p.deleteCollapsed(ctx, key, keys, deletes); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteCollapsed deletes parent, the collapse of the keys in deletes under
+// it, if every service stored under it is still being deleted when the
+// backend checks. Otherwise, as when a service was saved under parent since
+// collapseDeletes ran, the keys under it are deleted one by one.
+func (p coreDNSProvider) deleteCollapsed(ctx context.Context, parent string, keys []string, deletes map[string]bool) error {
+	deleted, err := deleteIfCovered(ctx, p.client, parent, func(key string) bool {
+		return p.keys.isDeleted(key, deletes)
+	})
+	if err != nil || deleted {
+		return err
+	}
+
+	log.Debugf("Services under %s changed, deleting its keys one by one", parent)
+	sorted := append([]string(nil), keys...)
+	sort.Strings(sorted)
+	for i, key := range sorted {
+		if i > 0 && key == sorted[i-1] || !p.keys.isUnder(key, parent) || p.keys.isDeleted(p.keys.parentKey(key), deletes) {
+			continue
+		}
 		if err := p.client.DeleteService(ctx, key); err != nil {
 			return err
 		}
@@ -461,10 +1458,161 @@ func (p coreDNSProvider) deleteEndpoints(ctx context.Context, endpoints []*endpo
 	return nil
 }
 
+// endpointKeys returns the keys holding the targets of ep. Targets are
+// labeled with the prefix of their key by Records; if none is, the key is
+// derived from the endpoint prefix label.
+func (p coreDNSProvider) endpointKeys(ep *endpoint.Endpoint) []string {
+	var keys []string
+	for _, target := range ep.Targets {
+		if prefix := ep.Labels[target]; prefix != "" && !shouldSkipLabel(target) {
+			keys = append(keys, p.etcdKeyFor(prefix+"."+ep.DNSName))
+		}
+	}
+	if len(keys) > 0 {
+		return keys
+	}
+	dnsName := ep.DNSName
+	if ep.Labels[randomPrefixLabel] != "" {
+		dnsName = ep.Labels[randomPrefixLabel] + "." + dnsName
+	}
+	return []string{p.etcdKeyFor(dnsName)}
+}
+
+// collapseDeletes returns the keys to delete so that all of keys, and
+// their children, are removed. Two or more keys sharing a parent are
+// replaced by the parent when every service stored under it is already
+// being deleted, repeating up the tree but never past the provider prefix
+// or the zones matched by the domain filter. Keys under another key being
+// deleted are dropped. The result is sorted.
+//
+// Parents are only collapsed into when the backend can check and delete
+// them atomically (see deleteCollapsed); otherwise keys are returned as is.
+func (p coreDNSProvider) collapseDeletes(ctx context.Context, keys []string) ([]string, error) {
+	root := strings.TrimRight(p.coreDNSPrefix, p.keys.sep())
+	deletes := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		deletes[key] = true
+	}
+	_, atomicDeletes := p.client.(coveredDeleter)
+
+	for collapsed := atomicDeletes; collapsed; {
+		collapsed = false
+		children := make(map[string][]string)
+		for key := range deletes {
+			parent := p.keys.parentKey(key)
+			if strings.HasPrefix(parent, root+p.keys.sep()) {
+				children[parent] = append(children[parent], key)
+			}
+		}
+		parents := make([]string, 0, len(children))
+		for parent := range children {
+			parents = append(parents, parent)
+		}
+		sort.Strings(parents)
+
+		for _, parent := range parents {
+			if len(children[parent]) < 2 {
+				continue
+			}
+			if dnsName, _ := p.keys.ParseKey(p.coreDNSPrefix, parent, 0); !p.domainFilter.Match(dnsName) {
+				continue
+			}
+			covered, err := p.coveredByDeletes(ctx, parent, deletes)
+			if err != nil {
+				return nil, err
+			}
+			if !covered {
+				continue
+			}
+			for _, child := range children[parent] {
+				delete(deletes, child)
+			}
+			deletes[parent] = true
+			collapsed = true
+		}
+	}
+
+	result := make([]string, 0, len(deletes))
+	for key := range deletes {
+		if !p.keys.isDeleted(p.keys.parentKey(key), deletes) {
+			result = append(result, key)
+		}
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+// coveredByDeletes reports whether every service stored at or under parent
+// would be removed by deleting the keys in deletes. It reads the innermost
+// backend, as decorators such as FilteringBackend hide some services.
+func (p coreDNSProvider) coveredByDeletes(ctx context.Context, parent string, deletes map[string]bool) (bool, error) {
+	covered := true
+	err := innermostBackend(p.client).ForEach(ctx, parent, func(key string, _ *Service) error {
+		if !p.keys.isUnder(key, parent) {
+			return nil
+		}
+		if !p.keys.isDeleted(key, deletes) {
+			covered = false
+			return errStopIteration
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, errStopIteration) {
+		return false, err
+	}
+	return covered, nil
+}
+
+// isDeleted reports whether key or one of its ancestors is in deletes.
+func (k KeyScheme) isDeleted(key string, deletes map[string]bool) bool {
+	for ; key != ""; key = k.parentKey(key) {
+		if deletes[key] {
+			return true
+		}
+	}
+	return false
+}
+
+// suffixer returns the KeySuffixer generating the key labels disambiguating
+// the targets of a name.
+func (p coreDNSProvider) suffixer() KeySuffixer {
+	if p.keySuffixer == nil {
+		return RandomSuffixer{}
+	}
+	return p.keySuffixer
+}
+
+// targetKeySuffix returns the key label of target in the endpoint with the
+// given set identifier, so that hash suffixes of the same target differ
+// between set identifiers.
+func (p coreDNSProvider) targetKeySuffix(setIdentifier, target string) string {
+	return targetKeySuffix(p.suffixer(), setIdentifier, target)
+}
+
+// targetKeySuffix returns the key label suffixer gives target in the
+// endpoint with the given set identifier.
+func targetKeySuffix(suffixer KeySuffixer, setIdentifier, target string) string {
+	if setIdentifier == "" {
+		return suffixer.Suffix(target)
+	}
+	return suffixer.Suffix(setIdentifier + "/" + target)
+}
+
 func (p coreDNSProvider) etcdKeyFor(dnsName string) string {
-	domains := strings.Split(dnsName, ".")
-	reverse(domains)
-	return p.coreDNSPrefix + strings.Join(domains, "/")
+	return p.keys.BuildKey(p.coreDNSPrefix, dnsName)
+}
+
+// recordTypeFor returns the record type for a service stored at dnsName.
+// Hosts under reverse-DNS zones are PTR targets and hosts flagged with
+// ForceCNAME are CNAME targets; otherwise the type is guessed from the host.
+func recordTypeFor(dnsName string, service *Service) string {
+	switch {
+	case isReverseName(dnsName):
+		return endpoint.RecordTypePTR
+	case service.ForceCNAME:
+		return endpoint.RecordTypeCNAME
+	}
+	return guessRecordType(service.Host)
 }
 
 func guessRecordType(target string) string {
@@ -18,13 +18,20 @@ package coredns
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"path/filepath"
 	"reflect"
+	"slices"
+	"sort"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
-	log "github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 	"go.etcd.io/etcd/api/v3/mvccpb"
@@ -44,7 +51,7 @@ type fakeETCDClient struct {
 }
 
 func (c fakeETCDClient) GetServices(_ context.Context, prefix string) ([]*Service, error) {
-	var result []*Service
+	result := []*Service{}
 	for key, value := range c.services {
 		if strings.HasPrefix(key, prefix) {
 			valueCopy := value
@@ -55,13 +62,100 @@ func (c fakeETCDClient) GetServices(_ context.Context, prefix string) ([]*Servic
 	return result, nil
 }
 
+func (c fakeETCDClient) GetServicesWithOptions(ctx context.Context, prefix string, _ GetServicesOptions) ([]*Service, error) {
+	return c.GetServices(ctx, prefix)
+}
+
+func (c fakeETCDClient) GetServicesByType(ctx context.Context, prefix, recordType string) ([]*Service, error) {
+	services, err := c.GetServices(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	return filterServicesByType(services, recordType), nil
+}
+
+func (c fakeETCDClient) GetServicesBySource(ctx context.Context, prefix, source string) ([]*Service, error) {
+	services, err := c.GetServices(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	return filterServicesBySource(services, source), nil
+}
+
+func (c fakeETCDClient) ForEach(_ context.Context, prefix string, fn func(key string, svc *Service) error) error {
+	for key, value := range c.services {
+		if strings.HasPrefix(key, prefix) {
+			valueCopy := value
+			valueCopy.Key = key
+			if err := fn(key, &valueCopy); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (c fakeETCDClient) Exists(_ context.Context, prefix string) (bool, error) {
+	for key := range c.services {
+		if strings.HasPrefix(key, prefix) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (c fakeETCDClient) Capabilities() BackendCapabilities {
+	return BackendCapabilities{}
+}
+
+func (c fakeETCDClient) GetServicesPage(_ context.Context, prefix, afterKey string, limit int) ([]*Service, string, error) {
+	var keys []string
+	for key := range c.services {
+		if strings.HasPrefix(key, prefix) && key > afterKey {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	if len(keys) > limit {
+		keys = keys[:limit]
+	}
+	page := []*Service{}
+	for _, key := range keys {
+		valueCopy := c.services[key]
+		valueCopy.Key = key
+		page = append(page, &valueCopy)
+	}
+	return page, nextCursor(page, limit), nil
+}
+
+func (c fakeETCDClient) Snapshot(_ context.Context) (map[string]Service, error) {
+	snapshot := make(map[string]Service, len(c.services))
+	for key, value := range c.services {
+		value.Key = ""
+		snapshot[key] = value
+	}
+	return snapshot, nil
+}
+
 func (c fakeETCDClient) SaveService(_ context.Context, service *Service) error {
 	c.services[service.Key] = *service
 	return nil
 }
 
 func (c fakeETCDClient) DeleteService(_ context.Context, key string) error {
-	delete(c.services, key)
+	for k := range c.services {
+		if k == key || strings.HasPrefix(k, key+"/") {
+			delete(c.services, k)
+		}
+	}
+	return nil
+}
+
+func (c fakeETCDClient) ClearPrefix(ctx context.Context, prefix string) error {
+	return c.DeleteService(ctx, prefix)
+}
+
+func (c fakeETCDClient) Flush(_ context.Context) error {
 	return nil
 }
 
@@ -84,8 +178,8 @@ func (m *MockEtcdKV) Get(ctx context.Context, key string, _ ...etcdcv3.OpOption)
 	return args.Get(0).(*etcdcv3.GetResponse), args.Error(1)
 }
 
-func (m *MockEtcdKV) Delete(ctx context.Context, key string, opts ...etcdcv3.OpOption) (*etcdcv3.DeleteResponse, error) {
-	args := m.Called(ctx, key, opts[0])
+func (m *MockEtcdKV) Delete(ctx context.Context, key string, _ ...etcdcv3.OpOption) (*etcdcv3.DeleteResponse, error) {
+	args := m.Called(ctx, key)
 	return args.Get(0).(*etcdcv3.DeleteResponse), args.Error(1)
 }
 
@@ -127,6 +221,49 @@ func TestETCDConfig(t *testing.T) {
 	}
 }
 
+func TestETCDConfigFor(t *testing.T) {
+	testutils.TestHelperEnvSetter(t, map[string]string{"ETCD_URLS": "http://ignored:2379"})
+
+	cfg, err := etcdConfigFor(&BackendConfig{
+		EtcdEndpoints:   []string{"http://etcd-0:2379", "http://etcd-1:2379"},
+		EtcdDialTimeout: 3 * time.Second,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"http://etcd-0:2379", "http://etcd-1:2379"}, cfg.Endpoints)
+	assert.Equal(t, 3*time.Second, cfg.DialTimeout)
+
+	// ETCD_URLS is used when no endpoints are configured
+	cfg, err = etcdConfigFor(&BackendConfig{})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"http://ignored:2379"}, cfg.Endpoints)
+
+	// Configured credentials replace ETCD_USERNAME and ETCD_PASSWORD
+	testutils.TestHelperEnvSetter(t, map[string]string{"ETCD_USERNAME": "env", "ETCD_PASSWORD": "env"})
+	tlsConfig := &tls.Config{ServerName: "etcd"}
+	cfg, err = etcdConfigFor(&BackendConfig{
+		EtcdEndpoints: []string{"https://etcd-0:2379"},
+		EtcdUsername:  "root",
+		EtcdPassword:  "secret",
+		EtcdTLS:       tlsConfig,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "root", cfg.Username)
+	assert.Equal(t, "secret", cfg.Password)
+	assert.Same(t, tlsConfig, cfg.TLS)
+}
+
+func TestETCDConfigFor_RejectsMalformedEndpoint(t *testing.T) {
+	for _, endpoints := range [][]string{
+		{"http://etcd-0:2379", "etcd-1:2379"},
+		{"ftp://etcd-0:2379"},
+		{"http://"},
+		{"http://etcd-0:port"},
+	} {
+		_, err := etcdConfigFor(&BackendConfig{EtcdEndpoints: endpoints})
+		assert.ErrorContains(t, err, "invalid etcd endpoint", "%v", endpoints)
+	}
+}
+
 func TestEtcdHttpsProtocol(t *testing.T) {
 	envs := map[string]string{
 		"ETCD_URLS": "https://example.com:2379",
@@ -249,6 +386,87 @@ func TestTXTServiceTranslation(t *testing.T) {
 	}
 }
 
+func TestMultipleTXTValuesPerName(t *testing.T) {
+	client := fakeETCDClient{
+		map[string]Service{},
+	}
+	coredns := coreDNSProvider{
+		client:        client,
+		coreDNSPrefix: defaultCoreDNSPrefix,
+	}
+	ctx := context.Background()
+
+	err := coredns.ApplyChanges(ctx, &plan.Changes{
+		Create: []*endpoint.Endpoint{
+			endpoint.NewEndpoint("example.local", endpoint.RecordTypeTXT, "v=spf1 -all", "google-site-verification=abc"),
+		},
+	})
+	require.NoError(t, err)
+
+	var texts []string
+	for _, service := range client.services {
+		texts = append(texts, service.Text)
+	}
+	assert.ElementsMatch(t, []string{"v=spf1 -all", "google-site-verification=abc"}, texts)
+
+	records, err := coredns.Records(ctx)
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	assert.Equal(t, endpoint.RecordTypeTXT, records[0].RecordType)
+	assert.ElementsMatch(t, endpoint.Targets{"v=spf1 -all", "google-site-verification=abc"}, records[0].Targets)
+
+	err = coredns.ApplyChanges(ctx, &plan.Changes{Delete: records})
+	require.NoError(t, err)
+	assert.Empty(t, client.services)
+}
+
+func TestSetIdentifierRoundTrip(t *testing.T) {
+	backend, err := NewSQLiteBackend(":memory:")
+	require.NoError(t, err)
+	defer backend.Close()
+	coredns := coreDNSProvider{
+		client:        backend,
+		coreDNSPrefix: defaultCoreDNSPrefix,
+		keySuffixer:   HashSuffixer{},
+	}
+	ctx := context.Background()
+
+	// The same target under two set identifiers must not share a key
+	blue := endpoint.NewEndpoint("app.example.local", endpoint.RecordTypeA, "1.2.3.4").WithSetIdentifier("blue")
+	green := endpoint.NewEndpoint("app.example.local", endpoint.RecordTypeA, "1.2.3.4", "5.6.7.8").WithSetIdentifier("green")
+	err = coredns.ApplyChanges(ctx, &plan.Changes{Create: []*endpoint.Endpoint{blue, green}})
+	require.NoError(t, err)
+
+	count, err := backend.Count(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 3, count)
+
+	records, err := coredns.Records(ctx)
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+	targets := make(map[string]endpoint.Targets)
+	for _, ep := range records {
+		assert.Equal(t, "app.example.local", ep.DNSName)
+		targets[ep.SetIdentifier] = ep.Targets
+	}
+	assert.Equal(t, map[string]endpoint.Targets{
+		"blue":  {"1.2.3.4"},
+		"green": {"1.2.3.4", "5.6.7.8"},
+	}, targets)
+
+	// Deleting one set identifier leaves the other
+	for _, ep := range records {
+		if ep.SetIdentifier == "blue" {
+			require.NoError(t, coredns.ApplyChanges(ctx, &plan.Changes{Delete: []*endpoint.Endpoint{ep}}))
+		}
+	}
+	records, err = coredns.Records(ctx)
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	assert.Equal(t, "green", records[0].SetIdentifier)
+	assert.ElementsMatch(t, endpoint.Targets{"1.2.3.4", "5.6.7.8"}, records[0].Targets)
+}
+
 func TestAWithTXTServiceTranslation(t *testing.T) {
 	expectedTargets := map[string]string{
 		endpoint.RecordTypeA:   "1.2.3.4",
@@ -429,7 +647,7 @@ func TestCoreDNSApplyChanges_DomainDoNotMatch(t *testing.T) {
 			endpoint.NewEndpoint("domain2.local", endpoint.RecordTypeCNAME, "site.local"),
 		},
 	}
-	hook := testutils.LogsUnderTestWithLogLevel(log.DebugLevel, t)
+	hook := testutils.LogsUnderTestWithLogLevel(logrus.DebugLevel, t)
 	err := coredns.ApplyChanges(context.Background(), changes1)
 	require.NoError(t, err)
 
@@ -547,6 +765,10 @@ func TestGetServices_Duplicate(t *testing.T) {
 	result, err := c.GetServices(context.Background(), "/prefix")
 	assert.NoError(t, err)
 	assert.Len(t, result, 1)
+
+	raw, err := c.GetServicesWithOptions(context.Background(), "/prefix", GetServicesOptions{Raw: true})
+	assert.NoError(t, err)
+	assert.Len(t, raw, 2)
 }
 
 func TestGetServices_Multiple(t *testing.T) {
@@ -646,8 +868,10 @@ func TestDeleteService(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			mockKV := new(MockEtcdKV)
-			mockKV.On("Delete", mock.Anything, mock.Anything, mock.AnythingOfType("clientv3.OpOption")).
-				Return(&etcdcv3.DeleteResponse{}, tt.mockErr)
+			mockKV.On("Delete", mock.Anything, tt.key+"/").Return(&etcdcv3.DeleteResponse{}, tt.mockErr)
+			if tt.mockErr == nil {
+				mockKV.On("Delete", mock.Anything, tt.key).Return(&etcdcv3.DeleteResponse{}, nil)
+			}
 
 			c := etcdClient{
 				client: &etcdcv3.Client{
@@ -752,8 +976,9 @@ func TestNewCoreDNSProvider(t *testing.T) {
 
 			provider, err := NewCoreDNSProvider(&endpoint.DomainFilter{}, "/prefix/", false)
 			if tt.wantErr {
-				require.Error(t, err)
-				assert.EqualError(t, err, tt.errMsg)
+				var backendErr *BackendError
+				require.ErrorAs(t, err, &backendErr)
+				assert.EqualError(t, backendErr.Err, tt.errMsg)
 			} else {
 				require.NoError(t, err)
 				require.NotNil(t, provider)
@@ -762,6 +987,240 @@ func TestNewCoreDNSProvider(t *testing.T) {
 	}
 }
 
+func TestNewCoreDNSProviderFromConfig(t *testing.T) {
+	// The environment would select an unreachable etcd; the Config wins
+	testutils.TestHelperEnvSetter(t, map[string]string{
+		"COREDNS_BACKEND":     "etcd",
+		"COREDNS_ETCD_PREFIX": "/env/",
+		"COREDNS_KEY_SUFFIX":  "unknown",
+		"ETCD_URLS":           "ftp://example.com:20",
+	})
+
+	p, err := NewCoreDNSProviderFromConfig(Config{
+		Backend: BackendConfig{
+			Type:       BackendTypeSQLite,
+			SQLitePath: filepath.Join(t.TempDir(), "dns.db"),
+			Prefix:     "/dns/",
+			Defaults:   ServiceDefaults{endpoint.RecordTypeA: {Priority: 5}},
+		},
+		KeySuffixer: HashSuffixer{},
+	})
+	require.NoError(t, err)
+	provider := p.(coreDNSProvider)
+	defer provider.client.Close()
+	assert.Equal(t, "/dns/", provider.coreDNSPrefix)
+
+	ctx := context.Background()
+	require.NoError(t, provider.ApplyChanges(ctx, &plan.Changes{
+		Create: []*endpoint.Endpoint{endpoint.NewEndpoint("www.example.com", endpoint.RecordTypeA, "10.0.0.1")},
+	}))
+
+	services, err := provider.client.GetServices(ctx, "/dns/com/example/www")
+	require.NoError(t, err)
+	require.Len(t, services, 1)
+	assert.Equal(t, "/dns/com/example/www/"+HashSuffixer{}.Suffix("10.0.0.1"), services[0].Key)
+	assert.Equal(t, 5, services[0].Priority)
+}
+
+func TestSupportedRecordTypes(t *testing.T) {
+	p, err := NewCoreDNSProviderFromConfig(Config{
+		Backend:              BackendConfig{Type: BackendTypeMemory},
+		Prefix:               "/skydns/",
+		SupportedRecordTypes: []string{"a", "TXT"},
+	})
+	require.NoError(t, err)
+	provider := p.(coreDNSProvider)
+	defer provider.client.Close()
+
+	// The provider skips endpoints of other types
+	ctx := context.Background()
+	require.NoError(t, provider.ApplyChanges(ctx, &plan.Changes{
+		Create: []*endpoint.Endpoint{
+			endpoint.NewEndpoint("www.example.com", endpoint.RecordTypeA, "10.0.0.1"),
+			endpoint.NewEndpoint("alias.example.com", endpoint.RecordTypeCNAME, "www.example.com"),
+		},
+	}))
+	services, err := provider.client.GetServices(ctx, "/skydns/com/example")
+	require.NoError(t, err)
+	require.Len(t, services, 1)
+	assert.Equal(t, "10.0.0.1", services[0].Host)
+
+	// and the backend rejects their records
+	err = provider.client.SaveService(ctx, &Service{Key: "/skydns/com/example/alias/x", Host: "www.example.com", TargetStrip: 1})
+	assert.ErrorIs(t, err, ErrRecordTypeNotAllowed)
+
+	_, err = NewCoreDNSProviderFromConfig(Config{
+		Backend:              BackendConfig{Type: BackendTypeMemory},
+		SupportedRecordTypes: []string{"A", "NS"},
+	})
+	assert.ErrorContains(t, err, `COREDNS_SUPPORTED_RECORD_TYPES: unsupported record type "NS"`)
+}
+
+func TestMaxTargetsPerName(t *testing.T) {
+	targets := make(endpoint.Targets, 50)
+	for i := range targets {
+		targets[i] = fmt.Sprintf("10.0.0.%d", i+1)
+	}
+
+	newProvider := func(t *testing.T, strict bool) coreDNSProvider {
+		t.Helper()
+		p, err := NewCoreDNSProviderFromConfig(Config{
+			Backend:           BackendConfig{Type: BackendTypeMemory},
+			Prefix:            "/skydns/",
+			MaxTargetsPerName: 10,
+			StrictMaxTargets:  strict,
+		})
+		require.NoError(t, err)
+		provider := p.(coreDNSProvider)
+		t.Cleanup(func() { provider.client.Close() })
+		return provider
+	}
+	ctx := context.Background()
+
+	t.Run("truncate", func(t *testing.T) {
+		provider := newProvider(t, false)
+		require.NoError(t, provider.ApplyChanges(ctx, &plan.Changes{
+			Create: []*endpoint.Endpoint{
+				endpoint.NewEndpoint("www.example.com", endpoint.RecordTypeA, targets...),
+				endpoint.NewEndpoint("www.example.com", endpoint.RecordTypeTXT, "hello"),
+			},
+		}))
+		services, err := provider.client.GetServices(ctx, "/skydns/com/example/www")
+		require.NoError(t, err)
+		hosts := 0
+		for _, svc := range services {
+			if svc.Host != "" {
+				hosts++
+				assert.Contains(t, targets, svc.Host)
+			}
+		}
+		assert.Equal(t, 10, hosts)
+
+		// The same subset is kept on the next write
+		records, err := provider.Records(ctx)
+		require.NoError(t, err)
+		first, _ := findTypedEp(records, "www.example.com", "", endpoint.RecordTypeA)
+		require.NotNil(t, first)
+		again := &endpoint.Endpoint{DNSName: "www.example.com", RecordType: endpoint.RecordTypeA, Targets: targets, Labels: first.Labels}
+		require.NoError(t, provider.ApplyChanges(ctx, &plan.Changes{UpdateOld: []*endpoint.Endpoint{first}, UpdateNew: []*endpoint.Endpoint{again}}))
+		records, err = provider.Records(ctx)
+		require.NoError(t, err)
+		second, _ := findTypedEp(records, "www.example.com", "", endpoint.RecordTypeA)
+		require.NotNil(t, second)
+		assert.ElementsMatch(t, first.Targets, second.Targets)
+	})
+
+	t.Run("strict", func(t *testing.T) {
+		provider := newProvider(t, true)
+		err := provider.ApplyChanges(ctx, &plan.Changes{
+			Create: []*endpoint.Endpoint{endpoint.NewEndpoint("www.example.com", endpoint.RecordTypeA, targets...)},
+		})
+		require.ErrorIs(t, err, ErrLimitExceeded)
+		exists, err := provider.client.Exists(ctx, "/skydns/com/example/www")
+		require.NoError(t, err)
+		assert.False(t, exists, "nothing is written")
+
+		// Endpoints within the cap are written
+		require.NoError(t, provider.ApplyChanges(ctx, &plan.Changes{
+			Create: []*endpoint.Endpoint{endpoint.NewEndpoint("www.example.com", endpoint.RecordTypeA, targets[:10]...)},
+		}))
+	})
+
+	_, err := NewCoreDNSProviderFromConfig(Config{Backend: BackendConfig{Type: BackendTypeMemory}, MaxTargetsPerName: -1})
+	assert.ErrorContains(t, err, "COREDNS_MAX_TARGETS_PER_NAME")
+}
+
+func TestReload(t *testing.T) {
+	dir := t.TempDir()
+	p, err := NewCoreDNSProviderFromConfig(Config{
+		Backend: BackendConfig{Type: BackendTypeSQLite, SQLitePath: filepath.Join(dir, "old.db")},
+		Prefix:  "/skydns/",
+	})
+	require.NoError(t, err)
+	provider := p.(coreDNSProvider)
+	defer provider.client.Close()
+
+	ctx := context.Background()
+	require.NoError(t, provider.ApplyChanges(ctx, &plan.Changes{
+		Create: []*endpoint.Endpoint{endpoint.NewEndpoint("old.example.com", endpoint.RecordTypeA, "10.0.0.1")},
+	}))
+
+	newPath := filepath.Join(dir, "new.db")
+	seed, err := NewSQLiteBackend(newPath)
+	require.NoError(t, err)
+	require.NoError(t, seed.SaveService(ctx, &Service{Key: "/skydns/com/example/new/a", Host: "10.0.0.2", TargetStrip: 1}))
+	require.NoError(t, seed.Close())
+
+	var reloader Reloader = provider
+	require.NoError(t, reloader.Reload(&BackendConfig{Type: BackendTypeSQLite, SQLitePath: newPath}))
+
+	records, err := provider.Records(ctx)
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	assert.Equal(t, "new.example.com", records[0].DNSName)
+
+	// A backend that can't be opened leaves the current one in use
+	assert.Error(t, provider.Reload(&BackendConfig{Type: BackendType("unknown")}))
+	records, err = provider.Records(ctx)
+	require.NoError(t, err)
+	assert.Len(t, records, 1)
+
+	fixed := NewCoreDNSProviderWithBackend(&endpoint.DomainFilter{}, "/skydns/", false, NewMemoryBackend())
+	assert.Error(t, fixed.(Reloader).Reload(nil))
+}
+
+func TestInstanceID(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "shared.db")
+	newProvider := func(instanceID string) coreDNSProvider {
+		p, err := NewCoreDNSProviderFromConfig(Config{
+			Backend: BackendConfig{Type: BackendTypeSQLite, SQLitePath: path, InstanceID: instanceID},
+			Prefix:  "/skydns/",
+		})
+		require.NoError(t, err)
+		provider := p.(coreDNSProvider)
+		t.Cleanup(func() { provider.client.Close() })
+		return provider
+	}
+	blue := newProvider("blue")
+	green := newProvider("green")
+	assert.Equal(t, "/skydns/blue/", blue.coreDNSPrefix)
+
+	ctx := context.Background()
+	require.NoError(t, blue.ApplyChanges(ctx, &plan.Changes{
+		Create: []*endpoint.Endpoint{endpoint.NewEndpoint("www.example.com", endpoint.RecordTypeA, "10.0.0.1")},
+	}))
+	require.NoError(t, green.ApplyChanges(ctx, &plan.Changes{
+		Create: []*endpoint.Endpoint{endpoint.NewEndpoint("www.example.com", endpoint.RecordTypeA, "10.0.0.2")},
+	}))
+
+	for _, tt := range []struct {
+		provider coreDNSProvider
+		target   string
+	}{{blue, "10.0.0.1"}, {green, "10.0.0.2"}} {
+		records, err := tt.provider.Records(ctx)
+		require.NoError(t, err)
+		require.Len(t, records, 1)
+		assert.Equal(t, "www.example.com", records[0].DNSName)
+		assert.Equal(t, endpoint.Targets{tt.target}, records[0].Targets)
+	}
+
+	// Deleting the records of one instance leaves the other's alone
+	records, err := blue.Records(ctx)
+	require.NoError(t, err)
+	require.NoError(t, blue.ApplyChanges(ctx, &plan.Changes{Delete: records}))
+	records, err = green.Records(ctx)
+	require.NoError(t, err)
+	assert.Len(t, records, 1)
+
+	services, err := green.client.GetServices(ctx, "com/example")
+	require.NoError(t, err, "relative keys resolve under the instance")
+	require.Len(t, services, 1)
+	assert.True(t, strings.HasPrefix(services[0].Key, "/skydns/green/com/example/www/"))
+
+	_, err = NewCoreDNSProviderFromConfig(Config{Backend: BackendConfig{Type: BackendTypeMemory, InstanceID: "a/b"}})
+	assert.ErrorContains(t, err, `COREDNS_INSTANCE_ID: invalid instance ID "a/b"`)
+}
+
 func TestFindEp(t *testing.T) {
 	tests := []struct {
 		name     string
@@ -905,3 +1364,477 @@ func TestRecordsAWithGroupServiceTranslation(t *testing.T) {
 		t.Errorf("got unexpected Group name: %s != %s", prop, "test1")
 	}
 }
+
+func TestRecordsForceCNAMEServiceTranslation(t *testing.T) {
+	client := fakeETCDClient{
+		map[string]Service{
+			"/skydns/com/example/www": {Host: "target.example.com", ForceCNAME: true},
+			"/skydns/com/example/api": {Host: "1.2.3.4", ForceCNAME: true},
+		},
+	}
+	provider := coreDNSProvider{
+		client:        client,
+		coreDNSPrefix: defaultCoreDNSPrefix,
+	}
+
+	endpoints, err := provider.Records(context.Background())
+	require.NoError(t, err)
+	require.Len(t, endpoints, 2)
+	for _, ep := range endpoints {
+		assert.Equal(t, endpoint.RecordTypeCNAME, ep.RecordType, ep.DNSName)
+	}
+}
+
+func TestForceCNAME_RoundTrip(t *testing.T) {
+	backends := map[string]func(t *testing.T) Backend{
+		"memory": func(_ *testing.T) Backend {
+			return NewMemoryBackend()
+		},
+		"sqlite": func(t *testing.T) Backend {
+			backend, err := NewSQLiteBackend(":memory:")
+			require.NoError(t, err)
+			return backend
+		},
+	}
+
+	for name, newBackend := range backends {
+		t.Run(name, func(t *testing.T) {
+			backend := newBackend(t)
+			defer backend.Close()
+
+			ctx := context.Background()
+			provider := NewCoreDNSProviderWithBackend(&endpoint.DomainFilter{}, defaultCoreDNSPrefix, false, backend)
+
+			// A CNAME whose target parses as an IP is flagged so it isn't read back as an A record
+			changes := &plan.Changes{
+				Create: []*endpoint.Endpoint{
+					endpoint.NewEndpoint("www.example.com", endpoint.RecordTypeCNAME, "1.2.3.4"),
+					endpoint.NewEndpoint("api.example.com", endpoint.RecordTypeA, "5.6.7.8"),
+				},
+			}
+			require.NoError(t, provider.ApplyChanges(ctx, changes))
+
+			cnames, err := backend.GetServicesByType(ctx, "/skydns/com/example/www", endpoint.RecordTypeCNAME)
+			require.NoError(t, err)
+			require.Len(t, cnames, 1)
+			assert.True(t, cnames[0].ForceCNAME)
+
+			records, err := provider.Records(ctx)
+			require.NoError(t, err)
+			types := make(map[string]string)
+			for _, ep := range records {
+				types[ep.DNSName] = ep.RecordType
+			}
+			assert.Equal(t, map[string]string{
+				"www.example.com": endpoint.RecordTypeCNAME,
+				"api.example.com": endpoint.RecordTypeA,
+			}, types)
+		})
+	}
+}
+
+func TestRecordsSplitsEndpointsByGroup(t *testing.T) {
+	client := fakeETCDClient{
+		map[string]Service{
+			"/skydns/com/example/www/a": {Host: "1.1.1.1", Group: "blue", TargetStrip: 1},
+			"/skydns/com/example/www/b": {Host: "1.1.1.2", Group: "blue", TargetStrip: 1},
+			"/skydns/com/example/www/c": {Host: "2.2.2.1", Group: "green", TargetStrip: 1},
+			"/skydns/com/example/www/d": {Host: "2.2.2.2", Group: "green", TargetStrip: 1},
+		},
+	}
+	provider := coreDNSProvider{
+		client:        client,
+		coreDNSPrefix: defaultCoreDNSPrefix,
+	}
+
+	endpoints, err := provider.Records(context.Background())
+	require.NoError(t, err)
+	require.Len(t, endpoints, 2)
+
+	targets := make(map[string][]string)
+	for _, ep := range endpoints {
+		assert.Equal(t, "www.example.com", ep.DNSName)
+		assert.Equal(t, endpoint.RecordTypeA, ep.RecordType)
+		group, ok := ep.GetProviderSpecificProperty(providerSpecificGroup)
+		require.True(t, ok)
+		targets[group] = append(targets[group], ep.Targets...)
+	}
+	assert.ElementsMatch(t, []string{"1.1.1.1", "1.1.1.2"}, targets["blue"])
+	assert.ElementsMatch(t, []string{"2.2.2.1", "2.2.2.2"}, targets["green"])
+}
+
+func TestRecordsMergesUngroupedTargets(t *testing.T) {
+	client := fakeETCDClient{
+		map[string]Service{
+			"/skydns/com/example/www/a": {Host: "1.1.1.1", TargetStrip: 1},
+			"/skydns/com/example/www/b": {Host: "1.1.1.2", TargetStrip: 1},
+			"/skydns/com/example/www/c": {Text: "heritage=external-dns", TargetStrip: 1},
+		},
+	}
+	provider := coreDNSProvider{
+		client:        client,
+		coreDNSPrefix: defaultCoreDNSPrefix,
+	}
+
+	endpoints, err := provider.Records(context.Background())
+	require.NoError(t, err)
+	require.Len(t, endpoints, 2)
+
+	for _, ep := range endpoints {
+		switch ep.RecordType {
+		case endpoint.RecordTypeA:
+			assert.ElementsMatch(t, endpoint.Targets{"1.1.1.1", "1.1.1.2"}, ep.Targets)
+		case endpoint.RecordTypeTXT:
+			assert.Equal(t, endpoint.Targets{"heritage=external-dns"}, ep.Targets)
+		default:
+			t.Errorf("unexpected endpoint %s", ep)
+		}
+	}
+}
+
+func TestRecordTTL_RoundTrip(t *testing.T) {
+	backend := NewMemoryBackend()
+	defer backend.Close()
+
+	ctx := context.Background()
+	provider := NewCoreDNSProviderWithBackend(&endpoint.DomainFilter{}, defaultCoreDNSPrefix, false, backend)
+
+	changes := &plan.Changes{
+		Create: []*endpoint.Endpoint{
+			endpoint.NewEndpointWithTTL("www.example.com", endpoint.RecordTypeA, 120, "1.2.3.4"),
+			endpoint.NewEndpointWithTTL("www.example.com", endpoint.RecordTypeTXT, 120, "heritage=external-dns"),
+			endpoint.NewEndpoint("api.example.com", endpoint.RecordTypeA, "5.6.7.8"),
+		},
+	}
+	require.NoError(t, provider.ApplyChanges(ctx, changes))
+
+	stored, err := backend.GetServices(ctx, "/skydns/com/example/www")
+	require.NoError(t, err)
+	require.Len(t, stored, 1)
+	assert.Equal(t, uint32(120), stored[0].TTL)
+
+	records, err := provider.Records(ctx)
+	require.NoError(t, err)
+	ttls := make(map[string]endpoint.TTL)
+	for _, ep := range records {
+		ttls[ep.DNSName+"/"+ep.RecordType] = ep.RecordTTL
+	}
+	assert.Equal(t, map[string]endpoint.TTL{
+		"www.example.com/A":   120,
+		"www.example.com/TXT": 120,
+		"api.example.com/A":   0,
+	}, ttls)
+}
+
+func TestTargetStrip_RoundTrip(t *testing.T) {
+	backend, err := NewSQLiteBackend(":memory:")
+	require.NoError(t, err)
+	defer backend.Close()
+
+	ctx := context.Background()
+	key := "/skydns/com/example/www/x1/y2"
+	require.NoError(t, backend.SaveService(ctx, &Service{Host: "1.2.3.4", Key: key, TargetStrip: 2}))
+
+	provider := NewCoreDNSProviderWithBackend(&endpoint.DomainFilter{}, defaultCoreDNSPrefix, false, backend)
+	records, err := provider.Records(ctx)
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	assert.Equal(t, "www.example.com", records[0].DNSName)
+	assert.Equal(t, "y2.x1", records[0].Labels["1.2.3.4"])
+
+	// Updating the record rewrites the same key with the same TargetStrip
+	updated := records[0].DeepCopy()
+	updated.RecordTTL = 60
+	require.NoError(t, provider.ApplyChanges(ctx, &plan.Changes{
+		UpdateOld: records,
+		UpdateNew: []*endpoint.Endpoint{updated},
+	}))
+
+	snapshot, err := backend.Snapshot(ctx)
+	require.NoError(t, err)
+	require.Len(t, snapshot, 1)
+	assert.Equal(t, 2, snapshot[key].TargetStrip)
+	assert.Equal(t, uint32(60), snapshot[key].TTL)
+}
+
+func TestDeleteEndpoints_CollapsesZone(t *testing.T) {
+	ctx := context.Background()
+	inner := NewMemoryBackend()
+	for _, key := range []string{
+		"/skydns/com/example/www",
+		"/skydns/com/example/api",
+		"/skydns/com/example/mail/x1",
+		"/skydns/com/example2/www",
+		"/skydns/org/example/www",
+	} {
+		require.NoError(t, inner.SaveService(ctx, &Service{Key: key, Host: "1.2.3.4"}))
+	}
+	backend := NewFaultInjectingBackend(inner)
+	provider := NewCoreDNSProviderWithBackend(&endpoint.DomainFilter{}, defaultCoreDNSPrefix, false, backend)
+
+	mail := endpoint.NewEndpoint("mail.example.com", endpoint.RecordTypeA, "1.2.3.4")
+	mail.Labels[randomPrefixLabel] = "x1"
+	require.NoError(t, provider.ApplyChanges(ctx, &plan.Changes{
+		Delete: []*endpoint.Endpoint{
+			endpoint.NewEndpoint("www.example.com", endpoint.RecordTypeA, "1.2.3.4"),
+			endpoint.NewEndpoint("api.example.com", endpoint.RecordTypeA, "1.2.3.4"),
+			mail,
+		},
+	}))
+
+	assert.Equal(t, 1, backend.Calls(OpDeleteService))
+	assert.Equal(t, []string{"/skydns/com/example2/www", "/skydns/org/example/www"}, inner.Keys())
+}
+
+func TestDeleteEndpoints_KeepsUndeletedSiblings(t *testing.T) {
+	ctx := context.Background()
+	inner := NewMemoryBackend()
+	for _, key := range []string{
+		"/skydns/com/example",
+		"/skydns/com/example/www",
+		"/skydns/com/example/api",
+		"/skydns/com/example/ftp",
+	} {
+		require.NoError(t, inner.SaveService(ctx, &Service{Key: key, Host: "1.2.3.4"}))
+	}
+	backend := NewFaultInjectingBackend(inner)
+	provider := NewCoreDNSProviderWithBackend(&endpoint.DomainFilter{}, defaultCoreDNSPrefix, false, backend)
+
+	require.NoError(t, provider.ApplyChanges(ctx, &plan.Changes{
+		Delete: []*endpoint.Endpoint{
+			endpoint.NewEndpoint("www.example.com", endpoint.RecordTypeA, "1.2.3.4"),
+			endpoint.NewEndpoint("api.example.com", endpoint.RecordTypeA, "1.2.3.4"),
+			endpoint.NewEndpoint("ftp.example.com", endpoint.RecordTypeA, "1.2.3.4"),
+		},
+	}))
+
+	// The apex record stored at the parent key isn't being deleted
+	assert.Equal(t, 3, backend.Calls(OpDeleteService))
+	assert.Equal(t, []string{"/skydns/com/example"}, inner.Keys())
+}
+
+func TestCollapseDeletes(t *testing.T) {
+	ctx := context.Background()
+	backend := NewMemoryBackend()
+	for _, key := range []string{
+		"/skydns/com/example/a/x",
+		"/skydns/com/example/a/y",
+		"/skydns/com/example/b",
+		"/skydns/com/other/www",
+	} {
+		require.NoError(t, backend.SaveService(ctx, &Service{Key: key, Host: "1.2.3.4"}))
+	}
+	provider := coreDNSProvider{client: backend, coreDNSPrefix: defaultCoreDNSPrefix}
+
+	keys, err := provider.collapseDeletes(ctx, []string{
+		"/skydns/com/example/a/x",
+		"/skydns/com/example/a/y",
+		"/skydns/com/example/b",
+		"/skydns/com/example/b/child",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"/skydns/com/example"}, keys)
+
+	// The provider prefix is never deleted, even when everything under it goes
+	keys, err = provider.collapseDeletes(ctx, []string{"/skydns/com", "/skydns/org"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"/skydns/com", "/skydns/org"}, keys)
+}
+
+func TestApplyChanges_CollapsesWithinFilteredZones(t *testing.T) {
+	ctx := context.Background()
+	inner := NewMemoryBackend()
+	for _, key := range []string{
+		"/skydns/com/example/a/x",
+		"/skydns/com/example/a/y",
+		"/skydns/com/example/b/x",
+		"/skydns/com/example/b/y",
+		"/skydns/com/example/c",
+	} {
+		require.NoError(t, inner.SaveService(ctx, &Service{Key: key, Host: "1.2.3.4"}))
+	}
+	domainFilter := endpoint.NewDomainFilter([]string{"a.example.com", "b.example.com"})
+	backend := NewFilteringBackend(inner, defaultCoreDNSPrefix, domainFilter)
+	provider := NewCoreDNSProviderWithBackend(domainFilter, defaultCoreDNSPrefix, false, backend)
+
+	require.NoError(t, provider.ApplyChanges(ctx, &plan.Changes{
+		Delete: []*endpoint.Endpoint{
+			endpoint.NewEndpoint("x.a.example.com", endpoint.RecordTypeA, "1.2.3.4"),
+			endpoint.NewEndpoint("y.a.example.com", endpoint.RecordTypeA, "1.2.3.4"),
+			endpoint.NewEndpoint("x.b.example.com", endpoint.RecordTypeA, "1.2.3.4"),
+			endpoint.NewEndpoint("y.b.example.com", endpoint.RecordTypeA, "1.2.3.4"),
+		},
+	}))
+
+	// The zones collapse into their own keys, never into example.com
+	assert.Equal(t, []string{"/skydns/com/example/c"}, inner.Keys())
+}
+
+func TestDeleteCollapsed_KeepsServicesSavedSincePlanning(t *testing.T) {
+	ctx := context.Background()
+	backend := NewMemoryBackend()
+	keys := []string{"/skydns/com/example/a/x", "/skydns/com/example/a/y"}
+	for _, key := range keys {
+		require.NoError(t, backend.SaveService(ctx, &Service{Key: key, Host: "1.2.3.4"}))
+	}
+	provider := coreDNSProvider{client: backend, coreDNSPrefix: defaultCoreDNSPrefix}
+
+	collapsed, err := provider.collapseDeletes(ctx, keys)
+	require.NoError(t, err)
+	require.Equal(t, []string{"/skydns/com/example/a"}, collapsed)
+
+	require.NoError(t, backend.SaveService(ctx, &Service{Key: "/skydns/com/example/a/z", Host: "5.6.7.8"}))
+	require.NoError(t, provider.deleteCollapsed(ctx, collapsed[0], keys, map[string]bool{keys[0]: true, keys[1]: true}))
+	assert.Equal(t, []string{"/skydns/com/example/a/z"}, backend.Keys())
+}
+
+// racingEtcdKV saves a key under /skydns/com/example after the first range
+// read, as a concurrent writer would.
+type racingEtcdKV struct {
+	*fakeEtcdKV
+	once sync.Once
+}
+
+func (r *racingEtcdKV) Get(ctx context.Context, key string, opts ...etcdcv3.OpOption) (*etcdcv3.GetResponse, error) {
+	resp, err := r.fakeEtcdKV.Get(ctx, key, opts...)
+	r.once.Do(func() {
+		_, _ = r.fakeEtcdKV.Put(ctx, "/skydns/com/example/z", `{"host":"5.6.7.8"}`)
+	})
+	return resp, err
+}
+
+func TestEtcdClient_DeleteIfCoveredFailsOnConcurrentWrite(t *testing.T) {
+	ctx := context.Background()
+	fake := newFakeEtcdKV()
+	client := etcdcv3.NewCtxClient(ctx)
+	client.KV = fake
+	c := &etcdClient{client: client}
+	for _, key := range []string{"/skydns/com/example/x", "/skydns/com/example/y"} {
+		require.NoError(t, c.SaveService(ctx, &Service{Key: key, Host: "1.2.3.4"}))
+	}
+
+	client.KV = &racingEtcdKV{fakeEtcdKV: fake}
+	deleted, err := c.deleteIfCovered(ctx, "/skydns/com/example", func(key string) bool {
+		return key == "/skydns/com/example/x" || key == "/skydns/com/example/y"
+	})
+	require.NoError(t, err)
+	assert.False(t, deleted)
+
+	services, err := c.GetServices(ctx, "/skydns/com/example")
+	require.NoError(t, err)
+	assert.Len(t, services, 3)
+}
+
+func TestEtcdClient_DeleteIfCoveredPaged(t *testing.T) {
+	ctx := context.Background()
+	fake := newFakeEtcdKV()
+	client := etcdcv3.NewCtxClient(ctx)
+	client.KV = fake
+	c := &etcdClient{client: client, pageSize: 2}
+	var keys []string
+	for i := 0; i < 5; i++ {
+		key := fmt.Sprintf("/skydns/com/example/host%d", i)
+		require.NoError(t, c.SaveService(ctx, &Service{Key: key, Host: "1.2.3.4"}))
+		keys = append(keys, key)
+	}
+
+	// A key on the last page that isn't covered keeps everything
+	deleted, err := c.deleteIfCovered(ctx, "/skydns/com/example", func(key string) bool {
+		return slices.Contains(keys[:4], key)
+	})
+	require.NoError(t, err)
+	assert.False(t, deleted)
+
+	fake.gets = nil
+	deleted, err = c.deleteIfCovered(ctx, "/skydns/com/example", func(key string) bool {
+		return slices.Contains(keys, key)
+	})
+	require.NoError(t, err)
+	assert.True(t, deleted)
+
+	// Three pages of keys, all read at the revision of the first
+	require.Len(t, fake.gets, 3)
+	for _, op := range fake.gets {
+		assert.Equal(t, int64(2), op.Limit())
+		assert.True(t, op.IsKeysOnly())
+	}
+	for _, op := range fake.gets[1:] {
+		assert.Equal(t, int64(5), op.Rev())
+	}
+	services, err := c.GetServices(ctx, "/skydns/com/example")
+	require.NoError(t, err)
+	assert.Empty(t, services)
+}
+
+func TestEtcdClient_PagedReads(t *testing.T) {
+	fake := newFakeEtcdKV()
+	client := etcdcv3.NewCtxClient(context.Background())
+	client.KV = fake
+	c := etcdClient{client: client, pageSize: 10}
+
+	ctx := context.Background()
+	const total = 35
+	for i := 0; i < total; i++ {
+		require.NoError(t, c.SaveService(ctx, &Service{Key: fmt.Sprintf("/skydns/com/example/host%02d", i), Host: "1.2.3.4", Port: 1000 + i}))
+	}
+	require.NoError(t, c.SaveService(ctx, &Service{Key: "/skydns/org/other/www", Host: "5.6.7.8"}))
+
+	fake.gets = nil
+	services, err := c.GetServices(ctx, "/skydns/com/example")
+	require.NoError(t, err)
+	require.Len(t, services, total)
+	seen := make(map[string]bool)
+	for i, svc := range services {
+		assert.Equal(t, fmt.Sprintf("/skydns/com/example/host%02d", i), svc.Key)
+		assert.False(t, seen[svc.Key], "returned twice: %s", svc.Key)
+		seen[svc.Key] = true
+	}
+
+	// Four pages, all read at the revision of the first
+	require.Len(t, fake.gets, 4)
+	for _, op := range fake.gets {
+		assert.Equal(t, int64(10), op.Limit())
+	}
+	assert.Zero(t, fake.gets[0].Rev())
+	for _, op := range fake.gets[1:] {
+		assert.Equal(t, fake.revision, op.Rev())
+	}
+
+	snapshot, err := c.Snapshot(ctx)
+	require.NoError(t, err)
+	assert.Len(t, snapshot, total+1)
+
+	visited := 0
+	require.NoError(t, c.ForEach(ctx, "/skydns/", func(string, *Service) error {
+		visited++
+		return nil
+	}))
+	assert.Equal(t, total+1, visited)
+}
+
+func TestGetBackendConfig_EtcdPageSize(t *testing.T) {
+	testutils.TestHelperEnvSetter(t, map[string]string{"COREDNS_ETCD_PAGE_SIZE": "250"})
+	assert.Equal(t, 250, GetBackendConfig().EtcdPageSize)
+}
+
+func TestApplyChanges_Flushes(t *testing.T) {
+	for _, dryRun := range []bool{false, true} {
+		backend := NewFaultInjectingBackend(NewMemoryBackend())
+		provider := NewCoreDNSProviderWithBackend(&endpoint.DomainFilter{}, defaultCoreDNSPrefix, dryRun, backend)
+
+		require.NoError(t, provider.ApplyChanges(context.Background(), &plan.Changes{
+			Create: []*endpoint.Endpoint{endpoint.NewEndpoint("www.example.com", endpoint.RecordTypeA, "1.2.3.4")},
+		}))
+		if dryRun {
+			assert.Zero(t, backend.Calls(OpFlush), "dry run")
+		} else {
+			assert.Equal(t, 1, backend.Calls(OpFlush))
+		}
+	}
+
+	backend := NewFaultInjectingBackend(NewMemoryBackend())
+	backend.FailOn(OpFlush, 0, ErrUnavailable)
+	provider := NewCoreDNSProviderWithBackend(&endpoint.DomainFilter{}, defaultCoreDNSPrefix, false, backend)
+	err := provider.ApplyChanges(context.Background(), &plan.Changes{})
+	assert.ErrorIs(t, err, ErrUnavailable)
+}
@@ -0,0 +1,134 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package coredns
+
+import (
+	"os"
+	"sort"
+
+	"sigs.k8s.io/external-dns/endpoint"
+)
+
+// RecordDefaults are the priority and weight given to services that leave
+// them unset.
+type RecordDefaults struct {
+	Priority int
+	Weight   int
+}
+
+// ServiceDefaults maps a record type (see Service.RecordType) to the defaults
+// applied to its services when they are read. Types without an entry get no
+// defaults.
+type ServiceDefaults map[string]RecordDefaults
+
+// DefaultServiceDefaults returns the built-in defaults: SRV and MX records get
+// a priority of 10, other types none. MX records sharing a name keep their
+// priorities (see applyTo).
+func DefaultServiceDefaults() ServiceDefaults {
+	return ServiceDefaults{
+		endpoint.RecordTypeSRV: {Priority: priority},
+		endpoint.RecordTypeMX:  {Priority: priority},
+	}
+}
+
+// serviceDefaultsOrDefault returns defaults, or DefaultServiceDefaults if
+// defaults is nil. An empty, non-nil table disables defaulting.
+func serviceDefaultsOrDefault(defaults ServiceDefaults) ServiceDefaults {
+	if defaults == nil {
+		return DefaultServiceDefaults()
+	}
+	return defaults
+}
+
+// apply sets the unset priority and weight of svc from the defaults of its
+// record type. Raw records are left as stored.
+func (d ServiceDefaults) apply(svc *Service) {
+	if svc.RawType != "" {
+		return
+	}
+	defaults := d[svc.RecordType()]
+	if svc.Priority == 0 {
+		svc.Priority = defaults.Priority
+	}
+	if svc.Weight == 0 {
+		svc.Weight = defaults.Weight
+	}
+}
+
+// applyTo applies the defaults to services read together from a backend.
+// The priority of an MX record is its preference, for which zero is a valid
+// value: when several MX records share an owner name, their priorities are
+// taken as set and only a lone MX record gets the default. MX records of the
+// same name are also reordered by priority within the positions they occupy.
+// Owner names are derived from the service keys written with keys.
+func (d ServiceDefaults) applyTo(keys KeyScheme, services []*Service) {
+	mail := make(map[string][]int)
+	for i, svc := range services {
+		if svc.RecordType() != endpoint.RecordTypeMX || svc.RawType != "" {
+			d.apply(svc)
+			continue
+		}
+		name := keys.stripKeyLabels(svc.Key, svc.TargetStrip)
+		mail[name] = append(mail[name], i)
+	}
+
+	for _, indexes := range mail {
+		if len(indexes) == 1 {
+			d.apply(services[indexes[0]])
+			continue
+		}
+		group := make([]*Service, len(indexes))
+		for j, i := range indexes {
+			group[j] = services[i]
+		}
+		sort.SliceStable(group, func(a, b int) bool {
+			return group[a].Priority < group[b].Priority
+		})
+		for j, i := range indexes {
+			services[i] = group[j]
+		}
+	}
+}
+
+// getServiceDefaults returns DefaultServiceDefaults overridden by the
+// COREDNS_DEFAULT_PRIORITY_SRV, COREDNS_DEFAULT_WEIGHT_SRV and
+// COREDNS_DEFAULT_PRIORITY_MX environment variables, or nil if none is set.
+func getServiceDefaults() ServiceDefaults {
+	overrides := []struct {
+		name       string
+		recordType string
+		set        func(d *RecordDefaults, value int)
+	}{
+		{"COREDNS_DEFAULT_PRIORITY_SRV", endpoint.RecordTypeSRV, func(d *RecordDefaults, v int) { d.Priority = v }},
+		{"COREDNS_DEFAULT_WEIGHT_SRV", endpoint.RecordTypeSRV, func(d *RecordDefaults, v int) { d.Weight = v }},
+		{"COREDNS_DEFAULT_PRIORITY_MX", endpoint.RecordTypeMX, func(d *RecordDefaults, v int) { d.Priority = v }},
+	}
+
+	var defaults ServiceDefaults
+	for _, o := range overrides {
+		if os.Getenv(o.name) == "" {
+			continue
+		}
+		if defaults == nil {
+			defaults = DefaultServiceDefaults()
+		}
+		d := defaults[o.recordType]
+		o.set(&d, getEnvInt(o.name))
+		defaults[o.recordType] = d
+	}
+	return defaults
+}
@@ -0,0 +1,125 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package coredns
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"sigs.k8s.io/external-dns/endpoint"
+	"sigs.k8s.io/external-dns/internal/testutils"
+)
+
+func TestServiceDefaults_Apply(t *testing.T) {
+	defaults := ServiceDefaults{
+		endpoint.RecordTypeSRV: {Priority: 20, Weight: 5},
+		endpoint.RecordTypeMX:  {Priority: 30},
+	}
+
+	a := &Service{Host: "1.2.3.4"}
+	defaults.apply(a)
+	assert.Zero(t, a.Priority)
+	assert.Zero(t, a.Weight)
+
+	srv := &Service{Host: "target.example.com", Port: 443}
+	defaults.apply(srv)
+	assert.Equal(t, 20, srv.Priority)
+	assert.Equal(t, 5, srv.Weight)
+
+	mx := &Service{Host: "mail.example.com", Mail: true}
+	defaults.apply(mx)
+	assert.Equal(t, 30, mx.Priority)
+
+	// Explicit values are kept
+	set := &Service{Host: "target.example.com", Port: 443, Priority: 1, Weight: 2}
+	defaults.apply(set)
+	assert.Equal(t, 1, set.Priority)
+	assert.Equal(t, 2, set.Weight)
+
+	// An empty table disables defaulting
+	none := &Service{Host: "target.example.com", Port: 443}
+	ServiceDefaults{}.apply(none)
+	assert.Zero(t, none.Priority)
+}
+
+func TestGetServiceDefaults(t *testing.T) {
+	testutils.TestHelperEnvSetter(t, map[string]string{})
+	assert.Nil(t, getServiceDefaults())
+
+	testutils.TestHelperEnvSetter(t, map[string]string{
+		"COREDNS_DEFAULT_PRIORITY_SRV": "20",
+		"COREDNS_DEFAULT_WEIGHT_SRV":   "5",
+	})
+	assert.Equal(t, ServiceDefaults{
+		endpoint.RecordTypeSRV: {Priority: 20, Weight: 5},
+		endpoint.RecordTypeMX:  {Priority: priority},
+	}, getServiceDefaults())
+}
+
+func TestNewBackend_ServiceDefaultsFromEnv(t *testing.T) {
+	testutils.TestHelperEnvSetter(t, map[string]string{
+		"COREDNS_BACKEND":              "sqlite",
+		"COREDNS_SQLITE_PATH":          ":memory:",
+		"COREDNS_DEFAULT_PRIORITY_SRV": "20",
+		"COREDNS_DEFAULT_WEIGHT_SRV":   "5",
+		"COREDNS_DEFAULT_PRIORITY_MX":  "30",
+	})
+
+	backend, err := NewBackend(nil)
+	require.NoError(t, err)
+	defer backend.Close()
+
+	ctx := context.Background()
+	require.NoError(t, backend.SaveService(ctx, &Service{Host: "1.2.3.4", Key: "/skydns/com/example/a"}))
+	require.NoError(t, backend.SaveService(ctx, &Service{Host: "mail.example.com", Mail: true, Key: "/skydns/com/example/b"}))
+	require.NoError(t, backend.SaveService(ctx, &Service{Host: "target.example.com", Port: 443, Key: "/skydns/com/example/c"}))
+
+	services, err := backend.GetServices(ctx, "/skydns/")
+	require.NoError(t, err)
+	require.Len(t, services, 3)
+	assert.Zero(t, services[0].Priority, "A")
+	assert.Equal(t, 30, services[1].Priority, "MX")
+	assert.Equal(t, 20, services[2].Priority, "SRV")
+	assert.Equal(t, 5, services[2].Weight, "SRV")
+}
+
+func TestServiceDefaults_ApplyToMail(t *testing.T) {
+	defaults := DefaultServiceDefaults()
+	services := []*Service{
+		{Host: "1.2.3.4", Key: "/skydns/com/example/www"},
+		{Host: "mx20.example.com", Mail: true, Priority: 20, TargetStrip: 1, Key: "/skydns/com/example/a"},
+		{Host: "mx0.example.com", Mail: true, TargetStrip: 1, Key: "/skydns/com/example/b"},
+		{Host: "target.example.com", Port: 443, Key: "/skydns/com/example/_sip"},
+		{Host: "mx10.example.com", Mail: true, Priority: 10, TargetStrip: 1, Key: "/skydns/com/example/c"},
+		{Host: "mail.example.org", Mail: true, Key: "/skydns/org/example/mx"},
+	}
+	defaults.applyTo(defaultKeyScheme, services)
+
+	hosts := make([]string, 0, len(services))
+	priorities := make([]int, 0, len(services))
+	for _, svc := range services {
+		hosts = append(hosts, svc.Host)
+		priorities = append(priorities, svc.Priority)
+	}
+
+	// Sibling MX records keep their zero priority and are sorted in place
+	assert.Equal(t, []string{"1.2.3.4", "mx0.example.com", "mx10.example.com", "target.example.com", "mx20.example.com", "mail.example.org"}, hosts)
+	assert.Equal(t, []int{0, 0, 10, priority, 20, priority}, priorities)
+}
@@ -0,0 +1,53 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package coredns
+
+import (
+	"sort"
+)
+
+// Diff compares two snapshots (see Backend.Snapshot) and returns the sorted
+// keys only present in new (added), present in both with different content
+// (updated) and only present in old (removed). The Key field of the services
+// is ignored when comparing content.
+func Diff(old, new map[string]Service) (added, updated, removed []string) {
+	for key, newSvc := range new {
+		oldSvc, ok := old[key]
+		switch {
+		case !ok:
+			added = append(added, key)
+		case !sameContent(oldSvc, newSvc):
+			updated = append(updated, key)
+		}
+	}
+	for key := range old {
+		if _, ok := new[key]; !ok {
+			removed = append(removed, key)
+		}
+	}
+
+	sort.Strings(added)
+	sort.Strings(updated)
+	sort.Strings(removed)
+	return added, updated, removed
+}
+
+// sameContent reports whether two services hold the same record data.
+func sameContent(a, b Service) bool {
+	a.Key, b.Key = "", ""
+	return a == b
+}
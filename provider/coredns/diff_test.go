@@ -0,0 +1,53 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package coredns
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiff(t *testing.T) {
+	old := map[string]Service{
+		"/skydns/com/example/same":    {Host: "1.1.1.1"},
+		"/skydns/com/example/changed": {Host: "2.2.2.2"},
+		"/skydns/com/example/removed": {Host: "3.3.3.3"},
+		"/skydns/com/example/keyonly": {Host: "4.4.4.4"},
+	}
+	new := map[string]Service{
+		"/skydns/com/example/same":    {Host: "1.1.1.1"},
+		"/skydns/com/example/changed": {Host: "2.2.2.3"},
+		"/skydns/com/example/added":   {Host: "5.5.5.5"},
+		"/skydns/com/example/keyonly": {Host: "4.4.4.4", Key: "/skydns/com/example/keyonly"},
+	}
+
+	added, updated, removed := Diff(old, new)
+	assert.Equal(t, []string{"/skydns/com/example/added"}, added)
+	assert.Equal(t, []string{"/skydns/com/example/changed"}, updated)
+	assert.Equal(t, []string{"/skydns/com/example/removed"}, removed)
+}
+
+func TestDiff_Empty(t *testing.T) {
+	added, updated, removed := Diff(nil, nil)
+	assert.Empty(t, added)
+	assert.Empty(t, updated)
+	assert.Empty(t, removed)
+
+	added, _, _ = Diff(nil, map[string]Service{"/skydns/com/example": {Host: "1.1.1.1"}})
+	assert.Equal(t, []string{"/skydns/com/example"}, added)
+}
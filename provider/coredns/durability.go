@@ -0,0 +1,53 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package coredns
+
+import "context"
+
+// Durability selects how hard a write is made durable before it returns.
+type Durability int
+
+const (
+	// DurabilityDefault uses the backend's configured durability.
+	DurabilityDefault Durability = iota
+	// DurabilityRelaxed trades durability for speed: a write may be lost
+	// if the host crashes shortly after it returns.
+	DurabilityRelaxed
+	// DurabilitySync makes a write survive a host crash once it returns.
+	DurabilitySync
+)
+
+// durabilityKey is the context key of the Durability of writes.
+type durabilityKey struct{}
+
+// WithDurability returns a context whose writes are made with durability d.
+//
+// SQLite maps it to PRAGMA synchronous (OFF or FULL) for the writes made with
+// the context, without changing the connection's setting for other writes.
+// A coalescing backend sends a DurabilitySync write, and the writes buffered
+// before it, to its backend before returning. etcd commits every write to
+// the disk of a quorum of members, so it honors DurabilitySync regardless
+// and ignores DurabilityRelaxed.
+func WithDurability(ctx context.Context, d Durability) context.Context {
+	return context.WithValue(ctx, durabilityKey{}, d)
+}
+
+// durabilityFrom returns the Durability set on ctx by WithDurability.
+func durabilityFrom(ctx context.Context) Durability {
+	d, _ := ctx.Value(durabilityKey{}).(Durability)
+	return d
+}
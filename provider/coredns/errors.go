@@ -0,0 +1,160 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package coredns
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/go-sql-driver/mysql"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// wrapError returns err wrapped with sentinel, so that errors.Is matches
+// both the sentinel and the original error. A nil sentinel returns err as is.
+func wrapError(sentinel, err error) error {
+	if sentinel == nil {
+		return err
+	}
+	return fmt.Errorf("%w: %w", sentinel, err)
+}
+
+// etcdError maps an etcd client error to ErrNotFound, ErrConflict or
+// ErrUnavailable based on its gRPC code. Other errors are returned as is.
+func etcdError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return wrapError(ErrUnavailable, err)
+	}
+
+	code := status.Code(err)
+	var coder interface{ Code() codes.Code }
+	if errors.As(err, &coder) {
+		code = coder.Code()
+	}
+
+	switch code {
+	case codes.NotFound:
+		return wrapError(ErrNotFound, err)
+	case codes.AlreadyExists, codes.FailedPrecondition, codes.Aborted:
+		return wrapError(ErrConflict, err)
+	case codes.Unavailable, codes.DeadlineExceeded, codes.ResourceExhausted:
+		return wrapError(ErrUnavailable, err)
+	}
+	return err
+}
+
+// mysqlError maps a database/sql or MySQL error to ErrNotFound, ErrConflict
+// or ErrUnavailable. Other errors are returned as is.
+func mysqlError(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, sql.ErrNoRows):
+		return wrapError(ErrNotFound, err)
+	case errors.Is(err, sql.ErrConnDone), errors.Is(err, driver.ErrBadConn), errors.Is(err, mysql.ErrInvalidConn):
+		return wrapError(ErrUnavailable, err)
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return wrapError(ErrUnavailable, err)
+	}
+	var mysqlErr *mysql.MySQLError
+	if !errors.As(err, &mysqlErr) {
+		return err
+	}
+	switch mysqlErr.Number {
+	case mysqlErrDupEntry:
+		return wrapError(ErrConflict, err)
+	case mysqlErrTooManyConnections, mysqlErrLockWaitTimeout, mysqlErrLockDeadlock:
+		return wrapError(ErrUnavailable, err)
+	}
+	return err
+}
+
+// MySQL server error numbers mapped by mysqlError.
+const (
+	mysqlErrTooManyConnections = 1040
+	mysqlErrDupEntry           = 1062
+	mysqlErrLockWaitTimeout    = 1205
+	mysqlErrLockDeadlock       = 1213
+)
+
+// sqliteError maps a database/sql or SQLite error to ErrNotFound, ErrConflict
+// or ErrUnavailable. Other errors are returned as is.
+func sqliteError(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, sql.ErrNoRows):
+		return wrapError(ErrNotFound, err)
+	case errors.Is(err, sql.ErrConnDone):
+		return wrapError(ErrUnavailable, err)
+	}
+
+	var coder interface{ Code() int }
+	if !errors.As(err, &coder) {
+		return err
+	}
+	// Extended result codes keep the primary code in the low byte
+	switch coder.Code() & 0xff {
+	case sqlite3.SQLITE_CONSTRAINT:
+		return wrapError(ErrConflict, err)
+	case sqlite3.SQLITE_BUSY, sqlite3.SQLITE_LOCKED, sqlite3.SQLITE_CANTOPEN, sqlite3.SQLITE_IOERR:
+		return wrapError(ErrUnavailable, err)
+	case sqlite3.SQLITE_NOTFOUND:
+		return wrapError(ErrNotFound, err)
+	}
+	return err
+}
+
+// BackendError is returned by NewBackend when the backend can't be created.
+// It names what was being opened and how the configuration can be fixed;
+// the underlying error is available through errors.Is and errors.As.
+type BackendError struct {
+	// Type is the backend being created.
+	Type BackendType
+
+	// Target is the database path or etcd endpoints the backend was opened at.
+	Target string
+
+	// Hint suggests a remediation. It may be empty.
+	Hint string
+
+	Err error
+}
+
+func (e *BackendError) Error() string {
+	msg := fmt.Sprintf("creating %s backend at %s: %v", e.Type, e.Target, e.Err)
+	if e.Hint != "" {
+		msg += " (" + e.Hint + ")"
+	}
+	return msg
+}
+
+func (e *BackendError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,97 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package coredns
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	etcdcv3 "go.etcd.io/etcd/client/v3"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+func TestEtcdError(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		sentinel error
+	}{
+		{name: "unavailable", err: status.Error(codes.Unavailable, "connection refused"), sentinel: ErrUnavailable},
+		{name: "no leader", err: rpctypes.ErrNoLeader, sentinel: ErrUnavailable},
+		{name: "client timeout", err: context.DeadlineExceeded, sentinel: ErrUnavailable},
+		{name: "lease not found", err: rpctypes.ErrLeaseNotFound, sentinel: ErrNotFound},
+		{name: "compacted", err: rpctypes.ErrCompacted, sentinel: nil},
+		{name: "precondition", err: status.Error(codes.FailedPrecondition, "txn failed"), sentinel: ErrConflict},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := etcdError(tt.err)
+			assert.ErrorIs(t, err, tt.err)
+			for _, sentinel := range []error{ErrNotFound, ErrConflict, ErrUnavailable} {
+				assert.Equal(t, sentinel == tt.sentinel, errors.Is(err, sentinel), "%v", sentinel)
+			}
+		})
+	}
+
+	plain := errors.New("etcd failure")
+	assert.Equal(t, plain, etcdError(plain))
+	assert.NoError(t, etcdError(nil))
+}
+
+func TestEtcdClient_WrapsUnavailable(t *testing.T) {
+	mockKV := new(MockEtcdKV)
+	c := etcdClient{client: &etcdcv3.Client{KV: mockKV}}
+
+	mockKV.On("Get", mock.Anything, "/skydns").Return(&etcdcv3.GetResponse{}, status.Error(codes.Unavailable, "connection refused"))
+
+	_, err := c.GetServices(context.Background(), "/skydns/")
+	assert.ErrorIs(t, err, ErrUnavailable)
+}
+
+func TestSQLiteError(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		sentinel error
+	}{
+		{name: "busy", err: sqliteCodeError(sqlite3.SQLITE_BUSY), sentinel: ErrUnavailable},
+		{name: "locked", err: sqliteCodeError(sqlite3.SQLITE_LOCKED_SHAREDCACHE), sentinel: ErrUnavailable},
+		{name: "cannot open", err: sqliteCodeError(sqlite3.SQLITE_CANTOPEN), sentinel: ErrUnavailable},
+		{name: "constraint", err: sqliteCodeError(sqlite3.SQLITE_CONSTRAINT_PRIMARYKEY), sentinel: ErrConflict},
+		{name: "no rows", err: sql.ErrNoRows, sentinel: ErrNotFound},
+		{name: "connection done", err: sql.ErrConnDone, sentinel: ErrUnavailable},
+		{name: "syntax", err: sqliteCodeError(sqlite3.SQLITE_ERROR), sentinel: nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := sqliteError(tt.err)
+			assert.ErrorIs(t, err, tt.err)
+			for _, sentinel := range []error{ErrNotFound, ErrConflict, ErrUnavailable} {
+				assert.Equal(t, sentinel == tt.sentinel, errors.Is(err, sentinel), "%v", sentinel)
+			}
+		})
+	}
+}
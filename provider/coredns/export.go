@@ -0,0 +1,266 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package coredns
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// zstdMagic is the frame header every zstd stream starts with.
+var zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+// rootPrefixer is implemented by backends that can report the prefix
+// addressing every key they store.
+type rootPrefixer interface {
+	rootPrefix() string
+}
+
+// rootPrefixOf returns the prefix addressing every key of b, or of the first
+// backend it wraps that reports one, defaulting to DefaultPrefix.
+func rootPrefixOf(b Backend) string {
+	for b != nil {
+		if rp, ok := b.(rootPrefixer); ok {
+			return rp.rootPrefix()
+		}
+		wrapper, ok := b.(interface{ Unwrap() Backend })
+		if !ok {
+			break
+		}
+		b = wrapper.Unwrap()
+	}
+	return DefaultPrefix + string(DefaultKeySeparator)
+}
+
+// keySchemer is implemented by backends that can report the scheme of the
+// keys they store.
+type keySchemer interface {
+	keyScheme() KeyScheme
+}
+
+// keySchemeOf returns the key scheme of b, or of the first backend it wraps
+// that reports one, defaulting to the "/" separated scheme.
+func keySchemeOf(b Backend) KeyScheme {
+	for b != nil {
+		if ks, ok := b.(keySchemer); ok {
+			return ks.keyScheme()
+		}
+		wrapper, ok := b.(interface{ Unwrap() Backend })
+		if !ok {
+			break
+		}
+		b = wrapper.Unwrap()
+	}
+	return defaultKeyScheme
+}
+
+// ExportJSON writes every service of backend to w as a single JSON object
+// mapping keys to services, the same layout Snapshot returns. Services are
+// streamed one at a time so memory stays flat for large stores.
+func ExportJSON(ctx context.Context, backend Backend, w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	if _, err := bw.WriteString("{"); err != nil {
+		return err
+	}
+	first := true
+	err := backend.ForEach(ctx, rootPrefixOf(backend), func(key string, svc *Service) error {
+		if !first {
+			if err := bw.WriteByte(','); err != nil {
+				return err
+			}
+		}
+		first = false
+
+		k, err := json.Marshal(key)
+		if err != nil {
+			return err
+		}
+		value := *svc
+		value.Key = ""
+		v, err := json.Marshal(&value)
+		if err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+		bw.Write(k)
+		bw.WriteByte(':')
+		_, err = bw.Write(v)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := bw.WriteString("}\n"); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// DuplicatePolicy controls what an import does with a key that appears more
+// than once in its input.
+type DuplicatePolicy int
+
+const (
+	// DuplicateOverwrite saves every occurrence, so the last one wins.
+	DuplicateOverwrite DuplicatePolicy = iota
+	// DuplicateSkip keeps the first occurrence and ignores the others.
+	DuplicateSkip
+	// DuplicateError aborts the import at the first repeated key.
+	DuplicateError
+)
+
+// ErrDuplicateKey is returned by an import with DuplicateError when a key
+// appears more than once in its input.
+var ErrDuplicateKey = errors.New("duplicate key")
+
+// ImportOptions configures ImportJSONWithOptions.
+type ImportOptions struct {
+	// OnDuplicate is the policy for keys repeated in the input.
+	OnDuplicate DuplicatePolicy
+}
+
+// ImportResult reports the outcome of an import.
+type ImportResult struct {
+	// Imported is the number of services saved.
+	Imported int
+
+	// Duplicates lists the keys found more than once in the input, once
+	// per repeated occurrence, in input order.
+	Duplicates []string
+}
+
+// ImportJSON reads a JSON object written by ExportJSON from r and saves each
+// service to backend as it is decoded. It returns the number of services
+// saved, stopping at the first one that can't be decoded or saved.
+// Repeated keys are overwritten, the last occurrence winning, and logged.
+func ImportJSON(ctx context.Context, backend Backend, r io.Reader) (int, error) {
+	result, err := ImportJSONWithOptions(ctx, backend, r, ImportOptions{})
+	return result.Imported, err
+}
+
+// ImportJSONWithOptions is ImportJSON with a configurable policy for keys
+// repeated in the input. Repeated keys are reported in the result whatever
+// the policy.
+func ImportJSONWithOptions(ctx context.Context, backend Backend, r io.Reader, opts ImportOptions) (ImportResult, error) {
+	var result ImportResult
+	dec := json.NewDecoder(r)
+	if err := expectDelim(dec, '{'); err != nil {
+		return result, err
+	}
+
+	seen := make(map[string]bool)
+	for dec.More() {
+		if err := ctx.Err(); err != nil {
+			return result, err
+		}
+		tok, err := dec.Token()
+		if err != nil {
+			return result, err
+		}
+		key, ok := tok.(string)
+		if !ok {
+			return result, fmt.Errorf("expected key, got %v", tok)
+		}
+		svc := new(Service)
+		if err := dec.Decode(svc); err != nil {
+			return result, fmt.Errorf("%s: %w", key, err)
+		}
+
+		if seen[key] {
+			result.Duplicates = append(result.Duplicates, key)
+			log.Warnf("Duplicate key %s in import", key)
+			switch opts.OnDuplicate {
+			case DuplicateSkip:
+				continue
+			case DuplicateError:
+				return result, fmt.Errorf("%w: %s", ErrDuplicateKey, key)
+			}
+		}
+		seen[key] = true
+
+		svc.Key = key
+		if err := backend.SaveService(ctx, svc); err != nil {
+			return result, fmt.Errorf("%s: %w", key, err)
+		}
+		result.Imported++
+	}
+	if err := expectDelim(dec, '}'); err != nil {
+		return result, err
+	}
+
+	log.Infof("Imported %d services", result.Imported)
+	return result, nil
+}
+
+// expectDelim reads the next token of dec and checks it is the delimiter want.
+func expectDelim(dec *json.Decoder, want json.Delim) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if tok != want {
+		return fmt.Errorf("expected %q, got %v", want, tok)
+	}
+	return nil
+}
+
+// ExportCompressed is ExportJSON with the output compressed with zstd.
+// Compression is streamed, so large backups don't need to fit in memory.
+func ExportCompressed(ctx context.Context, backend Backend, w io.Writer) error {
+	zw, err := zstd.NewWriter(w)
+	if err != nil {
+		return err
+	}
+	if err := ExportJSON(ctx, backend, zw); err != nil {
+		zw.Close()
+		return err
+	}
+	return zw.Close()
+}
+
+// ImportCompressed imports a backup written by ExportCompressed or
+// ExportJSON, detecting zstd compression from the stream's magic bytes.
+func ImportCompressed(ctx context.Context, backend Backend, r io.Reader) (int, error) {
+	result, err := ImportCompressedWithOptions(ctx, backend, r, ImportOptions{})
+	return result.Imported, err
+}
+
+// ImportCompressedWithOptions is ImportCompressed with a configurable policy
+// for keys repeated in the input.
+func ImportCompressedWithOptions(ctx context.Context, backend Backend, r io.Reader, opts ImportOptions) (ImportResult, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(len(zstdMagic))
+	if err != nil && err != io.EOF {
+		return ImportResult{}, err
+	}
+	if !bytes.Equal(magic, zstdMagic) {
+		return ImportJSONWithOptions(ctx, backend, br, opts)
+	}
+
+	zr, err := zstd.NewReader(br)
+	if err != nil {
+		return ImportResult{}, err
+	}
+	defer zr.Close()
+	return ImportJSONWithOptions(ctx, backend, zr, opts)
+}
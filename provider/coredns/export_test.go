@@ -0,0 +1,177 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package coredns
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// populateBackend saves n distinct services to backend.
+func populateBackend(t *testing.T, backend Backend, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		require.NoError(t, backend.SaveService(context.Background(), &Service{
+			Key:  fmt.Sprintf("/skydns/com/example/host%05d", i),
+			Host: fmt.Sprintf("10.%d.%d.%d", i>>16&0xff, i>>8&0xff, i&0xff),
+			TTL:  300,
+			Text: "owner=external-dns",
+		}))
+	}
+}
+
+func TestExportImportJSON(t *testing.T) {
+	ctx := context.Background()
+	src := NewMemoryBackend()
+	defer src.Close()
+	require.NoError(t, src.SaveService(ctx, &Service{Key: "/skydns/com/example/www", Host: "1.2.3.4", TTL: 60}))
+	require.NoError(t, src.SaveService(ctx, &Service{Key: "/skydns/com/example/_sip/_tcp/sip", Host: "sip.example.com", Port: 5060}))
+
+	var buf bytes.Buffer
+	require.NoError(t, ExportJSON(ctx, src, &buf))
+	assert.JSONEq(t, `{
+		"/skydns/com/example/_sip/_tcp/sip": {"host":"sip.example.com","port":5060},
+		"/skydns/com/example/www": {"host":"1.2.3.4","ttl":60}
+	}`, buf.String())
+
+	dst := NewMemoryBackend()
+	defer dst.Close()
+	imported, err := ImportJSON(ctx, dst, &buf)
+	require.NoError(t, err)
+	assert.Equal(t, 2, imported)
+	assertSameSnapshot(t, src, dst)
+}
+
+func TestExportImportJSON_Empty(t *testing.T) {
+	ctx := context.Background()
+	src := NewMemoryBackend()
+	defer src.Close()
+
+	var buf bytes.Buffer
+	require.NoError(t, ExportJSON(ctx, src, &buf))
+	assert.JSONEq(t, `{}`, buf.String())
+
+	imported, err := ImportJSON(ctx, NewMemoryBackend(), &buf)
+	require.NoError(t, err)
+	assert.Zero(t, imported)
+}
+
+func TestImportJSON_Malformed(t *testing.T) {
+	for name, input := range map[string]string{
+		"not an object": `["a"]`,
+		"bad service":   `{"/skydns/com/example/www": "1.2.3.4"}`,
+		"truncated":     `{"/skydns/com/example/www": {"host":"1.2.3.4"}`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := ImportJSON(context.Background(), NewMemoryBackend(), bytes.NewBufferString(input))
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestExportImportCompressed(t *testing.T) {
+	ctx := context.Background()
+	src, err := NewSQLiteBackend(":memory:")
+	require.NoError(t, err)
+	defer src.Close()
+	populateBackend(t, src, 3000)
+
+	var plain, compressed bytes.Buffer
+	require.NoError(t, ExportJSON(ctx, src, &plain))
+	require.NoError(t, ExportCompressed(ctx, src, &compressed))
+	assert.Less(t, compressed.Len(), plain.Len())
+	assert.Equal(t, zstdMagic, compressed.Bytes()[:len(zstdMagic)])
+
+	dst := NewMemoryBackend()
+	defer dst.Close()
+	imported, err := ImportCompressed(ctx, dst, &compressed)
+	require.NoError(t, err)
+	assert.Equal(t, 3000, imported)
+	assertSameSnapshot(t, src, dst)
+}
+
+func TestImportCompressed_DetectsPlainJSON(t *testing.T) {
+	ctx := context.Background()
+	src := NewMemoryBackend()
+	defer src.Close()
+	populateBackend(t, src, 10)
+
+	var plain bytes.Buffer
+	require.NoError(t, ExportJSON(ctx, src, &plain))
+
+	dst := NewMemoryBackend()
+	defer dst.Close()
+	imported, err := ImportCompressed(ctx, dst, &plain)
+	require.NoError(t, err)
+	assert.Equal(t, 10, imported)
+	assertSameSnapshot(t, src, dst)
+}
+
+func assertSameSnapshot(t *testing.T, want, got Backend) {
+	t.Helper()
+	wantSnapshot, err := want.Snapshot(context.Background())
+	require.NoError(t, err)
+	gotSnapshot, err := got.Snapshot(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, wantSnapshot, gotSnapshot)
+}
+
+func TestImportJSONWithOptions_Duplicates(t *testing.T) {
+	const input = `{
+		"/skydns/com/example/www": {"host":"1.1.1.1"},
+		"/skydns/com/example/api": {"host":"2.2.2.2"},
+		"/skydns/com/example/www": {"host":"3.3.3.3"}
+	}`
+
+	for _, tc := range []struct {
+		name     string
+		policy   DuplicatePolicy
+		imported int
+		wantErr  error
+		wantWWW  string
+	}{
+		{"overwrite", DuplicateOverwrite, 3, nil, "3.3.3.3"},
+		{"skip", DuplicateSkip, 2, nil, "1.1.1.1"},
+		{"error", DuplicateError, 2, ErrDuplicateKey, "1.1.1.1"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			backend, err := NewSQLiteBackend(":memory:")
+			require.NoError(t, err)
+			defer backend.Close()
+
+			result, err := ImportJSONWithOptions(ctx, backend, bytes.NewBufferString(input), ImportOptions{OnDuplicate: tc.policy})
+			if tc.wantErr != nil {
+				assert.ErrorIs(t, err, tc.wantErr)
+			} else {
+				require.NoError(t, err)
+			}
+			assert.Equal(t, tc.imported, result.Imported)
+			assert.Equal(t, []string{"/skydns/com/example/www"}, result.Duplicates)
+
+			services, err := backend.GetServices(ctx, "/skydns/com/example/www")
+			require.NoError(t, err)
+			require.Len(t, services, 1)
+			assert.Equal(t, tc.wantWWW, services[0].Host)
+		})
+	}
+}
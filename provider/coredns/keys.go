@@ -0,0 +1,319 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package coredns
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// DefaultPrefix is the root under which CoreDNS looks up records in etcd.
+const DefaultPrefix = "/skydns"
+
+// DefaultKeySeparator separates the labels of keys, as in CoreDNS's
+// default etcd path style.
+const DefaultKeySeparator = '/'
+
+// ErrInvalidKeySeparator is returned for key separators that aren't a
+// single character safe to use between DNS labels.
+var ErrInvalidKeySeparator = errors.New("invalid key separator")
+
+// unsafeKeySeparators can't separate keys: they can appear in DNS labels,
+// are wildcards in SQL LIKE patterns or are otherwise ambiguous.
+const unsafeKeySeparators = ".-_*%\\"
+
+// ErrInvalidPrefix is returned by reads and deletes given a prefix that
+// doesn't address the keys of the backend.
+var ErrInvalidPrefix = errors.New("invalid key prefix")
+
+// KeyScheme builds and parses keys whose labels are joined by Separator.
+// The zero value uses DefaultKeySeparator.
+type KeyScheme struct {
+	Separator byte
+
+	// RequireRoot makes backends reject absolute prefixes outside their root.
+	RequireRoot bool
+}
+
+// defaultKeyScheme is the scheme of the package level key functions.
+var defaultKeyScheme = KeyScheme{Separator: DefaultKeySeparator}
+
+// NewKeyScheme returns the scheme using separator, or the default scheme if
+// separator is empty. The separator must be a single printable ASCII
+// character that can't appear in a DNS label.
+func NewKeyScheme(separator string) (KeyScheme, error) {
+	if separator == "" {
+		return defaultKeyScheme, nil
+	}
+	if err := validateKeySeparator(separator); err != nil {
+		return KeyScheme{}, err
+	}
+	return KeyScheme{Separator: separator[0]}, nil
+}
+
+// validateKeySeparator checks that separator is usable by NewKeyScheme.
+func validateKeySeparator(separator string) error {
+	if len(separator) != 1 {
+		return fmt.Errorf("%w %q: must be a single character", ErrInvalidKeySeparator, separator)
+	}
+	c := separator[0]
+	if c <= ' ' || c > '~' || isHostnameChar(rune(c)) || strings.IndexByte(unsafeKeySeparators, c) >= 0 {
+		return fmt.Errorf("%w %q: must be a printable ASCII character that can't appear in a DNS label", ErrInvalidKeySeparator, separator)
+	}
+	return nil
+}
+
+// validatePrefix checks that prefix, given to a read or delete of a backend
+// rooted at root, isn't empty, as an empty prefix would silently address
+// every key, and, if k.RequireRoot is set, is relative or under root.
+func (k KeyScheme) validatePrefix(root, prefix string) error {
+	if prefix == "" {
+		return fmt.Errorf("%w: prefix is empty, use %s to address every key", ErrInvalidPrefix, root+k.sep())
+	}
+	if k.RequireRoot && strings.HasPrefix(prefix, k.sep()) && !k.isUnder(strings.TrimRight(prefix, k.sep()), root) {
+		return fmt.Errorf("%w: %s is not under the root %s", ErrInvalidPrefix, prefix, root+k.sep())
+	}
+	return nil
+}
+
+// validateClearPrefix checks prefix as validatePrefix does and, since a
+// clear is meant to wipe a zone, rejects the root and the prefixes above it.
+func (k KeyScheme) validateClearPrefix(root, prefix string) error {
+	if err := k.validatePrefix(root, prefix); err != nil {
+		return err
+	}
+	if key := k.resolveKey(root, prefix); key == k.sep() || k.isUnder(root, key) {
+		return fmt.Errorf("%w: refusing to clear %s, it holds every record under the root %s", ErrInvalidPrefix, prefix, root+k.sep())
+	}
+	return nil
+}
+
+// sep returns the separator as a string.
+func (k KeyScheme) sep() string {
+	if k.Separator == 0 {
+		return string(rune(DefaultKeySeparator))
+	}
+	return string(rune(k.Separator))
+}
+
+// DefaultPrefix returns DefaultPrefix written with the scheme's separator.
+func (k KeyScheme) DefaultPrefix() string {
+	return k.sep() + strings.TrimPrefix(DefaultPrefix, "/")
+}
+
+// cleanKey collapses repeated separators in key and strips a trailing one,
+// unless key is the lone separator, so that keys written as
+// "/skydns//com/example/" and "/skydns/com/example" are the same.
+func (k KeyScheme) cleanKey(key string) string {
+	sep := k.sep()
+	if !strings.Contains(key, sep+sep) && (len(key) <= 1 || !strings.HasSuffix(key, sep)) {
+		return key
+	}
+	for strings.Contains(key, sep+sep) {
+		key = strings.ReplaceAll(key, sep+sep, sep)
+	}
+	if len(key) > 1 {
+		key = strings.TrimSuffix(key, sep)
+	}
+	return key
+}
+
+// normalizePrefix returns prefix cleaned and without trailing separators,
+// or the default prefix if empty.
+func (k KeyScheme) normalizePrefix(prefix string) string {
+	prefix = strings.TrimRight(k.cleanKey(prefix), k.sep())
+	if prefix == "" {
+		return k.DefaultPrefix()
+	}
+	return prefix
+}
+
+// InstancePrefix returns the root of the keys of the external-dns instance
+// instanceID under prefix: prefix followed by instanceID as one more label,
+// or prefix itself if instanceID is empty. Instances sharing a store under
+// different IDs don't read or write each other's keys when BuildKey and
+// ParseKey are given their instance prefix.
+func (k KeyScheme) InstancePrefix(prefix, instanceID string) string {
+	if instanceID == "" {
+		return prefix
+	}
+	return k.normalizePrefix(prefix) + k.sep() + instanceID
+}
+
+// validateInstanceID checks that instanceID is empty or a single label of
+// at most 63 letters, digits, hyphens and underscores.
+func validateInstanceID(instanceID string) error {
+	if len(instanceID) > maxLabelLength {
+		return fmt.Errorf("invalid instance ID %q: longer than %d characters", instanceID, maxLabelLength)
+	}
+	for _, c := range instanceID {
+		if !isHostnameChar(c) {
+			return fmt.Errorf("invalid instance ID %q: contains invalid character %q", instanceID, c)
+		}
+	}
+	return nil
+}
+
+// BuildKey returns the key holding the records of dnsName under prefix.
+func (k KeyScheme) BuildKey(prefix, dnsName string) string {
+	labels := strings.Split(dnsName, ".")
+	reverse(labels)
+	return k.cleanKey(strings.TrimRight(prefix, k.sep()) + k.sep() + strings.Join(labels, k.sep()))
+}
+
+// ParseKey returns the DNS name stored at key under prefix and the suffix
+// made of its targetStrip leftmost labels, as the package level ParseKey.
+func (k KeyScheme) ParseKey(prefix, key string, targetStrip int) (dnsName, suffix string) {
+	dnsName, suffix, ok := k.ParseKeyChecked(prefix, key, targetStrip)
+	if !ok {
+		log.Warnf("Key %s has no suffix of %d labels to strip, reading it as %q", key, targetStrip, dnsName)
+	}
+	return dnsName, suffix
+}
+
+// ParseKeyChecked is ParseKey, also reporting whether key had the
+// targetStrip suffix labels to strip, as the package level ParseKeyChecked.
+func (k KeyScheme) ParseKeyChecked(prefix, key string, targetStrip int) (dnsName, suffix string, ok bool) {
+	prefix, key = k.cleanKey(prefix), k.cleanKey(key)
+	labels := strings.Split(strings.TrimPrefix(strings.TrimPrefix(key, prefix), k.sep()), k.sep())
+	reverse(labels)
+	ok = targetStrip < len(labels)
+	if !ok || targetStrip < 0 {
+		targetStrip = 0
+	}
+	return strings.Join(labels[targetStrip:], "."), strings.Join(labels[:targetStrip], "."), ok
+}
+
+// resolveKey returns key scoped under root and cleaned, as the package
+// level resolveKey.
+func (k KeyScheme) resolveKey(root, key string) string {
+	if strings.HasPrefix(key, k.sep()) {
+		return k.cleanKey(key)
+	}
+	if key == "" {
+		return k.cleanKey(root + k.sep())
+	}
+	return k.cleanKey(root + k.sep() + key)
+}
+
+// isUnder reports whether key is parent or one of its descendants.
+func (k KeyScheme) isUnder(key, parent string) bool {
+	return key == parent || strings.HasPrefix(key, parent+k.sep())
+}
+
+// childPrefix returns the start shared by the keys below the cleaned
+// prefix: prefix followed by the separator, or the root itself.
+func (k KeyScheme) childPrefix(prefix string) string {
+	if strings.HasSuffix(prefix, k.sep()) {
+		return prefix
+	}
+	return prefix + k.sep()
+}
+
+// inPrefix reports whether key is addressed by the cleaned prefix, as a
+// backend read does: key is prefix or below it. Matching is by label, so
+// "/skydns/com/example" doesn't address "/skydns/com/example2/www". An
+// empty prefix addresses every key.
+func (k KeyScheme) inPrefix(key, prefix string) bool {
+	return prefix == "" || key == prefix || strings.HasPrefix(key, k.childPrefix(prefix))
+}
+
+// zoneKey returns the part of key made of prefix and up to depth labels
+// below it, e.g. "/skydns/com/example" for "/skydns/com/example/www" and a
+// depth of 2. complete reports whether key extends past that part with a
+// separator, in which case every key starting with key has the same zone key.
+func (k KeyScheme) zoneKey(prefix, key string, depth int) (zoneKey string, complete bool) {
+	sep := k.sep()
+	end := 0
+	for n := strings.Count(prefix, sep) + depth; n > 0; n-- {
+		if end >= len(key) {
+			return key, false
+		}
+		next := strings.Index(key[end+1:], sep)
+		if next < 0 {
+			return key, false
+		}
+		end += next + 1
+	}
+	return key[:end], true
+}
+
+// parentKey returns key without its last label, or an empty string for a
+// key with a single label.
+func (k KeyScheme) parentKey(key string) string {
+	i := strings.LastIndex(key, k.sep())
+	if i <= 0 {
+		return ""
+	}
+	return key[:i]
+}
+
+// stripKeyLabels removes the last n labels from a key.
+// At least the first label is always kept.
+func (k KeyScheme) stripKeyLabels(key string, n int) string {
+	if n <= 0 {
+		return key
+	}
+	// Cut at the separators rather than splitting, as this runs for every
+	// read service
+	for ; n > 0; n-- {
+		i := strings.LastIndex(key, k.sep())
+		if i < 0 {
+			break
+		}
+		key = key[:i]
+	}
+	return key
+}
+
+// normalizePrefix returns prefix without trailing slashes, or DefaultPrefix if empty.
+func normalizePrefix(prefix string) string {
+	return defaultKeyScheme.normalizePrefix(prefix)
+}
+
+// BuildKey returns the key holding the records of dnsName under prefix,
+// e.g. "www.example.com" under "/skydns" becomes "/skydns/com/example/www".
+func BuildKey(prefix, dnsName string) string {
+	return defaultKeyScheme.BuildKey(prefix, dnsName)
+}
+
+// ParseKey returns the DNS name stored at key under prefix, with its
+// targetStrip leftmost labels removed and returned separately as the suffix
+// (the label that disambiguates several targets of the same name).
+// For example "/skydns/com/example/www/1a2b3c4d" with targetStrip 1 yields
+// ("www.example.com", "1a2b3c4d"), and "/skydns/com/example/www/a/b" with
+// targetStrip 2 yields ("www.example.com", "b.a").
+// A key without more than targetStrip labels, such as a record created by
+// hand without a suffix, is read whole with an empty suffix and a warning is
+// logged.
+func ParseKey(prefix, key string, targetStrip int) (dnsName, suffix string) {
+	return defaultKeyScheme.ParseKey(prefix, key, targetStrip)
+}
+
+// ParseKeyChecked is ParseKey without the warning, reporting instead whether
+// key had the targetStrip suffix labels to strip.
+func ParseKeyChecked(prefix, key string, targetStrip int) (dnsName, suffix string, ok bool) {
+	return defaultKeyScheme.ParseKeyChecked(prefix, key, targetStrip)
+}
+
+// resolveKey returns key scoped under the backend root prefix. Absolute keys
+// (starting with "/") are kept; relative keys are joined to root. Repeated
+// slashes are collapsed and a trailing one is stripped, except for "/".
+func resolveKey(root, key string) string {
+	return defaultKeyScheme.resolveKey(root, key)
+}
@@ -0,0 +1,344 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package coredns
+
+import (
+	"context"
+	"maps"
+	"slices"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"sigs.k8s.io/external-dns/endpoint"
+	"sigs.k8s.io/external-dns/internal/testutils"
+	"sigs.k8s.io/external-dns/plan"
+)
+
+func TestBuildKey(t *testing.T) {
+	assert.Equal(t, "/skydns/com/example/www", BuildKey("/skydns/", "www.example.com"))
+	assert.Equal(t, "/skydns/com/example/www", BuildKey("/skydns", "www.example.com"))
+	assert.Equal(t, "/dns/com/example/www", BuildKey("/dns", "www.example.com"))
+}
+
+func TestParseKey(t *testing.T) {
+	tests := []struct {
+		name        string
+		prefix      string
+		key         string
+		targetStrip int
+		dnsName     string
+		suffix      string
+	}{
+		{name: "no strip", prefix: "/skydns/", key: "/skydns/com/example/www", dnsName: "www.example.com"},
+		{name: "strip one", prefix: "/skydns/", key: "/skydns/com/example/www/1a2b3c4d", targetStrip: 1, dnsName: "www.example.com", suffix: "1a2b3c4d"},
+		{name: "prefix without slash", prefix: "/skydns", key: "/skydns/com/example/www", dnsName: "www.example.com"},
+		{name: "custom prefix", prefix: "/dns/", key: "/dns/com/example/www/abc", targetStrip: 1, dnsName: "www.example.com", suffix: "abc"},
+		{name: "strip two", prefix: "/skydns/", key: "/skydns/com/example/www/a/b", targetStrip: 2, dnsName: "www.example.com", suffix: "b.a"},
+		{name: "strip three", prefix: "/skydns/", key: "/skydns/com/example/www/a/b/c", targetStrip: 3, dnsName: "www.example.com", suffix: "c.b.a"},
+		{name: "strip beyond name", prefix: "/skydns/", key: "/skydns/com/example", targetStrip: 5, dnsName: "example.com"},
+		{name: "strip whole name", prefix: "/skydns/", key: "/skydns/com/example/www", targetStrip: 3, dnsName: "www.example.com"},
+		{name: "negative strip", prefix: "/skydns/", key: "/skydns/com/example/www", targetStrip: -1, dnsName: "www.example.com"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dnsName, suffix := ParseKey(tt.prefix, tt.key, tt.targetStrip)
+			assert.Equal(t, tt.dnsName, dnsName)
+			assert.Equal(t, tt.suffix, suffix)
+		})
+	}
+}
+
+func TestParseKeyChecked(t *testing.T) {
+	dnsName, suffix, ok := ParseKeyChecked("/skydns", "/skydns/com/example/www/1a2b3c4d", 1)
+	assert.True(t, ok)
+	assert.Equal(t, "www.example.com", dnsName)
+	assert.Equal(t, "1a2b3c4d", suffix)
+
+	// A record created by hand, without the suffix its targetstrip expects
+	dnsName, suffix, ok = ParseKeyChecked("/skydns", "/skydns/com/example", 2)
+	assert.False(t, ok)
+	assert.Equal(t, "example.com", dnsName)
+	assert.Empty(t, suffix)
+}
+
+func TestParseKey_MissingSuffixWarns(t *testing.T) {
+	hook := testutils.LogsUnderTestWithLogLevel(logrus.WarnLevel, t)
+
+	dnsName, suffix := ParseKey("/skydns", "/skydns/com/example", 2)
+	assert.Equal(t, "example.com", dnsName)
+	assert.Empty(t, suffix)
+	testutils.TestHelperLogContains(`Key /skydns/com/example has no suffix of 2 labels to strip, reading it as "example.com"`, hook, t)
+}
+
+func TestRecords_MissingSuffix(t *testing.T) {
+	client := fakeETCDClient{map[string]Service{
+		"/skydns/com/example": {Host: "1.2.3.4", TargetStrip: 2},
+	}}
+	provider := coreDNSProvider{client: client, coreDNSPrefix: defaultCoreDNSPrefix}
+
+	records, err := provider.Records(context.Background())
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	assert.Equal(t, "example.com", records[0].DNSName)
+}
+
+func TestTargetStrip_MultiLabel(t *testing.T) {
+	backend := NewMemoryBackend()
+	defer backend.Close()
+
+	ctx := context.Background()
+	provider := NewCoreDNSProviderWithBackend(&endpoint.DomainFilter{}, "/skydns/", false, backend)
+
+	require.NoError(t, backend.SaveService(ctx, &Service{Host: "1.2.3.4", TargetStrip: 2, Key: "/skydns/com/example/www/a/b"}))
+	require.NoError(t, backend.SaveService(ctx, &Service{Host: "5.6.7.8", TargetStrip: 2, Key: "/skydns/com/example/www/c/d"}))
+
+	records, err := provider.Records(ctx)
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	assert.Equal(t, "www.example.com", records[0].DNSName)
+	assert.ElementsMatch(t, endpoint.Targets{"1.2.3.4", "5.6.7.8"}, records[0].Targets)
+	assert.Equal(t, "b.a", records[0].Labels["1.2.3.4"])
+	assert.Equal(t, "d.c", records[0].Labels["5.6.7.8"])
+
+	// Dropping a target deletes the key built from its multi-label prefix
+	desired := records[0].DeepCopy()
+	desired.Targets = endpoint.Targets{"5.6.7.8"}
+	require.NoError(t, provider.ApplyChanges(ctx, &plan.Changes{
+		UpdateOld: []*endpoint.Endpoint{records[0]},
+		UpdateNew: []*endpoint.Endpoint{desired},
+	}))
+	assert.Equal(t, []string{"/skydns/com/example/www/c/d"}, backend.Keys())
+
+	records, err = provider.Records(ctx)
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	assert.Equal(t, "www.example.com", records[0].DNSName)
+	assert.Equal(t, endpoint.Targets{"5.6.7.8"}, records[0].Targets)
+}
+
+func TestResolveKey(t *testing.T) {
+	assert.Equal(t, "/skydns/com/example", resolveKey("/skydns", "/skydns/com/example"))
+	assert.Equal(t, "/dns/com/example", resolveKey("/dns", "com/example"))
+	assert.Equal(t, "/dns", resolveKey("/dns", ""))
+	assert.Equal(t, "/skydns/com/example", resolveKey("/skydns", "/skydns//com/example/"))
+	assert.Equal(t, "/dns/com/example", resolveKey("/dns/", "com//example/"))
+}
+
+func TestKeyScheme_CleanKey(t *testing.T) {
+	for _, tc := range []struct {
+		key, want string
+	}{
+		{"/skydns/com/example", "/skydns/com/example"},
+		{"/skydns/com/example/", "/skydns/com/example"},
+		{"/skydns//com/example/", "/skydns/com/example"},
+		{"/skydns///com//example//", "/skydns/com/example"},
+		{"/", "/"},
+		{"//", "/"},
+		{"", ""},
+	} {
+		assert.Equal(t, tc.want, defaultKeyScheme.cleanKey(tc.key), tc.key)
+	}
+	assert.Equal(t, ":skydns:com", KeyScheme{Separator: ':'}.cleanKey(":skydns::com:"))
+}
+
+func TestKeyScheme_InPrefix(t *testing.T) {
+	keys := defaultKeyScheme
+	assert.True(t, keys.inPrefix("/skydns/com/example", "/skydns/com/example"))
+	assert.True(t, keys.inPrefix("/skydns/com/example/www", "/skydns/com/example"))
+	assert.False(t, keys.inPrefix("/skydns/com/example2/www", "/skydns/com/example"))
+	assert.False(t, keys.inPrefix("/skydns/com/example-2", "/skydns/com/example"))
+	assert.True(t, keys.inPrefix("/skydns/com/example", "/"))
+	assert.True(t, keys.inPrefix("/skydns/com/example", ""))
+}
+
+func TestKeyNormalization(t *testing.T) {
+	assert.Equal(t, BuildKey("/skydns", "www.example.com"), BuildKey("/skydns//", "www.example.com"))
+	dnsName, suffix := ParseKey("/skydns/", "/skydns//com/example/www/1a2b/", 1)
+	assert.Equal(t, "www.example.com", dnsName)
+	assert.Equal(t, "1a2b", suffix)
+}
+
+func TestNewKeyScheme(t *testing.T) {
+	keys, err := NewKeyScheme("")
+	require.NoError(t, err)
+	assert.Equal(t, defaultKeyScheme, keys)
+
+	for _, separator := range []string{"/", ":", "|", "#"} {
+		keys, err := NewKeyScheme(separator)
+		require.NoError(t, err, separator)
+		assert.Equal(t, separator, keys.sep())
+	}
+
+	for _, separator := range []string{"::", ".", "-", "_", "a", "7", " ", "%", "*", "\\", "\t", "é"} {
+		_, err := NewKeyScheme(separator)
+		assert.ErrorIs(t, err, ErrInvalidKeySeparator, "%q", separator)
+	}
+}
+
+func TestKeyScheme_AlternateSeparator(t *testing.T) {
+	keys := KeyScheme{Separator: ':'}
+
+	assert.Equal(t, ":skydns", keys.DefaultPrefix())
+	assert.Equal(t, ":skydns", keys.normalizePrefix(""))
+	assert.Equal(t, ":dns", keys.normalizePrefix(":dns:"))
+	assert.Equal(t, ":skydns:com:example:www", keys.BuildKey(":skydns:", "www.example.com"))
+
+	dnsName, suffix := keys.ParseKey(":skydns:", ":skydns:com:example:www:a:b", 2)
+	assert.Equal(t, "www.example.com", dnsName)
+	assert.Equal(t, "b.a", suffix)
+
+	assert.Equal(t, ":dns:com:example", keys.resolveKey(":dns", "com:example"))
+	assert.Equal(t, ":dns:com:example", keys.resolveKey(":dns", ":dns:com:example"))
+	assert.True(t, keys.isUnder(":dns:com:example:www", ":dns:com:example"))
+	assert.False(t, keys.isUnder(":dns:com:examplez", ":dns:com:example"))
+	assert.False(t, keys.isUnder("/dns/com/example/www", "/dns/com/example"))
+	assert.Equal(t, ":dns:com", keys.parentKey(":dns:com:example"))
+	assert.Equal(t, ":dns:com:example", keys.stripKeyLabels(":dns:com:example:www:x1", 2))
+}
+
+func TestKeySeparator_EndToEnd(t *testing.T) {
+	for _, backendType := range []string{"memory", "sqlite"} {
+		t.Run(backendType, func(t *testing.T) {
+			testutils.TestHelperEnvSetter(t, map[string]string{
+				"COREDNS_BACKEND":       backendType,
+				"COREDNS_SQLITE_PATH":   ":memory:",
+				"COREDNS_KEY_SEPARATOR": ":",
+			})
+
+			p, err := NewCoreDNSProvider(endpoint.NewDomainFilter([]string{"example.com"}), ":dns:", false)
+			require.NoError(t, err)
+			cp := p.(coreDNSProvider)
+			backend := cp.client
+			defer backend.Close()
+
+			ctx := context.Background()
+			require.NoError(t, backend.SaveService(ctx, &Service{Host: "9.9.9.9", Key: ":dns:com:example:wwwx"}))
+
+			require.NoError(t, p.ApplyChanges(ctx, &plan.Changes{
+				Create: []*endpoint.Endpoint{
+					endpoint.NewEndpoint("www.example.com", endpoint.RecordTypeA, "1.2.3.4", "5.6.7.8"),
+					endpoint.NewEndpoint("api.example.com", endpoint.RecordTypeA, "1.2.3.4"),
+				},
+			}))
+
+			snapshot, err := backend.Snapshot(ctx)
+			require.NoError(t, err)
+			assert.Len(t, snapshot, 4)
+			for key := range snapshot {
+				assert.Regexp(t, `^:dns:com:example`, key)
+				assert.NotContains(t, key, "/")
+			}
+
+			records, err := p.Records(ctx)
+			require.NoError(t, err)
+			targets := make(map[string][]string)
+			for _, ep := range records {
+				targets[ep.DNSName] = ep.Targets
+			}
+			assert.ElementsMatch(t, []string{"1.2.3.4", "5.6.7.8"}, targets["www.example.com"])
+			assert.Equal(t, []string{"1.2.3.4"}, targets["api.example.com"])
+
+			var deletes []*endpoint.Endpoint
+			for _, ep := range records {
+				if ep.DNSName != "wwwx.example.com" {
+					deletes = append(deletes, ep)
+				}
+			}
+			require.NoError(t, p.ApplyChanges(ctx, &plan.Changes{Delete: deletes}))
+
+			snapshot, err = backend.Snapshot(ctx)
+			require.NoError(t, err)
+			assert.Equal(t, []string{":dns:com:example:wwwx"}, slices.Collect(maps.Keys(snapshot)), "deletes don't reach sibling keys sharing a prefix")
+		})
+	}
+}
+
+func TestCustomPrefix_EndToEnd(t *testing.T) {
+	backends := map[string]func(t *testing.T) Backend{
+		"memory": func(_ *testing.T) Backend {
+			return NewMemoryBackendWithPrefix("/dns")
+		},
+		"sqlite": func(t *testing.T) Backend {
+			backend, err := NewSQLiteBackendWithOptions(":memory:", SQLiteOptions{Prefix: "/dns/"})
+			require.NoError(t, err)
+			return backend
+		},
+	}
+
+	for name, newBackend := range backends {
+		t.Run(name, func(t *testing.T) {
+			backend := newBackend(t)
+			defer backend.Close()
+
+			ctx := context.Background()
+			provider := NewCoreDNSProviderWithBackend(&endpoint.DomainFilter{}, "/dns/", false, backend)
+
+			changes := &plan.Changes{
+				Create: []*endpoint.Endpoint{
+					endpoint.NewEndpoint("www.example.com", endpoint.RecordTypeA, "1.2.3.4"),
+				},
+			}
+			require.NoError(t, provider.ApplyChanges(ctx, changes))
+
+			// Absolute and relative prefixes address the same records
+			absolute, err := backend.GetServices(ctx, "/dns/com/example")
+			require.NoError(t, err)
+			require.Len(t, absolute, 1)
+			relative, err := backend.GetServices(ctx, "com/example")
+			require.NoError(t, err)
+			assert.Equal(t, absolute, relative)
+
+			// Nothing was written under the default prefix
+			skydns, err := backend.GetServices(ctx, "/skydns/")
+			require.NoError(t, err)
+			assert.Empty(t, skydns)
+
+			records, err := provider.Records(ctx)
+			require.NoError(t, err)
+			require.Len(t, records, 1)
+			assert.Equal(t, "www.example.com", records[0].DNSName)
+			assert.Equal(t, endpoint.Targets{"1.2.3.4"}, records[0].Targets)
+
+			require.NoError(t, backend.DeleteService(ctx, "com/example"))
+			remaining, err := backend.GetServices(ctx, "/dns/")
+			require.NoError(t, err)
+			assert.Empty(t, remaining)
+		})
+	}
+}
+
+func TestNewCoreDNSProvider_EtcdPrefixEnv(t *testing.T) {
+	testutils.TestHelperEnvSetter(t, map[string]string{
+		"COREDNS_BACKEND":     "memory",
+		"COREDNS_ETCD_PREFIX": "/dns",
+	})
+
+	p, err := NewCoreDNSProvider(&endpoint.DomainFilter{}, "/skydns/", false)
+	require.NoError(t, err)
+
+	cp, ok := p.(coreDNSProvider)
+	require.True(t, ok)
+	assert.Equal(t, "/dns/", cp.coreDNSPrefix)
+
+	mem, ok := cp.reloadable.Unwrap().(*MemoryBackend)
+	require.True(t, ok)
+	assert.Equal(t, "/dns", mem.prefix)
+}
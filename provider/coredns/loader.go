@@ -0,0 +1,95 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package coredns
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// FileTreeLoader bootstraps a Backend from a directory tree of SkyDNS JSON
+// files, as exported from CoreDNS. The tree mirrors the key hierarchy: the
+// file com/example/www.json under Root holds the service stored at
+// <Prefix>/com/example/www.
+type FileTreeLoader struct {
+	// Root is the directory mapped to Prefix.
+	Root string
+
+	// Prefix is the key the root directory maps to (DefaultPrefix if empty).
+	Prefix string
+}
+
+// NewFileTreeLoader returns a loader mapping the directory root to prefix.
+func NewFileTreeLoader(root, prefix string) *FileTreeLoader {
+	return &FileTreeLoader{Root: root, Prefix: prefix}
+}
+
+// Load walks the tree, including nested directories, and saves the service
+// of every .json file to backend. Other files are skipped. It returns the
+// number of services saved, stopping at the first file that can't be read,
+// decoded or saved.
+func (l *FileTreeLoader) Load(ctx context.Context, backend Backend) (int, error) {
+	prefix := normalizePrefix(l.Prefix)
+	loaded := 0
+
+	err := filepath.WalkDir(l.Root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		if filepath.Ext(path) != ".json" {
+			log.Debugf("Skipping non-JSON file %s", path)
+			return nil
+		}
+
+		rel, err := filepath.Rel(l.Root, path)
+		if err != nil {
+			return err
+		}
+		key := prefix + "/" + filepath.ToSlash(strings.TrimSuffix(rel, ".json"))
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		svc := new(Service)
+		if err := (JSONCodec{}).Unmarshal(data, svc); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		svc.Key = key
+		if err := backend.SaveService(ctx, svc); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		loaded++
+		return nil
+	})
+	if err != nil {
+		return loaded, err
+	}
+
+	log.Infof("Loaded %d services from %s", loaded, l.Root)
+	return loaded, nil
+}
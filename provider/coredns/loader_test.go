@@ -0,0 +1,95 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package coredns
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeFileTree creates the given files, keyed by slash-separated path, under dir.
+func writeFileTree(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(t, os.WriteFile(path, []byte(content), 0644))
+	}
+}
+
+func TestFileTreeLoader_Load(t *testing.T) {
+	root := t.TempDir()
+	writeFileTree(t, root, map[string]string{
+		"com/example/www.json":           `{"host":"1.2.3.4","ttl":300}`,
+		"com/example/www/a1b2c3d4.json":  `{"host":"5.6.7.8","targetstrip":1}`,
+		"com/example/_sip/_tcp/sip.json": `{"host":"sip.example.com","port":5060,"priority":10,"weight":20}`,
+		"org/other/txt.json":             `{"text":"hello"}`,
+		"com/example/README.md":          "not a record",
+		"com/example/www.json.bak":       `{"host":"9.9.9.9"}`,
+	})
+
+	backend := NewMemoryBackend()
+	defer backend.Close()
+
+	loaded, err := NewFileTreeLoader(root, "/skydns/").Load(context.Background(), backend)
+	require.NoError(t, err)
+	assert.Equal(t, 4, loaded)
+
+	snapshot, err := backend.Snapshot(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, map[string]Service{
+		"/skydns/com/example/www":           {Host: "1.2.3.4", TTL: 300},
+		"/skydns/com/example/www/a1b2c3d4":  {Host: "5.6.7.8", TargetStrip: 1},
+		"/skydns/com/example/_sip/_tcp/sip": {Host: "sip.example.com", Port: 5060, Priority: 10, Weight: 20},
+		"/skydns/org/other/txt":             {Text: "hello"},
+	}, snapshot)
+}
+
+func TestFileTreeLoader_CustomPrefix(t *testing.T) {
+	root := t.TempDir()
+	writeFileTree(t, root, map[string]string{"com/example/www.json": `{"host":"1.2.3.4"}`})
+
+	backend, err := NewSQLiteBackendWithOptions(":memory:", SQLiteOptions{Prefix: "/dns"})
+	require.NoError(t, err)
+	defer backend.Close()
+
+	_, err = NewFileTreeLoader(root, "/dns").Load(context.Background(), backend)
+	require.NoError(t, err)
+
+	keys, err := backend.Keys(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []string{"/dns/com/example/www"}, keys)
+}
+
+func TestFileTreeLoader_InvalidJSON(t *testing.T) {
+	root := t.TempDir()
+	writeFileTree(t, root, map[string]string{"com/example/www.json": `{"host":`})
+
+	_, err := NewFileTreeLoader(root, "").Load(context.Background(), NewMemoryBackend())
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), filepath.Join("com", "example", "www.json"))
+}
+
+func TestFileTreeLoader_MissingRoot(t *testing.T) {
+	_, err := NewFileTreeLoader(filepath.Join(t.TempDir(), "missing"), "").Load(context.Background(), NewMemoryBackend())
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
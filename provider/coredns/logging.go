@@ -0,0 +1,82 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package coredns
+
+import (
+	"io"
+	"sync/atomic"
+
+	"github.com/sirupsen/logrus"
+)
+
+// log is the destination of all package logging. It defaults to the logrus
+// standard logger so the external-dns binary keeps its current output, while
+// library consumers can redirect it with SetLogger or mute it with SetSilent.
+var log = &packageLogger{}
+
+// silentLogger discards everything logged while silent mode is enabled.
+var silentLogger = &logrus.Logger{
+	Out:       io.Discard,
+	Formatter: new(logrus.TextFormatter),
+	Hooks:     make(logrus.LevelHooks),
+	Level:     logrus.PanicLevel,
+}
+
+// packageLogger forwards log calls to the configured logger.
+type packageLogger struct {
+	logger atomic.Pointer[logrus.FieldLogger]
+	silent atomic.Bool
+}
+
+// SetLogger redirects the package logging to logger.
+// A nil logger restores the logrus standard logger.
+func SetLogger(logger logrus.FieldLogger) {
+	if logger == nil {
+		log.logger.Store(nil)
+		return
+	}
+	log.logger.Store(&logger)
+}
+
+// SetSilent enables or disables silent mode. While silent, the package
+// produces no log output whatever logger is configured.
+func SetSilent(silent bool) {
+	log.silent.Store(silent)
+}
+
+// current returns the logger calls are forwarded to.
+func (l *packageLogger) current() logrus.FieldLogger {
+	if l.silent.Load() {
+		return silentLogger
+	}
+	if logger := l.logger.Load(); logger != nil {
+		return *logger
+	}
+	return logrus.StandardLogger()
+}
+
+func (l *packageLogger) Debug(args ...any) { l.current().Debug(args...) }
+
+func (l *packageLogger) Debugf(format string, args ...any) { l.current().Debugf(format, args...) }
+
+func (l *packageLogger) Info(args ...any) { l.current().Info(args...) }
+
+func (l *packageLogger) Infof(format string, args ...any) { l.current().Infof(format, args...) }
+
+func (l *packageLogger) Warnf(format string, args ...any) { l.current().Warnf(format, args...) }
+
+func (l *packageLogger) Errorf(format string, args ...any) { l.current().Errorf(format, args...) }
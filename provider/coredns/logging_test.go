@@ -0,0 +1,85 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package coredns
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// captureStandardLogger redirects the logrus standard logger to a buffer for
+// the duration of the test.
+func captureStandardLogger(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	std := logrus.StandardLogger()
+	out, level := std.Out, std.GetLevel()
+	std.SetOutput(&buf)
+	std.SetLevel(logrus.DebugLevel)
+	t.Cleanup(func() {
+		std.SetOutput(out)
+		std.SetLevel(level)
+	})
+	return &buf
+}
+
+func TestSetSilent(t *testing.T) {
+	buf := captureStandardLogger(t)
+
+	SetSilent(true)
+	t.Cleanup(func() { SetSilent(false) })
+
+	backend := NewMemoryBackend()
+	require.NoError(t, backend.Close())
+	sqlite, err := NewSQLiteBackend(":memory:")
+	require.NoError(t, err)
+	require.NoError(t, sqlite.Close())
+	assert.Empty(t, buf.String())
+
+	SetSilent(false)
+	NewMemoryBackend()
+	assert.Contains(t, buf.String(), "Memory backend initialized")
+}
+
+func TestSetLogger(t *testing.T) {
+	std := captureStandardLogger(t)
+
+	var buf bytes.Buffer
+	logger := logrus.New()
+	logger.SetOutput(&buf)
+	SetLogger(logger)
+	t.Cleanup(func() { SetLogger(nil) })
+
+	NewMemoryBackend()
+	assert.Contains(t, buf.String(), "Memory backend initialized")
+	assert.Empty(t, std.String())
+
+	// Silent mode takes precedence over the configured logger
+	buf.Reset()
+	SetSilent(true)
+	NewMemoryBackend()
+	SetSilent(false)
+	assert.Empty(t, buf.String())
+
+	SetLogger(nil)
+	NewMemoryBackend()
+	assert.Contains(t, std.String(), "Memory backend initialized")
+}
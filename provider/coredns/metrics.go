@@ -0,0 +1,45 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package coredns
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+
+	"sigs.k8s.io/external-dns/pkg/metrics"
+)
+
+var dedupCollapsedTotal = metrics.NewCounterWithOpts(
+	prometheus.CounterOpts{
+		Subsystem: "coredns",
+		Name:      "backend_dedup_collapsed_total",
+		Help:      "Number of records dropped by CoreDNS backend reads as duplicates of another record's DNS answer.",
+	},
+)
+
+func init() {
+	metrics.RegisterMetric.MustRegister(dedupCollapsedTotal)
+}
+
+// recordCollapsed reports that a read of prefix dropped n records as
+// duplicates, which usually means two sources write the same answer.
+func recordCollapsed(prefix string, n int) {
+	if n <= 0 {
+		return
+	}
+	log.Debugf("Collapsed %d duplicate records under %s", n, prefix)
+	dedupCollapsedTotal.Counter.Add(float64(n))
+}
@@ -0,0 +1,115 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package coredns
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const (
+	// reverseIPv4Suffix is the zone holding IPv4 reverse-DNS names
+	reverseIPv4Suffix = ".in-addr.arpa"
+
+	// reverseIPv6Suffix is the zone holding IPv6 reverse-DNS names
+	reverseIPv6Suffix = ".ip6.arpa"
+)
+
+// hexDigits are the nibble labels of IPv6 reverse-DNS names.
+const hexDigits = "0123456789abcdef"
+
+// ReverseAddr returns the reverse-DNS name for an IP address, e.g. "1.2.3.4"
+// becomes "4.3.2.1.in-addr.arpa" and "2001:db8::1" becomes the 32 nibbles of
+// the expanded address, reversed, followed by "ip6.arpa".
+func ReverseAddr(addr string) (string, error) {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return "", fmt.Errorf("invalid IP address %q", addr)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return strconv.Itoa(int(ip4[3])) + "." +
+			strconv.Itoa(int(ip4[2])) + "." +
+			strconv.Itoa(int(ip4[1])) + "." +
+			strconv.Itoa(int(ip4[0])) + reverseIPv4Suffix, nil
+	}
+
+	var b strings.Builder
+	for i := len(ip) - 1; i >= 0; i-- {
+		b.WriteByte(hexDigits[ip[i]&0x0f])
+		b.WriteByte('.')
+		b.WriteByte(hexDigits[ip[i]>>4])
+		b.WriteByte('.')
+	}
+	return strings.TrimSuffix(b.String(), ".") + reverseIPv6Suffix, nil
+}
+
+// AddrFromReverse returns the IP address a reverse-DNS name built by
+// ReverseAddr stands for, e.g. "4.3.2.1.in-addr.arpa" becomes "1.2.3.4".
+func AddrFromReverse(name string) (string, error) {
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	switch {
+	case strings.HasSuffix(name, reverseIPv4Suffix):
+		labels := strings.Split(strings.TrimSuffix(name, reverseIPv4Suffix), ".")
+		if len(labels) != net.IPv4len {
+			return "", fmt.Errorf("reverse name %q must have %d address labels", name, net.IPv4len)
+		}
+		reverse(labels)
+		ip := net.ParseIP(strings.Join(labels, "."))
+		if ip == nil {
+			return "", fmt.Errorf("invalid reverse name %q", name)
+		}
+		return ip.String(), nil
+	case strings.HasSuffix(name, reverseIPv6Suffix):
+		labels := strings.Split(strings.TrimSuffix(name, reverseIPv6Suffix), ".")
+		if len(labels) != 2*net.IPv6len {
+			return "", fmt.Errorf("reverse name %q must have %d nibble labels", name, 2*net.IPv6len)
+		}
+		ip := make(net.IP, net.IPv6len)
+		for i, label := range labels {
+			nibble := strings.Index(hexDigits, label)
+			if len(label) != 1 || nibble < 0 {
+				return "", fmt.Errorf("invalid nibble %q in reverse name %q", label, name)
+			}
+			// labels run from the least significant nibble
+			pos := len(labels) - 1 - i
+			ip[pos/2] |= byte(nibble) << (4 * (1 - pos%2))
+		}
+		return ip.String(), nil
+	default:
+		return "", fmt.Errorf("%q is not a reverse-DNS name", name)
+	}
+}
+
+// PTRKey returns the CoreDNS etcd key holding the PTR record for addr,
+// e.g. "1.2.3.4" under "/skydns/" becomes "/skydns/arpa/in-addr/1/2/3/4" and
+// IPv6 addresses map to 32 nibble labels under "/skydns/arpa/ip6".
+func PTRKey(prefix, addr string) (string, error) {
+	name, err := ReverseAddr(addr)
+	if err != nil {
+		return "", err
+	}
+	labels := strings.Split(name, ".")
+	reverse(labels)
+	return strings.TrimSuffix(prefix, "/") + "/" + strings.Join(labels, "/"), nil
+}
+
+// isReverseName reports whether dnsName lives in a reverse-DNS zone.
+func isReverseName(dnsName string) bool {
+	return strings.HasSuffix(dnsName, reverseIPv4Suffix) || strings.HasSuffix(dnsName, reverseIPv6Suffix)
+}
@@ -0,0 +1,175 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package coredns
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"sigs.k8s.io/external-dns/endpoint"
+	"sigs.k8s.io/external-dns/plan"
+)
+
+func TestReverseAddr(t *testing.T) {
+	tests := []struct {
+		name    string
+		addr    string
+		want    string
+		wantErr bool
+	}{
+		{name: "ipv4", addr: "1.2.3.4", want: "4.3.2.1.in-addr.arpa"},
+		{name: "ipv4 zeros", addr: "10.0.0.1", want: "1.0.0.10.in-addr.arpa"},
+		{name: "ipv6", addr: "2001:db8::1", want: "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa"},
+		{name: "ipv6 mapped ipv4", addr: "::ffff:1.2.3.4", want: "4.3.2.1.in-addr.arpa"},
+		{name: "invalid", addr: "1.2.3.999", wantErr: true},
+		{name: "hostname", addr: "www.example.com", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ReverseAddr(tt.addr)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestPTRKey(t *testing.T) {
+	key, err := PTRKey("/skydns/", "1.2.3.4")
+	require.NoError(t, err)
+	assert.Equal(t, "/skydns/arpa/in-addr/1/2/3/4", key)
+
+	key, err = PTRKey("/skydns", "1.2.3.4")
+	require.NoError(t, err)
+	assert.Equal(t, "/skydns/arpa/in-addr/1/2/3/4", key)
+}
+
+func TestAddrFromReverse(t *testing.T) {
+	for _, addr := range []string{"1.2.3.4", "10.0.0.1", "2001:db8::1", "fe80::1:2:3:4", "::1"} {
+		name, err := ReverseAddr(addr)
+		require.NoError(t, err)
+		got, err := AddrFromReverse(name)
+		require.NoError(t, err)
+		assert.Equal(t, addr, got)
+	}
+
+	got, err := AddrFromReverse("1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.B.D.0.1.0.0.2.IP6.ARPA.")
+	require.NoError(t, err)
+	assert.Equal(t, "2001:db8::1", got)
+
+	for _, name := range []string{
+		"www.example.com",
+		"3.2.1.in-addr.arpa",
+		"4.3.2.999.in-addr.arpa",
+		"1.0.0.2.ip6.arpa",
+		"g.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa",
+		"10.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa",
+	} {
+		_, err := AddrFromReverse(name)
+		assert.Error(t, err, name)
+	}
+}
+
+func TestPTRKey_IPv6(t *testing.T) {
+	key, err := PTRKey("/skydns/", "2001:db8::1")
+	require.NoError(t, err)
+	assert.Equal(t, "/skydns/arpa/ip6/2/0/0/1/0/d/b/8/0/0/0/0/0/0/0/0/0/0/0/0/0/0/0/0/0/0/0/0/0/0/0/1", key)
+}
+
+func TestPTRServiceTranslation(t *testing.T) {
+	client := fakeETCDClient{
+		map[string]Service{
+			"/skydns/arpa/in-addr/1/2/3/4": {Host: "www.example.com"},
+		},
+	}
+	provider := coreDNSProvider{
+		client:        client,
+		coreDNSPrefix: defaultCoreDNSPrefix,
+	}
+
+	endpoints, err := provider.Records(context.Background())
+	require.NoError(t, err)
+	require.Len(t, endpoints, 1)
+	assert.Equal(t, "4.3.2.1.in-addr.arpa", endpoints[0].DNSName)
+	assert.Equal(t, endpoint.RecordTypePTR, endpoints[0].RecordType)
+	assert.Equal(t, endpoint.Targets{"www.example.com"}, endpoints[0].Targets)
+}
+
+func TestPTRRoundTrip(t *testing.T) {
+	backend := NewMemoryBackend()
+	defer backend.Close()
+
+	ctx := context.Background()
+	provider := NewCoreDNSProviderWithBackend(&endpoint.DomainFilter{}, defaultCoreDNSPrefix, false, backend)
+
+	changes := &plan.Changes{
+		Create: []*endpoint.Endpoint{
+			endpoint.NewEndpoint("4.3.2.1.in-addr.arpa", endpoint.RecordTypePTR, "www.example.com"),
+		},
+	}
+	require.NoError(t, provider.ApplyChanges(ctx, changes))
+
+	services, err := backend.GetServices(ctx, "/skydns/arpa/in-addr/1/2/3/4")
+	require.NoError(t, err)
+	require.Len(t, services, 1)
+	assert.Equal(t, "www.example.com", services[0].Host)
+
+	records, err := provider.Records(ctx)
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	assert.Equal(t, "4.3.2.1.in-addr.arpa", records[0].DNSName)
+	assert.Equal(t, endpoint.RecordTypePTR, records[0].RecordType)
+	assert.Equal(t, endpoint.Targets{"www.example.com"}, records[0].Targets)
+}
+
+func TestPTRRoundTrip_IPv6(t *testing.T) {
+	backend := NewMemoryBackend()
+	defer backend.Close()
+
+	ctx := context.Background()
+	provider := NewCoreDNSProviderWithBackend(&endpoint.DomainFilter{}, defaultCoreDNSPrefix, false, backend)
+
+	name, err := ReverseAddr("2001:db8::1")
+	require.NoError(t, err)
+	require.NoError(t, provider.ApplyChanges(ctx, &plan.Changes{
+		Create: []*endpoint.Endpoint{endpoint.NewEndpoint(name, endpoint.RecordTypePTR, "www.example.com")},
+	}))
+
+	key, err := PTRKey(defaultCoreDNSPrefix, "2001:db8::1")
+	require.NoError(t, err)
+	services, err := backend.GetServices(ctx, key)
+	require.NoError(t, err)
+	require.Len(t, services, 1)
+	assert.Equal(t, "www.example.com", services[0].Host)
+
+	records, err := provider.Records(ctx)
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	assert.Equal(t, name, records[0].DNSName)
+	assert.Equal(t, endpoint.RecordTypePTR, records[0].RecordType)
+
+	addr, err := AddrFromReverse(records[0].DNSName)
+	require.NoError(t, err)
+	assert.Equal(t, "2001:db8::1", addr)
+}
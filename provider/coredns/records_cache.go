@@ -0,0 +1,113 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package coredns
+
+import (
+	"sync"
+	"time"
+
+	"sigs.k8s.io/external-dns/endpoint"
+)
+
+// recordsCache holds the endpoints last assembled by Records so that
+// reconciles in quick succession don't re-read the whole store. Entries are
+// keyed by a generation that ApplyChanges bumps, and expire after ttl in
+// case the store is changed by another writer, or sooner if a record has a
+// shorter TTL of its own. A nil cache caches nothing.
+type recordsCache struct {
+	ttl   time.Duration
+	clock Clock
+
+	mu         sync.Mutex
+	endpoints  []*endpoint.Endpoint
+	expires    time.Time
+	generation uint64
+	valid      bool
+}
+
+// newRecordsCache returns a cache keeping endpoints for ttl as told by clock
+// (SystemClock if nil), or nil if ttl is not positive.
+func newRecordsCache(ttl time.Duration, clock Clock) *recordsCache {
+	if ttl <= 0 {
+		return nil
+	}
+	return &recordsCache{ttl: ttl, clock: clockOrDefault(clock)}
+}
+
+// get returns a copy of the cached endpoints if they are still fresh, along
+// with the current generation to pass to set after a miss.
+func (c *recordsCache) get() ([]*endpoint.Endpoint, uint64, bool) {
+	if c == nil {
+		return nil, 0, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.valid || !c.clock.Now().Before(c.expires) {
+		return nil, c.generation, false
+	}
+	return copyEndpoints(c.endpoints), c.generation, true
+}
+
+// set caches a copy of endpoints read at generation, until the smallest
+// non-zero TTL among them or ttl, whichever is shorter. Endpoints read
+// before an invalidation are discarded.
+func (c *recordsCache) set(endpoints []*endpoint.Endpoint, generation uint64) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if generation != c.generation {
+		return
+	}
+	c.endpoints = copyEndpoints(endpoints)
+	c.expires = c.clock.Now().Add(cacheTTLFor(endpoints, c.ttl))
+	c.valid = true
+}
+
+// cacheTTLFor returns the smallest non-zero record TTL of endpoints, capped
+// at maxTTL.
+func cacheTTLFor(endpoints []*endpoint.Endpoint, maxTTL time.Duration) time.Duration {
+	ttl := maxTTL
+	for _, ep := range endpoints {
+		if ep.RecordTTL.IsConfigured() {
+			ttl = min(ttl, time.Duration(ep.RecordTTL)*time.Second)
+		}
+	}
+	return ttl
+}
+
+// invalidate drops the cached endpoints.
+func (c *recordsCache) invalidate() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	c.endpoints = nil
+	c.valid = false
+}
+
+// copyEndpoints deep copies endpoints, so callers can't modify cached ones.
+func copyEndpoints(endpoints []*endpoint.Endpoint) []*endpoint.Endpoint {
+	copied := make([]*endpoint.Endpoint, len(endpoints))
+	for i, ep := range endpoints {
+		copied[i] = ep.DeepCopy()
+	}
+	return copied
+}
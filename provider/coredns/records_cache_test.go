@@ -0,0 +1,152 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package coredns
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"sigs.k8s.io/external-dns/endpoint"
+	"sigs.k8s.io/external-dns/internal/testutils"
+	"sigs.k8s.io/external-dns/plan"
+)
+
+// newCachingProvider returns a provider caching Records for a minute of
+// clock time, over a backend counting its calls.
+func newCachingProvider(t *testing.T, clock *FakeClock) (coreDNSProvider, *FaultInjectingBackend) {
+	t.Helper()
+	backend := NewFaultInjectingBackend(NewMemoryBackend())
+	t.Cleanup(func() { backend.Close() })
+	require.NoError(t, backend.SaveService(context.Background(), &Service{Key: "/skydns/com/example/www", Host: "1.2.3.4"}))
+
+	cache := newRecordsCache(time.Minute, clock)
+	return coreDNSProvider{
+		client:        backend,
+		coreDNSPrefix: defaultCoreDNSPrefix,
+		domainFilter:  &endpoint.DomainFilter{},
+		cache:         cache,
+	}, backend
+}
+
+func TestRecordsCache_HitWithinTTL(t *testing.T) {
+	clock := newFakeClock()
+	provider, backend := newCachingProvider(t, clock)
+	ctx := context.Background()
+
+	first, err := provider.Records(ctx)
+	require.NoError(t, err)
+	second, err := provider.Records(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, first, second)
+	assert.Equal(t, 1, backend.Calls(OpGetServices))
+
+	// Returned endpoints are copies
+	second[0].Targets[0] = "9.9.9.9"
+	third, err := provider.Records(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "1.2.3.4", third[0].Targets[0])
+
+	clock.Advance(time.Minute)
+	_, err = provider.Records(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 2, backend.Calls(OpGetServices), "expired entries are reloaded")
+}
+
+func TestRecordsCache_InvalidatedByApplyChanges(t *testing.T) {
+	clock := newFakeClock()
+	provider, backend := newCachingProvider(t, clock)
+	ctx := context.Background()
+
+	_, err := provider.Records(ctx)
+	require.NoError(t, err)
+
+	require.NoError(t, provider.ApplyChanges(ctx, &plan.Changes{
+		Create: []*endpoint.Endpoint{endpoint.NewEndpoint("api.example.com", endpoint.RecordTypeA, "5.6.7.8")},
+	}))
+
+	records, err := provider.Records(ctx)
+	require.NoError(t, err)
+	assert.Len(t, records, 2)
+	assert.Equal(t, 2, backend.Calls(OpGetServices))
+}
+
+func TestRecordsCache_DiscardsReadsRacingInvalidation(t *testing.T) {
+	cache := newRecordsCache(time.Minute, nil)
+	_, generation, ok := cache.get()
+	require.False(t, ok)
+
+	cache.invalidate()
+	cache.set([]*endpoint.Endpoint{endpoint.NewEndpoint("www.example.com", endpoint.RecordTypeA, "1.2.3.4")}, generation)
+	_, _, ok = cache.get()
+	assert.False(t, ok, "endpoints read before an invalidation must not be cached")
+}
+
+func TestRecordsCache_Disabled(t *testing.T) {
+	assert.Nil(t, newRecordsCache(0, nil))
+
+	provider := NewCoreDNSProviderWithBackend(&endpoint.DomainFilter{}, defaultCoreDNSPrefix, false, NewMemoryBackend())
+	assert.Nil(t, provider.(coreDNSProvider).cache)
+}
+
+func TestNewCoreDNSProvider_CacheTTL(t *testing.T) {
+	testutils.TestHelperEnvSetter(t, map[string]string{
+		"COREDNS_BACKEND":            "memory",
+		"COREDNS_PROVIDER_CACHE_TTL": "30s",
+	})
+	provider, err := NewCoreDNSProvider(&endpoint.DomainFilter{}, defaultCoreDNSPrefix, false)
+	require.NoError(t, err)
+	cache := provider.(coreDNSProvider).cache
+	require.NotNil(t, cache)
+	assert.Equal(t, 30*time.Second, cache.ttl)
+}
+
+func TestRecordsCache_ExpiresWithRecordTTL(t *testing.T) {
+	clock := newFakeClock()
+	provider, backend := newCachingProvider(t, clock)
+	ctx := context.Background()
+	require.NoError(t, backend.SaveService(ctx, &Service{Key: "/skydns/com/example/api", Host: "1.2.3.5", TTL: 30}))
+
+	_, err := provider.Records(ctx)
+	require.NoError(t, err)
+	clock.Advance(29 * time.Second)
+	_, err = provider.Records(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, backend.Calls(OpGetServices))
+
+	clock.Advance(time.Second)
+	_, err = provider.Records(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 2, backend.Calls(OpGetServices), "entries expire with the shortest record TTL")
+}
+
+func TestCacheTTLFor(t *testing.T) {
+	assert.Equal(t, time.Minute, cacheTTLFor(nil, time.Minute))
+	assert.Equal(t, time.Minute, cacheTTLFor([]*endpoint.Endpoint{
+		endpoint.NewEndpoint("www.example.com", endpoint.RecordTypeA, "1.2.3.4"),
+	}, time.Minute), "unset TTLs fall back to the maximum")
+	assert.Equal(t, 10*time.Second, cacheTTLFor([]*endpoint.Endpoint{
+		endpoint.NewEndpointWithTTL("www.example.com", endpoint.RecordTypeA, 30, "1.2.3.4"),
+		endpoint.NewEndpointWithTTL("api.example.com", endpoint.RecordTypeA, 10, "1.2.3.5"),
+	}, time.Minute))
+	assert.Equal(t, time.Minute, cacheTTLFor([]*endpoint.Endpoint{
+		endpoint.NewEndpointWithTTL("www.example.com", endpoint.RecordTypeA, 3600, "1.2.3.4"),
+	}, time.Minute), "long TTLs are capped")
+}
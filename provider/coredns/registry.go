@@ -0,0 +1,67 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package coredns
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"sigs.k8s.io/external-dns/endpoint"
+)
+
+// ErrInvalidRegistryTXT is returned when a TXT registry record can't be parsed.
+var ErrInvalidRegistryTXT = errors.New("invalid registry TXT record")
+
+// registryHeritage is the heritage value of records managed by external-dns.
+const registryHeritage = "external-dns"
+
+// ParseRegistryTXT parses the labels of a TXT registry record such as
+// "heritage=external-dns,external-dns/owner=default". The returned map holds
+// the heritage under "heritage" and every external-dns/ label under its name
+// without the prefix (e.g. "owner"). Text that isn't a comma-separated list of
+// key=value pairs is rejected with ErrInvalidRegistryTXT, and a missing or
+// foreign heritage with endpoint.ErrInvalidHeritage.
+func ParseRegistryTXT(text string) (map[string]string, error) {
+	labels := make(map[string]string)
+	for _, token := range strings.Split(strings.Trim(text, `"`), ",") {
+		key, value, ok := strings.Cut(token, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("%w: malformed label %q", ErrInvalidRegistryTXT, token)
+		}
+		switch {
+		case key == "heritage":
+			labels[key] = value
+		case strings.HasPrefix(key, registryHeritage+"/"):
+			labels[strings.TrimPrefix(key, registryHeritage+"/")] = value
+		}
+	}
+	if labels["heritage"] != registryHeritage {
+		return nil, endpoint.ErrInvalidHeritage
+	}
+	return labels, nil
+}
+
+// Owner returns the owner recorded in the service's TXT registry record, or
+// an empty string if Text isn't a registry record or has no owner.
+func (s *Service) Owner() string {
+	labels, err := ParseRegistryTXT(s.Text)
+	if err != nil {
+		return ""
+	}
+	return labels[endpoint.OwnerLabelKey]
+}
@@ -0,0 +1,73 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package coredns
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"sigs.k8s.io/external-dns/endpoint"
+)
+
+func TestParseRegistryTXT(t *testing.T) {
+	labels, err := ParseRegistryTXT(`"heritage=external-dns,external-dns/owner=default,external-dns/resource=ingress/default/web"`)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"heritage": "external-dns",
+		"owner":    "default",
+		"resource": "ingress/default/web",
+	}, labels)
+}
+
+func TestParseRegistryTXT_MissingOwner(t *testing.T) {
+	labels, err := ParseRegistryTXT("heritage=external-dns")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"heritage": "external-dns"}, labels)
+
+	svc := &Service{Text: "heritage=external-dns"}
+	assert.Empty(t, svc.Owner())
+}
+
+func TestParseRegistryTXT_Malformed(t *testing.T) {
+	for _, text := range []string{
+		"",
+		"heritage=external-dns,owner",
+		"heritage=external-dns,,external-dns/owner=default",
+		"=external-dns",
+	} {
+		_, err := ParseRegistryTXT(text)
+		assert.ErrorIs(t, err, ErrInvalidRegistryTXT, text)
+	}
+}
+
+func TestParseRegistryTXT_ForeignHeritage(t *testing.T) {
+	for _, text := range []string{
+		"heritage=other,external-dns/owner=default",
+		"external-dns/owner=default",
+	} {
+		_, err := ParseRegistryTXT(text)
+		assert.ErrorIs(t, err, endpoint.ErrInvalidHeritage, text)
+	}
+}
+
+func TestService_Owner(t *testing.T) {
+	assert.Equal(t, "default", (&Service{Text: "heritage=external-dns,external-dns/owner=default"}).Owner())
+	assert.Empty(t, (&Service{Text: "some free text"}).Owner())
+	assert.Empty(t, (&Service{Host: "1.2.3.4"}).Owner())
+}
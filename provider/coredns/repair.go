@@ -0,0 +1,235 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package coredns
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"sigs.k8s.io/external-dns/endpoint"
+)
+
+// RepairOptions configures Repair.
+type RepairOptions struct {
+	// Fix applies the repairs. By default Repair only reports what it
+	// would do.
+	Fix bool
+
+	// Prefix is the root the records are stored under.
+	// If empty, DefaultPrefix is used.
+	Prefix string
+
+	// Keys is the scheme of stored keys. The zero value separates labels with "/".
+	Keys KeyScheme
+
+	// DomainFilter, if configured, marks the records whose DNS name it
+	// doesn't match as out of zone.
+	DomainFilter *endpoint.DomainFilter
+
+	// FixPriorities sets the priority of services that leave it unset from
+	// Defaults, as readers would. MX records sharing a name are left alone,
+	// since zero is a valid preference for them.
+	FixPriorities bool
+
+	// Defaults are the priorities FixPriorities applies.
+	// If nil, DefaultServiceDefaults is used.
+	Defaults ServiceDefaults
+}
+
+// RepairReport summarizes a Repair run. In a dry run, Fixed and Removed count
+// the records that would be fixed or removed.
+type RepairReport struct {
+	Scanned int
+	Fixed   int
+	Removed int
+
+	// Corrupt are the keys whose value can't be decoded or isn't a valid
+	// service, or whose key has empty labels.
+	Corrupt []string
+
+	// OutOfZone are the keys whose DNS name DomainFilter doesn't match.
+	OutOfZone []string
+
+	// Kept are corrupt or out-of-zone keys that weren't removed because
+	// records are stored under them, which deleting would remove too.
+	Kept []string
+}
+
+// recordScanner is implemented by backends that can report the records their
+// readers skip because they can't be decoded.
+type recordScanner interface {
+	scanRecords(ctx context.Context, prefix string, fn func(key string, svc *Service, err error) error) error
+}
+
+// Repair scans every record of b, reporting corrupt and out-of-zone records
+// and optionally services missing a priority. With opts.Fix, the reported
+// records are removed and the priorities set.
+//
+// Undecodable records are only found if b, or a backend it wraps, can report
+// them; other backends skip them while reading.
+func Repair(ctx context.Context, b Backend, opts RepairOptions) (RepairReport, error) {
+	var report RepairReport
+	prefix := opts.Keys.normalizePrefix(opts.Prefix)
+
+	var keys []string
+	services := make(map[string]*Service)
+	bad := make(map[string]bool)
+	visit := func(key string, svc *Service, err error) error {
+		report.Scanned++
+		keys = append(keys, key)
+		if err == nil && !validRepairKey(opts.Keys, prefix, key) {
+			err = errors.New("invalid key")
+		}
+		if err == nil {
+			err = svc.Validate()
+		}
+		switch {
+		case err != nil:
+			log.Warnf("Corrupt record at %s: %v", key, err)
+			report.Corrupt = append(report.Corrupt, key)
+			bad[key] = true
+		case opts.DomainFilter.IsConfigured() && !opts.DomainFilter.Match(repairDNSName(opts.Keys, prefix, svc)):
+			log.Infof("Record %s is outside the domain filter", key)
+			report.OutOfZone = append(report.OutOfZone, key)
+			bad[key] = true
+		default:
+			services[key] = svc
+		}
+		return nil
+	}
+
+	var err error
+	if scanner, ok := findRecordScanner(b); ok {
+		err = scanner.scanRecords(ctx, "", visit)
+	} else {
+		err = b.ForEach(ctx, rootPrefixOf(b), func(key string, svc *Service) error {
+			return visit(key, svc, nil)
+		})
+	}
+	if err != nil {
+		return report, err
+	}
+
+	removed := make(map[string]bool)
+	for _, key := range keys {
+		if !bad[key] {
+			continue
+		}
+		if hasKeptChild(opts.Keys, key, services) {
+			log.Warnf("Not removing %s, records are stored under it", key)
+			report.Kept = append(report.Kept, key)
+			continue
+		}
+		report.Removed++
+		if !opts.Fix || hasRemovedParent(opts.Keys, key, removed) {
+			continue
+		}
+		if err := b.DeleteService(ctx, key); err != nil {
+			return report, err
+		}
+		removed[key] = true
+	}
+
+	if !opts.FixPriorities {
+		return report, nil
+	}
+	defaults := serviceDefaultsOrDefault(opts.Defaults)
+	mail := make(map[string]int)
+	for _, svc := range services {
+		if svc.RecordType() == endpoint.RecordTypeMX && svc.RawType == "" {
+			mail[repairDNSName(opts.Keys, prefix, svc)]++
+		}
+	}
+	for _, key := range keys {
+		svc, ok := services[key]
+		if !ok || svc.RawType != "" || svc.Priority != 0 || defaults[svc.RecordType()].Priority == 0 {
+			continue
+		}
+		if svc.RecordType() == endpoint.RecordTypeMX && mail[repairDNSName(opts.Keys, prefix, svc)] > 1 {
+			continue
+		}
+		report.Fixed++
+		if !opts.Fix {
+			continue
+		}
+		fixed := *svc
+		fixed.Priority = defaults[svc.RecordType()].Priority
+		if err := b.SaveService(ctx, &fixed); err != nil {
+			return report, err
+		}
+	}
+	return report, nil
+}
+
+// findRecordScanner returns b, or the first backend it wraps, that can
+// report undecodable records.
+func findRecordScanner(b Backend) (recordScanner, bool) {
+	for b != nil {
+		if scanner, ok := b.(recordScanner); ok {
+			return scanner, true
+		}
+		wrapper, ok := b.(interface{ Unwrap() Backend })
+		if !ok {
+			return nil, false
+		}
+		b = wrapper.Unwrap()
+	}
+	return nil, false
+}
+
+// validRepairKey reports whether key is stored under prefix and has no
+// empty labels.
+func validRepairKey(keys KeyScheme, prefix, key string) bool {
+	if !strings.HasPrefix(key, prefix+keys.sep()) {
+		return false
+	}
+	for _, label := range strings.Split(strings.TrimPrefix(key, prefix+keys.sep()), keys.sep()) {
+		if label == "" {
+			return false
+		}
+	}
+	return true
+}
+
+// repairDNSName returns the DNS name of the record svc.
+func repairDNSName(keys KeyScheme, prefix string, svc *Service) string {
+	dnsName, _ := keys.ParseKey(prefix, svc.Key, svc.TargetStrip)
+	return dnsName
+}
+
+// hasKeptChild reports whether a record that isn't being removed is stored
+// under key.
+func hasKeptChild(keys KeyScheme, key string, services map[string]*Service) bool {
+	for k := range services {
+		if k != key && keys.isUnder(k, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasRemovedParent reports whether a parent of key was deleted, removing key
+// with it.
+func hasRemovedParent(keys KeyScheme, key string, removed map[string]bool) bool {
+	for parent := keys.parentKey(key); parent != ""; parent = keys.parentKey(parent) {
+		if removed[parent] {
+			return true
+		}
+	}
+	return false
+}
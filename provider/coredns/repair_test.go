@@ -0,0 +1,118 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package coredns
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"sigs.k8s.io/external-dns/endpoint"
+)
+
+// seedRepairStore returns a SQLite backend holding a valid record, an SRV
+// record missing its priority, a corrupt row and an out-of-zone record.
+func seedRepairStore(t *testing.T) *SQLiteBackend {
+	backend, err := NewSQLiteBackend(":memory:")
+	require.NoError(t, err)
+	t.Cleanup(func() { backend.Close() })
+
+	ctx := context.Background()
+	require.NoError(t, backend.SaveService(ctx, &Service{Key: "/skydns/com/example/www", Host: "1.2.3.4"}))
+	require.NoError(t, backend.SaveService(ctx, &Service{Key: "/skydns/com/example/_sip/_tcp", Host: "sip.example.com", Port: 5060}))
+	require.NoError(t, backend.SaveService(ctx, &Service{Key: "/skydns/org/other/www", Host: "5.6.7.8"}))
+	_, err = backend.db.Exec(`INSERT INTO services (key, value) VALUES (?, ?)`, "/skydns/com/example/broken", "{not json")
+	require.NoError(t, err)
+	return backend
+}
+
+func TestRepair_DryRun(t *testing.T) {
+	backend := seedRepairStore(t)
+	ctx := context.Background()
+
+	report, err := Repair(ctx, NewRateLimitedBackend(backend, 0), RepairOptions{
+		DomainFilter:  endpoint.NewDomainFilter([]string{"example.com"}),
+		FixPriorities: true,
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, 4, report.Scanned)
+	assert.Equal(t, []string{"/skydns/com/example/broken"}, report.Corrupt)
+	assert.Equal(t, []string{"/skydns/org/other/www"}, report.OutOfZone)
+	assert.Equal(t, 2, report.Removed)
+	assert.Equal(t, 1, report.Fixed)
+
+	// Nothing was changed
+	count, err := backend.Count(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 4, count)
+}
+
+func TestRepair_Fix(t *testing.T) {
+	backend := seedRepairStore(t)
+	ctx := context.Background()
+
+	report, err := Repair(ctx, backend, RepairOptions{
+		Fix:           true,
+		DomainFilter:  endpoint.NewDomainFilter([]string{"example.com"}),
+		FixPriorities: true,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 2, report.Removed)
+	assert.Equal(t, 1, report.Fixed)
+
+	snapshot, err := backend.Snapshot(ctx)
+	require.NoError(t, err)
+	assert.Len(t, snapshot, 2)
+	assert.Contains(t, snapshot, "/skydns/com/example/www")
+	assert.Equal(t, priority, snapshot["/skydns/com/example/_sip/_tcp"].Priority)
+
+	// A second run finds nothing to do
+	report, err = Repair(ctx, backend, RepairOptions{
+		DomainFilter:  endpoint.NewDomainFilter([]string{"example.com"}),
+		FixPriorities: true,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, RepairReport{Scanned: 2}, report)
+}
+
+func TestRepair_KeepsParentOfValidRecords(t *testing.T) {
+	backend := NewMemoryBackend()
+	defer backend.Close()
+	ctx := context.Background()
+
+	// example.com is out of zone, but www.example.com is stored under it
+	require.NoError(t, backend.SaveService(ctx, &Service{Key: "/skydns/com/example", Host: "1.2.3.4"}))
+	require.NoError(t, backend.SaveService(ctx, &Service{Key: "/skydns/com/example/www", Host: "1.2.3.4"}))
+	require.NoError(t, backend.SaveService(ctx, &Service{Key: "/skydns/net/example", Host: "1.2.3.4"}))
+
+	report, err := Repair(ctx, backend, RepairOptions{
+		Fix:          true,
+		DomainFilter: endpoint.NewDomainFilter([]string{"www.example.com"}),
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"/skydns/com/example", "/skydns/net/example"}, report.OutOfZone)
+	assert.Equal(t, []string{"/skydns/com/example"}, report.Kept)
+	assert.Equal(t, 1, report.Removed)
+
+	snapshot, err := backend.Snapshot(ctx)
+	require.NoError(t, err)
+	assert.Len(t, snapshot, 2)
+	assert.NotContains(t, snapshot, "/skydns/net/example")
+}
@@ -0,0 +1,269 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package coredns
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"sigs.k8s.io/external-dns/endpoint"
+)
+
+// ErrInvalidService is returned when saving a service that can't produce a valid record
+var ErrInvalidService = errors.New("invalid service")
+
+// maxUint16 bounds the SRV port, priority and weight fields (RFC 2782).
+const maxUint16 = 1<<16 - 1
+
+// Hostname limits (RFC 1035).
+const (
+	maxHostnameLength = 253
+	maxLabelLength    = 63
+)
+
+// Validate checks that the service can be served as a well-formed record.
+// A raw record needs a type and data, and nothing else of a record.
+// Otherwise at least one of Host and Text must be set. The Host must be a valid IP
+// address or a plausible hostname. Services with a Port are SRV records:
+// they need a Host, and their port, priority and weight must fit in 16 bits.
+func (s *Service) Validate() error {
+	if s.RawType != "" || s.RawData != "" {
+		return s.validateRaw()
+	}
+	if s.Host == "" {
+		switch {
+		case s.Port > 0:
+			return fmt.Errorf("%w: SRV service at %s has no host", ErrInvalidService, s.Key)
+		case s.Text == "":
+			return fmt.Errorf("%w: service at %s has neither host nor text", ErrInvalidService, s.Key)
+		}
+		return nil
+	}
+	if err := s.validateHost(); err != nil {
+		return err
+	}
+	if s.Port == 0 {
+		return nil
+	}
+	for _, field := range []struct {
+		name  string
+		value int
+	}{
+		{"port", s.Port},
+		{"priority", s.Priority},
+		{"weight", s.Weight},
+	} {
+		if field.value < 0 || field.value > maxUint16 {
+			return fmt.Errorf("%w: SRV %s %d at %s is out of range [0, %d]", ErrInvalidService, field.name, field.value, s.Key, maxUint16)
+		}
+	}
+	return nil
+}
+
+// validateRaw checks that a raw record has a type of letters and digits and
+// data, and sets none of the fields of modeled records.
+func (s *Service) validateRaw() error {
+	switch {
+	case s.RawType == "":
+		return fmt.Errorf("%w: raw record at %s has no type", ErrInvalidService, s.Key)
+	case s.RawData == "":
+		return fmt.Errorf("%w: raw %s record at %s has no data", ErrInvalidService, s.RawType, s.Key)
+	case s.Host != "" || s.Text != "" || s.Port != 0 || s.Mail:
+		return fmt.Errorf("%w: raw %s record at %s must not set host, text, port or mail", ErrInvalidService, s.RawType, s.Key)
+	}
+	for _, c := range s.RawType {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9') {
+			return fmt.Errorf("%w: raw record type %q at %s contains invalid character %q", ErrInvalidService, s.RawType, s.Key, c)
+		}
+	}
+	return nil
+}
+
+// validateHost checks that a Host meant as an address (digits and dots for A,
+// colons for AAAA) parses as an IP of that family, and that any other Host is
+// a plausible hostname.
+func (s *Service) validateHost() error {
+	if net.ParseIP(s.Host) != nil {
+		return nil
+	}
+	switch {
+	case strings.Contains(s.Host, ":"):
+		return fmt.Errorf("%w: AAAA host %q at %s is not a valid IPv6 address", ErrInvalidService, s.Host, s.Key)
+	case strings.Trim(s.Host, "0123456789.") == "":
+		return fmt.Errorf("%w: A host %q at %s is not a valid IPv4 address", ErrInvalidService, s.Host, s.Key)
+	}
+	if err := validateHostname(s.Host); err != nil {
+		return fmt.Errorf("%w: CNAME host %q at %s: %w", ErrInvalidService, s.Host, s.Key, err)
+	}
+	return nil
+}
+
+// validateHostname checks that name, with an optional trailing dot, is made of
+// 1 to 63 character labels of letters, digits, hyphens and underscores that
+// don't start or end with a hyphen.
+func validateHostname(name string) error {
+	name = strings.TrimSuffix(name, ".")
+	if name == "" || len(name) > maxHostnameLength {
+		return fmt.Errorf("hostname length must be between 1 and %d", maxHostnameLength)
+	}
+	for _, label := range strings.Split(name, ".") {
+		if label == "" || len(label) > maxLabelLength {
+			return fmt.Errorf("label %q length must be between 1 and %d", label, maxLabelLength)
+		}
+		if label[0] == '-' || label[len(label)-1] == '-' {
+			return fmt.Errorf("label %q must not start or end with a hyphen", label)
+		}
+		for _, c := range label {
+			if !isHostnameChar(c) {
+				return fmt.Errorf("label %q contains invalid character %q", label, c)
+			}
+		}
+	}
+	return nil
+}
+
+func isHostnameChar(c rune) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_'
+}
+
+// RecordType returns the DNS record type CoreDNS serves for the service's Host:
+// MX for mail services, SRV for services with a port, A/AAAA for IP addresses
+// and CNAME for hostnames or hosts flagged with ForceCNAME. Services without
+// a Host but with Text are TXT records. Raw records are of their RawType.
+// An empty string is returned for services with neither.
+func (s *Service) RecordType() string {
+	switch {
+	case s.RawType != "":
+		return strings.ToUpper(s.RawType)
+	case s.Host == "" && s.Text != "":
+		return endpoint.RecordTypeTXT
+	case s.Host == "":
+		return ""
+	case s.Mail:
+		return endpoint.RecordTypeMX
+	case s.Port > 0:
+		return endpoint.RecordTypeSRV
+	}
+
+	ip := net.ParseIP(s.Host)
+	switch {
+	case ip == nil || s.ForceCNAME:
+		return endpoint.RecordTypeCNAME
+	case ip.To4() != nil:
+		return endpoint.RecordTypeA
+	default:
+		return endpoint.RecordTypeAAAA
+	}
+}
+
+// HasRecordType reports whether the service produces a record of the given type.
+// A service with both Host and Text produces two records, so it matches TXT in
+// addition to the type of its Host.
+func (s *Service) HasRecordType(recordType string) bool {
+	recordType = strings.ToUpper(recordType)
+	if recordType == endpoint.RecordTypeTXT && s.RawType == "" {
+		return s.Text != ""
+	}
+	return s.RecordType() == recordType
+}
+
+// serviceDedupKey identifies the DNS answer a service produces: the owner name
+// it is served under and the record content. Two services with the same
+// dedup key are duplicates even if they are stored under different keys.
+type serviceDedupKey struct {
+	name     string
+	host     string
+	port     int
+	priority int
+	weight   int
+	text     string
+	cname    bool
+	setID    string
+	rawType  string
+	rawData  string
+}
+
+// dedupKeyFor returns the dedup key of a service. The owner name is the
+// service key with its TargetStrip trailing labels (the random or hash
+// suffix used to store several targets under one name) removed, so
+// /skydns/com/example/www/aaaa and /skydns/com/example/www/bbbb holding the
+// same Host collapse into a single answer for www.example.com.
+func dedupKeyFor(svc *Service) serviceDedupKey {
+	return defaultKeyScheme.dedupKeyFor(svc)
+}
+
+// dedupKeyFor returns the dedup key of a service whose key uses the scheme.
+func (k KeyScheme) dedupKeyFor(svc *Service) serviceDedupKey {
+	return serviceDedupKey{
+		name:     k.stripKeyLabels(svc.Key, svc.TargetStrip),
+		host:     svc.Host,
+		port:     svc.Port,
+		priority: svc.Priority,
+		weight:   svc.Weight,
+		text:     svc.Text,
+		cname:    svc.ForceCNAME,
+		setID:    svc.SetIdentifier,
+		rawType:  strings.ToUpper(svc.RawType),
+		rawData:  svc.RawData,
+	}
+}
+
+// dedupServices returns services without those producing the same DNS
+// answer as an earlier one (see dedupKeyFor), in the same order.
+func (k KeyScheme) dedupServices(services []*Service) []*Service {
+	seen := make(map[serviceDedupKey]bool, len(services))
+	deduped := make([]*Service, 0, len(services))
+	for _, svc := range services {
+		dedupKey := k.dedupKeyFor(svc)
+		if seen[dedupKey] {
+			continue
+		}
+		seen[dedupKey] = true
+		deduped = append(deduped, svc)
+	}
+	return deduped
+}
+
+// stripKeyLabels removes the last n labels from a key.
+// At least the first label is always kept.
+func stripKeyLabels(key string, n int) string {
+	return defaultKeyScheme.stripKeyLabels(key, n)
+}
+
+// filterServicesByType returns the services that produce a record of the given type.
+func filterServicesByType(services []*Service, recordType string) []*Service {
+	filtered := []*Service{}
+	for _, svc := range services {
+		if svc.HasRecordType(recordType) {
+			filtered = append(filtered, svc)
+		}
+	}
+	return filtered
+}
+
+// filterServicesBySource returns the services created by the given source.
+func filterServicesBySource(services []*Service, source string) []*Service {
+	filtered := []*Service{}
+	for _, svc := range services {
+		if svc.Source == source {
+			filtered = append(filtered, svc)
+		}
+	}
+	return filtered
+}
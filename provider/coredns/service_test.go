@@ -0,0 +1,132 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package coredns
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"sigs.k8s.io/external-dns/endpoint"
+)
+
+func TestServiceRecordType(t *testing.T) {
+	tests := []struct {
+		name     string
+		service  Service
+		expected string
+	}{
+		{name: "ipv4", service: Service{Host: "1.2.3.4"}, expected: endpoint.RecordTypeA},
+		{name: "ipv6", service: Service{Host: "2001:db8::1"}, expected: endpoint.RecordTypeAAAA},
+		{name: "hostname", service: Service{Host: "target.example.com"}, expected: endpoint.RecordTypeCNAME},
+		{name: "forced cname hostname", service: Service{Host: "target.example.com", ForceCNAME: true}, expected: endpoint.RecordTypeCNAME},
+		{name: "forced cname ip", service: Service{Host: "1.2.3.4", ForceCNAME: true}, expected: endpoint.RecordTypeCNAME},
+		{name: "text only", service: Service{Text: "hello"}, expected: endpoint.RecordTypeTXT},
+		{name: "host and text", service: Service{Host: "1.2.3.4", Text: "hello"}, expected: endpoint.RecordTypeA},
+		{name: "srv", service: Service{Host: "target.example.com", Port: 443}, expected: endpoint.RecordTypeSRV},
+		{name: "mx", service: Service{Host: "mail.example.com", Mail: true}, expected: endpoint.RecordTypeMX},
+		{name: "empty", service: Service{}, expected: ""},
+		{name: "raw", service: Service{RawType: "caa", RawData: `0 issue "letsencrypt.org"`}, expected: "CAA"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, tt.service.RecordType())
+		})
+	}
+}
+
+func TestServiceValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		service Service
+		valid   bool
+	}{
+		{name: "srv boundaries", service: Service{Host: "target.example.com", Port: 65535, Priority: 65535, Weight: 65535}, valid: true},
+		{name: "srv zero priority and weight", service: Service{Host: "target.example.com", Port: 1}, valid: true},
+		{name: "negative priority", service: Service{Host: "target.example.com", Port: 443, Priority: -1}},
+		{name: "port too large", service: Service{Host: "target.example.com", Port: 70000}},
+		{name: "negative port", service: Service{Host: "target.example.com", Port: -1}},
+		{name: "weight too large", service: Service{Host: "target.example.com", Port: 443, Weight: 65536}},
+		{name: "not srv", service: Service{Host: "1.2.3.4", Priority: -1}, valid: true},
+		{name: "text only", service: Service{Text: "hello"}, valid: true},
+		{name: "empty", service: Service{Key: "/skydns/com/example/www"}},
+		{name: "srv without host", service: Service{Port: 443, Text: "hello"}},
+		{name: "ipv4", service: Service{Host: "192.0.2.10"}, valid: true},
+		{name: "invalid ipv4", service: Service{Host: "1.2.3.999"}},
+		{name: "truncated ipv4", service: Service{Host: "1.2.3"}},
+		{name: "ipv6", service: Service{Host: "2001:db8::1"}, valid: true},
+		{name: "invalid ipv6", service: Service{Host: "2001:db8:::1"}},
+		{name: "hostname", service: Service{Host: "target.example.com"}, valid: true},
+		{name: "fqdn hostname", service: Service{Host: "target.example.com."}, valid: true},
+		{name: "underscore label", service: Service{Host: "_sip._tcp.example.com"}, valid: true},
+		{name: "empty label", service: Service{Host: "target..example.com"}},
+		{name: "hyphen edge", service: Service{Host: "-target.example.com"}},
+		{name: "invalid character", service: Service{Host: "target!.example.com"}},
+		{name: "label too long", service: Service{Host: strings.Repeat("a", 64) + ".example.com"}},
+		{name: "invalid srv target", service: Service{Host: "target example.com", Port: 443}},
+		{name: "raw", service: Service{RawType: "CAA", RawData: `0 issue "letsencrypt.org"`}, valid: true},
+		{name: "raw generic type", service: Service{RawType: "TYPE65534", RawData: `\# 0`}, valid: true},
+		{name: "raw without data", service: Service{RawType: "CAA"}},
+		{name: "raw without type", service: Service{RawData: `0 issue "letsencrypt.org"`}},
+		{name: "raw invalid type", service: Service{RawType: "CA A", RawData: `0 issue "letsencrypt.org"`}},
+		{name: "raw with host", service: Service{RawType: "NS", RawData: "ns1.example.com.", Host: "ns1.example.com"}},
+		{name: "raw with port", service: Service{RawType: "SRV", RawData: "10 5 443 target.example.com.", Port: 443}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.service.Validate()
+			if tt.valid {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorIs(t, err, ErrInvalidService)
+			}
+		})
+	}
+}
+
+func TestServiceHasRecordType(t *testing.T) {
+	svc := Service{Host: "1.2.3.4", Text: "hello"}
+
+	assert.True(t, svc.HasRecordType(endpoint.RecordTypeA))
+	assert.True(t, svc.HasRecordType(endpoint.RecordTypeTXT))
+	assert.True(t, svc.HasRecordType("txt"))
+	assert.False(t, svc.HasRecordType(endpoint.RecordTypeCNAME))
+}
+
+func TestDedupKeyFor(t *testing.T) {
+	a := &Service{Host: "1.2.3.4", TargetStrip: 1, Key: "/skydns/com/example/www/aaaa"}
+	b := &Service{Host: "1.2.3.4", TargetStrip: 1, Key: "/skydns/com/example/www/bbbb"}
+	c := &Service{Host: "1.2.3.4", Key: "/skydns/com/example/www/cccc"}
+
+	assert.Equal(t, dedupKeyFor(a), dedupKeyFor(b))
+	assert.NotEqual(t, dedupKeyFor(a), dedupKeyFor(c), "without TargetStrip the suffix is part of the name")
+
+	d := &Service{Host: "1.2.3.4", TargetStrip: 1, ForceCNAME: true, Key: "/skydns/com/example/www/dddd"}
+	assert.NotEqual(t, dedupKeyFor(a), dedupKeyFor(d), "a forced CNAME is a different answer")
+}
+
+func TestStripKeyLabels(t *testing.T) {
+	assert.Equal(t, "/skydns/com/example/www", stripKeyLabels("/skydns/com/example/www/aaaa", 1))
+	assert.Equal(t, "/skydns/com/example", stripKeyLabels("/skydns/com/example/www/aaaa", 2))
+	assert.Equal(t, "/skydns/com/example/www/aaaa", stripKeyLabels("/skydns/com/example/www/aaaa", 0))
+	assert.Empty(t, stripKeyLabels("/skydns", 5))
+	assert.Equal(t, "skydns", stripKeyLabels("skydns/com", 5), "the first label is kept")
+	assert.Equal(t, "/skydns/com", stripKeyLabels("/skydns/com/", 1))
+}
@@ -0,0 +1,68 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package coredns
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"math/rand"
+	"os"
+	"strings"
+)
+
+// KeySuffixer generates the label appended to a DNS name's key to store one
+// of its several targets, e.g. the "1a2b3c4d" of /skydns/com/example/www/1a2b3c4d.
+type KeySuffixer interface {
+	Suffix(target string) string
+}
+
+// RandomSuffixer returns a random 8-digit hex suffix for every target.
+type RandomSuffixer struct{}
+
+// Suffix returns a random suffix.
+func (RandomSuffixer) Suffix(_ string) string {
+	return fmt.Sprintf("%08x", rand.Int31())
+}
+
+// HashSuffixer derives the suffix from the SHA-1 of the target, so the same
+// target is always stored under the same key and rewrites are idempotent.
+type HashSuffixer struct{}
+
+// Suffix returns the first 8 hex digits of the SHA-1 of target.
+func (HashSuffixer) Suffix(target string) string {
+	sum := sha1.Sum([]byte(target))
+	return hex.EncodeToString(sum[:4])
+}
+
+// NewKeySuffixer returns the suffixer named by strategy: "random" (the
+// default if empty) or "hash".
+func NewKeySuffixer(strategy string) (KeySuffixer, error) {
+	switch strings.ToLower(strategy) {
+	case "", "random":
+		return RandomSuffixer{}, nil
+	case "hash":
+		return HashSuffixer{}, nil
+	default:
+		return nil, fmt.Errorf("unknown key suffix strategy %q: must be random or hash", strategy)
+	}
+}
+
+// getKeySuffixer returns the suffixer selected by COREDNS_KEY_SUFFIX.
+func getKeySuffixer() (KeySuffixer, error) {
+	return NewKeySuffixer(os.Getenv("COREDNS_KEY_SUFFIX"))
+}
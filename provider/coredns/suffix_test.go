@@ -0,0 +1,82 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package coredns
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"sigs.k8s.io/external-dns/endpoint"
+	"sigs.k8s.io/external-dns/internal/testutils"
+	"sigs.k8s.io/external-dns/plan"
+)
+
+func TestHashSuffixer(t *testing.T) {
+	s := HashSuffixer{}
+
+	assert.Equal(t, s.Suffix("1.2.3.4"), s.Suffix("1.2.3.4"))
+	assert.NotEqual(t, s.Suffix("1.2.3.4"), s.Suffix("1.2.3.5"))
+	assert.Len(t, s.Suffix("1.2.3.4"), 8)
+}
+
+func TestNewKeySuffixer(t *testing.T) {
+	for strategy, expected := range map[string]KeySuffixer{
+		"":       RandomSuffixer{},
+		"random": RandomSuffixer{},
+		"HASH":   HashSuffixer{},
+	} {
+		suffixer, err := NewKeySuffixer(strategy)
+		require.NoError(t, err)
+		assert.Equal(t, expected, suffixer)
+	}
+
+	_, err := NewKeySuffixer("sequential")
+	assert.Error(t, err)
+}
+
+func TestHashSuffixer_IdempotentKeys(t *testing.T) {
+	testutils.TestHelperEnvSetter(t, map[string]string{
+		"COREDNS_BACKEND":    "memory",
+		"COREDNS_KEY_SUFFIX": "hash",
+	})
+
+	p, err := NewCoreDNSProvider(&endpoint.DomainFilter{}, "/skydns/", false)
+	require.NoError(t, err)
+	cp := p.(coreDNSProvider)
+	backend := cp.reloadable.Unwrap().(*MemoryBackend)
+
+	ctx := context.Background()
+	create := func() {
+		require.NoError(t, p.ApplyChanges(ctx, &plan.Changes{
+			Create: []*endpoint.Endpoint{
+				endpoint.NewEndpoint("www.example.com", endpoint.RecordTypeA, "1.2.3.4", "5.6.7.8"),
+			},
+		}))
+	}
+
+	create()
+	keys := backend.Keys()
+	require.Len(t, keys, 2)
+	assert.NotEqual(t, keys[0], keys[1])
+
+	// Writing the same targets again lands on the same keys
+	create()
+	assert.Equal(t, keys, backend.Keys())
+}
@@ -0,0 +1,175 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package coredns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// ErrWatchUnsupported is returned by Sync when the source can't stream changes
+var ErrWatchUnsupported = errors.New("backend does not support watching changes")
+
+// WatchEventType is the kind of change reported by a WatchEvent.
+type WatchEventType int
+
+const (
+	// WatchEventPut reports a created or updated service.
+	WatchEventPut WatchEventType = iota
+	// WatchEventDelete reports a deleted key.
+	WatchEventDelete
+)
+
+// WatchEvent is a change to a single key.
+type WatchEvent struct {
+	Type WatchEventType
+	Key  string
+
+	// Service is the new value of the key for WatchEventPut, nil otherwise.
+	Service *Service
+
+	// Err is set on the last event sent before the channel is closed when
+	// the watch fails. Type, Key and Service are then unset.
+	Err error
+}
+
+// Watcher is implemented by backends that can stream changes to their keys.
+type Watcher interface {
+	// Watch streams the changes made to the keys under prefix, in order,
+	// until ctx is done or the watch fails. The channel is closed when the
+	// watch ends.
+	Watch(ctx context.Context, prefix string) (<-chan WatchEvent, error)
+}
+
+// Sync mirrors the services of src into dst until ctx is done. It first
+// copies every service of src, removing the services dst holds that src
+// doesn't, then applies the changes streamed by src. src must implement
+// Watcher. The watch is started before the initial copy so that no change is
+// missed; changes replayed over the copy are idempotent.
+//
+// Since DeleteService removes a key and its children, the children that src
+// still holds are copied again after each delete.
+func Sync(ctx context.Context, src, dst Backend) error {
+	watcher, ok := src.(Watcher)
+	if !ok {
+		return fmt.Errorf("%w: %T", ErrWatchUnsupported, src)
+	}
+
+	watchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	events, err := watcher.Watch(watchCtx, "")
+	if err != nil {
+		return err
+	}
+
+	if err := syncSnapshot(ctx, src, dst); err != nil {
+		return err
+	}
+
+	applied := 0
+	for {
+		select {
+		case <-ctx.Done():
+			log.Infof("Sync stopped after applying %d changes", applied)
+			return ctx.Err()
+		case event, ok := <-events:
+			if !ok {
+				if err := ctx.Err(); err != nil {
+					log.Infof("Sync stopped after applying %d changes", applied)
+					return err
+				}
+				return errors.New("watch channel closed")
+			}
+			if event.Err != nil {
+				return event.Err
+			}
+			if err := applyWatchEvent(ctx, src, dst, event); err != nil {
+				return err
+			}
+			applied++
+		}
+	}
+}
+
+// syncSnapshot makes dst hold the same services as src.
+func syncSnapshot(ctx context.Context, src, dst Backend) error {
+	want, err := src.Snapshot(ctx)
+	if err != nil {
+		return err
+	}
+	have, err := dst.Snapshot(ctx)
+	if err != nil {
+		return err
+	}
+
+	added, updated, removed := Diff(have, want)
+	for _, key := range removed {
+		if err := syncDelete(ctx, src, dst, key); err != nil {
+			return err
+		}
+	}
+	for _, key := range append(added, updated...) {
+		svc := want[key]
+		svc.Key = key
+		if err := dst.SaveService(ctx, &svc); err != nil {
+			return err
+		}
+	}
+
+	log.Infof("Sync copied %d services (%d added, %d updated, %d removed)", len(want), len(added), len(updated), len(removed))
+	return nil
+}
+
+// applyWatchEvent applies a change streamed by src to dst.
+func applyWatchEvent(ctx context.Context, src, dst Backend, event WatchEvent) error {
+	switch event.Type {
+	case WatchEventPut:
+		log.Debugf("Sync saving %s", event.Key)
+		svc := *event.Service
+		svc.Key = event.Key
+		return dst.SaveService(ctx, &svc)
+	case WatchEventDelete:
+		log.Debugf("Sync deleting %s", event.Key)
+		return syncDelete(ctx, src, dst, event.Key)
+	default:
+		return fmt.Errorf("unknown watch event type %d for %s", event.Type, event.Key)
+	}
+}
+
+// syncDelete deletes key from dst, then copies again the children of key
+// that src still holds.
+func syncDelete(ctx context.Context, src, dst Backend, key string) error {
+	if err := dst.DeleteService(ctx, key); err != nil {
+		return err
+	}
+
+	var children []*Service
+	if err := src.ForEach(ctx, key+"/", func(_ string, svc *Service) error {
+		children = append(children, svc)
+		return nil
+	}); err != nil {
+		return err
+	}
+	for _, svc := range children {
+		if err := dst.SaveService(ctx, svc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
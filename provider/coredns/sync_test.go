@@ -0,0 +1,120 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package coredns
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// watchableBackend is a memory backend streaming the changes made through it.
+type watchableBackend struct {
+	*MemoryBackend
+	events chan WatchEvent
+}
+
+func newWatchableBackend() *watchableBackend {
+	return &watchableBackend{
+		MemoryBackend: NewMemoryBackend(),
+		events:        make(chan WatchEvent),
+	}
+}
+
+func (w *watchableBackend) Watch(_ context.Context, _ string) (<-chan WatchEvent, error) {
+	return w.events, nil
+}
+
+func (w *watchableBackend) put(t *testing.T, svc *Service) {
+	t.Helper()
+	require.NoError(t, w.SaveService(context.Background(), svc))
+	w.events <- WatchEvent{Type: WatchEventPut, Key: svc.Key, Service: svc}
+}
+
+func (w *watchableBackend) delete(t *testing.T, key string) {
+	t.Helper()
+	require.NoError(t, w.DeleteService(context.Background(), key))
+	w.events <- WatchEvent{Type: WatchEventDelete, Key: key}
+}
+
+// assertConverges waits until dst holds the same services as src.
+func assertConverges(t *testing.T, src, dst Backend) {
+	t.Helper()
+	ctx := context.Background()
+	assert.Eventually(t, func() bool {
+		want, err := src.Snapshot(ctx)
+		require.NoError(t, err)
+		have, err := dst.Snapshot(ctx)
+		require.NoError(t, err)
+		added, updated, removed := Diff(have, want)
+		return len(added)+len(updated)+len(removed) == 0
+	}, time.Second, 5*time.Millisecond)
+}
+
+func TestSync(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	src := newWatchableBackend()
+	dst := NewMemoryBackend()
+	require.NoError(t, src.SaveService(ctx, &Service{Host: "1.1.1.1", Key: "/skydns/com/example/a"}))
+	require.NoError(t, src.SaveService(ctx, &Service{Host: "2.2.2.2", Key: "/skydns/com/example/b"}))
+	require.NoError(t, src.SaveService(ctx, &Service{Host: "3.3.3.3", Key: "/skydns/com/example/stale/child"}))
+	require.NoError(t, dst.SaveService(ctx, &Service{Host: "9.9.9.9", Key: "/skydns/com/example/b"}))
+	require.NoError(t, dst.SaveService(ctx, &Service{Host: "9.9.9.9", Key: "/skydns/com/example/stale"}))
+
+	done := make(chan error)
+	go func() { done <- Sync(ctx, src, dst) }()
+
+	// Initial copy: b is updated, stale is removed without losing its child
+	assertConverges(t, src, dst)
+
+	src.put(t, &Service{Host: "4.4.4.4", Key: "/skydns/com/example/c"})
+	src.put(t, &Service{Host: "1.1.1.2", Key: "/skydns/com/example/a"})
+	src.delete(t, "/skydns/com/example/b")
+	assertConverges(t, src, dst)
+	assert.Equal(t, []string{"/skydns/com/example/a", "/skydns/com/example/c", "/skydns/com/example/stale/child"}, dst.Keys())
+
+	cancel()
+	select {
+	case err := <-done:
+		assert.ErrorIs(t, err, context.Canceled)
+	case <-time.After(time.Second):
+		t.Fatal("Sync did not stop when the context was canceled")
+	}
+}
+
+func TestSync_WatchError(t *testing.T) {
+	src := newWatchableBackend()
+	dst := NewMemoryBackend()
+
+	done := make(chan error)
+	go func() { done <- Sync(context.Background(), src, dst) }()
+
+	watchErr := errors.New("watch failed")
+	src.events <- WatchEvent{Err: watchErr}
+	assert.ErrorIs(t, <-done, watchErr)
+}
+
+func TestSync_Unsupported(t *testing.T) {
+	err := Sync(context.Background(), NewMemoryBackend(), NewMemoryBackend())
+	assert.ErrorIs(t, err, ErrWatchUnsupported)
+}
@@ -0,0 +1,74 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package coredns
+
+import (
+	"hash/fnv"
+	"sort"
+)
+
+// SelectTargets returns up to max of the services, picked by rendezvous
+// (highest random weight) hashing of seed and each service's Key, so that a
+// seed always selects the same subset and adding or removing a target only
+// changes the picks involving it. The selected services keep their order in
+// svcs. If max is not positive or at least len(svcs), svcs is returned.
+func SelectTargets(svcs []*Service, max int, seed string) []*Service {
+	if max <= 0 || max >= len(svcs) {
+		return svcs
+	}
+	picked := rendezvousPick(len(svcs), max, seed, func(i int) string { return svcs[i].Key })
+	selected := make([]*Service, max)
+	for i, index := range picked {
+		selected[i] = svcs[index]
+	}
+	return selected
+}
+
+// rendezvousPick returns the indexes, in increasing order, of the max of n
+// items with the highest rendezvous weight for seed, each identified by id.
+func rendezvousPick(n, max int, seed string, id func(i int) string) []int {
+	type scored struct {
+		index  int
+		weight uint64
+	}
+	candidates := make([]scored, n)
+	for i := range candidates {
+		candidates[i] = scored{index: i, weight: targetWeight(seed, id(i))}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].weight != candidates[j].weight {
+			return candidates[i].weight > candidates[j].weight
+		}
+		return id(candidates[i].index) < id(candidates[j].index)
+	})
+
+	picked := make([]int, max)
+	for i, c := range candidates[:max] {
+		picked[i] = c.index
+	}
+	sort.Ints(picked)
+	return picked
+}
+
+// targetWeight returns the rendezvous weight of the target stored at key for seed.
+func targetWeight(seed, key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(seed))
+	h.Write([]byte{0})
+	h.Write([]byte(key))
+	return h.Sum64()
+}
@@ -0,0 +1,71 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package coredns
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSelectTargets(t *testing.T) {
+	var svcs []*Service
+	for i := 0; i < 30; i++ {
+		svcs = append(svcs, &Service{Key: fmt.Sprintf("/skydns/com/example/www/%02d", i), Host: fmt.Sprintf("10.0.0.%d", i)})
+	}
+
+	first := SelectTargets(svcs, 5, "client-a")
+	require.Len(t, first, 5)
+	assert.Equal(t, first, SelectTargets(svcs, 5, "client-a"), "the same seed selects the same subset")
+	for i := 1; i < len(first); i++ {
+		assert.Less(t, first[i-1].Key, first[i].Key, "selected services keep their order")
+	}
+
+	other := SelectTargets(svcs, 5, "client-b")
+	require.Len(t, other, 5)
+	assert.NotEqual(t, first, other)
+	assert.Equal(t, other, SelectTargets(svcs, 5, "client-b"))
+
+	// The input order doesn't change the subset
+	reversed := make([]*Service, len(svcs))
+	for i, svc := range svcs {
+		reversed[len(svcs)-1-i] = svc
+	}
+	assert.ElementsMatch(t, first, SelectTargets(reversed, 5, "client-a"))
+
+	// Removing an unselected target doesn't change the subset
+	var remaining []*Service
+	removed := false
+	for _, svc := range svcs {
+		if !removed && !slices.Contains(first, svc) {
+			removed = true
+			continue
+		}
+		remaining = append(remaining, svc)
+	}
+	assert.Equal(t, first, SelectTargets(remaining, 5, "client-a"))
+}
+
+func TestSelectTargets_NoCap(t *testing.T) {
+	svcs := []*Service{{Key: "/skydns/com/example/www/a"}, {Key: "/skydns/com/example/www/b"}}
+	assert.Equal(t, svcs, SelectTargets(svcs, 0, "seed"))
+	assert.Equal(t, svcs, SelectTargets(svcs, 2, "seed"))
+	assert.Empty(t, SelectTargets(nil, 3, "seed"))
+}